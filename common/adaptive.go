@@ -0,0 +1,103 @@
+package common
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// AdaptiveLogging quiets logging while invocations are healthy: once the failure rate over the last window
+// invocations is at most threshold, logs below Warn level are dropped, and they're logged again as soon as the
+// failure rate rises above it
+type AdaptiveLogging struct {
+	threshold float64
+
+	mu       sync.Mutex
+	results  []bool
+	next     int
+	count    int
+	failures int
+	quiet    int32
+}
+
+// NewAdaptiveLogging returns an AdaptiveLogging observing the last window invocations, quiet while at most
+// threshold of them, a ratio between 0 and 1, failed
+func NewAdaptiveLogging(window int, threshold float64) (*AdaptiveLogging, error) {
+	if window < 1 {
+		return nil, fmt.Errorf("adaptive logging window must be positive, got %v", window)
+	}
+	if !(threshold >= 0 && threshold <= 1) {
+		return nil, fmt.Errorf("adaptive logging failure rate threshold must be between 0 and 1, got %v", threshold)
+	}
+	return &AdaptiveLogging{
+		threshold: threshold,
+		results:   make([]bool, window),
+	}, nil
+}
+
+// Quiet tells whether logs below Warn level are currently dropped
+func (a *AdaptiveLogging) Quiet() bool {
+	return atomic.LoadInt32(&a.quiet) == 1
+}
+
+// observe records whether an invocation failed and switches verbosity when the failure rate crosses the threshold
+func (a *AdaptiveLogging) observe(outcome Outcome, logger *zap.Logger) {
+	failed := outcome == OutcomeFailure || outcome == OutcomeRetry
+	a.mu.Lock()
+	if a.count == len(a.results) {
+		if a.results[a.next] {
+			a.failures--
+		}
+	} else {
+		a.count++
+	}
+	a.results[a.next] = failed
+	if failed {
+		a.failures++
+	}
+	a.next = (a.next + 1) % len(a.results)
+	rate := float64(a.failures) / float64(a.count)
+	quiet := a.count == len(a.results) && rate <= a.threshold
+	a.mu.Unlock()
+
+	if quiet && atomic.CompareAndSwapInt32(&a.quiet, 0, 1) {
+		logger.Warn("invocations healthy, logging only warnings and errors", zap.Float64("failure_rate", rate))
+	} else if !quiet && atomic.CompareAndSwapInt32(&a.quiet, 1, 0) {
+		logger.Warn("invocation failure rate rose, resuming detailed logging", zap.Float64("failure_rate", rate))
+	}
+}
+
+// wrap returns logger dropping entries below Warn level while quiet
+func (a *AdaptiveLogging) wrap(logger *zap.Logger) *zap.Logger {
+	return logger.WithOptions(zap.WrapCore(func(core zapcore.Core) zapcore.Core {
+		return adaptiveCore{Core: core, adaptive: a}
+	}))
+}
+
+// adaptiveCore drops entries below Warn level while its AdaptiveLogging is quiet
+type adaptiveCore struct {
+	zapcore.Core
+	adaptive *AdaptiveLogging
+}
+
+func (c adaptiveCore) allows(level zapcore.Level) bool {
+	return level >= zapcore.WarnLevel || !c.adaptive.Quiet()
+}
+
+func (c adaptiveCore) Enabled(level zapcore.Level) bool {
+	return c.allows(level) && c.Core.Enabled(level)
+}
+
+func (c adaptiveCore) With(fields []zapcore.Field) zapcore.Core {
+	return adaptiveCore{Core: c.Core.With(fields), adaptive: c.adaptive}
+}
+
+func (c adaptiveCore) Check(entry zapcore.Entry, checked *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if !c.allows(entry.Level) {
+		return checked
+	}
+	return c.Core.Check(entry, checked)
+}
@@ -0,0 +1,176 @@
+package common
+
+import (
+	"net/http"
+	"testing"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestAdaptiveLoggingObserve(t *testing.T) {
+	adaptive, err := NewAdaptiveLogging(4, 0.25)
+	if err != nil {
+		t.Fatal(err)
+	}
+	steps := []struct {
+		outcome   Outcome
+		wantQuiet bool
+	}{
+		// Not quiet until the window is full
+		{outcome: OutcomeSuccess},
+		{outcome: OutcomeSuccess},
+		{outcome: OutcomeSuccess},
+		{outcome: OutcomeSuccess, wantQuiet: true},
+		// One failure out of 4 is within the threshold
+		{outcome: OutcomeFailure, wantQuiet: true},
+		// Two out of 4 aren't, retries counting as failures
+		{outcome: OutcomeRetry},
+		// Incomplete invocations aren't failures
+		{outcome: OutcomeIncomplete},
+		{outcome: OutcomeSuccess},
+		// The failure left the window, the retry remains
+		{outcome: OutcomeSuccess, wantQuiet: true},
+	}
+	core, logs := observer.New(zapcore.WarnLevel)
+	for i, step := range steps {
+		adaptive.observe(step.outcome, zap.New(core))
+		if got := adaptive.Quiet(); got != step.wantQuiet {
+			t.Errorf("step %v: quiet = %v, want %v", i, got, step.wantQuiet)
+		}
+	}
+	if got := logs.FilterMessage("invocations healthy, logging only warnings and errors").Len(); got != 2 {
+		t.Errorf("logged quieting %v times, want 2", got)
+	}
+	if got := logs.FilterMessage("invocation failure rate rose, resuming detailed logging").Len(); got != 1 {
+		t.Errorf("logged resuming %v times, want 1", got)
+	}
+}
+
+func TestAdaptiveLoggingWrap(t *testing.T) {
+	tests := []struct {
+		name      string
+		quiet     bool
+		level     zapcore.Level
+		wantEntry bool
+	}{
+		{name: "debug logged while failing", level: zapcore.DebugLevel, wantEntry: true},
+		{name: "info logged while failing", level: zapcore.InfoLevel, wantEntry: true},
+		{name: "debug dropped while quiet", quiet: true, level: zapcore.DebugLevel},
+		{name: "info dropped while quiet", quiet: true, level: zapcore.InfoLevel},
+		{name: "warn logged while quiet", quiet: true, level: zapcore.WarnLevel, wantEntry: true},
+		{name: "error logged while quiet", quiet: true, level: zapcore.ErrorLevel, wantEntry: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			adaptive, err := NewAdaptiveLogging(1, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.quiet {
+				adaptive.observe(OutcomeSuccess, zap.NewNop())
+			}
+			core, logs := observer.New(zapcore.DebugLevel)
+			logger := adaptive.wrap(zap.New(core)).With(zap.String("source", "test"))
+			if ce := logger.Check(tt.level, "entry"); ce != nil {
+				ce.Write()
+			}
+			if got := logs.Len() == 1; got != tt.wantEntry {
+				t.Errorf("logged %v entries, want entry %v", logs.Len(), tt.wantEntry)
+			}
+			if got := logger.Core().Enabled(tt.level); got != tt.wantEntry {
+				t.Errorf("Enabled() = %v, want %v", got, tt.wantEntry)
+			}
+		})
+	}
+}
+
+func TestAdaptiveLoggingInvocations(t *testing.T) {
+	srv, _ := statusServer(t, http.StatusOK, http.StatusOK, http.StatusInternalServerError)
+	adaptive, err := NewAdaptiveLogging(2, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := testMetadata(t, srv.URL, WithAdaptiveLogging(adaptive))
+	var quiet []bool
+	for i := 0; i < 3; i++ {
+		if resp, err := HandleHTTPRequest("{}", http.Header{}, data, zap.NewNop()); err == nil {
+			resp.Body.Close()
+		}
+		quiet = append(quiet, adaptive.Quiet())
+	}
+	if quiet[0] || !quiet[1] || quiet[2] {
+		t.Errorf("quiet after each invocation = %v, want [false true false]", quiet)
+	}
+}
+
+func TestNewAdaptiveLoggingInvalid(t *testing.T) {
+	tests := []struct {
+		name      string
+		window    int
+		threshold float64
+	}{
+		{name: "zero window", window: 0, threshold: 0.1},
+		{name: "negative threshold", window: 10, threshold: -0.1},
+		{name: "threshold above 1", window: 10, threshold: 1.5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewAdaptiveLogging(tt.window, tt.threshold); err == nil {
+				t.Error("NewAdaptiveLogging() succeeded")
+			}
+		})
+	}
+}
+
+func TestParseConnectorMetadataAdaptiveLogging(t *testing.T) {
+	tests := []struct {
+		name          string
+		env           map[string]string
+		wantWindow    int
+		wantThreshold float64
+		wantErr       bool
+	}{
+		{name: "unset", env: map[string]string{}},
+		{name: "window", env: map[string]string{"ADAPTIVE_LOGGING_WINDOW": "100"}, wantWindow: 100},
+		{name: "failure rate", env: map[string]string{"ADAPTIVE_LOGGING_WINDOW": "100", "ADAPTIVE_LOGGING_FAILURE_RATE": "0.05"}, wantWindow: 100, wantThreshold: 0.05},
+		{name: "failure rate alone ignored", env: map[string]string{"ADAPTIVE_LOGGING_FAILURE_RATE": "0.05"}},
+		{name: "invalid window", env: map[string]string{"ADAPTIVE_LOGGING_WINDOW": "wide"}, wantErr: true},
+		{name: "zero window", env: map[string]string{"ADAPTIVE_LOGGING_WINDOW": "0"}, wantErr: true},
+		{name: "invalid failure rate", env: map[string]string{"ADAPTIVE_LOGGING_WINDOW": "100", "ADAPTIVE_LOGGING_FAILURE_RATE": "low"}, wantErr: true},
+		{name: "failure rate out of range", env: map[string]string{"ADAPTIVE_LOGGING_WINDOW": "100", "ADAPTIVE_LOGGING_FAILURE_RATE": "5"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := map[string]string{
+				"TOPIC":                         "topic",
+				"HTTP_ENDPOINT":                 "http://function.default",
+				"MAX_RETRIES":                   "3",
+				"CONTENT_TYPE":                  "application/json",
+				"ADAPTIVE_LOGGING_WINDOW":       "",
+				"ADAPTIVE_LOGGING_FAILURE_RATE": "",
+			}
+			for name, value := range tt.env {
+				env[name] = value
+			}
+			setEnv(t, env)
+			meta, err := ParseConnectorMetadata()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseConnectorMetadata() error = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if tt.wantWindow == 0 {
+				if meta.AdaptiveLogging != nil {
+					t.Error("adaptive logging enabled")
+				}
+				return
+			}
+			if meta.AdaptiveLogging == nil || len(meta.AdaptiveLogging.results) != tt.wantWindow || meta.AdaptiveLogging.threshold != tt.wantThreshold {
+				t.Errorf("adaptive logging = %+v, want window %v and threshold %v", meta.AdaptiveLogging, tt.wantWindow, tt.wantThreshold)
+			}
+		})
+	}
+}
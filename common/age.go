@@ -0,0 +1,51 @@
+package common
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// unixMillisThreshold separates event times given in unix seconds from those given in milliseconds
+const unixMillisThreshold = 100000000000
+
+// parseEventTime parses an event time given as RFC 3339 or as unix seconds or milliseconds
+func parseEventTime(value string) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	if unix, err := strconv.ParseInt(value, 10, 64); err == nil {
+		if unix >= unixMillisThreshold {
+			return time.Unix(0, unix*int64(time.Millisecond)), nil
+		}
+		return time.Unix(unix, 0), nil
+	}
+	return time.Parse(time.RFC3339Nano, value)
+}
+
+// messageAge returns the age of the message according to its EventTimeHeader, false if it has no valid event time
+func (m ConnectorMetadata) messageAge(headers http.Header) (time.Duration, bool) {
+	value := headers.Get(m.EventTimeHeader)
+	if value == "" {
+		return 0, false
+	}
+	eventTime, err := parseEventTime(value)
+	if err != nil {
+		return 0, false
+	}
+	return since(eventTime), true
+}
+
+// reportStale reports a message dead-lettered without invoking the function for being older than MaxMessageAge
+func reportStale(body payload, headers http.Header, age time.Duration, data ConnectorMetadata, logger *zap.Logger) error {
+	return reportError(ErrorResponse{
+		Message:      fmt.Sprintf("message is %v old, older than the maximum age of %v; dead-lettered without invoking the function", age, data.MaxMessageAge),
+		HttpEndpoint: data.endpoints()[0],
+		Source:       data.SourceName,
+		Request:      body.message(),
+		Coordinates:  data.SourceCoordinates(headers),
+		ErrorKind:    ErrorKindStale,
+	}, data, logger)
+}
@@ -0,0 +1,73 @@
+package common
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestMaxMessageAge(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name      string
+		eventTime string
+		wantStale bool
+	}{
+		{name: "fresh rfc 3339", eventTime: start.Add(-time.Minute).Format(time.RFC3339)},
+		{name: "stale rfc 3339", eventTime: start.Add(-2 * time.Hour).Format(time.RFC3339Nano), wantStale: true},
+		{name: "fresh unix seconds", eventTime: strconv.FormatInt(start.Add(-time.Minute).Unix(), 10)},
+		{name: "stale unix seconds", eventTime: strconv.FormatInt(start.Add(-2*time.Hour).Unix(), 10), wantStale: true},
+		{name: "stale unix milliseconds", eventTime: strconv.FormatInt(start.Add(-2*time.Hour).UnixNano()/int64(time.Millisecond), 10), wantStale: true},
+		{name: "exactly the maximum age", eventTime: start.Add(-time.Hour).Format(time.RFC3339)},
+		{name: "event in the future", eventTime: start.Add(time.Hour).Format(time.RFC3339)},
+		{name: "missing event time"},
+		{name: "invalid event time", eventTime: "yesterday"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useFakeClock(t)
+			srv, invoked := statusServer(t, http.StatusOK)
+			data := testMetadata(t, srv.URL, WithMaxMessageAge("X-Event-Time", time.Hour))
+			headers := http.Header{}
+			if tt.eventTime != "" {
+				headers.Set("X-Event-Time", tt.eventTime)
+			}
+			resp, report, err := InvokeHTTPRequest(context.Background(), "{}", headers, data, zap.NewNop())
+			if !tt.wantStale {
+				if err != nil {
+					t.Fatalf("fresh message failed: %v", err)
+				}
+				resp.Body.Close()
+				if got := atomic.LoadInt32(invoked); got != 1 {
+					t.Errorf("invoked the function %v times, want 1", got)
+				}
+				return
+			}
+			if got := errorResponseOf(t, err).ErrorKind; got != ErrorKindStale {
+				t.Errorf("error kind = %v, want %v", got, ErrorKindStale)
+			}
+			if report.Outcome != OutcomeFailure {
+				t.Errorf("outcome = %v, want %v", report.Outcome, OutcomeFailure)
+			}
+			if got := atomic.LoadInt32(invoked); got != 0 {
+				t.Errorf("invoked the function %v times for a stale message", got)
+			}
+		})
+	}
+}
+
+func TestMaxMessageAgeRequiresHeader(t *testing.T) {
+	if _, err := NewConnectorMetadata(
+		WithTopic("topic"),
+		WithEndpoint("http://function.default"),
+		WithContentType("application/json"),
+		WithMaxMessageAge("", time.Hour),
+	); err == nil {
+		t.Error("NewConnectorMetadata() accepted a maximum age without event time header")
+	}
+}
@@ -0,0 +1,118 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Credential audit events
+const (
+	// AuditCredentialSelected is emitted when GetAwsConfig selects a credentials provider
+	AuditCredentialSelected = "credential_selected"
+	// AuditCredentialRefreshed is emitted when instrumented credentials are retrieved or refreshed
+	AuditCredentialRefreshed = "credential_refreshed"
+	// AuditCredentialRefreshFailed is emitted when retrieving or refreshing instrumented credentials fails
+	AuditCredentialRefreshFailed = "credential_refresh_failed"
+)
+
+// AuditEvent records which AWS identity the connector used and when, without exposing secrets
+type AuditEvent struct {
+	Time     time.Time `json:"time"`
+	Event    string    `json:"event"`
+	Provider string    `json:"provider"`
+	// AccessKeyHint is the access key ID with all but its last four characters masked
+	AccessKeyHint string `json:"access_key_hint,omitempty"`
+	// Profile is the shared credentials profile, if any
+	Profile string `json:"profile,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// AuditSink receives credential audit events
+type AuditSink interface {
+	Audit(event AuditEvent)
+}
+
+// JSONAuditSink writes audit events to a writer as JSON lines
+type JSONAuditSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewJSONAuditSink returns a JSONAuditSink writing to w
+func NewJSONAuditSink(w io.Writer) *JSONAuditSink {
+	return &JSONAuditSink{w: w}
+}
+
+// Audit implements AuditSink
+func (s *JSONAuditSink) Audit(event AuditEvent) {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.w.Write(append(line, '\n'))
+}
+
+var auditSink = struct {
+	sync.RWMutex
+	sink AuditSink
+}{}
+
+// SetAuditSink sets the sink receiving credential audit events, nil disables auditing.
+// GetAwsConfig sets it from the AWS_CREDENTIAL_AUDIT environment variable unless already set.
+func SetAuditSink(sink AuditSink) {
+	auditSink.Lock()
+	defer auditSink.Unlock()
+	auditSink.sink = sink
+}
+
+// auditSinkFromEnv sets the audit sink from AWS_CREDENTIAL_AUDIT, stderr, stdout or a file path, unless one is set
+func auditSinkFromEnv() error {
+	output := os.Getenv("AWS_CREDENTIAL_AUDIT")
+	auditSink.Lock()
+	defer auditSink.Unlock()
+	if output == "" || auditSink.sink != nil {
+		return nil
+	}
+	switch output {
+	case "stderr":
+		auditSink.sink = NewJSONAuditSink(os.Stderr)
+	case "stdout":
+		auditSink.sink = NewJSONAuditSink(os.Stdout)
+	default:
+		file, err := os.OpenFile(output, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return fmt.Errorf("failed to open AWS_CREDENTIAL_AUDIT file %v", err)
+		}
+		auditSink.sink = NewJSONAuditSink(file)
+	}
+	return nil
+}
+
+// audit sends event to the audit sink, if any
+func audit(event AuditEvent) {
+	auditSink.RLock()
+	sink := auditSink.sink
+	auditSink.RUnlock()
+	if sink == nil {
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = now()
+	}
+	sink.Audit(event)
+}
+
+// redactAccessKey masks all but the last four characters of an access key ID
+func redactAccessKey(accessKeyID string) string {
+	if len(accessKeyID) <= 4 {
+		return strings.Repeat("*", len(accessKeyID))
+	}
+	return strings.Repeat("*", len(accessKeyID)-4) + accessKeyID[len(accessKeyID)-4:]
+}
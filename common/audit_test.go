@@ -0,0 +1,173 @@
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+)
+
+// recordingSink records the audit events it receives
+type recordingSink struct {
+	mu     sync.Mutex
+	events []AuditEvent
+}
+
+func (s *recordingSink) Audit(event AuditEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, event)
+}
+
+// useAuditSink makes the package audit to a recordingSink for the duration of the test
+func useAuditSink(t *testing.T) *recordingSink {
+	t.Helper()
+	sink := &recordingSink{}
+	SetAuditSink(sink)
+	t.Cleanup(func() { SetAuditSink(nil) })
+	return sink
+}
+
+func TestCredentialAuditEvents(t *testing.T) {
+	dir := t.TempDir()
+	shared := filepath.Join(dir, "credentials")
+	if err := ioutil.WriteFile(shared, []byte("[team]\naws_access_key_id = AKIASHAREDKEY1234\naws_secret_access_key = sharedsecret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		env  map[string]string
+		want []AuditEvent
+	}{
+		{
+			name: "static",
+			env:  map[string]string{"AWS_ACCESS_KEY_ID": "AKIASTATICKEY5678", "AWS_SECRET_ACCESS_KEY": "staticsecret"},
+			want: []AuditEvent{
+				{Time: start, Event: AuditCredentialSelected, Provider: credentials.StaticProviderName, AccessKeyHint: "*************5678"},
+				{Time: start, Event: AuditCredentialRefreshed, Provider: credentials.StaticProviderName, AccessKeyHint: "*************5678"},
+			},
+		},
+		{
+			name: "shared profile",
+			env:  map[string]string{"AWS_CRED_PATH": shared, "AWS_CRED_PROFILE": "team"},
+			want: []AuditEvent{
+				{Time: start, Event: AuditCredentialSelected, Provider: credentials.SharedCredsProviderName, Profile: "team"},
+				{Time: start, Event: AuditCredentialRefreshed, Provider: credentials.SharedCredsProviderName, AccessKeyHint: "*************1234"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useFakeClock(t)
+			sink := useAuditSink(t)
+			env := map[string]string{"AWS_REGION": "us-east-1", "AWS_ENDPOINT": "", "AWS_ACCESS_KEY_ID": "", "AWS_SECRET_ACCESS_KEY": "", "AWS_CRED_PATH": "", "AWS_CRED_PROFILE": ""}
+			for name, value := range tt.env {
+				env[name] = value
+			}
+			setEnv(t, env)
+			cfg, err := GetAwsConfig()
+			if err != nil {
+				t.Fatalf("GetAwsConfig() error = %v", err)
+			}
+			if _, err := cfg.Credentials.Get(); err != nil {
+				t.Fatalf("failed to retrieve credentials: %v", err)
+			}
+			if !reflect.DeepEqual(sink.events, tt.want) {
+				t.Errorf("audited %+v, want %+v", sink.events, tt.want)
+			}
+			assertNoSecrets(t, sink.events, "staticsecret", "sharedsecret", "AKIASTATICKEY", "AKIASHAREDKEY")
+		})
+	}
+}
+
+func TestRoleCredentialAuditEvents(t *testing.T) {
+	useFakeClock(t)
+	sink := useAuditSink(t)
+	role := &stubProvider{value: credentials.Value{AccessKeyID: "ASIAROLEKEY9999", SecretAccessKey: "rolesecret", SessionToken: "token"}}
+	creds := NewInstrumentedCredentials(role, "AssumeRoleProvider")
+	creds.Get()
+	// The stub credentials always expire, every retrieval refreshes them
+	role.err = errors.New("AccessDenied: not authorized to assume role")
+	creds.Get()
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	want := []AuditEvent{
+		{Time: start, Event: AuditCredentialRefreshed, Provider: "AssumeRoleProvider", AccessKeyHint: "***********9999"},
+		{Time: start, Event: AuditCredentialRefreshFailed, Provider: "AssumeRoleProvider", Error: "AccessDenied: not authorized to assume role"},
+	}
+	if !reflect.DeepEqual(sink.events, want) {
+		t.Errorf("audited %+v, want %+v", sink.events, want)
+	}
+	assertNoSecrets(t, sink.events, "rolesecret", "token", "ASIAROLEKEY")
+}
+
+// assertNoSecrets fails the test if any of secrets appears in the JSON encoding of events
+func assertNoSecrets(t *testing.T, events []AuditEvent, secrets ...string) {
+	t.Helper()
+	raw, _ := json.Marshal(events)
+	for _, secret := range secrets {
+		if strings.Contains(string(raw), secret) {
+			t.Errorf("audit events expose %q: %s", secret, raw)
+		}
+	}
+}
+
+func TestJSONAuditSink(t *testing.T) {
+	var out bytes.Buffer
+	sink := NewJSONAuditSink(&out)
+	sink.Audit(AuditEvent{Event: AuditCredentialSelected, Provider: "StaticProvider"})
+	sink.Audit(AuditEvent{Event: AuditCredentialRefreshed, Provider: "StaticProvider", AccessKeyHint: "****1234"})
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("wrote %q, want 2 lines", out.String())
+	}
+	var event AuditEvent
+	if err := json.Unmarshal([]byte(lines[1]), &event); err != nil || event.AccessKeyHint != "****1234" {
+		t.Errorf("second line %q decoded to %+v with error %v", lines[1], event, err)
+	}
+}
+
+func TestAuditSinkFromEnv(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	setEnv(t, map[string]string{"AWS_CREDENTIAL_AUDIT": path})
+	t.Cleanup(func() { SetAuditSink(nil) })
+	if err := auditSinkFromEnv(); err != nil {
+		t.Fatalf("auditSinkFromEnv() error = %v", err)
+	}
+	audit(AuditEvent{Event: AuditCredentialSelected, Provider: "StaticProvider"})
+	raw, err := ioutil.ReadFile(path)
+	if err != nil || !strings.Contains(string(raw), `"event":"credential_selected"`) {
+		t.Errorf("audit file holds %q with error %v", raw, err)
+	}
+
+	setEnv(t, map[string]string{"AWS_CREDENTIAL_AUDIT": filepath.Join(path, "not-a-dir", "audit.log")})
+	SetAuditSink(nil)
+	if err := auditSinkFromEnv(); err == nil {
+		t.Error("auditSinkFromEnv() succeeded with an unwritable path")
+	}
+}
+
+func TestRedactAccessKey(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{in: "", want: ""},
+		{in: "AKI", want: "***"},
+		{in: "ABCD", want: "****"},
+		{in: "AKIAEXAMPLE", want: "*******MPLE"},
+	}
+	for _, tt := range tests {
+		if got := redactAccessKey(tt.in); got != tt.want {
+			t.Errorf("redactAccessKey(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// instrumentedProvider wraps a credentials provider to count retrieval failures, so that operators can alert
+// on failing refreshes before AWS calls start failing
+type instrumentedProvider struct {
+	credentials.Provider
+	name string
+}
+
+func (p *instrumentedProvider) Retrieve() (credentials.Value, error) {
+	val, err := p.Provider.Retrieve()
+	if err != nil {
+		awsCredentialErrorsTotal.WithLabelValues(p.name).Inc()
+		audit(AuditEvent{Event: AuditCredentialRefreshFailed, Provider: p.name, Error: err.Error()})
+		return val, err
+	}
+	audit(AuditEvent{Event: AuditCredentialRefreshed, Provider: p.name, AccessKeyHint: redactAccessKey(val.AccessKeyID)})
+	return val, err
+}
+
+// instrumentedProviders maps the credentials returned by NewInstrumentedCredentials to their provider, so that
+// ValidateAwsConfig can inspect them without retrieving them
+var instrumentedProviders sync.Map
+
+// NewInstrumentedCredentials returns credentials retrieved from provider, counting retrieval failures
+// in the keda_connector_aws_credential_errors_total metric labelled with name and auditing retrievals
+func NewInstrumentedCredentials(provider credentials.Provider, name string) *credentials.Credentials {
+	creds := credentials.NewCredentials(&instrumentedProvider{Provider: provider, name: name})
+	instrumentedProviders.Store(creds, provider)
+	return creds
+}
+
+// ValidateAwsConfig checks that cfg, whether built by GetAwsConfig or in code, holds a region and either an
+// endpoint or credentials, so that misconfiguration is reported at startup rather than on the first AWS call.
+// No credentials are retrieved and no network call is made: the providers of credentials built with
+// NewInstrumentedCredentials are inspected for incomplete static keys, unreadable shared credentials files and
+// chains holding both, other credentials are left to be checked on first use.
+func ValidateAwsConfig(cfg *aws.Config) error {
+	if cfg == nil {
+		return errors.New("aws config required")
+	}
+	if aws.StringValue(cfg.Region) == "" {
+		return errors.New("aws region required")
+	}
+	if cfg.Credentials == nil {
+		if aws.StringValue(cfg.Endpoint) == "" {
+			return errors.New("no aws configuration specified")
+		}
+		return nil
+	}
+	provider, ok := instrumentedProviders.Load(cfg.Credentials)
+	if !ok {
+		return nil
+	}
+	var static, shared bool
+	for _, provider := range flattenProviders(provider.(credentials.Provider)) {
+		switch provider := provider.(type) {
+		case *credentials.StaticProvider:
+			if (provider.AccessKeyID == "") != (provider.SecretAccessKey == "") {
+				return errors.New("incomplete static aws credentials: access key id and secret access key must be set together")
+			}
+			static = static || provider.AccessKeyID != ""
+		case *credentials.SharedCredentialsProvider:
+			if err := validateSharedCredentials(provider); err != nil {
+				return err
+			}
+			shared = true
+		}
+	}
+	if static && shared {
+		return errors.New("conflicting aws credentials: both static keys and a shared credentials file are set")
+	}
+	return nil
+}
+
+// flattenProviders returns the providers provider is made of, unwrapping instrumented providers and chains
+func flattenProviders(provider credentials.Provider) []credentials.Provider {
+	switch provider := provider.(type) {
+	case *instrumentedProvider:
+		return flattenProviders(provider.Provider)
+	case *credentials.ChainProvider:
+		var providers []credentials.Provider
+		for _, p := range provider.Providers {
+			providers = append(providers, flattenProviders(p)...)
+		}
+		return providers
+	}
+	return []credentials.Provider{provider}
+}
+
+// validateSharedCredentials checks that the shared credentials file of provider can be read and holds keys for its
+// profile. Only the file is read.
+func validateSharedCredentials(provider *credentials.SharedCredentialsProvider) error {
+	if provider.Filename != "" {
+		file, err := os.Open(provider.Filename)
+		if err != nil {
+			return fmt.Errorf("failed to read aws shared credentials file %v", err)
+		}
+		file.Close()
+	}
+	if _, err := provider.Retrieve(); err != nil {
+		return fmt.Errorf("invalid aws shared credentials %v", err)
+	}
+	return nil
+}
+
+// NewErrorResponseFromAWS returns the ErrorResponse describing a failed AWS operation, so that it is reported
+// like failed function invocations. Failures without an HTTP response are transport errors reported with status 503,
+// throttling without one with status 429.
+func NewErrorResponseFromAWS(err error, data ConnectorMetadata) ErrorResponse {
+	errorResponse := ErrorResponse{
+		Status:    http.StatusServiceUnavailable,
+		Message:   err.Error(),
+		Source:    data.SourceName,
+		ErrorKind: ErrorKindTransport,
+		Throttled: request.IsErrorThrottle(err),
+		Version:   Version,
+	}
+	if errorResponse.Throttled {
+		errorResponse.Status = http.StatusTooManyRequests
+	}
+	if aerr, ok := err.(awserr.Error); ok {
+		errorResponse.Code = aerr.Code()
+		errorResponse.Message = aerr.Message()
+	}
+	if reqErr, ok := err.(awserr.RequestFailure); ok && reqErr.StatusCode() != 0 {
+		errorResponse.Status = reqErr.StatusCode()
+		errorResponse.ErrorKind = ErrorKindResponse
+	}
+	return errorResponse
+}
+
+// awsIdentityTimeout bounds the GetCallerIdentity call of LogAwsIdentity
+const awsIdentityTimeout = 10 * time.Second
+
+// LogAwsIdentity logs the AWS account and ARN cfg resolves to, calling STS GetCallerIdentity, when the
+// AWS_LOG_IDENTITY environment variable is true, so that operators can confirm the connector uses the intended
+// identity in cross-account or role setups. Failures are logged without stopping the connector.
+func LogAwsIdentity(ctx context.Context, cfg *aws.Config, logger *zap.Logger) {
+	if enabled, _ := strconv.ParseBool(os.Getenv("AWS_LOG_IDENTITY")); !enabled || cfg == nil {
+		return
+	}
+	sess, err := session.NewSession(cfg)
+	if err != nil {
+		logger.Warn("failed to create aws session to resolve the caller identity", zap.Error(err))
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, awsIdentityTimeout)
+	defer cancel()
+	identity, err := sts.New(sess).GetCallerIdentityWithContext(ctx, &sts.GetCallerIdentityInput{})
+	if err != nil {
+		logger.Warn("failed to resolve the aws caller identity", zap.Error(err))
+		return
+	}
+	logger.Info("resolved aws caller identity",
+		zap.String("account", aws.StringValue(identity.Account)),
+		zap.String("arn", aws.StringValue(identity.Arn)),
+		zap.String("user_id", aws.StringValue(identity.UserId)))
+}
@@ -0,0 +1,278 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"sync/atomic"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// stubProvider is a credentials provider returning value, or err when set
+type stubProvider struct {
+	value credentials.Value
+	err   error
+}
+
+func (p *stubProvider) Retrieve() (credentials.Value, error) {
+	return p.value, p.err
+}
+
+func (p *stubProvider) IsExpired() bool {
+	return true
+}
+
+func TestInstrumentedCredentials(t *testing.T) {
+	tests := []struct {
+		name     string
+		provider *stubProvider
+		wantErrs float64
+	}{
+		{name: "failing provider", provider: &stubProvider{err: errors.New("refresh failed")}, wantErrs: 1},
+		{name: "working provider", provider: &stubProvider{value: credentials.Value{AccessKeyID: "AKID", SecretAccessKey: "secret"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			counter := awsCredentialErrorsTotal.WithLabelValues(tt.name)
+			before := testutil.ToFloat64(counter)
+			_, err := NewInstrumentedCredentials(tt.provider, tt.name).Get()
+			if (err != nil) != (tt.provider.err != nil) {
+				t.Errorf("Get() error = %v", err)
+			}
+			if got := testutil.ToFloat64(counter) - before; got != tt.wantErrs {
+				t.Errorf("counted %v errors, want %v", got, tt.wantErrs)
+			}
+		})
+	}
+}
+
+func TestValidateAwsConfig(t *testing.T) {
+	dir := t.TempDir()
+	shared := filepath.Join(dir, "credentials")
+	if err := ioutil.WriteFile(shared, []byte("[default]\naws_access_key_id = AKID\naws_secret_access_key = secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	incomplete := filepath.Join(dir, "incomplete")
+	if err := ioutil.WriteFile(incomplete, []byte("[default]\naws_access_key_id = AKID\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	region := aws.String("us-east-1")
+	static := func(id, secret string) *credentials.StaticProvider {
+		return &credentials.StaticProvider{Value: credentials.Value{AccessKeyID: id, SecretAccessKey: secret}}
+	}
+	sharedFile := func(filename, profile string) *credentials.SharedCredentialsProvider {
+		return &credentials.SharedCredentialsProvider{Filename: filename, Profile: profile}
+	}
+	tests := []struct {
+		name    string
+		cfg     *aws.Config
+		wantErr bool
+	}{
+		{name: "nil config", cfg: nil, wantErr: true},
+		{name: "missing region", cfg: &aws.Config{Credentials: credentials.NewStaticCredentials("AKID", "secret", "")}, wantErr: true},
+		{name: "neither credentials nor endpoint", cfg: &aws.Config{Region: region}, wantErr: true},
+		{name: "endpoint without credentials", cfg: &aws.Config{Region: region, Endpoint: aws.String("http://localstack:4566")}},
+		{name: "static credentials", cfg: &aws.Config{Region: region, Credentials: NewInstrumentedCredentials(static("AKID", "secret"), "static")}},
+		{name: "static access key without secret", cfg: &aws.Config{Region: region, Credentials: NewInstrumentedCredentials(static("AKID", ""), "static")}, wantErr: true},
+		{name: "static secret without access key", cfg: &aws.Config{Region: region, Credentials: NewInstrumentedCredentials(static("", "secret"), "static")}, wantErr: true},
+		{name: "shared credentials file", cfg: &aws.Config{Region: region, Credentials: NewInstrumentedCredentials(sharedFile(shared, "default"), "shared")}},
+		{name: "unreadable shared credentials file", cfg: &aws.Config{Region: region, Credentials: NewInstrumentedCredentials(sharedFile(filepath.Join(dir, "missing"), "default"), "shared")}, wantErr: true},
+		{name: "unknown shared credentials profile", cfg: &aws.Config{Region: region, Credentials: NewInstrumentedCredentials(sharedFile(shared, "other"), "shared")}, wantErr: true},
+		{name: "incomplete shared credentials", cfg: &aws.Config{Region: region, Credentials: NewInstrumentedCredentials(sharedFile(incomplete, "default"), "shared")}, wantErr: true},
+		{
+			name: "static keys and shared credentials file",
+			cfg: &aws.Config{Region: region, Credentials: NewInstrumentedCredentials(&credentials.ChainProvider{
+				Providers: []credentials.Provider{static("AKID", "secret"), sharedFile(shared, "default")},
+			}, "chain")},
+			wantErr: true,
+		},
+		{name: "credentials built in code", cfg: &aws.Config{Region: region, Credentials: credentials.NewStaticCredentials("", "", "")}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ValidateAwsConfig(tt.cfg); (err != nil) != tt.wantErr {
+				t.Errorf("ValidateAwsConfig() error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// countingProvider is a credentials provider counting its retrievals
+type countingProvider struct {
+	retrievals int32
+}
+
+func (p *countingProvider) Retrieve() (credentials.Value, error) {
+	atomic.AddInt32(&p.retrievals, 1)
+	return credentials.Value{}, errors.New("no role")
+}
+
+func (p *countingProvider) IsExpired() bool {
+	return true
+}
+
+func TestValidateAwsConfigRetrievesNoCredentials(t *testing.T) {
+	provider := &countingProvider{}
+	counter := awsCredentialErrorsTotal.WithLabelValues("validate-offline")
+	before := testutil.ToFloat64(counter)
+	cfg := &aws.Config{Region: aws.String("us-east-1"), Credentials: NewInstrumentedCredentials(provider, "validate-offline")}
+	if err := ValidateAwsConfig(cfg); err != nil {
+		t.Errorf("ValidateAwsConfig() error = %v", err)
+	}
+	if got := atomic.LoadInt32(&provider.retrievals); got != 0 {
+		t.Errorf("retrieved credentials %v times, want none", got)
+	}
+	if got := testutil.ToFloat64(counter) - before; got != 0 {
+		t.Errorf("counted %v credential errors, want none", got)
+	}
+}
+
+func TestNewErrorResponseFromAWS(t *testing.T) {
+	data := ConnectorMetadata{SourceName: "SQSConnector"}
+	tests := []struct {
+		name string
+		err  error
+		want ErrorResponse
+	}{
+		{
+			name: "transport error",
+			err:  errors.New("dial tcp: connection refused"),
+			want: ErrorResponse{Status: http.StatusServiceUnavailable, Message: "dial tcp: connection refused", ErrorKind: ErrorKindTransport},
+		},
+		{
+			name: "aws error without response",
+			err:  awserr.New("RequestError", "send request failed", errors.New("timeout")),
+			want: ErrorResponse{Status: http.StatusServiceUnavailable, Message: "send request failed", Code: "RequestError", ErrorKind: ErrorKindTransport},
+		},
+		{
+			name: "throttling without response",
+			err:  awserr.New("ThrottlingException", "rate exceeded", nil),
+			want: ErrorResponse{Status: http.StatusTooManyRequests, Message: "rate exceeded", Code: "ThrottlingException", ErrorKind: ErrorKindTransport, Throttled: true},
+		},
+		{
+			name: "request failure",
+			err:  awserr.NewRequestFailure(awserr.New("AccessDenied", "not authorized", nil), http.StatusForbidden, "req-1"),
+			want: ErrorResponse{Status: http.StatusForbidden, Message: "not authorized", Code: "AccessDenied", ErrorKind: ErrorKindResponse},
+		},
+		{
+			name: "throttled request failure",
+			err:  awserr.NewRequestFailure(awserr.New("Throttling", "rate exceeded", nil), http.StatusBadRequest, "req-2"),
+			want: ErrorResponse{Status: http.StatusBadRequest, Message: "rate exceeded", Code: "Throttling", ErrorKind: ErrorKindResponse, Throttled: true},
+		},
+		{
+			name: "request failure without status",
+			err:  awserr.NewRequestFailure(awserr.New("RequestError", "send request failed", nil), 0, ""),
+			want: ErrorResponse{Status: http.StatusServiceUnavailable, Message: "send request failed", Code: "RequestError", ErrorKind: ErrorKindTransport},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.want.Source = data.SourceName
+			tt.want.Version = Version
+			if got := NewErrorResponseFromAWS(tt.err, data); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("NewErrorResponseFromAWS() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+const callerIdentityResponse = `<GetCallerIdentityResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <GetCallerIdentityResult>
+    <Arn>arn:aws:iam::123456789012:role/connector</Arn>
+    <UserId>AROAEXAMPLE:connector</UserId>
+    <Account>123456789012</Account>
+  </GetCallerIdentityResult>
+  <ResponseMetadata><RequestId>req-1</RequestId></ResponseMetadata>
+</GetCallerIdentityResponse>`
+
+const stsErrorResponse = `<ErrorResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <Error><Type>Sender</Type><Code>InvalidClientTokenId</Code><Message>The security token included in the request is invalid.</Message></Error>
+  <RequestId>req-2</RequestId>
+</ErrorResponse>`
+
+func TestLogAwsIdentity(t *testing.T) {
+	tests := []struct {
+		name         string
+		enabled      string
+		status       int
+		nilConfig    bool
+		wantRequests int32
+		wantMessage  string
+		wantFields   map[string]interface{}
+	}{
+		{
+			name:         "resolved",
+			enabled:      "true",
+			status:       http.StatusOK,
+			wantRequests: 1,
+			wantMessage:  "resolved aws caller identity",
+			wantFields:   map[string]interface{}{"account": "123456789012", "arn": "arn:aws:iam::123456789012:role/connector", "user_id": "AROAEXAMPLE:connector"},
+		},
+		{name: "sts failure", enabled: "true", status: http.StatusForbidden, wantRequests: 1, wantMessage: "failed to resolve the aws caller identity"},
+		{name: "disabled", enabled: "", status: http.StatusOK},
+		{name: "invalid flag", enabled: "sure", status: http.StatusOK},
+		{name: "nil config", enabled: "true", status: http.StatusOK, nilConfig: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var requests int32
+			srv := newServer(t, func(w http.ResponseWriter, r *http.Request) {
+				raw, _ := ioutil.ReadAll(r.Body)
+				atomic.AddInt32(&requests, 1)
+				if form, _ := url.ParseQuery(string(raw)); form.Get("Action") != "GetCallerIdentity" {
+					t.Errorf("called action %q", form.Get("Action"))
+				}
+				w.Header().Set("Content-Type", "text/xml")
+				w.WriteHeader(tt.status)
+				if tt.status == http.StatusOK {
+					w.Write([]byte(callerIdentityResponse))
+					return
+				}
+				w.Write([]byte(stsErrorResponse))
+			})
+			setEnv(t, map[string]string{"AWS_LOG_IDENTITY": tt.enabled})
+			cfg := &aws.Config{
+				Region:      aws.String("us-east-1"),
+				Endpoint:    aws.String(srv.URL),
+				Credentials: credentials.NewStaticCredentials("AKID", "secret", ""),
+				MaxRetries:  aws.Int(0),
+			}
+			if tt.nilConfig {
+				cfg = nil
+			}
+			core, logs := observer.New(zapcore.InfoLevel)
+			LogAwsIdentity(context.Background(), cfg, zap.New(core))
+			if got := atomic.LoadInt32(&requests); got != tt.wantRequests {
+				t.Errorf("sent %v requests to STS, want %v", got, tt.wantRequests)
+			}
+			if tt.wantMessage == "" {
+				if logs.Len() != 0 {
+					t.Errorf("logged %v", logs.All())
+				}
+				return
+			}
+			entries := logs.FilterMessage(tt.wantMessage).All()
+			if len(entries) != 1 {
+				t.Fatalf("logged %v, want %q", logs.All(), tt.wantMessage)
+			}
+			fields := entries[0].ContextMap()
+			for name, want := range tt.wantFields {
+				if fields[name] != want {
+					t.Errorf("logged %v = %v, want %v", name, fields[name], want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,81 @@
+package common
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// DefaultRetryBackoffMultiplier is the growth factor of the delay between retries unless configured otherwise
+const DefaultRetryBackoffMultiplier = 2.0
+
+// MaxRetryDelayLimit caps the delay between retries when RetryMaxDelay is not set
+const MaxRetryDelayLimit = time.Hour
+
+// MaxRetriesLimit caps the number of retries of an invocation, larger MaxRetries values are clamped to it
+const MaxRetriesLimit = 1000
+
+// retryDelay returns the delay to wait before the given retry, the first retry being 1.
+// The delay grows exponentially from RetryBackoff by RetryBackoffMultiplier and is capped by RetryMaxDelay,
+// or MaxRetryDelayLimit if not set, so that it can't overflow however many retries are made.
+// With RetryImmediateFirst the first retry doesn't wait and the curve starts with the second one.
+func (m ConnectorMetadata) retryDelay(retry int) time.Duration {
+	if m.RetryImmediateFirst {
+		retry--
+	}
+	if m.RetryBackoff <= 0 || retry < 1 {
+		return 0
+	}
+	maxDelay := m.RetryMaxDelay
+	if maxDelay <= 0 {
+		maxDelay = MaxRetryDelayLimit
+	}
+	multiplier := m.RetryBackoffMultiplier
+	if multiplier == 0 {
+		multiplier = DefaultRetryBackoffMultiplier
+	}
+	// Compute in floating point, where a huge exponent yields +Inf instead of wrapping around
+	delay := float64(m.RetryBackoff) * math.Pow(multiplier, float64(retry-1))
+	if math.IsNaN(delay) || delay >= float64(maxDelay) {
+		return maxDelay
+	}
+	return time.Duration(delay)
+}
+
+// warnClampedRetries makes sure the clamping of MaxRetries is only logged once
+var warnClampedRetries sync.Once
+
+// maxRetries returns the number of retries to make, clamping absurd MaxRetries values to MaxRetriesLimit.
+// Negative values are treated as zero so that at least one attempt is always made.
+func (m ConnectorMetadata) maxRetries(logger *zap.Logger) int {
+	if m.MaxRetries < 0 {
+		return 0
+	}
+	if m.MaxRetries <= MaxRetriesLimit {
+		return m.MaxRetries
+	}
+	warnClampedRetries.Do(func() {
+		logger.Warn("max retries exceeds the limit, clamping it",
+			zap.Int("max_retries", m.MaxRetries),
+			zap.Int("limit", MaxRetriesLimit))
+	})
+	return MaxRetriesLimit
+}
+
+// sleepContext waits for delay, returning the context error if ctx is done first
+func sleepContext(ctx context.Context, delay time.Duration) error {
+	if delay <= 0 {
+		return ctx.Err()
+	}
+	timer := newTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C():
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
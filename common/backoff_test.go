@@ -0,0 +1,199 @@
+package common
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"reflect"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestRetryDelay(t *testing.T) {
+	tests := []struct {
+		name       string
+		base       time.Duration
+		multiplier float64
+		maxDelay   time.Duration
+		want       []time.Duration
+	}{
+		{name: "no backoff", base: 0, want: []time.Duration{0, 0, 0}},
+		{name: "default multiplier", base: 100 * time.Millisecond, want: []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond}},
+		{name: "configured multiplier", base: 100 * time.Millisecond, multiplier: 3, want: []time.Duration{100 * time.Millisecond, 300 * time.Millisecond, 900 * time.Millisecond}},
+		{name: "constant", base: time.Second, multiplier: 1, want: []time.Duration{time.Second, time.Second, time.Second}},
+		{name: "capped", base: time.Second, multiplier: 10, maxDelay: 30 * time.Second, want: []time.Duration{time.Second, 10 * time.Second, 30 * time.Second, 30 * time.Second}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := ConnectorMetadata{RetryBackoff: tt.base, RetryBackoffMultiplier: tt.multiplier, RetryMaxDelay: tt.maxDelay}
+			var got []time.Duration
+			for retry := 1; retry <= len(tt.want); retry++ {
+				got = append(got, data.retryDelay(retry))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("delays = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetryBackoffEnv(t *testing.T) {
+	tests := []struct {
+		name       string
+		multiplier string
+		maxDelay   string
+		wantErr    bool
+	}{
+		{name: "unset"},
+		{name: "valid", multiplier: "1.5", maxDelay: "10s"},
+		{name: "multiplier below 1", multiplier: "0.5", wantErr: true},
+		{name: "invalid multiplier", multiplier: "fast", wantErr: true},
+		{name: "invalid max delay", maxDelay: "soon", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setEnv(t, map[string]string{
+				"TOPIC":                    "topic",
+				"HTTP_ENDPOINT":            "http://function",
+				"MAX_RETRIES":              "3",
+				"CONTENT_TYPE":             "application/json",
+				"RETRY_BACKOFF":            "100ms",
+				"RETRY_BACKOFF_MULTIPLIER": tt.multiplier,
+				"RETRY_MAX_DELAY":          tt.maxDelay,
+			})
+			meta, err := ParseConnectorMetadata()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseConnectorMetadata() error = %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil && tt.maxDelay == "10s" && (meta.RetryBackoffMultiplier != 1.5 || meta.RetryMaxDelay != 10*time.Second) {
+				t.Errorf("multiplier = %v and max delay = %v", meta.RetryBackoffMultiplier, meta.RetryMaxDelay)
+			}
+		})
+	}
+}
+
+func TestRetryDelayHugeRetries(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     ConnectorMetadata
+		retry    int
+		wantWait time.Duration
+	}{
+		{name: "default cap", data: ConnectorMetadata{RetryBackoff: time.Second}, retry: math.MaxInt32, wantWait: MaxRetryDelayLimit},
+		{name: "configured cap", data: ConnectorMetadata{RetryBackoff: time.Second, RetryMaxDelay: time.Minute}, retry: MaxRetriesLimit, wantWait: time.Minute},
+		{name: "huge multiplier", data: ConnectorMetadata{RetryBackoff: time.Second, RetryBackoffMultiplier: math.MaxFloat64}, retry: 3, wantWait: MaxRetryDelayLimit},
+		{name: "largest int", data: ConnectorMetadata{RetryBackoff: time.Nanosecond}, retry: math.MaxInt64, wantWait: MaxRetryDelayLimit},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.data.retryDelay(tt.retry); got != tt.wantWait {
+				t.Errorf("retryDelay(%v) = %v, want %v", tt.retry, got, tt.wantWait)
+			}
+		})
+	}
+}
+
+func TestMaxRetriesClamped(t *testing.T) {
+	tests := []struct {
+		maxRetries int
+		want       int
+	}{
+		{maxRetries: -1, want: 0},
+		{maxRetries: 3, want: 3},
+		{maxRetries: MaxRetriesLimit, want: MaxRetriesLimit},
+		{maxRetries: math.MaxInt64, want: MaxRetriesLimit},
+	}
+	for _, tt := range tests {
+		if got := (ConnectorMetadata{MaxRetries: tt.maxRetries}).maxRetries(zap.NewNop()); got != tt.want {
+			t.Errorf("maxRetries() of %v = %v, want %v", tt.maxRetries, got, tt.want)
+		}
+	}
+}
+
+func TestHugeMaxRetriesEnv(t *testing.T) {
+	setEnv(t, map[string]string{
+		"TOPIC":         "topic",
+		"HTTP_ENDPOINT": "http://function",
+		"MAX_RETRIES":   strconv.FormatInt(math.MaxInt64, 10),
+		"CONTENT_TYPE":  "application/json",
+	})
+	meta, err := ParseConnectorMetadata()
+	if err != nil {
+		t.Fatalf("ParseConnectorMetadata() error = %v", err)
+	}
+	srv, requests := statusServer(t, http.StatusInternalServerError, http.StatusOK)
+	meta.HTTPEndpoint = srv.URL
+	resp, err := HandleHTTPRequest("{}", http.Header{}, meta, zap.NewNop())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resp.Body.Close()
+	if *requests != 2 {
+		t.Errorf("server received %v requests, want 2", *requests)
+	}
+}
+
+func TestRetryDelayImmediateFirst(t *testing.T) {
+	tests := []struct {
+		name string
+		data ConnectorMetadata
+		want []time.Duration
+	}{
+		{
+			name: "backoff from the second retry",
+			data: ConnectorMetadata{RetryBackoff: 100 * time.Millisecond, RetryImmediateFirst: true},
+			want: []time.Duration{0, 100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond},
+		},
+		{
+			name: "capped",
+			data: ConnectorMetadata{RetryBackoff: time.Second, RetryBackoffMultiplier: 10, RetryMaxDelay: 5 * time.Second, RetryImmediateFirst: true},
+			want: []time.Duration{0, time.Second, 5 * time.Second},
+		},
+		{
+			name: "without backoff",
+			data: ConnectorMetadata{RetryImmediateFirst: true},
+			want: []time.Duration{0, 0, 0},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []time.Duration
+			for retry := 1; retry <= len(tt.want); retry++ {
+				got = append(got, tt.data.retryDelay(retry))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("delays = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestImmediateFirstRetry(t *testing.T) {
+	clock := useFakeClock(t)
+	srv, attempts := statusServer(t, http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusOK)
+	data := testMetadata(t, srv.URL, WithMaxRetries(2), WithRetryBackoff(time.Second, 2, 0), WithRetryImmediateFirst(true))
+	done := make(chan InvocationReport, 1)
+	go func() {
+		resp, report, err := InvokeHTTPRequest(context.Background(), "{}", http.Header{}, data, zap.NewNop())
+		if err == nil {
+			resp.Body.Close()
+		}
+		done <- report
+	}()
+	waitForTimers(t, clock, 1)
+	if got := atomic.LoadInt32(attempts); got != 2 {
+		t.Fatalf("made %v attempts before the first backoff, want the first retry made immediately", got)
+	}
+	clock.Advance(time.Second)
+	report := <-done
+	if report.Outcome != OutcomeSuccess || report.Attempts != 3 {
+		t.Errorf("report = %+v, want success after 3 attempts", report)
+	}
+	if report.Duration != time.Second {
+		t.Errorf("invocation took %v, want only the second retry to back off", report.Duration)
+	}
+}
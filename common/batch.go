@@ -0,0 +1,153 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// errBatchTooLarge ends the invocation of a batch rejected with 413 Payload Too Large so that it's split
+var errBatchTooLarge = errors.New("batch rejected as too large")
+
+// BatchResult is the result of invoking the function with the messages of a batch from index Start to End excluded
+type BatchResult struct {
+	Start    int
+	End      int
+	Response *http.Response
+	Report   InvocationReport
+	Err      error
+}
+
+// InvokeHTTPBatch invokes the function like InvokeHTTPRequest with messages sent together as a JSON array, messages
+// holding JSON being embedded as is and others as strings. With SplitBatchOnTooLarge, a batch the function rejects
+// with 413 Payload Too Large is split in halves invoked in turn, down to single messages, only the messages still
+// rejected on their own failing without retries; the rejected batches are reported as failures.
+// One result is returned per invoked part of the batch, in the order of the messages.
+func InvokeHTTPBatch(ctx context.Context, messages []string, headers http.Header, data ConnectorMetadata, logger *zap.Logger) []BatchResult {
+	if len(messages) == 0 {
+		return nil
+	}
+	return invokeBatch(ctx, messages, 0, headers, data, logger)
+}
+
+// invokeBatch invokes the function with messages starting at index start of the batch
+func invokeBatch(ctx context.Context, messages []string, start int, headers http.Header, data ConnectorMetadata, logger *zap.Logger) []BatchResult {
+	message := encodeBatch(messages)
+	body := payload{
+		open:       func() io.Reader { return strings.NewReader(message) },
+		length:     int64(len(message)),
+		message:    func() string { return message },
+		splittable: data.SplitBatchOnTooLarge && len(messages) > 1,
+		batched:    data.SplitBatchOnTooLarge,
+	}
+	resp, report, err := handleHTTPRequest(ctx, body, headers, data, logger)
+	if err != errBatchTooLarge {
+		return []BatchResult{{Start: start, End: start + len(messages), Response: resp, Report: report, Err: err}}
+	}
+	half := len(messages) / 2
+	logger.Info("function rejected batch as too large, splitting it",
+		zap.Int("messages", len(messages)),
+		zap.String("http_endpoint", report.Endpoint),
+		zap.String("source", data.SourceName))
+	results := invokeBatch(ctx, messages[:half], start, headers, data, logger)
+	return append(results, invokeBatch(ctx, messages[half:], start+half, headers, data, logger)...)
+}
+
+// encodeBatch encodes messages as a JSON array, embedding messages holding JSON as is and others as strings
+func encodeBatch(messages []string) string {
+	elements := make([]json.RawMessage, len(messages))
+	for i, message := range messages {
+		if json.Valid([]byte(message)) {
+			elements[i] = json.RawMessage(message)
+		} else {
+			elements[i], _ = json.Marshal(message)
+		}
+	}
+	encoded, _ := json.Marshal(elements)
+	return string(encoded)
+}
+
+// batcher collects values and flushes them together once size values are held or interval elapsed since the
+// first of them was added
+type batcher struct {
+	size     int
+	interval time.Duration
+	flush    func(values []string)
+
+	mu     sync.Mutex
+	values []string
+	stop   chan struct{}
+	closed bool
+}
+
+// newBatcher returns a batcher handing batches of at most size values to flush, at least every interval.
+// The values are usually encoded together with encodeBatch.
+func newBatcher(size int, interval time.Duration, flush func(values []string)) *batcher {
+	return &batcher{
+		size:     size,
+		interval: interval,
+		flush:    flush,
+	}
+}
+
+// add adds value to the current batch, flushing it if full, or returns false once the batcher is closed
+func (b *batcher) add(value string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return false
+	}
+	b.values = append(b.values, value)
+	if len(b.values) >= b.size {
+		b.flushLocked()
+		return true
+	}
+	if len(b.values) == 1 {
+		b.stop = make(chan struct{})
+		go b.flushAfter(newTimer(b.interval), b.stop)
+	}
+	return true
+}
+
+// flushAfter flushes the batch when timer fires unless stop is closed first because it was already flushed
+func (b *batcher) flushAfter(timer Timer, stop chan struct{}) {
+	defer timer.Stop()
+	select {
+	case <-timer.C():
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if b.stop == stop {
+			b.flushLocked()
+		}
+	case <-stop:
+	}
+}
+
+// flushLocked flushes the current batch, if any, with b.mu held so that batches are flushed in order
+func (b *batcher) flushLocked() {
+	if len(b.values) == 0 {
+		return
+	}
+	values := b.values
+	b.values = nil
+	if b.stop != nil {
+		close(b.stop)
+		b.stop = nil
+	}
+	b.flush(values)
+}
+
+// close flushes the current batch and rejects values added afterwards
+func (b *batcher) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	b.flushLocked()
+}
@@ -0,0 +1,200 @@
+package common
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+// batchServer starts a server rejecting with 413 Payload Too Large the batches of more than maxMessages messages or
+// holding a message named "huge", returning the batches it received
+func batchServer(t *testing.T, maxMessages int) (*httptest.Server, func() [][]string) {
+	t.Helper()
+	var mu sync.Mutex
+	var received [][]string
+	srv := newServer(t, func(w http.ResponseWriter, r *http.Request) {
+		var reader io.Reader = r.Body
+		if r.Header.Get("Content-Encoding") == CompressGzip {
+			zr, err := gzip.NewReader(r.Body)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			reader = zr
+		}
+		raw, _ := ioutil.ReadAll(reader)
+		var batch []string
+		if err := json.Unmarshal(raw, &batch); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		received = append(received, batch)
+		mu.Unlock()
+		for _, message := range batch {
+			if message == "huge" {
+				w.WriteHeader(http.StatusRequestEntityTooLarge)
+				return
+			}
+		}
+		if len(batch) > maxMessages {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+		}
+	})
+	return srv, func() [][]string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([][]string(nil), received...)
+	}
+}
+
+func TestInvokeHTTPBatch(t *testing.T) {
+	type part struct {
+		start, end int
+		status     int // status of the ErrorResponse of a failed part, zero on success
+	}
+	tests := []struct {
+		name         string
+		messages     []string
+		split        bool
+		opts         []Option
+		wantParts    []part
+		wantBatches  [][]string
+		wantOutcomes []Outcome
+	}{
+		{
+			name:         "fits",
+			messages:     []string{"a", "b"},
+			split:        true,
+			wantParts:    []part{{0, 2, 0}},
+			wantBatches:  [][]string{{"a", "b"}},
+			wantOutcomes: []Outcome{OutcomeSuccess},
+		},
+		{
+			name:         "split in halves",
+			messages:     []string{"a", "b", "c", "d"},
+			split:        true,
+			wantParts:    []part{{0, 2, 0}, {2, 4, 0}},
+			wantBatches:  [][]string{{"a", "b", "c", "d"}, {"a", "b"}, {"c", "d"}},
+			wantOutcomes: []Outcome{OutcomeFailure, OutcomeSuccess, OutcomeSuccess},
+		},
+		{
+			name:      "oversized message dead-lettered",
+			messages:  []string{"a", "b", "huge", "d"},
+			split:     true,
+			wantParts: []part{{0, 2, 0}, {2, 3, http.StatusRequestEntityTooLarge}, {3, 4, 0}},
+			wantBatches: [][]string{
+				{"a", "b", "huge", "d"}, {"a", "b"}, {"huge", "d"}, {"huge"}, {"d"},
+			},
+			wantOutcomes: []Outcome{OutcomeFailure, OutcomeSuccess, OutcomeFailure, OutcomeFailure, OutcomeSuccess},
+		},
+		{
+			name:         "compressed split in halves",
+			messages:     []string{"a", "b", "c", "d"},
+			split:        true,
+			opts:         []Option{WithCompressAlgorithm(CompressGzip)},
+			wantParts:    []part{{0, 2, 0}, {2, 4, 0}},
+			wantBatches:  [][]string{{"a", "b", "c", "d"}, {"a", "b"}, {"c", "d"}},
+			wantOutcomes: []Outcome{OutcomeFailure, OutcomeSuccess, OutcomeSuccess},
+		},
+		{
+			name:         "not split",
+			messages:     []string{"a", "b", "c", "d"},
+			wantParts:    []part{{0, 4, http.StatusRequestEntityTooLarge}},
+			wantBatches:  [][]string{{"a", "b", "c", "d"}, {"a", "b", "c", "d"}, {"a", "b", "c", "d"}},
+			wantOutcomes: []Outcome{OutcomeFailure},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, received := batchServer(t, 2)
+			reporter := &fakeReporter{}
+			opts := append([]Option{WithMaxRetries(2), WithSplitBatchOnTooLarge(tt.split), WithOutcomeReporter(reporter)}, tt.opts...)
+			data := testMetadata(t, srv.URL, opts...)
+			results := InvokeHTTPBatch(context.Background(), tt.messages, http.Header{}, data, zap.NewNop())
+			var parts []part
+			for _, result := range results {
+				p := part{start: result.Start, end: result.End}
+				if result.Err != nil {
+					p.status = errorResponseOf(t, result.Err).Status
+				} else {
+					result.Response.Body.Close()
+				}
+				parts = append(parts, p)
+			}
+			if !reflect.DeepEqual(parts, tt.wantParts) {
+				t.Errorf("results = %+v, want %+v", parts, tt.wantParts)
+			}
+			if got := received(); !reflect.DeepEqual(got, tt.wantBatches) {
+				t.Errorf("function received %q, want %q", got, tt.wantBatches)
+			}
+			if got := reporter.outcomes(); !reflect.DeepEqual(got, tt.wantOutcomes) {
+				t.Errorf("reported outcomes %v, want %v", got, tt.wantOutcomes)
+			}
+		})
+	}
+}
+
+func TestBatchPayloadRewrites(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    ConnectorMetadata
+		rewrite func(payload, http.Header, ConnectorMetadata) (payload, http.Header, error)
+	}{
+		{name: "compression", data: ConnectorMetadata{CompressAlgorithm: CompressGzip}, rewrite: withCompression},
+		{name: "body headers", data: ConnectorMetadata{BodyHeaders: []string{"X-Id"}}, rewrite: withBodyHeaders},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			const message = `{"id":1}`
+			body := payload{
+				open:       func() io.Reader { return strings.NewReader(message) },
+				length:     int64(len(message)),
+				message:    func() string { return message },
+				splittable: true,
+				batched:    true,
+				queued:     true,
+			}
+			rewritten, _, err := tt.rewrite(body, http.Header{"X-Id": {"1"}}, tt.data)
+			if err != nil {
+				t.Fatalf("rewrite error = %v", err)
+			}
+			if !rewritten.splittable || !rewritten.batched || !rewritten.queued {
+				t.Errorf("rewritten payload splittable %v, batched %v, queued %v, want the flags kept",
+					rewritten.splittable, rewritten.batched, rewritten.queued)
+			}
+		})
+	}
+}
+
+func TestInvokeHTTPBatchEmpty(t *testing.T) {
+	if results := InvokeHTTPBatch(context.Background(), nil, http.Header{}, ConnectorMetadata{}, zap.NewNop()); results != nil {
+		t.Errorf("InvokeHTTPBatch() = %+v, want no results", results)
+	}
+}
+
+func TestEncodeBatch(t *testing.T) {
+	tests := []struct {
+		messages []string
+		want     string
+	}{
+		{messages: []string{`{"id":1}`, `[2]`, `3`}, want: `[{"id":1},[2],3]`},
+		{messages: []string{"plain", `say "hi"`}, want: `["plain","say \"hi\""]`},
+		{messages: []string{`{"broken"`}, want: `["{\"broken\""]`},
+	}
+	for _, tt := range tests {
+		if got := encodeBatch(tt.messages); got != tt.want {
+			t.Errorf("encodeBatch(%q) = %v, want %v", strings.Join(tt.messages, ", "), got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// DefaultBodyHeadersField is the field of the JSON body headers are injected into unless configured otherwise
+const DefaultBodyHeadersField = "headers"
+
+// injectBodyHeaders adds the BodyHeaders found in headers as an object to the JSON object held by message.
+// It fails if message is not a JSON object.
+func injectBodyHeaders(message string, headers http.Header, data ConnectorMetadata) (string, error) {
+	var body map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(message), &body); err != nil || body == nil {
+		return "", fmt.Errorf("message is not a JSON object")
+	}
+	injected := make(map[string]string)
+	for _, key := range data.BodyHeaders {
+		if vals := headers.Values(key); len(vals) > 0 {
+			injected[http.CanonicalHeaderKey(key)] = strings.Join(vals, ", ")
+		}
+	}
+	field := data.BodyHeadersField
+	if field == "" {
+		field = DefaultBodyHeadersField
+	}
+	raw, err := json.Marshal(injected)
+	if err != nil {
+		return "", err
+	}
+	body[field] = raw
+	merged, err := json.Marshal(body)
+	if err != nil {
+		return "", err
+	}
+	return string(merged), nil
+}
+
+// withBodyFieldHeaders returns headers with the scalars found in the JSON body at the paths of BodyFieldHeaders added
+// under their header names, so that they can be routed on without parsing the body. Streams are left unchanged,
+// as are headers whose path isn't found; a body which isn't JSON is reported as an error.
+func withBodyFieldHeaders(body payload, headers http.Header, data ConnectorMetadata) (http.Header, error) {
+	if len(data.BodyFieldHeaders) == 0 || body.once {
+		return headers, nil
+	}
+	var document interface{}
+	if err := json.Unmarshal([]byte(body.message()), &document); err != nil {
+		return headers, err
+	}
+	headers = headers.Clone()
+	if headers == nil {
+		headers = make(http.Header)
+	}
+	for header, paths := range data.BodyFieldHeaders {
+		for _, path := range paths {
+			value, ok := walkJSONPath(document, path)
+			if !ok {
+				continue
+			}
+			if field, ok := jsonScalarString(value); ok {
+				headers.Set(header, field)
+			}
+		}
+	}
+	return headers, nil
+}
+
+// withBodyHeaders returns the payload with BodyHeaders injected into its JSON body, and the headers to send along.
+// The payload is left unchanged if it is a stream or not a JSON object.
+func withBodyHeaders(body payload, headers http.Header, data ConnectorMetadata) (payload, http.Header, error) {
+	if len(data.BodyHeaders) == 0 || body.once {
+		return body, headers, nil
+	}
+	message, err := injectBodyHeaders(body.message(), headers, data)
+	if err != nil {
+		return body, headers, err
+	}
+	injected := body
+	injected.open = func() io.Reader { return strings.NewReader(message) }
+	injected.length = int64(len(message))
+	injected.message = func() string { return message }
+	if data.BodyHeadersOnly {
+		headers = headers.Clone()
+		for _, key := range data.BodyHeaders {
+			headers.Del(key)
+		}
+	}
+	return injected, headers, nil
+}
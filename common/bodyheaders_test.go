@@ -0,0 +1,156 @@
+package common
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestBodyHeaders(t *testing.T) {
+	tests := []struct {
+		name       string
+		message    string
+		field      string
+		only       bool
+		wantBody   string
+		wantHeader string
+	}{
+		{name: "default field", message: `{"id":1}`, wantBody: `{"headers":{"X-Tenant":"acme"},"id":1}`, wantHeader: "acme"},
+		{name: "configured field", message: `{"id":1}`, field: "meta", wantBody: `{"id":1,"meta":{"X-Tenant":"acme"}}`, wantHeader: "acme"},
+		{name: "body only", message: `{"id":1}`, only: true, wantBody: `{"headers":{"X-Tenant":"acme"},"id":1}`},
+		{name: "field replaced", message: `{"headers":"old"}`, wantBody: `{"headers":{"X-Tenant":"acme"}}`, wantHeader: "acme"},
+		{name: "not an object left unchanged", message: `[1,2]`, only: true, wantBody: `[1,2]`, wantHeader: "acme"},
+		{name: "not JSON left unchanged", message: `plain`, wantBody: `plain`, wantHeader: "acme"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var body, header string
+			srv := newServer(t, func(w http.ResponseWriter, r *http.Request) {
+				raw, _ := ioutil.ReadAll(r.Body)
+				body, header = string(raw), r.Header.Get("X-Tenant")
+			})
+			data := testMetadata(t, srv.URL, WithBodyHeaders([]string{"x-tenant", "X-Missing"}, tt.field, tt.only))
+			headers := http.Header{"X-Tenant": {"acme"}, "X-Other": {"kept"}}
+			resp, err := HandleHTTPRequest(tt.message, headers, data, zap.NewNop())
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			resp.Body.Close()
+			if body != tt.wantBody {
+				t.Errorf("body = %v, want %v", body, tt.wantBody)
+			}
+			if header != tt.wantHeader {
+				t.Errorf("X-Tenant header = %q, want %q", header, tt.wantHeader)
+			}
+		})
+	}
+}
+
+func TestInjectBodyHeadersJoinsValues(t *testing.T) {
+	data := ConnectorMetadata{BodyHeaders: []string{"X-Multi"}}
+	got, err := injectBodyHeaders(`{}`, http.Header{"X-Multi": {"a", "b"}}, data)
+	if err != nil {
+		t.Fatalf("injectBodyHeaders() error = %v", err)
+	}
+	var body struct {
+		Headers map[string]string `json:"headers"`
+	}
+	if err := json.Unmarshal([]byte(got), &body); err != nil || body.Headers["X-Multi"] != "a, b" {
+		t.Errorf("injectBodyHeaders() = %v with error %v", got, err)
+	}
+}
+
+func TestBodyFieldHeaders(t *testing.T) {
+	const order = `{"order":{"id":42,"tenant":"acme","express":true,"price":9.5,"lines":[{"sku":"A-1"}],"notes":null}}`
+	tests := []struct {
+		name    string
+		message string
+		stream  bool
+		fields  map[string]string
+		want    http.Header
+	}{
+		{
+			name:    "scalars",
+			message: order,
+			fields:  map[string]string{"X-Order-Id": "order.id", "X-Tenant": "order.tenant", "X-Express": "order.express", "X-Price": "order.price"},
+			want:    http.Header{"X-Order-Id": {"42"}, "X-Tenant": {"acme"}, "X-Express": {"true"}, "X-Price": {"9.5"}, "X-Source": {"incoming"}},
+		},
+		{name: "array index", message: order, fields: map[string]string{"X-Sku": "order.lines.0.sku"}, want: http.Header{"X-Sku": {"A-1"}, "X-Source": {"incoming"}}},
+		{name: "replaces incoming header", message: order, fields: map[string]string{"X-Source": "order.tenant"}, want: http.Header{"X-Source": {"acme"}}},
+		{
+			name:    "missing and non-scalar fields left out",
+			message: order,
+			fields:  map[string]string{"X-Missing": "order.customer", "X-Lines": "order.lines", "X-Notes": "order.notes", "X-Out-Of-Range": "order.lines.3.sku"},
+			want:    http.Header{"X-Source": {"incoming"}},
+		},
+		{name: "not JSON", message: "plain", fields: map[string]string{"X-Tenant": "order.tenant"}, want: http.Header{"X-Source": {"incoming"}}},
+		{name: "stream left unchanged", message: order, stream: true, fields: map[string]string{"X-Tenant": "order.tenant"}, want: http.Header{"X-Source": {"incoming"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			received := make(chan http.Header, 1)
+			srv := newServer(t, func(w http.ResponseWriter, r *http.Request) {
+				ioutil.ReadAll(r.Body)
+				received <- r.Header.Clone()
+			})
+			data := testMetadata(t, srv.URL, WithBodyFieldHeaders(tt.fields), WithChunkedTransfer(tt.stream))
+			headers := http.Header{"X-Source": {"incoming"}}
+			var resp *http.Response
+			var err error
+			if tt.stream {
+				resp, err = HandleHTTPRequestStream(strings.NewReader(tt.message), headers, data, zap.NewNop())
+			} else {
+				resp, err = HandleHTTPRequest(tt.message, headers, data, zap.NewNop())
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			resp.Body.Close()
+			got := <-received
+			for _, header := range []string{"X-Order-Id", "X-Tenant", "X-Express", "X-Price", "X-Sku", "X-Source", "X-Missing", "X-Lines", "X-Notes", "X-Out-Of-Range"} {
+				if !reflect.DeepEqual(got[header], tt.want[header]) {
+					t.Errorf("%v header = %v, want %v", header, got[header], tt.want[header])
+				}
+			}
+			if headers.Get("X-Tenant") != "" {
+				t.Error("incoming headers modified")
+			}
+		})
+	}
+}
+
+func TestParseConnectorMetadataBodyFieldHeaders(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    http.Header
+		wantErr bool
+	}{
+		{name: "unset"},
+		{name: "fields", value: "X-Order-Id=order.id, X-Tenant=tenant", want: http.Header{"X-Order-Id": {"order.id"}, "X-Tenant": {"tenant"}}},
+		{name: "invalid", value: "X-Order-Id", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setEnv(t, map[string]string{
+				"TOPIC":              "topic",
+				"HTTP_ENDPOINT":      "http://function.default",
+				"MAX_RETRIES":        "3",
+				"CONTENT_TYPE":       "application/json",
+				"BODY_FIELD_HEADERS": tt.value,
+			})
+			meta, err := ParseConnectorMetadata()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseConnectorMetadata() error = %v, want error %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(meta.BodyFieldHeaders, tt.want) {
+				t.Errorf("body field headers = %v, want %v", meta.BodyFieldHeaders, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,117 @@
+package common
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned instead of invoking the function while the circuit breaker is open; the message should be nacked
+var ErrCircuitOpen = errors.New("circuit breaker open")
+
+// DefaultBreakerCooldown is how long the circuit breaker stays open unless configured otherwise
+const DefaultBreakerCooldown = 30 * time.Second
+
+// BreakerState is the state of a CircuitBreaker
+type BreakerState int
+
+const (
+	// BreakerClosed lets invocations through
+	BreakerClosed BreakerState = iota
+	// BreakerOpen rejects invocations until the cooldown elapses
+	BreakerOpen
+	// BreakerHalfOpen lets a single probe invocation through, closing the breaker if it succeeds
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	default:
+		return "half-open"
+	}
+}
+
+// CircuitBreaker stops invoking a function failing consecutively, so that an unavailable endpoint isn't hammered
+// and messages are kept for later instead of being dead-lettered
+type CircuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	state    BreakerState
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+// NewCircuitBreaker returns a CircuitBreaker opening after threshold consecutive failures for cooldown
+func NewCircuitBreaker(threshold int, cooldown time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{threshold: threshold, cooldown: cooldown}
+}
+
+// Allow tells whether an invocation may be made, moving an open breaker whose cooldown elapsed to half-open
+func (b *CircuitBreaker) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == BreakerOpen && since(b.openedAt) >= b.cooldown {
+		b.state = BreakerHalfOpen
+		b.probing = false
+	}
+	switch b.state {
+	case BreakerOpen:
+		return false
+	case BreakerHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+	}
+	return true
+}
+
+// Success records a successful invocation, closing the breaker
+func (b *CircuitBreaker) Success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.state = BreakerClosed
+	b.failures = 0
+	b.probing = false
+}
+
+// Failure records a failed invocation, opening the breaker once threshold consecutive failures were recorded
+// or when the probe of a half-open breaker fails. It returns whether this failure opened the breaker, failures
+// recorded while it is already open returning false.
+func (b *CircuitBreaker) Failure() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	b.probing = false
+	if b.state == BreakerHalfOpen || b.failures >= b.threshold {
+		opened := b.state != BreakerOpen
+		b.state = BreakerOpen
+		b.openedAt = now()
+		return opened
+	}
+	return false
+}
+
+// Abort records an invocation that ended without a definitive result, letting another probe through
+func (b *CircuitBreaker) Abort() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+}
+
+// State returns the current state of the breaker
+func (b *CircuitBreaker) State() BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == BreakerOpen && since(b.openedAt) >= b.cooldown {
+		return BreakerHalfOpen
+	}
+	return b.state
+}
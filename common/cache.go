@@ -0,0 +1,219 @@
+package common
+
+import (
+	"bytes"
+	"container/list"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// DefaultResponseCacheSize bounds the number of responses kept by a ResponseCache unless configured otherwise
+const DefaultResponseCacheSize = 1000
+
+// ResponseCache keeps successful responses of idempotent requests for a limited time, evicting the least recently
+// used ones once full. Expired GET responses carrying an ETag are revalidated with a conditional request instead of
+// being fetched again.
+type ResponseCache struct {
+	ttl     time.Duration
+	size    int
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List // of *cachedResponse, most recently used first
+}
+
+type cachedResponse struct {
+	key     string
+	status  int
+	header  http.Header
+	body    []byte
+	expires time.Time
+}
+
+// NewResponseCache returns a ResponseCache keeping at most size responses for ttl, DefaultResponseCacheSize
+// when size isn't positive
+func NewResponseCache(ttl time.Duration, size int) *ResponseCache {
+	if size <= 0 {
+		size = DefaultResponseCacheSize
+	}
+	return &ResponseCache{
+		ttl:     ttl,
+		size:    size,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// get returns the cached response for key if it hasn't expired, otherwise the ETag to revalidate it with if any
+func (c *ResponseCache) get(key string) (resp *http.Response, etag string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, ok := c.entries[key]
+	if !ok {
+		return nil, ""
+	}
+	entry := element.Value.(*cachedResponse)
+	if now().After(entry.expires) {
+		if etag = entry.header.Get("ETag"); etag == "" {
+			c.remove(element)
+		}
+		return nil, etag
+	}
+	c.lru.MoveToFront(element)
+	return entry.response(), ""
+}
+
+// revalidate extends the lifetime of the response cached for key after the server reported it unchanged
+func (c *ResponseCache) revalidate(key string) (*http.Response, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := element.Value.(*cachedResponse)
+	entry.expires = now().Add(c.ttl)
+	c.lru.MoveToFront(element)
+	return entry.response(), true
+}
+
+func (c *ResponseCache) put(key string, resp *http.Response, body []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, ok := c.entries[key]; ok {
+		c.remove(element)
+	}
+	c.entries[key] = c.lru.PushFront(&cachedResponse{
+		key:     key,
+		status:  resp.StatusCode,
+		header:  resp.Header.Clone(),
+		body:    body,
+		expires: now().Add(c.ttl),
+	})
+	for c.lru.Len() > c.size {
+		c.remove(c.lru.Back())
+	}
+}
+
+// remove drops element from the cache, with c.mu held
+func (c *ResponseCache) remove(element *list.Element) {
+	c.lru.Remove(element)
+	delete(c.entries, element.Value.(*cachedResponse).key)
+}
+
+// Len returns the number of cached responses, including expired ones kept for revalidation
+func (c *ResponseCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+func (e cachedResponse) response() *http.Response {
+	return &http.Response{
+		Status:        http.StatusText(e.status),
+		StatusCode:    e.status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        e.header.Clone(),
+		Body:          ioutil.NopCloser(bytes.NewReader(e.body)),
+		ContentLength: int64(len(e.body)),
+	}
+}
+
+// isIdempotentMethod reports whether responses to method are safe to reuse
+func isIdempotentMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead
+}
+
+// FetchHTTP sends a single request with method to url, e.g. to probe an endpoint or fetch reference data, and returns the response.
+// When data.ResponseCache is set, successful GET and HEAD responses are cached and reused until they expire.
+func FetchHTTP(method, url string, headers http.Header, data ConnectorMetadata, logger *zap.Logger) (*http.Response, error) {
+	cacheable := data.ResponseCache != nil && isIdempotentMethod(method)
+	key := cacheKey(method, url, headers)
+	var etag string
+	if cacheable {
+		var resp *http.Response
+		if resp, etag = data.ResponseCache.get(key); resp != nil {
+			logger.Debug("serving response from cache", zap.String("method", method), zap.String("url", url))
+			return resp, nil
+		}
+	}
+
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to create HTTP request. url: %v, source: %v", url, data.SourceName)
+	}
+	for key, vals := range headers {
+		for _, val := range vals {
+			req.Header.Add(key, val)
+		}
+	}
+	if etag != "" && method == http.MethodGet {
+		req.Header.Set("If-None-Match", etag)
+	}
+	client, err := data.clientFor(data.endpointFor(url))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to configure HTTP client. url: %v, source: %v", url, data.SourceName)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to send HTTP request. url: %v, source: %v", url, data.SourceName)
+	}
+	applyDefaultContentType(resp, data)
+	if etag != "" && resp.StatusCode == http.StatusNotModified {
+		resp.Body.Close()
+		if cached, ok := data.ResponseCache.revalidate(key); ok {
+			logger.Debug("serving revalidated response from cache", zap.String("method", method), zap.String("url", url))
+			return cached, nil
+		}
+		return nil, errors.Errorf("server reported unchanged response which is no longer cached. url: %v, source: %v", url, data.SourceName)
+	}
+	if !cacheable || resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp, nil
+	}
+
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read HTTP response. url: %v, source: %v", url, data.SourceName)
+	}
+	data.ResponseCache.put(key, resp, body)
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return resp, nil
+}
+
+// cacheKey identifies the response to a request, which may vary with any of its headers, e.g. Authorization
+func cacheKey(method, url string, headers http.Header) string {
+	var key strings.Builder
+	key.WriteString(method + " " + url)
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, val := range headers[name] {
+			// Names and values can't hold newlines, keeping keys of distinct headers apart
+			key.WriteString("\n" + http.CanonicalHeaderKey(name) + ": " + val)
+		}
+	}
+	return key.String()
+}
+
+// endpointFor returns the configured endpoint url belongs to, so that it's fetched with the transport of that
+// endpoint, or url itself if it doesn't belong to any
+func (m ConnectorMetadata) endpointFor(url string) string {
+	for _, endpoint := range m.endpoints() {
+		if endpoint != "" && strings.HasPrefix(url, endpoint) {
+			return endpoint
+		}
+	}
+	return url
+}
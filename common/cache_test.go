@@ -0,0 +1,151 @@
+package common
+
+import (
+	"io/ioutil"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestFetchHTTPCache(t *testing.T) {
+	tests := []struct {
+		name         string
+		method       string
+		headers      []http.Header
+		advance      time.Duration
+		wantRequests int32
+	}{
+		{name: "cached within ttl", method: http.MethodGet, headers: []http.Header{nil, nil}, wantRequests: 1},
+		{name: "refetched after ttl", method: http.MethodGet, headers: []http.Header{nil, nil}, advance: 2 * time.Minute, wantRequests: 2},
+		{name: "head cached", method: http.MethodHead, headers: []http.Header{nil, nil}, wantRequests: 1},
+		{name: "post not cached", method: http.MethodPost, headers: []http.Header{nil, nil}, wantRequests: 2},
+		{
+			name:         "distinct headers not shared",
+			method:       http.MethodGet,
+			headers:      []http.Header{{"Authorization": {"Bearer a"}}, {"Authorization": {"Bearer b"}}},
+			wantRequests: 2,
+		},
+		{
+			name:         "same headers shared",
+			method:       http.MethodGet,
+			headers:      []http.Header{{"Authorization": {"Bearer a"}}, {"authorization": {"Bearer a"}}},
+			wantRequests: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := useFakeClock(t)
+			var requests int32
+			srv := newServer(t, func(w http.ResponseWriter, r *http.Request) {
+				atomic.AddInt32(&requests, 1)
+				w.Write([]byte("reference data"))
+			})
+			data := testMetadata(t, srv.URL, WithResponseCache(NewResponseCache(time.Minute, 0)))
+			for i, headers := range tt.headers {
+				if i > 0 {
+					clock.Advance(tt.advance)
+				}
+				resp, err := FetchHTTP(tt.method, srv.URL+"/ref", headers, data, zap.NewNop())
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				body, _ := ioutil.ReadAll(resp.Body)
+				resp.Body.Close()
+				if tt.method != http.MethodHead && string(body) != "reference data" {
+					t.Errorf("body = %q, want %q", body, "reference data")
+				}
+			}
+			if got := atomic.LoadInt32(&requests); got != tt.wantRequests {
+				t.Errorf("server received %v requests, want %v", got, tt.wantRequests)
+			}
+		})
+	}
+}
+
+func TestResponseCacheBounded(t *testing.T) {
+	cache := NewResponseCache(time.Minute, 2)
+	resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}}
+	for _, key := range []string{"a", "b", "c"} {
+		cache.put(key, resp, []byte(key))
+	}
+	if cache.Len() != 2 {
+		t.Fatalf("cache holds %v responses, want 2", cache.Len())
+	}
+	if got, _ := cache.get("a"); got != nil {
+		t.Error("least recently used response wasn't evicted")
+	}
+	for _, key := range []string{"b", "c"} {
+		if got, _ := cache.get(key); got == nil {
+			t.Errorf("response %v was evicted", key)
+		}
+	}
+}
+
+func TestFetchHTTPUsesEndpointTransport(t *testing.T) {
+	srv := newTLSServer(t, func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("ok")) })
+	data := testMetadata(t, srv.URL, WithTLS(TLSConfig{CAFile: serverCAFile(t, srv)}))
+	resp, err := FetchHTTP(http.MethodGet, srv.URL+"/probe", nil, data, zap.NewNop())
+	if err != nil {
+		t.Fatalf("FetchHTTP didn't trust the configured CA: %v", err)
+	}
+	resp.Body.Close()
+}
+
+func TestFetchHTTPRevalidatesETag(t *testing.T) {
+	tests := []struct {
+		name     string
+		etag     string
+		modified bool
+		wantBody string
+		wantINM  string
+	}{
+		{name: "unchanged reuses cached body", etag: `"v1"`, wantBody: "v1 data", wantINM: `"v1"`},
+		{name: "changed refetches", etag: `"v1"`, modified: true, wantBody: "v2 data", wantINM: `"v1"`},
+		{name: "without etag refetches", etag: "", wantBody: "v1 data", wantINM: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := useFakeClock(t)
+			var requests int32
+			var gotINM string
+			srv := newServer(t, func(w http.ResponseWriter, r *http.Request) {
+				if atomic.AddInt32(&requests, 1) == 1 {
+					if tt.etag != "" {
+						w.Header().Set("ETag", tt.etag)
+					}
+					w.Write([]byte("v1 data"))
+					return
+				}
+				gotINM = r.Header.Get("If-None-Match")
+				if gotINM != "" && gotINM == tt.etag && !tt.modified {
+					w.WriteHeader(http.StatusNotModified)
+					return
+				}
+				w.Write([]byte(tt.wantBody))
+			})
+			data := testMetadata(t, srv.URL, WithResponseCache(NewResponseCache(time.Minute, 0)))
+			var body []byte
+			for i := 0; i < 2; i++ {
+				resp, err := FetchHTTP(http.MethodGet, srv.URL, nil, data, zap.NewNop())
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				body, _ = ioutil.ReadAll(resp.Body)
+				resp.Body.Close()
+				clock.Advance(2 * time.Minute)
+			}
+			if requests != 2 {
+				t.Errorf("server received %v requests, want 2", requests)
+			}
+			if gotINM != tt.wantINM {
+				t.Errorf("If-None-Match = %q, want %q", gotINM, tt.wantINM)
+			}
+			if string(body) != tt.wantBody {
+				t.Errorf("body = %q, want %q", body, tt.wantBody)
+			}
+		})
+	}
+}
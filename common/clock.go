@@ -0,0 +1,148 @@
+package common
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock tells the time and makes timers, so that tests can control time deterministically
+type Clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) Timer
+}
+
+// Timer is a timer made by a Clock
+type Timer interface {
+	// C returns the channel the time is sent on when the timer fires
+	C() <-chan time.Time
+	// Stop prevents the timer from firing, reporting whether it was stopped before firing
+	Stop() bool
+}
+
+// realClock is the Clock of the time package
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) NewTimer(d time.Duration) Timer { return realTimer{time.NewTimer(d)} }
+
+type realTimer struct{ *time.Timer }
+
+func (t realTimer) C() <-chan time.Time { return t.Timer.C }
+
+var clock = struct {
+	sync.RWMutex
+	Clock
+}{Clock: realClock{}}
+
+// SetClock sets the clock used for backoff, timeouts of the circuit breaker and caches, rate limits and durations,
+// nil restoring the real clock. It is meant for tests, together with NewFakeClock.
+func SetClock(c Clock) {
+	if c == nil {
+		c = realClock{}
+	}
+	clock.Lock()
+	defer clock.Unlock()
+	clock.Clock = c
+}
+
+// now returns the current time of the package clock
+func now() time.Time {
+	clock.RLock()
+	defer clock.RUnlock()
+	return clock.Now()
+}
+
+// since returns the time elapsed since t according to the package clock
+func since(t time.Time) time.Duration {
+	return now().Sub(t)
+}
+
+// newTimer returns a timer of the package clock
+func newTimer(d time.Duration) Timer {
+	clock.RLock()
+	defer clock.RUnlock()
+	return clock.NewTimer(d)
+}
+
+// FakeClock is a Clock whose time only moves when advanced
+type FakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+// NewFakeClock returns a FakeClock starting at start
+func NewFakeClock(start time.Time) *FakeClock {
+	return &FakeClock{now: start}
+}
+
+// Now implements Clock
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// NewTimer implements Clock
+func (c *FakeClock) NewTimer(d time.Duration) Timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTimer{clock: c, at: c.now.Add(d), c: make(chan time.Time, 1)}
+	if d <= 0 {
+		t.fired = true
+		t.c <- c.now
+		return t
+	}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+// Advance moves the time forward by d, firing the timers due
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	pending := c.timers[:0]
+	for _, t := range c.timers {
+		if t.at.After(c.now) {
+			pending = append(pending, t)
+			continue
+		}
+		t.fired = true
+		t.c <- c.now
+	}
+	c.timers = pending
+}
+
+// Timers returns the number of timers waiting to fire, e.g. to wait until code under test sleeps
+func (c *FakeClock) Timers() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.timers)
+}
+
+type fakeTimer struct {
+	clock *FakeClock
+	at    time.Time
+	c     chan time.Time
+	fired bool
+}
+
+func (t *fakeTimer) C() <-chan time.Time { return t.c }
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	if t.fired {
+		return false
+	}
+	for i, pending := range t.clock.timers {
+		if pending == t {
+			t.clock.timers = append(t.clock.timers[:i], t.clock.timers[i+1:]...)
+			break
+		}
+	}
+	t.fired = true
+	return true
+}
@@ -0,0 +1,158 @@
+package common
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestFakeClock(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(start)
+	early := clock.NewTimer(time.Second)
+	late := clock.NewTimer(time.Minute)
+	stopped := clock.NewTimer(time.Second)
+	if !stopped.Stop() {
+		t.Error("Stop() of a pending timer = false")
+	}
+	if immediate := clock.NewTimer(0); !fired(immediate) {
+		t.Error("timer without delay didn't fire immediately")
+	}
+	if got := clock.Timers(); got != 2 {
+		t.Errorf("%v timers pending, want 2", got)
+	}
+	clock.Advance(999 * time.Millisecond)
+	if fired(early) {
+		t.Error("timer fired before its time")
+	}
+	clock.Advance(time.Millisecond)
+	if !fired(early) || fired(late) || fired(stopped) {
+		t.Error("Advance() didn't fire exactly the timers due")
+	}
+	if early.Stop() {
+		t.Error("Stop() of a fired timer = true")
+	}
+	if got := clock.Now(); !got.Equal(start.Add(time.Second)) {
+		t.Errorf("Now() = %v, want %v", got, start.Add(time.Second))
+	}
+	if got := clock.Timers(); got != 1 {
+		t.Errorf("%v timers pending, want 1", got)
+	}
+}
+
+// fired tells whether timer fired, without waiting
+func fired(timer Timer) bool {
+	select {
+	case <-timer.C():
+		return true
+	default:
+		return false
+	}
+}
+
+func TestCircuitBreakerWindow(t *testing.T) {
+	type step struct {
+		advance time.Duration
+		record  string // "failure", "success" or empty
+		allow   bool
+		state   BreakerState
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{
+			name: "opens at threshold and stays open through the cooldown",
+			steps: []step{
+				{record: "failure", allow: true, state: BreakerClosed},
+				{record: "failure", allow: false, state: BreakerOpen},
+				{advance: 29 * time.Second, allow: false, state: BreakerOpen},
+			},
+		},
+		{
+			name: "half-open probe closes on success",
+			steps: []step{
+				{record: "failure", allow: true, state: BreakerClosed},
+				{record: "failure", allow: false, state: BreakerOpen},
+				{advance: 30 * time.Second, allow: true, state: BreakerHalfOpen},
+				{allow: false, state: BreakerHalfOpen},
+				{record: "success", allow: true, state: BreakerClosed},
+			},
+		},
+		{
+			name: "failed probe reopens for a full cooldown",
+			steps: []step{
+				{record: "failure", allow: true, state: BreakerClosed},
+				{record: "failure", allow: false, state: BreakerOpen},
+				{advance: 30 * time.Second, allow: true, state: BreakerHalfOpen},
+				{record: "failure", allow: false, state: BreakerOpen},
+				{advance: 29 * time.Second, allow: false, state: BreakerOpen},
+				{advance: time.Second, allow: true, state: BreakerHalfOpen},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := useFakeClock(t)
+			breaker := NewCircuitBreaker(2, DefaultBreakerCooldown)
+			for i, s := range tt.steps {
+				clock.Advance(s.advance)
+				switch s.record {
+				case "failure":
+					breaker.Failure()
+				case "success":
+					breaker.Success()
+				}
+				if got := breaker.State(); got != s.state {
+					t.Fatalf("step %v: state = %v, want %v", i, got, s.state)
+				}
+				if got := breaker.Allow(); got != s.allow {
+					t.Fatalf("step %v: Allow() = %v, want %v", i, got, s.allow)
+				}
+			}
+		})
+	}
+}
+
+func TestBackoffWithFakeClock(t *testing.T) {
+	clock := useFakeClock(t)
+	srv, attempts := statusServer(t, http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusOK)
+	data := testMetadata(t, srv.URL, WithMaxRetries(2), WithRetryBackoff(time.Second, 2, 0))
+	type result struct {
+		report InvocationReport
+		err    error
+	}
+	done := make(chan result, 1)
+	go func() {
+		resp, report, err := InvokeHTTPRequest(context.Background(), "{}", http.Header{}, data, zap.NewNop())
+		if err == nil {
+			resp.Body.Close()
+		}
+		done <- result{report, err}
+	}()
+	for i, delay := range []time.Duration{time.Second, 2 * time.Second} {
+		waitForTimers(t, clock, 1)
+		if got := atomic.LoadInt32(attempts); got != int32(i+1) {
+			t.Fatalf("made %v attempts before retry %v, want %v", got, i+1, i+1)
+		}
+		clock.Advance(delay - time.Millisecond)
+		if got := atomic.LoadInt32(attempts); got != int32(i+1) {
+			t.Fatalf("retried %v before its delay elapsed", i+1)
+		}
+		clock.Advance(time.Millisecond)
+	}
+	res := <-done
+	if res.err != nil {
+		t.Fatalf("InvokeHTTPRequest() error = %v", res.err)
+	}
+	if res.report.Attempts != 3 {
+		t.Errorf("report attempts = %v, want 3", res.report.Attempts)
+	}
+	if res.report.Duration != 3*time.Second {
+		t.Errorf("report duration = %v, want exactly the 3s of backoff", res.report.Duration)
+	}
+}
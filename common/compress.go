@@ -0,0 +1,108 @@
+package common
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+)
+
+// Compression algorithms accepted as CompressAlgorithm, named after their Content-Encoding
+const (
+	CompressGzip   = "gzip"
+	CompressZstd   = "zstd"
+	CompressBrotli = "br"
+)
+
+// Encoder returns a writer compressing what is written to w, flushing it on Close
+type Encoder func(w io.Writer) (io.WriteCloser, error)
+
+var (
+	encodersMu sync.RWMutex
+	encoders   = map[string]Encoder{
+		CompressGzip: func(w io.Writer) (io.WriteCloser, error) { return gzip.NewWriter(w), nil },
+	}
+)
+
+// RegisterEncoder makes encoder available as the CompressAlgorithm named algorithm. Only gzip is built in,
+// so that this module doesn't depend on zstd or brotli implementations; connectors needing them register one, e.g.
+// from github.com/klauspost/compress/zstd or github.com/andybalholm/brotli
+func RegisterEncoder(algorithm string, encoder Encoder) {
+	encodersMu.Lock()
+	defer encodersMu.Unlock()
+	encoders[algorithm] = encoder
+}
+
+// encoderFor returns the encoder registered for algorithm, or false if there is none
+func encoderFor(algorithm string) (Encoder, bool) {
+	encodersMu.RLock()
+	defer encodersMu.RUnlock()
+	encoder, ok := encoders[algorithm]
+	return encoder, ok
+}
+
+// validateCompressAlgorithm checks that an encoder is registered for algorithm, if any
+func validateCompressAlgorithm(algorithm string) error {
+	if algorithm == "" {
+		return nil
+	}
+	if _, ok := encoderFor(algorithm); !ok {
+		return fmt.Errorf("no encoder registered for compression algorithm %q, register one with RegisterEncoder", algorithm)
+	}
+	return nil
+}
+
+// withCompression returns the payload compressed using CompressAlgorithm and the headers to send along,
+// leaving the payload unchanged if compression is disabled, the body is empty or already encoded.
+// Streams are compressed while being sent, other payloads once for all attempts.
+func withCompression(body payload, headers http.Header, data ConnectorMetadata) (payload, http.Header, error) {
+	if data.CompressAlgorithm == "" || body.length == 0 || headers.Get("Content-Encoding") != "" {
+		return body, headers, nil
+	}
+	algorithm := data.CompressAlgorithm
+	encoder, ok := encoderFor(algorithm)
+	if !ok {
+		return body, headers, validateCompressAlgorithm(algorithm)
+	}
+	encoded := headers.Clone()
+	if encoded == nil {
+		encoded = make(http.Header)
+	}
+	encoded.Set("Content-Encoding", algorithm)
+	if body.once {
+		open := body.open
+		body.open = func() io.Reader {
+			pr, pw := io.Pipe()
+			go func() { pw.CloseWithError(encode(pw, open(), encoder)) }()
+			return pr
+		}
+		body.length = -1
+		return body, encoded, nil
+	}
+	var buf bytes.Buffer
+	if err := encode(&buf, body.open(), encoder); err != nil {
+		return body, headers, err
+	}
+	compressed := buf.Bytes()
+	body.open = func() io.Reader { return bytes.NewReader(compressed) }
+	body.length = int64(len(compressed))
+	return body, encoded, nil
+}
+
+// encode writes r compressed by encoder to w
+func encode(w io.Writer, r io.Reader, encoder Encoder) error {
+	if closer, ok := r.(io.Closer); ok {
+		defer closer.Close()
+	}
+	enc, err := encoder(w)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(enc, r); err != nil {
+		enc.Close()
+		return err
+	}
+	return enc.Close()
+}
@@ -0,0 +1,139 @@
+package common
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+// upperWriter is an Encoder writer uppercasing what is written, standing in for a registered algorithm
+type upperWriter struct {
+	w io.Writer
+}
+
+func (u upperWriter) Write(p []byte) (int, error) {
+	return u.w.Write(bytes.ToUpper(p))
+}
+
+func (u upperWriter) Close() error {
+	return nil
+}
+
+func init() {
+	RegisterEncoder("x-upper", func(w io.Writer) (io.WriteCloser, error) { return upperWriter{w}, nil })
+}
+
+// decodingServer starts a server recording the Content-Encoding and decoded body of every request
+func decodingServer(t *testing.T, statuses ...int) (*httptest.Server, func() ([]string, []string)) {
+	t.Helper()
+	var mu sync.Mutex
+	var encodings, bodies []string
+	srv := newServer(t, func(w http.ResponseWriter, r *http.Request) {
+		var body io.Reader = r.Body
+		encoding := r.Header.Get("Content-Encoding")
+		if encoding == CompressGzip {
+			zr, err := gzip.NewReader(r.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			body = zr
+		}
+		decoded, err := ioutil.ReadAll(body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		encodings = append(encodings, encoding)
+		bodies = append(bodies, string(decoded))
+		n := len(bodies)
+		mu.Unlock()
+		if n <= len(statuses) {
+			w.WriteHeader(statuses[n-1])
+		}
+	})
+	return srv, func() ([]string, []string) {
+		mu.Lock()
+		defer mu.Unlock()
+		return encodings, bodies
+	}
+}
+
+func TestCompression(t *testing.T) {
+	message := strings.Repeat(`{"greeting":"hello"}`, 100)
+	tests := []struct {
+		name         string
+		algorithm    string
+		stream       bool
+		headers      http.Header
+		wantEncoding string
+		wantBody     string
+	}{
+		{name: "disabled", wantBody: message},
+		{name: "gzip", algorithm: CompressGzip, wantEncoding: CompressGzip, wantBody: message},
+		{name: "gzip stream", algorithm: CompressGzip, stream: true, wantEncoding: CompressGzip, wantBody: message},
+		{name: "registered encoder", algorithm: "x-upper", wantEncoding: "x-upper", wantBody: strings.ToUpper(message)},
+		{name: "already encoded", algorithm: CompressGzip, headers: http.Header{"Content-Encoding": {"identity"}}, wantEncoding: "identity", wantBody: message},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The first attempt fails, the compressed body must be sent again unchanged
+			statuses, retries := []int{http.StatusInternalServerError}, 1
+			if tt.stream {
+				// Streams can't be replayed
+				statuses, retries = nil, 0
+			}
+			srv, received := decodingServer(t, statuses...)
+			data := testMetadata(t, srv.URL, WithMaxRetries(retries), WithCompressAlgorithm(tt.algorithm))
+			headers := tt.headers
+			if headers == nil {
+				headers = http.Header{}
+			}
+			var resp *http.Response
+			var err error
+			if tt.stream {
+				resp, err = HandleHTTPRequestStream(strings.NewReader(message), headers, data, zap.NewNop())
+			} else {
+				resp, err = HandleHTTPRequest(message, headers, data, zap.NewNop())
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			resp.Body.Close()
+			encodings, bodies := received()
+			if len(bodies) != retries+1 {
+				t.Fatalf("server received %v requests, want %v", len(bodies), retries+1)
+			}
+			for i := range bodies {
+				if encodings[i] != tt.wantEncoding || bodies[i] != tt.wantBody {
+					t.Errorf("attempt %v sent %q encoded %q, want %q encoded %q", i, bodies[i], encodings[i], tt.wantBody, tt.wantEncoding)
+				}
+			}
+		})
+	}
+}
+
+func TestUnknownCompressAlgorithm(t *testing.T) {
+	if _, err := NewConnectorMetadata(WithTopic("topic"), WithEndpoint("http://function"), WithContentType("application/json"), WithCompressAlgorithm(CompressZstd)); err == nil {
+		t.Errorf("zstd accepted without a registered encoder")
+	}
+	setEnv(t, map[string]string{
+		"TOPIC":              "topic",
+		"HTTP_ENDPOINT":      "http://function",
+		"MAX_RETRIES":        "3",
+		"CONTENT_TYPE":       "application/json",
+		"COMPRESS_ALGORITHM": "deflate",
+	})
+	if _, err := ParseConnectorMetadata(); err == nil {
+		t.Errorf("deflate accepted without a registered encoder")
+	}
+}
@@ -0,0 +1,92 @@
+package common
+
+import (
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// Version is the build version of the connector, injected with
+// -ldflags "-X github.com/fission/keda-connectors/common.Version=<version>"
+var Version string
+
+// RetryPolicy summarizes how failed invocations are retried
+type RetryPolicy struct {
+	// MaxRetries is the effective number of retries after clamping
+	MaxRetries int
+	// Backoff is the delay before the first retry, growing by BackoffMultiplier up to MaxDelay
+	Backoff           time.Duration
+	BackoffMultiplier float64
+	MaxDelay          time.Duration
+	// RetryableStatuses describes which responses are retried
+	RetryableStatuses string
+	// ResponseActionField names the response field letting the function override retries, if any
+	ResponseActionField string
+	// NoRetryHeader names the response header marking failures as permanent, if any
+	NoRetryHeader string
+	// ImmediateFirst tells whether the first retry is made without waiting, Backoff applying from the second one
+	ImmediateFirst bool
+}
+
+// RetryPolicy returns the retry policy resolved from the configuration
+func (m ConnectorMetadata) RetryPolicy() RetryPolicy {
+	policy := RetryPolicy{
+		MaxRetries:          m.MaxRetries,
+		Backoff:             m.RetryBackoff,
+		BackoffMultiplier:   m.RetryBackoffMultiplier,
+		MaxDelay:            m.RetryMaxDelay,
+		RetryableStatuses:   "non-2xx",
+		ResponseActionField: m.ResponseActionField,
+		NoRetryHeader:       m.NoRetryHeader,
+		ImmediateFirst:      m.RetryImmediateFirst,
+	}
+	for _, status := range m.Retryable2xx {
+		policy.RetryableStatuses += "," + strconv.Itoa(status)
+	}
+	if policy.MaxRetries < 0 {
+		policy.MaxRetries = 0
+	} else if policy.MaxRetries > MaxRetriesLimit {
+		policy.MaxRetries = MaxRetriesLimit
+	}
+	if policy.BackoffMultiplier == 0 {
+		policy.BackoffMultiplier = DefaultRetryBackoffMultiplier
+	}
+	if policy.MaxDelay <= 0 {
+		policy.MaxDelay = MaxRetryDelayLimit
+	}
+	return policy
+}
+
+// MarshalLogObject implements zapcore.ObjectMarshaler
+func (p RetryPolicy) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+	enc.AddInt("max_retries", p.MaxRetries)
+	enc.AddDuration("backoff", p.Backoff)
+	enc.AddFloat64("backoff_multiplier", p.BackoffMultiplier)
+	enc.AddDuration("max_delay", p.MaxDelay)
+	enc.AddString("retryable_statuses", p.RetryableStatuses)
+	if p.ResponseActionField != "" {
+		enc.AddString("response_action_field", p.ResponseActionField)
+	}
+	if p.NoRetryHeader != "" {
+		enc.AddString("no_retry_header", p.NoRetryHeader)
+	}
+	if p.ImmediateFirst {
+		enc.AddBool("immediate_first", p.ImmediateFirst)
+	}
+	return nil
+}
+
+// LogConnectorMetadata logs the resolved configuration at startup, leaving out secrets, to help debugging deployments
+func LogConnectorMetadata(data ConnectorMetadata, logger *zap.Logger) {
+	logger.Info("connector configuration",
+		zap.String("version", Version),
+		zap.String("topic", data.Topic),
+		zap.String("response_topic", data.ResponseTopic),
+		zap.String("error_topic", data.ErrorTopic),
+		zap.Strings("http_endpoints", data.endpoints()),
+		zap.String("content_type", data.ContentType),
+		zap.String("source", data.SourceName),
+		zap.Object("retry_policy", data.RetryPolicy()))
+}
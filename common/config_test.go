@@ -0,0 +1,129 @@
+package common
+
+import (
+	"errors"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestRetryPolicy(t *testing.T) {
+	tests := []struct {
+		name string
+		data ConnectorMetadata
+		want RetryPolicy
+	}{
+		{
+			name: "defaults",
+			data: ConnectorMetadata{MaxRetries: 3},
+			want: RetryPolicy{MaxRetries: 3, BackoffMultiplier: DefaultRetryBackoffMultiplier, MaxDelay: MaxRetryDelayLimit, RetryableStatuses: "non-2xx"},
+		},
+		{
+			name: "configured",
+			data: ConnectorMetadata{
+				MaxRetries:             5,
+				RetryBackoff:           time.Second,
+				RetryBackoffMultiplier: 1.5,
+				RetryMaxDelay:          time.Minute,
+				Retryable2xx:           []int{202, 207},
+				ResponseActionField:    "action",
+				NoRetryHeader:          "X-No-Retry",
+				RetryImmediateFirst:    true,
+			},
+			want: RetryPolicy{
+				MaxRetries:          5,
+				Backoff:             time.Second,
+				BackoffMultiplier:   1.5,
+				MaxDelay:            time.Minute,
+				RetryableStatuses:   "non-2xx,202,207",
+				ResponseActionField: "action",
+				NoRetryHeader:       "X-No-Retry",
+				ImmediateFirst:      true,
+			},
+		},
+		{
+			name: "clamped retries",
+			data: ConnectorMetadata{MaxRetries: MaxRetriesLimit + 1},
+			want: RetryPolicy{MaxRetries: MaxRetriesLimit, BackoffMultiplier: DefaultRetryBackoffMultiplier, MaxDelay: MaxRetryDelayLimit, RetryableStatuses: "non-2xx"},
+		},
+		{
+			name: "negative retries",
+			data: ConnectorMetadata{MaxRetries: -1},
+			want: RetryPolicy{MaxRetries: 0, BackoffMultiplier: DefaultRetryBackoffMultiplier, MaxDelay: MaxRetryDelayLimit, RetryableStatuses: "non-2xx"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.data.RetryPolicy(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("RetryPolicy() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLogConnectorMetadata(t *testing.T) {
+	core, logs := observer.New(zapcore.InfoLevel)
+	data := testMetadata(t, "http://function", WithMaxRetries(2), WithRetryBackoff(100*time.Millisecond, 3, 10*time.Second), WithNoRetryHeader("X-No-Retry"))
+	LogConnectorMetadata(data, zap.New(core))
+	entries := logs.FilterMessage("connector configuration").All()
+	if len(entries) != 1 {
+		t.Fatalf("logged %v configurations, want 1", len(entries))
+	}
+	want := map[string]interface{}{
+		"max_retries":        2,
+		"backoff":            100 * time.Millisecond,
+		"backoff_multiplier": float64(3),
+		"max_delay":          10 * time.Second,
+		"retryable_statuses": "non-2xx",
+		"no_retry_header":    "X-No-Retry",
+	}
+	if got := entries[0].ContextMap()["retry_policy"]; !reflect.DeepEqual(got, want) {
+		t.Errorf("logged retry policy %v, want %v", got, want)
+	}
+}
+
+// useVersion sets the build version for the duration of the test
+func useVersion(t *testing.T, version string) {
+	t.Helper()
+	previous := Version
+	Version = version
+	t.Cleanup(func() { Version = previous })
+}
+
+func TestVersion(t *testing.T) {
+	tests := []struct {
+		name    string
+		version string
+	}{
+		{name: "set", version: "v1.2.3"},
+		{name: "unset", version: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useVersion(t, tt.version)
+			srv, _ := statusServer(t, http.StatusInternalServerError)
+			core, logs := observer.New(zapcore.InfoLevel)
+			data := testMetadata(t, srv.URL)
+			LogConnectorMetadata(data, zap.New(core))
+			if got := logs.FilterMessage("connector configuration").All()[0].ContextMap()["version"]; got != tt.version {
+				t.Errorf("logged version %q, want %q", got, tt.version)
+			}
+			_, err := HandleHTTPRequest("{}", http.Header{}, data, zap.NewNop())
+			if got := errorResponseOf(t, err).Version; got != tt.version {
+				t.Errorf("error response version %q, want %q", got, tt.version)
+			}
+			if hasField := strings.Contains(err.Error(), `"version"`); hasField != (tt.version != "") {
+				t.Errorf("error response %v, want the version field only when set", err)
+			}
+			if got := NewErrorResponseFromAWS(errors.New("failed"), data).Version; got != tt.version {
+				t.Errorf("AWS error response version %q, want %q", got, tt.version)
+			}
+		})
+	}
+}
@@ -0,0 +1,62 @@
+package common
+
+import "net/http"
+
+// SourceCoordinates locates a message in the source it was consumed from
+type SourceCoordinates struct {
+	Topic     string `json:"topic,omitempty"`
+	Partition string `json:"partition,omitempty"`
+	Offset    string `json:"offset,omitempty"`
+}
+
+// Headers of forwarded messages carrying the source coordinates
+const (
+	SourceTopicHeader     = "X-Source-Topic"
+	SourcePartitionHeader = "X-Source-Partition"
+	SourceOffsetHeader    = "X-Source-Offset"
+)
+
+// SourceCoordinateHeaders names the incoming headers the source coordinates of a message are read from
+type SourceCoordinateHeaders struct {
+	// Topic header, the consumed Topic is used when empty
+	Topic     string
+	Partition string
+	Offset    string
+}
+
+// SourceCoordinates returns the coordinates of the message with the given incoming headers,
+// or nil if no coordinate headers are configured
+func (m ConnectorMetadata) SourceCoordinates(headers http.Header) *SourceCoordinates {
+	if m.SourceCoordinateHeaders == (SourceCoordinateHeaders{}) {
+		return nil
+	}
+	coordinates := &SourceCoordinates{
+		Topic:     m.Topic,
+		Partition: headers.Get(m.SourceCoordinateHeaders.Partition),
+		Offset:    headers.Get(m.SourceCoordinateHeaders.Offset),
+	}
+	if m.SourceCoordinateHeaders.Topic != "" {
+		if topic := headers.Get(m.SourceCoordinateHeaders.Topic); topic != "" {
+			coordinates.Topic = topic
+		}
+	}
+	return coordinates
+}
+
+// Header returns the coordinates as headers to attach to messages forwarded to the response or error topic
+func (c *SourceCoordinates) Header() http.Header {
+	header := make(http.Header)
+	if c == nil {
+		return header
+	}
+	for key, val := range map[string]string{
+		SourceTopicHeader:     c.Topic,
+		SourcePartitionHeader: c.Partition,
+		SourceOffsetHeader:    c.Offset,
+	} {
+		if val != "" {
+			header.Set(key, val)
+		}
+	}
+	return header
+}
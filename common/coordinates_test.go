@@ -0,0 +1,105 @@
+package common
+
+import (
+	"net/http"
+	"reflect"
+	"sync"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+// publishedMessage is a message published by a Forwarder through a recordingPublisher
+type publishedMessage struct {
+	topic   string
+	key     string
+	value   string
+	headers http.Header
+}
+
+// recordingPublisher records the messages published with its publish method
+type recordingPublisher struct {
+	mu       sync.Mutex
+	messages []publishedMessage
+}
+
+func (p *recordingPublisher) publish(topic, key string, value []byte, headers http.Header) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.messages = append(p.messages, publishedMessage{topic: topic, key: key, value: string(value), headers: headers})
+	return nil
+}
+
+func (p *recordingPublisher) published() []publishedMessage {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]publishedMessage(nil), p.messages...)
+}
+
+var testCoordinateHeaders = SourceCoordinateHeaders{Partition: "X-Kafka-Partition", Offset: "X-Kafka-Offset", Topic: "X-Kafka-Topic"}
+
+func TestSourceCoordinates(t *testing.T) {
+	tests := []struct {
+		name       string
+		configured SourceCoordinateHeaders
+		incoming   http.Header
+		want       *SourceCoordinates
+	}{
+		{name: "not configured", incoming: http.Header{"X-Kafka-Partition": {"3"}}, want: nil},
+		{
+			name:       "from headers",
+			configured: testCoordinateHeaders,
+			incoming:   http.Header{"X-Kafka-Partition": {"3"}, "X-Kafka-Offset": {"42"}, "X-Kafka-Topic": {"orders"}},
+			want:       &SourceCoordinates{Topic: "orders", Partition: "3", Offset: "42"},
+		},
+		{
+			name:       "consumed topic by default",
+			configured: testCoordinateHeaders,
+			incoming:   http.Header{"X-Kafka-Partition": {"3"}},
+			want:       &SourceCoordinates{Topic: "topic", Partition: "3"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := ConnectorMetadata{Topic: "topic", SourceCoordinateHeaders: tt.configured}
+			if got := data.SourceCoordinates(tt.incoming); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("SourceCoordinates() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSourceCoordinatesRoundTrip(t *testing.T) {
+	incoming := http.Header{"X-Kafka-Partition": {"3"}, "X-Kafka-Offset": {"42"}}
+	want := &SourceCoordinates{Topic: "topic", Partition: "3", Offset: "42"}
+	wantHeaders := http.Header{SourceTopicHeader: {"topic"}, SourcePartitionHeader: {"3"}, SourceOffsetHeader: {"42"}}
+
+	srv, _ := statusServer(t, http.StatusBadRequest)
+	data := testMetadata(t, srv.URL, WithSourceCoordinateHeaders(testCoordinateHeaders), WithErrorTopic("errors"), WithResponseTopic("responses"))
+	_, err := HandleHTTPRequest("{}", incoming, data, zap.NewNop())
+	errorResponse := errorResponseOf(t, err)
+	if !reflect.DeepEqual(errorResponse.Coordinates, want) {
+		t.Errorf("ErrorResponse coordinates = %+v, want %+v", errorResponse.Coordinates, want)
+	}
+
+	publisher := &recordingPublisher{}
+	forwarder := NewForwarder(publisher.publish, data, zap.NewNop())
+	if err := forwarder.ForwardError("key", errorResponse); err != nil {
+		t.Fatal(err)
+	}
+	if err := forwarder.ForwardResponseFor("key", []byte("ok"), http.Header{"Content-Type": {"text/plain"}}, incoming); err != nil {
+		t.Fatal(err)
+	}
+	forwarder.Close()
+	published := publisher.published()
+	if len(published) != 2 {
+		t.Fatalf("published %v messages, want 2", len(published))
+	}
+	for _, msg := range published {
+		for key, vals := range wantHeaders {
+			if !reflect.DeepEqual(msg.headers[key], vals) {
+				t.Errorf("message to %v has header %v = %v, want %v", msg.topic, key, msg.headers[key], vals)
+			}
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package common
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// redactedHeaderWords mark headers whose values are redacted from the errors exposed by the debug handler
+var redactedHeaderWords = []string{"auth", "cookie", "token", "secret", "password", "key"}
+
+// RecentErrors keeps the last error responses in a ring, exposed as JSON by its debug handler
+type RecentErrors struct {
+	mu    sync.Mutex
+	ring  []ErrorResponse
+	next  int
+	count int
+}
+
+// NewRecentErrors returns RecentErrors keeping the last size error responses
+func NewRecentErrors(size int) *RecentErrors {
+	return &RecentErrors{ring: make([]ErrorResponse, size)}
+}
+
+// add records errorResponse, overwriting the oldest one when full
+func (r *RecentErrors) add(errorResponse ErrorResponse) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.ring) == 0 {
+		return
+	}
+	r.ring[r.next] = errorResponse
+	r.next = (r.next + 1) % len(r.ring)
+	if r.count < len(r.ring) {
+		r.count++
+	}
+}
+
+// List returns the recorded error responses, oldest first, with secret headers and URL credentials redacted and
+// without the request and response bodies, which may hold personal data
+func (r *RecentErrors) List() []ErrorResponse {
+	return r.list(false)
+}
+
+// list returns the recorded error responses, oldest first, keeping their bodies if includeBodies is set
+func (r *RecentErrors) list(includeBodies bool) []ErrorResponse {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	list := make([]ErrorResponse, 0, r.count)
+	for i := 0; i < r.count; i++ {
+		errorResponse := r.ring[(r.next-r.count+i+len(r.ring))%len(r.ring)]
+		errorResponse.Headers = redactHeaders(errorResponse.Headers)
+		errorResponse.HttpEndpoint = redactURL(errorResponse.HttpEndpoint)
+		if !includeBodies {
+			errorResponse.Body = ""
+			errorResponse.BodyEncoding = ""
+			errorResponse.Request = ""
+		}
+		list = append(list, errorResponse)
+	}
+	return list
+}
+
+// Handler returns an HTTP handler serving the recorded error responses as JSON, with their request and response
+// bodies only if includeBodies is set. When token isn't empty requests must carry it as a bearer token.
+func (r *RecentErrors) Handler(token string, includeBodies bool) http.Handler {
+	return requireToken(token, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(r.list(includeBodies))
+	}))
+}
+
+// requireToken returns handler rejecting requests which don't carry token as a bearer token, unless token is empty
+func requireToken(token string, handler http.Handler) http.Handler {
+	if token == "" {
+		return handler
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		given := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		handler.ServeHTTP(w, req)
+	})
+}
+
+// redactHeaders returns a copy of header with the values of headers likely holding secrets redacted
+func redactHeaders(header http.Header) http.Header {
+	if header == nil {
+		return nil
+	}
+	redacted := make(http.Header, len(header))
+	for key, vals := range header {
+		lower := strings.ToLower(key)
+		for _, word := range redactedHeaderWords {
+			if strings.Contains(lower, word) {
+				vals = []string{"REDACTED"}
+				break
+			}
+		}
+		redacted[key] = vals
+	}
+	return redacted
+}
+
+// redactURL returns raw with its user info and query parameter values redacted, which may hold credentials
+func redactURL(raw string) string {
+	parsed, err := url.Parse(raw)
+	if err != nil {
+		return raw
+	}
+	if parsed.User != nil {
+		parsed.User = url.User("REDACTED")
+	}
+	if parsed.RawQuery != "" {
+		query := parsed.Query()
+		for key := range query {
+			query[key] = []string{"REDACTED"}
+		}
+		parsed.RawQuery = query.Encode()
+	}
+	return parsed.String()
+}
+
+// DebugHandler returns the handler exposing the last error responses, authenticated with DebugToken and including
+// their bodies if DebugIncludeBodies is set, or a handler responding 404 Not Found if RecentErrors isn't configured
+func (m ConnectorMetadata) DebugHandler() http.Handler {
+	if m.RecentErrors == nil {
+		return http.NotFoundHandler()
+	}
+	return m.RecentErrors.Handler(m.DebugToken, m.DebugIncludeBodies)
+}
@@ -0,0 +1,141 @@
+package common
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrDuplicateMessage is returned instead of invoking the function for a message whose fingerprint was already
+// processed successfully within the dedupe TTL; the message should be acked
+var ErrDuplicateMessage = errors.New("message already processed")
+
+// DedupeStore records the fingerprints of successfully processed messages, so that redeliveries can be skipped
+type DedupeStore interface {
+	// Seen reports whether fingerprint was recorded and hasn't expired
+	Seen(fingerprint string) (bool, error)
+	// Record records fingerprint for ttl
+	Record(fingerprint string, ttl time.Duration) error
+}
+
+// FailureStore is implemented by DedupeStores also counting the consecutive failures of messages across deliveries,
+// enabling poison message detection
+type FailureStore interface {
+	// Failures returns the consecutive failures recorded for fingerprint that haven't expired
+	Failures(fingerprint string) (int, error)
+	// RecordFailure counts a failure of fingerprint, remembered for ttl, and returns the consecutive failures
+	RecordFailure(fingerprint string, ttl time.Duration) (int, error)
+	// ResetFailures forgets the failures of fingerprint
+	ResetFailures(fingerprint string) error
+}
+
+// MessageFingerprint returns the fingerprint identifying a message by its content
+func MessageFingerprint(message string) string {
+	sum := sha256.Sum256([]byte(message))
+	return hex.EncodeToString(sum[:])
+}
+
+// memorySweepInterval is how often a MemoryDedupeStore drops expired entries so that its maps don't grow forever
+const memorySweepInterval = time.Minute
+
+// MemoryDedupeStore is a DedupeStore local to the process, the default when no shared store is configured
+type MemoryDedupeStore struct {
+	mu       sync.Mutex
+	expires  map[string]time.Time
+	failures map[string]failureCount
+	swept    time.Time
+}
+
+type failureCount struct {
+	count   int
+	expires time.Time
+}
+
+// NewMemoryDedupeStore returns an empty MemoryDedupeStore
+func NewMemoryDedupeStore() *MemoryDedupeStore {
+	return &MemoryDedupeStore{
+		expires:  make(map[string]time.Time),
+		failures: make(map[string]failureCount),
+		swept:    now(),
+	}
+}
+
+// sweep drops the expired entries once memorySweepInterval elapsed since the last sweep, with s.mu held, keeping
+// recording amortized constant time
+func (s *MemoryDedupeStore) sweep(current time.Time) {
+	if current.Sub(s.swept) < memorySweepInterval {
+		return
+	}
+	s.swept = current
+	for key, expires := range s.expires {
+		if current.After(expires) {
+			delete(s.expires, key)
+		}
+	}
+	for key, failures := range s.failures {
+		if current.After(failures.expires) {
+			delete(s.failures, key)
+		}
+	}
+}
+
+// Seen implements DedupeStore
+func (s *MemoryDedupeStore) Seen(fingerprint string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	expires, ok := s.expires[fingerprint]
+	if ok && now().After(expires) {
+		delete(s.expires, fingerprint)
+		return false, nil
+	}
+	return ok, nil
+}
+
+// Record implements DedupeStore
+func (s *MemoryDedupeStore) Record(fingerprint string, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	current := now()
+	s.sweep(current)
+	s.expires[fingerprint] = current.Add(ttl)
+	return nil
+}
+
+// Failures implements FailureStore
+func (s *MemoryDedupeStore) Failures(fingerprint string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	failures, ok := s.failures[fingerprint]
+	if ok && now().After(failures.expires) {
+		delete(s.failures, fingerprint)
+		return 0, nil
+	}
+	return failures.count, nil
+}
+
+// RecordFailure implements FailureStore
+func (s *MemoryDedupeStore) RecordFailure(fingerprint string, ttl time.Duration) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	current := now()
+	s.sweep(current)
+	failures := s.failures[fingerprint]
+	if current.After(failures.expires) {
+		// Failures recorded before the TTL aren't consecutive anymore
+		failures.count = 0
+	}
+	failures.count++
+	failures.expires = current.Add(ttl)
+	s.failures[fingerprint] = failures
+	return failures.count, nil
+}
+
+// ResetFailures implements FailureStore
+func (s *MemoryDedupeStore) ResetFailures(fingerprint string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.failures, fingerprint)
+	return nil
+}
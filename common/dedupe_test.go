@@ -0,0 +1,162 @@
+package common
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestMemoryDedupeStore(t *testing.T) {
+	clock := useFakeClock(t)
+	store := NewMemoryDedupeStore()
+	if err := store.Record("fp", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		advance time.Duration
+		want    bool
+	}{
+		{name: "within ttl", advance: 59 * time.Second, want: true},
+		{name: "at ttl", advance: time.Second, want: true},
+		{name: "expired", advance: time.Nanosecond, want: false},
+	}
+	for _, tt := range tests {
+		clock.Advance(tt.advance)
+		if seen, err := store.Seen("fp"); err != nil || seen != tt.want {
+			t.Errorf("%v: Seen() = %v with error %v, want %v", tt.name, seen, err, tt.want)
+		}
+	}
+}
+
+func TestMemoryDedupeStoreSweep(t *testing.T) {
+	clock := useFakeClock(t)
+	store := NewMemoryDedupeStore()
+	store.Record("expiring", time.Second)
+	store.RecordFailure("failing", time.Second)
+	store.Record("kept", time.Hour)
+	clock.Advance(memorySweepInterval)
+	// Recording sweeps the expired entries left unread
+	store.Record("new", time.Hour)
+	if len(store.expires) != 2 || len(store.failures) != 0 {
+		t.Errorf("store holds %v fingerprints and %v failures after the sweep, want 2 and 0", len(store.expires), len(store.failures))
+	}
+}
+
+func TestMemoryDedupeStoreFailures(t *testing.T) {
+	clock := useFakeClock(t)
+	store := NewMemoryDedupeStore()
+	store.RecordFailure("fp", time.Minute)
+	if got, _ := store.RecordFailure("fp", time.Minute); got != 2 {
+		t.Errorf("RecordFailure() = %v, want 2", got)
+	}
+	clock.Advance(2 * time.Minute)
+	if got, _ := store.RecordFailure("fp", time.Minute); got != 1 {
+		t.Errorf("RecordFailure() after the ttl = %v, want failures counted anew", got)
+	}
+	store.ResetFailures("fp")
+	if got, _ := store.Failures("fp"); got != 0 {
+		t.Errorf("Failures() after reset = %v, want 0", got)
+	}
+}
+
+func TestDedupeOnlyRecordsSuccess(t *testing.T) {
+	srv, requests := statusServer(t, http.StatusInternalServerError, http.StatusOK)
+	data := testMetadata(t, srv.URL, WithDedupe(NewMemoryDedupeStore(), time.Minute))
+	wantErrs := []bool{true, false, true}
+	for i, wantErr := range wantErrs {
+		resp, err := HandleHTTPRequest("{}", http.Header{}, data, zap.NewNop())
+		if (err != nil) != wantErr {
+			t.Errorf("delivery %v error = %v, want error %v", i, err, wantErr)
+		}
+		if err == nil {
+			resp.Body.Close()
+		}
+	}
+	if *requests != 2 {
+		t.Errorf("function invoked %v times, want the failed delivery retried and the success deduplicated", *requests)
+	}
+}
+
+func TestPoisonThreshold(t *testing.T) {
+	tests := []struct {
+		name  string
+		store func(t *testing.T) DedupeStore
+	}{
+		{name: "memory store", store: func(*testing.T) DedupeStore { return NewMemoryDedupeStore() }},
+		{name: "redis store", store: func(t *testing.T) DedupeStore { return NewRedisDedupeStore(newFakeRedis(t, "").addr, "", 0) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, requests := statusServer(t, http.StatusInternalServerError)
+			var deadLetters bytes.Buffer
+			data := testMetadata(t, srv.URL, WithMaxRetries(1), WithDedupe(tt.store(t), time.Minute), WithPoisonThreshold(2), WithErrorWriter(&deadLetters))
+			// Each delivery fails after its retries, counting a single failure
+			for delivery, wantRequests := range []int32{2, 4, 4, 4} {
+				_, err := HandleHTTPRequest(`{"poison":true}`, http.Header{}, data, zap.NewNop())
+				errorResponse := errorResponseOf(t, err)
+				poisoned := errorResponse.ErrorKind == ErrorKindPoison
+				if poisoned != (delivery >= 2) {
+					t.Errorf("delivery %v reported %+v, want dead-lettered as poison from the third delivery", delivery, errorResponse)
+				}
+				if *requests != wantRequests {
+					t.Errorf("delivery %v: function invoked %v times, want %v", delivery, *requests, wantRequests)
+				}
+			}
+			if lines := strings.Count(deadLetters.String(), "\n"); lines != 4 {
+				t.Errorf("dead-lettered %v error responses, want 4", lines)
+			}
+			// Other messages are still invoked
+			HandleHTTPRequest(`{"poison":false}`, http.Header{}, data, zap.NewNop())
+			if *requests != 6 {
+				t.Errorf("function invoked %v times, want another message invoked", *requests)
+			}
+		})
+	}
+}
+
+func TestPoisonFailuresResetOnSuccess(t *testing.T) {
+	srv, requests := statusServer(t, http.StatusInternalServerError, http.StatusOK, http.StatusInternalServerError)
+	// Without remembering successes every delivery reaches the function
+	data := testMetadata(t, srv.URL, WithDedupe(NewMemoryDedupeStore(), time.Minute), WithPoisonThreshold(2))
+	data.DedupeStore = failuresOnly{data.DedupeStore.(*MemoryDedupeStore)}
+	for i := 0; i < 4; i++ {
+		if resp, err := HandleHTTPRequest("{}", http.Header{}, data, zap.NewNop()); err == nil {
+			resp.Body.Close()
+		}
+	}
+	if *requests != 4 {
+		t.Errorf("function invoked %v times, want the failures before the success forgotten", *requests)
+	}
+}
+
+// failuresOnly is a dedupe store counting failures but never reporting messages as seen
+type failuresOnly struct {
+	*MemoryDedupeStore
+}
+
+func (failuresOnly) Seen(string) (bool, error) {
+	return false, nil
+}
+
+func TestPoisonThresholdRequiresFailureStore(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    []Option
+		wantErr bool
+	}{
+		{name: "without store", opts: []Option{WithPoisonThreshold(3)}, wantErr: true},
+		{name: "negative", opts: []Option{WithDedupe(NewMemoryDedupeStore(), time.Minute), WithPoisonThreshold(-1)}, wantErr: true},
+		{name: "with store", opts: []Option{WithDedupe(NewMemoryDedupeStore(), time.Minute), WithPoisonThreshold(3)}},
+	}
+	for _, tt := range tests {
+		opts := append([]Option{WithTopic("topic"), WithEndpoint("http://function"), WithContentType("application/json")}, tt.opts...)
+		if _, err := NewConnectorMetadata(opts...); (err != nil) != tt.wantErr {
+			t.Errorf("%v: NewConnectorMetadata() error = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package common
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// hostResolver resolves host names, implemented by net.Resolver
+type hostResolver interface {
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// dnsCache remembers the addresses hosts resolve to for ttl, so that repeated requests don't resolve them again
+type dnsCache struct {
+	resolver hostResolver
+	ttl      time.Duration
+
+	mu      sync.Mutex
+	entries map[string]dnsEntry
+}
+
+type dnsEntry struct {
+	addrs   []string
+	expires time.Time
+}
+
+func newDNSCache(resolver hostResolver, ttl time.Duration) *dnsCache {
+	return &dnsCache{resolver: resolver, ttl: ttl, entries: make(map[string]dnsEntry)}
+}
+
+// lookup returns the addresses of host, resolving them if they aren't cached or have expired
+func (c *dnsCache) lookup(ctx context.Context, host string) ([]string, error) {
+	c.mu.Lock()
+	entry, ok := c.entries[host]
+	c.mu.Unlock()
+	if ok && now().Before(entry.expires) {
+		return entry.addrs, nil
+	}
+	addrs, err := c.resolver.LookupHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	c.entries[host] = dnsEntry{addrs: addrs, expires: now().Add(c.ttl)}
+	c.mu.Unlock()
+	return addrs, nil
+}
+
+// forget drops the cached addresses of host, so that the next dial resolves it again
+func (c *dnsCache) forget(host string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, host)
+}
+
+// dial returns dial connecting to the cached addresses of the host, trying each in turn.
+// The addresses are resolved again on the next dial if none could be connected to.
+func (c *dnsCache) dial(dial dialFunc) dialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil || net.ParseIP(host) != nil {
+			return dial(ctx, network, addr)
+		}
+		addrs, err := c.lookup(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		for _, ip := range addrs {
+			var conn net.Conn
+			if conn, err = dial(ctx, network, net.JoinHostPort(ip, port)); err == nil {
+				return conn, nil
+			}
+		}
+		c.forget(host)
+		return nil, err
+	}
+}
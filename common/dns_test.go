@@ -0,0 +1,97 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stubResolver resolves every host to addrs, counting lookups
+type stubResolver struct {
+	mu      sync.Mutex
+	addrs   []string
+	err     error
+	lookups int
+}
+
+func (r *stubResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lookups++
+	return r.addrs, r.err
+}
+
+// stubDialer records the addresses dialed, failing those listed in refused
+type stubDialer struct {
+	dialed  []string
+	refused map[string]bool
+}
+
+func (d *stubDialer) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	d.dialed = append(d.dialed, addr)
+	if d.refused[addr] {
+		return nil, errors.New("connection refused")
+	}
+	client, server := net.Pipe()
+	server.Close()
+	return client, nil
+}
+
+func TestDNSCache(t *testing.T) {
+	tests := []struct {
+		name        string
+		addr        string
+		advance     time.Duration
+		refused     map[string]bool
+		wantLookups int
+		wantDialed  []string
+		wantErr     bool
+	}{
+		{name: "first dial resolves", addr: "function:8080", wantLookups: 1, wantDialed: []string{"10.0.0.1:8080"}},
+		{name: "within ttl", addr: "function:8080", advance: 29 * time.Second, wantLookups: 1, wantDialed: []string{"10.0.0.1:8080"}},
+		{name: "expired", addr: "function:8080", advance: time.Second, wantLookups: 2, wantDialed: []string{"10.0.0.1:8080"}},
+		{name: "falls back to the next address", addr: "function:8080", refused: map[string]bool{"10.0.0.1:8080": true}, wantLookups: 2, wantDialed: []string{"10.0.0.1:8080", "10.0.0.2:8080"}},
+		{name: "every address refused", addr: "function:8080", refused: map[string]bool{"10.0.0.1:8080": true, "10.0.0.2:8080": true}, wantLookups: 2, wantDialed: []string{"10.0.0.1:8080", "10.0.0.2:8080"}, wantErr: true},
+		{name: "resolved again after failing", addr: "function:8080", wantLookups: 3, wantDialed: []string{"10.0.0.1:8080"}},
+		{name: "ip literal", addr: "127.0.0.1:8080", wantLookups: 3, wantDialed: []string{"127.0.0.1:8080"}},
+	}
+	clock := useFakeClock(t)
+	resolver := &stubResolver{addrs: []string{"10.0.0.1", "10.0.0.2"}}
+	cache := newDNSCache(resolver, 30*time.Second)
+	for _, tt := range tests {
+		clock.Advance(tt.advance)
+		dialer := &stubDialer{refused: tt.refused}
+		conn, err := cache.dial(dialer.dial)(context.Background(), "tcp", tt.addr)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%v: dial error = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+		if conn != nil {
+			conn.Close()
+		}
+		if resolver.lookups != tt.wantLookups {
+			t.Errorf("%v: %v lookups, want %v", tt.name, resolver.lookups, tt.wantLookups)
+		}
+		if !reflect.DeepEqual(dialer.dialed, tt.wantDialed) {
+			t.Errorf("%v: dialed %v, want %v", tt.name, dialer.dialed, tt.wantDialed)
+		}
+	}
+}
+
+func TestDNSCacheLookupError(t *testing.T) {
+	useFakeClock(t)
+	resolver := &stubResolver{err: errors.New("no such host")}
+	cache := newDNSCache(resolver, time.Minute)
+	dialer := &stubDialer{}
+	for i := 0; i < 2; i++ {
+		if _, err := cache.dial(dialer.dial)(context.Background(), "tcp", "function:80"); err == nil {
+			t.Error("dial succeeded, want the lookup error")
+		}
+	}
+	if resolver.lookups != 2 || len(dialer.dialed) != 0 {
+		t.Errorf("%v lookups and dialed %v, want failures not cached and nothing dialed", resolver.lookups, dialer.dialed)
+	}
+}
@@ -0,0 +1,81 @@
+package common
+
+import (
+	"fmt"
+	"sync"
+)
+
+// OverflowPolicy decides which error response is dropped when an ErrorBuffer is full
+type OverflowPolicy string
+
+const (
+	// DropOldest evicts the oldest buffered error response to make room for the new one
+	DropOldest OverflowPolicy = "drop-oldest"
+	// DropNewest discards the new error response, keeping the buffered ones
+	DropNewest OverflowPolicy = "drop-newest"
+)
+
+// ErrorBuffer holds a bounded number of error responses waiting to be forwarded, so that sustained outages
+// can't make the connector run out of memory
+type ErrorBuffer struct {
+	mu      sync.Mutex
+	size    int
+	policy  OverflowPolicy
+	items   []ErrorResponse
+	dropped uint64
+}
+
+// NewErrorBuffer returns an ErrorBuffer holding at most size error responses
+func NewErrorBuffer(size int, policy OverflowPolicy) (*ErrorBuffer, error) {
+	if size <= 0 {
+		return nil, fmt.Errorf("error buffer size must be positive, got %v", size)
+	}
+	if policy != DropOldest && policy != DropNewest {
+		return nil, fmt.Errorf("invalid error buffer overflow policy %q: %v or %v expected", policy, DropOldest, DropNewest)
+	}
+	return &ErrorBuffer{
+		size:   size,
+		policy: policy,
+		items:  make([]ErrorResponse, 0, size),
+	}, nil
+}
+
+// Add buffers errorResponse, applying the overflow policy when full. It reports whether an error response was dropped.
+func (b *ErrorBuffer) Add(errorResponse ErrorResponse) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.items) < b.size {
+		b.items = append(b.items, errorResponse)
+		return false
+	}
+	b.dropped++
+	errorBufferDroppedTotal.WithLabelValues(string(b.policy)).Inc()
+	if b.policy == DropOldest {
+		copy(b.items, b.items[1:])
+		b.items[len(b.items)-1] = errorResponse
+	}
+	return true
+}
+
+// Drain removes and returns the buffered error responses, oldest first
+func (b *ErrorBuffer) Drain() []ErrorResponse {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	items := b.items
+	b.items = make([]ErrorResponse, 0, b.size)
+	return items
+}
+
+// Len returns the number of buffered error responses
+func (b *ErrorBuffer) Len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.items)
+}
+
+// Dropped returns the number of error responses dropped so far
+func (b *ErrorBuffer) Dropped() uint64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.dropped
+}
@@ -0,0 +1,80 @@
+package common
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.uber.org/zap"
+)
+
+func TestErrorBufferOverflow(t *testing.T) {
+	tests := []struct {
+		policy      OverflowPolicy
+		added       []int
+		want        []int
+		wantDropped uint64
+	}{
+		{policy: DropOldest, added: []int{1, 2}, want: []int{1, 2}, wantDropped: 0},
+		{policy: DropOldest, added: []int{1, 2, 3, 4, 5}, want: []int{3, 4, 5}, wantDropped: 2},
+		{policy: DropNewest, added: []int{1, 2, 3, 4, 5}, want: []int{1, 2, 3}, wantDropped: 2},
+	}
+	for _, tt := range tests {
+		buffer, err := NewErrorBuffer(3, tt.policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		metric := errorBufferDroppedTotal.WithLabelValues(string(tt.policy))
+		before := testutil.ToFloat64(metric)
+		for _, status := range tt.added {
+			buffer.Add(ErrorResponse{Status: status})
+		}
+		var got []int
+		for _, errorResponse := range buffer.Drain() {
+			got = append(got, errorResponse.Status)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%v: drained %v, want %v", tt.policy, got, tt.want)
+		}
+		if buffer.Dropped() != tt.wantDropped {
+			t.Errorf("%v: dropped %v, want %v", tt.policy, buffer.Dropped(), tt.wantDropped)
+		}
+		if counted := testutil.ToFloat64(metric) - before; counted != float64(tt.wantDropped) {
+			t.Errorf("%v: counted %v drops, want %v", tt.policy, counted, tt.wantDropped)
+		}
+		if buffer.Len() != 0 {
+			t.Errorf("%v: %v error responses left after draining", tt.policy, buffer.Len())
+		}
+	}
+}
+
+func TestNewErrorBuffer(t *testing.T) {
+	tests := []struct {
+		size    int
+		policy  OverflowPolicy
+		wantErr bool
+	}{
+		{size: 1, policy: DropOldest},
+		{size: 1, policy: DropNewest},
+		{size: 0, policy: DropOldest, wantErr: true},
+		{size: 1, policy: "drop-random", wantErr: true},
+	}
+	for _, tt := range tests {
+		if _, err := NewErrorBuffer(tt.size, tt.policy); (err != nil) != tt.wantErr {
+			t.Errorf("NewErrorBuffer(%v, %q) error = %v, want error %v", tt.size, tt.policy, err, tt.wantErr)
+		}
+	}
+}
+
+func TestErrorBufferCollectsFailures(t *testing.T) {
+	srv, _ := statusServer(t, http.StatusBadRequest)
+	buffer, _ := NewErrorBuffer(2, DropNewest)
+	data := testMetadata(t, srv.URL, WithErrorBuffer(buffer))
+	for i := 0; i < 3; i++ {
+		HandleHTTPRequest("{}", http.Header{}, data, zap.NewNop())
+	}
+	if buffer.Len() != 2 || buffer.Dropped() != 1 {
+		t.Errorf("buffered %v and dropped %v error responses, want 2 and 1", buffer.Len(), buffer.Dropped())
+	}
+}
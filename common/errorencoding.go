@@ -0,0 +1,84 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+)
+
+// Encodings of the ErrorResponse published by ForwardError
+const (
+	ErrorEncodingJSON = "json"
+	ErrorEncodingForm = "form"
+)
+
+// validateErrorEncoding checks encoding is a known ErrorEncoding, empty meaning JSON
+func validateErrorEncoding(encoding string) error {
+	switch encoding {
+	case "", ErrorEncodingJSON, ErrorEncodingForm:
+		return nil
+	}
+	return fmt.Errorf("unknown error encoding %q, expected %v or %v", encoding, ErrorEncodingJSON, ErrorEncodingForm)
+}
+
+// encodeErrorResponse encodes errorResponse using encoding, returning it along with its content type
+func encodeErrorResponse(errorResponse ErrorResponse, encoding string) ([]byte, string, error) {
+	if encoding == ErrorEncodingForm {
+		return []byte(errorResponse.FormValues().Encode()), "application/x-www-form-urlencoded", nil
+	}
+	value, err := json.Marshal(errorResponse)
+	return value, "application/json", err
+}
+
+// FormValues returns the fields of the ErrorResponse as form values named after their JSON fields,
+// nested fields being named like headers[Content-Type] and source_coordinates[topic]
+func (e ErrorResponse) FormValues() url.Values {
+	values := url.Values{
+		"status":        {strconv.Itoa(e.Status)},
+		"message":       {e.Message},
+		"http_endpoint": {e.HttpEndpoint},
+		"source":        {e.Source},
+		"body":          {e.Body},
+		"request":       {e.Request},
+	}
+	for key, vals := range e.Headers {
+		values["headers["+key+"]"] = vals
+	}
+	if e.Coordinates != nil {
+		if e.Coordinates.Topic != "" {
+			values.Set("source_coordinates[topic]", e.Coordinates.Topic)
+		}
+		if e.Coordinates.Partition != "" {
+			values.Set("source_coordinates[partition]", e.Coordinates.Partition)
+		}
+		if e.Coordinates.Offset != "" {
+			values.Set("source_coordinates[offset]", e.Coordinates.Offset)
+		}
+	}
+	if e.ErrorKind != "" {
+		values.Set("error_kind", string(e.ErrorKind))
+	}
+	if e.Code != "" {
+		values.Set("code", e.Code)
+	}
+	if e.Throttled {
+		values.Set("throttled", "true")
+	}
+	if e.BodyEncoding != "" {
+		values.Set("body_encoding", e.BodyEncoding)
+	}
+	if e.BodyTruncated {
+		values.Set("body_truncated", "true")
+	}
+	if e.LatencyMs != 0 {
+		values.Set("latency_ms", strconv.FormatInt(e.LatencyMs, 10))
+	}
+	if e.Instance != "" {
+		values.Set("instance", e.Instance)
+	}
+	if e.Version != "" {
+		values.Set("version", e.Version)
+	}
+	return values
+}
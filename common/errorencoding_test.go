@@ -0,0 +1,179 @@
+package common
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+// fullErrorResponse has every field set
+var fullErrorResponse = ErrorResponse{
+	Status:        502,
+	Message:       "request returned failure",
+	HttpEndpoint:  "http://function",
+	Source:        "KEDAConnector",
+	Body:          "a=b&c",
+	Request:       `{"id":1}`,
+	Headers:       http.Header{"Content-Type": {"text/plain"}, "X-Multi": {"1", "2"}},
+	Coordinates:   &SourceCoordinates{Topic: "orders", Partition: "3", Offset: "42"},
+	ErrorKind:     ErrorKindGateway,
+	Code:          "Throttling",
+	Throttled:     true,
+	Version:       "v1.2.3",
+	BodyEncoding:  BodyEncodingBase64,
+	LatencyMs:     1500,
+	BodyTruncated: true,
+	Instance:      "pod-0",
+}
+
+func TestErrorResponseFormValues(t *testing.T) {
+	tests := []struct {
+		name          string
+		errorResponse ErrorResponse
+		want          url.Values
+	}{
+		{
+			name:          "every field",
+			errorResponse: fullErrorResponse,
+			want: url.Values{
+				"status":                        {"502"},
+				"message":                       {"request returned failure"},
+				"http_endpoint":                 {"http://function"},
+				"source":                        {"KEDAConnector"},
+				"body":                          {"a=b&c"},
+				"request":                       {`{"id":1}`},
+				"headers[Content-Type]":         {"text/plain"},
+				"headers[X-Multi]":              {"1", "2"},
+				"source_coordinates[topic]":     {"orders"},
+				"source_coordinates[partition]": {"3"},
+				"source_coordinates[offset]":    {"42"},
+				"error_kind":                    {"gateway"},
+				"code":                          {"Throttling"},
+				"throttled":                     {"true"},
+				"version":                       {"v1.2.3"},
+				"body_encoding":                 {"base64"},
+				"latency_ms":                    {"1500"},
+				"body_truncated":                {"true"},
+				"instance":                      {"pod-0"},
+			},
+		},
+		{
+			name:          "optional fields omitted",
+			errorResponse: ErrorResponse{Status: 500, Message: "failed"},
+			want: url.Values{
+				"status":        {"500"},
+				"message":       {"failed"},
+				"http_endpoint": {""},
+				"source":        {""},
+				"body":          {""},
+				"request":       {""},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.errorResponse.FormValues(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("FormValues() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFormValuesCoverJSONFields(t *testing.T) {
+	raw, err := json.Marshal(fullErrorResponse)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		t.Fatal(err)
+	}
+	values := fullErrorResponse.FormValues()
+	for field := range fields {
+		if _, ok := values[field]; ok {
+			continue
+		}
+		nested := false
+		for key := range values {
+			if strings.HasPrefix(key, field+"[") {
+				nested = true
+			}
+		}
+		if !nested {
+			t.Errorf("JSON field %v missing from the form values", field)
+		}
+	}
+}
+
+func TestForwardErrorEncoding(t *testing.T) {
+	tests := []struct {
+		encoding        string
+		wantContentType string
+		decode          func(string) (ErrorResponse, error)
+	}{
+		{encoding: "", wantContentType: "application/json", decode: decodeJSONErrorResponse},
+		{encoding: ErrorEncodingJSON, wantContentType: "application/json", decode: decodeJSONErrorResponse},
+		{encoding: ErrorEncodingForm, wantContentType: "application/x-www-form-urlencoded", decode: decodeFormErrorResponse},
+	}
+	for _, tt := range tests {
+		t.Run(tt.encoding, func(t *testing.T) {
+			publisher := &recordingPublisher{}
+			data := testMetadata(t, "http://function", WithErrorTopic("errors"), WithErrorEncoding(tt.encoding))
+			f := NewForwarder(publisher.publish, data, zap.NewNop())
+			errorResponse := ErrorResponse{Status: 500, Message: "failed", Request: "a&b=c"}
+			if err := f.ForwardError("k", errorResponse); err != nil {
+				t.Fatalf("ForwardError() error = %v", err)
+			}
+			f.Close()
+			published := publisher.published()
+			if len(published) != 1 {
+				t.Fatalf("published %v messages, want 1", len(published))
+			}
+			if got := published[0].headers.Get("Content-Type"); got != tt.wantContentType {
+				t.Errorf("Content-Type = %v, want %v", got, tt.wantContentType)
+			}
+			if got, err := tt.decode(published[0].value); err != nil || !reflect.DeepEqual(got, errorResponse) {
+				t.Errorf("published %+v with error %v, want %+v", got, err, errorResponse)
+			}
+		})
+	}
+}
+
+func TestInvalidErrorEncoding(t *testing.T) {
+	if _, err := NewConnectorMetadata(WithTopic("topic"), WithEndpoint("http://function"), WithContentType("application/json"), WithErrorEncoding("xml")); err == nil {
+		t.Error("xml error encoding accepted")
+	}
+}
+
+func decodeJSONErrorResponse(value string) (ErrorResponse, error) {
+	var errorResponse ErrorResponse
+	err := json.Unmarshal([]byte(value), &errorResponse)
+	return errorResponse, err
+}
+
+// decodeFormErrorResponse decodes the fields set by TestForwardErrorEncoding
+func decodeFormErrorResponse(value string) (ErrorResponse, error) {
+	values, err := url.ParseQuery(value)
+	if err != nil {
+		return ErrorResponse{}, err
+	}
+	status, err := strconv.Atoi(values.Get("status"))
+	if err != nil {
+		return ErrorResponse{}, err
+	}
+	errorResponse := ErrorResponse{
+		Status:       status,
+		Message:      values.Get("message"),
+		HttpEndpoint: values.Get("http_endpoint"),
+		Source:       values.Get("source"),
+		Body:         values.Get("body"),
+		Request:      values.Get("request"),
+	}
+	return errorResponse, nil
+}
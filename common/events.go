@@ -0,0 +1,207 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// EventTypeWarning is the type of the Kubernetes events emitted by FailureEvents
+const EventTypeWarning = "Warning"
+
+// Reasons of the events emitted by FailureEvents
+const (
+	// EventReasonCircuitOpen is emitted when the circuit breaker opens
+	EventReasonCircuitOpen = "CircuitBreakerOpen"
+	// EventReasonRetriesExhausted is emitted when consecutive invocations failed after exhausting their retries
+	EventReasonRetriesExhausted = "RetriesExhausted"
+)
+
+// DefaultRetriesExhaustedThreshold is the number of consecutive invocations exhausting their retries after which
+// an event is emitted unless configured otherwise
+const DefaultRetriesExhaustedThreshold = 10
+
+// inClusterEventTimeout bounds each request of the in-cluster EventRecorder
+const inClusterEventTimeout = 5 * time.Second
+
+// inClusterEventAttempts is how many times the in-cluster EventRecorder sends an event failing transiently, backing
+// off exponentially from inClusterEventBackoff
+const (
+	inClusterEventAttempts = 3
+	inClusterEventBackoff  = 200 * time.Millisecond
+)
+
+// serviceAccountDir holds the credentials of the pod's service account
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// EventRecorder emits Kubernetes events about the connector's pod, e.g. wrapping a client-go record.EventRecorder
+type EventRecorder interface {
+	Event(eventType, reason, message string) error
+}
+
+// FailureEvents emits Warning events through an EventRecorder when the circuit breaker opens and when invocations
+// chronically exhaust their retries, so that `kubectl describe pod` shows sustained failures
+type FailureEvents struct {
+	recorder  EventRecorder
+	threshold int32
+
+	exhausted int32
+}
+
+// NewFailureEvents returns FailureEvents emitting through recorder, reporting exhausted retries once threshold
+// consecutive invocations exhausted them, DefaultRetriesExhaustedThreshold if not positive
+func NewFailureEvents(recorder EventRecorder, threshold int) *FailureEvents {
+	if threshold < 1 {
+		threshold = DefaultRetriesExhaustedThreshold
+	}
+	return &FailureEvents{recorder: recorder, threshold: int32(threshold)}
+}
+
+// emit records an event without blocking the invocation, logging failures
+func (e *FailureEvents) emit(reason, message string, data ConnectorMetadata, logger *zap.Logger) {
+	go func() {
+		if err := e.recorder.Event(EventTypeWarning, reason, message); err != nil {
+			logger.Warn("failed to emit kubernetes event",
+				zap.Error(err),
+				zap.String("reason", reason),
+				zap.String("source", data.SourceName))
+		}
+	}()
+}
+
+// breakerOpened emits an event for the circuit breaker opening on endpoint
+func (e *FailureEvents) breakerOpened(endpoint string, data ConnectorMetadata, logger *zap.Logger) {
+	e.emit(EventReasonCircuitOpen,
+		fmt.Sprintf("circuit breaker opened for %v of %v after repeated failures", endpoint, data.SourceName),
+		data, logger)
+}
+
+// observe counts the consecutive invocations exhausting their retries, emitting an event when the threshold is reached
+func (e *FailureEvents) observe(report InvocationReport, data ConnectorMetadata, logger *zap.Logger) {
+	switch {
+	case report.Outcome == OutcomeSuccess:
+		atomic.StoreInt32(&e.exhausted, 0)
+	case report.Outcome == OutcomeFailure && report.Attempts > data.maxRetries(logger):
+		if atomic.AddInt32(&e.exhausted, 1) == e.threshold {
+			e.emit(EventReasonRetriesExhausted,
+				fmt.Sprintf("%v consecutive invocations of %v failed after %v attempts, last with status %v",
+					e.threshold, report.Endpoint, report.Attempts, report.StatusCode),
+				data, logger)
+		}
+	}
+}
+
+// inClusterEventRecorder creates events on the pod through the Kubernetes API with the pod's service account
+type inClusterEventRecorder struct {
+	client    *http.Client
+	server    string
+	tokenFile string
+	namespace string
+	pod       string
+	backoff   ConnectorMetadata
+}
+
+// NewInClusterEventRecorder returns an EventRecorder creating events on pod in namespace, usually provided by the
+// downward API, through the Kubernetes API using the service account of the pod, which must be allowed to create events.
+// Events are sent through the pooled transport of the package trusting the cluster CA, retrying transient failures.
+func NewInClusterEventRecorder(namespace, pod string) (EventRecorder, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("not running in a kubernetes cluster, KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT are not set")
+	}
+	return newInClusterEventRecorder("https://"+net.JoinHostPort(host, port), serviceAccountDir+"/ca.crt", serviceAccountDir+"/token", namespace, pod)
+}
+
+func newInClusterEventRecorder(server, caFile, tokenFile, namespace, pod string) (*inClusterEventRecorder, error) {
+	if namespace == "" || pod == "" {
+		return nil, fmt.Errorf("namespace and pod name are required to emit kubernetes events")
+	}
+	// Fail early without the service account token, it's read again for every event as it's rotated
+	if _, err := ioutil.ReadFile(tokenFile); err != nil {
+		return nil, err
+	}
+	client, err := ConnectorMetadata{TLS: TLSConfig{CAFile: caFile}}.clientFor(server)
+	if err != nil {
+		return nil, err
+	}
+	return &inClusterEventRecorder{
+		client:    client,
+		server:    server,
+		tokenFile: tokenFile,
+		namespace: namespace,
+		pod:       pod,
+		backoff:   ConnectorMetadata{RetryBackoff: inClusterEventBackoff},
+	}, nil
+}
+
+func (r *inClusterEventRecorder) Event(eventType, reason, message string) error {
+	timestamp := now().UTC().Format(time.RFC3339)
+	event := map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "Event",
+		"metadata": map[string]interface{}{
+			"generateName": r.pod + ".",
+			"namespace":    r.namespace,
+		},
+		"involvedObject": map[string]interface{}{
+			"apiVersion": "v1",
+			"kind":       "Pod",
+			"namespace":  r.namespace,
+			"name":       r.pod,
+		},
+		"type":           eventType,
+		"reason":         reason,
+		"message":        message,
+		"source":         map[string]interface{}{"component": "keda-connector"},
+		"firstTimestamp": timestamp,
+		"lastTimestamp":  timestamp,
+		"count":          1,
+	}
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	for attempt := 1; ; attempt++ {
+		retryable, err := r.send(body)
+		if err == nil || !retryable || attempt == inClusterEventAttempts {
+			return err
+		}
+		sleepContext(context.Background(), r.backoff.retryDelay(attempt))
+	}
+}
+
+// send posts the event body, telling whether a failure is transient and worth retrying
+func (r *inClusterEventRecorder) send(body []byte) (retryable bool, err error) {
+	token, err := ioutil.ReadFile(r.tokenFile)
+	if err != nil {
+		return false, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), inClusterEventTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("%v/api/v1/namespaces/%v/events", r.server, r.namespace), bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Authorization", "Bearer "+string(bytes.TrimSpace(token)))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		respBody, _ := ioutil.ReadAll(resp.Body)
+		retryable = resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+		return retryable, fmt.Errorf("kubernetes API responded %v: %s", resp.Status, respBody)
+	}
+	return false, nil
+}
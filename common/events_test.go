@@ -0,0 +1,256 @@
+package common
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+type recordedEvent struct {
+	eventType, reason, message string
+}
+
+// fakeRecorder is an EventRecorder sending the recorded events to a channel
+type fakeRecorder struct {
+	events chan recordedEvent
+}
+
+func newFakeRecorder() *fakeRecorder {
+	return &fakeRecorder{events: make(chan recordedEvent, 16)}
+}
+
+func (r *fakeRecorder) Event(eventType, reason, message string) error {
+	r.events <- recordedEvent{eventType, reason, message}
+	return nil
+}
+
+// take returns the reasons of the events recorded within a short wait, as events are emitted asynchronously
+func (r *fakeRecorder) take() []string {
+	var reasons []string
+	for {
+		select {
+		case event := <-r.events:
+			reasons = append(reasons, event.reason)
+		case <-time.After(50 * time.Millisecond):
+			return reasons
+		}
+	}
+}
+
+func TestFailureEvents(t *testing.T) {
+	tests := []struct {
+		name      string
+		statuses  []int
+		breaker   bool
+		retries   int
+		threshold int
+		want      []string
+	}{
+		{name: "breaker opens", statuses: []int{500}, breaker: true, threshold: 10, want: []string{EventReasonCircuitOpen}},
+		{name: "retries exhausted", statuses: []int{500}, retries: 1, threshold: 3, want: []string{EventReasonRetriesExhausted}},
+		{name: "threshold not reached", statuses: []int{500}, retries: 1, threshold: 5},
+		{name: "not exhausted when retries succeed", statuses: []int{500, 200, 500, 200, 500, 200, 500, 200}, retries: 1, threshold: 3},
+		{name: "client errors don't open the breaker", statuses: []int{400}, breaker: true, threshold: 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, _ := statusServer(t, tt.statuses...)
+			recorder := newFakeRecorder()
+			opts := []Option{WithMaxRetries(tt.retries), WithFailureEvents(NewFailureEvents(recorder, tt.threshold))}
+			if tt.breaker {
+				opts = append(opts, WithCircuitBreaker(NewCircuitBreaker(2, time.Minute)))
+			}
+			data := testMetadata(t, srv.URL, opts...)
+			for i := 0; i < 4; i++ {
+				if resp, err := HandleHTTPRequest("{}", http.Header{}, data, zap.NewNop()); err == nil {
+					resp.Body.Close()
+				}
+			}
+			if got := recorder.take(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("emitted %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBreakerOpenedOnce(t *testing.T) {
+	const inFlight = 5
+	arrived := make(chan struct{}, inFlight)
+	release := make(chan struct{})
+	srv := newServer(t, func(w http.ResponseWriter, r *http.Request) {
+		arrived <- struct{}{}
+		<-release
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	recorder := newFakeRecorder()
+	data := testMetadata(t, srv.URL, WithFailureEvents(NewFailureEvents(recorder, 10)),
+		WithCircuitBreaker(NewCircuitBreaker(2, time.Minute)))
+	var wg sync.WaitGroup
+	for i := 0; i < inFlight; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if resp, err := HandleHTTPRequest("{}", http.Header{}, data, zap.NewNop()); err == nil {
+				resp.Body.Close()
+			}
+		}()
+	}
+	for i := 0; i < inFlight; i++ {
+		<-arrived
+	}
+	close(release)
+	wg.Wait()
+	if got := recorder.take(); !reflect.DeepEqual(got, []string{EventReasonCircuitOpen}) {
+		t.Errorf("emitted %v for %v failures, want a single %v", got, inFlight, EventReasonCircuitOpen)
+	}
+}
+
+func TestRetriesExhaustedResetBySuccess(t *testing.T) {
+	events := NewFailureEvents(newFakeRecorder(), 2)
+	data := ConnectorMetadata{MaxRetries: 1}
+	failed := InvocationReport{Outcome: OutcomeFailure, Attempts: 2}
+	events.observe(failed, data, zap.NewNop())
+	events.observe(InvocationReport{Outcome: OutcomeSuccess, Attempts: 1}, data, zap.NewNop())
+	events.observe(failed, data, zap.NewNop())
+	if got := events.recorder.(*fakeRecorder).take(); len(got) != 0 {
+		t.Errorf("emitted %v although a success broke the streak", got)
+	}
+	events.observe(failed, data, zap.NewNop())
+	events.observe(failed, data, zap.NewNop())
+	if got := events.recorder.(*fakeRecorder).take(); !reflect.DeepEqual(got, []string{EventReasonRetriesExhausted}) {
+		t.Errorf("emitted %v, want a single event once the threshold is reached", got)
+	}
+}
+
+// eventsAPIServer starts a TLS server standing for the Kubernetes API, responding to event creations with statuses
+// in turn, returning its URL, the file of its CA and the bearer tokens and events received
+func eventsAPIServer(t *testing.T, statuses ...int) (string, string, func() ([]string, []map[string]interface{})) {
+	t.Helper()
+	var mu sync.Mutex
+	var tokens []string
+	var events []map[string]interface{}
+	srv, ca := newCertTLSServer(t, func(w http.ResponseWriter, r *http.Request) {
+		raw, _ := ioutil.ReadAll(r.Body)
+		if r.Method != http.MethodPost || r.URL.Path != "/api/v1/namespaces/connectors/events" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		var event map[string]interface{}
+		json.Unmarshal(raw, &event)
+		mu.Lock()
+		tokens = append(tokens, r.Header.Get("Authorization"))
+		events = append(events, event)
+		status := statuses[len(statuses)-1]
+		if len(events) <= len(statuses) {
+			status = statuses[len(events)-1]
+		}
+		mu.Unlock()
+		w.WriteHeader(status)
+	})
+	return srv.URL, ca, func() ([]string, []map[string]interface{}) {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), tokens...), append([]map[string]interface{}(nil), events...)
+	}
+}
+
+func TestInClusterEventRecorder(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses []int
+		wantSent int
+		wantErr  bool
+	}{
+		{name: "created", statuses: []int{http.StatusCreated}, wantSent: 1},
+		{name: "transient failure retried", statuses: []int{http.StatusServiceUnavailable, http.StatusTooManyRequests, http.StatusCreated}, wantSent: 3},
+		{name: "retries exhausted", statuses: []int{http.StatusInternalServerError}, wantSent: inClusterEventAttempts, wantErr: true},
+		{name: "forbidden not retried", statuses: []int{http.StatusForbidden}, wantSent: 1, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, ca, received := eventsAPIServer(t, tt.statuses...)
+			tokenFile := filepath.Join(t.TempDir(), "token")
+			if err := ioutil.WriteFile(tokenFile, []byte("s3cret\n"), 0600); err != nil {
+				t.Fatal(err)
+			}
+			recorder, err := newInClusterEventRecorder(server, ca, tokenFile, "connectors", "connector-0")
+			if err != nil {
+				t.Fatalf("newInClusterEventRecorder() error = %v", err)
+			}
+			recorder.backoff.RetryBackoff = time.Millisecond
+			err = recorder.Event(EventTypeWarning, EventReasonCircuitOpen, "breaker opened")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Event() error = %v, want error %v", err, tt.wantErr)
+			}
+			tokens, events := received()
+			if len(events) != tt.wantSent {
+				t.Fatalf("sent %v requests, want %v", len(events), tt.wantSent)
+			}
+			if tokens[0] != "Bearer s3cret" {
+				t.Errorf("authorization = %q, want the trimmed service account token", tokens[0])
+			}
+			event := events[0]
+			involved, _ := event["involvedObject"].(map[string]interface{})
+			if event["type"] != EventTypeWarning || event["reason"] != EventReasonCircuitOpen || event["message"] != "breaker opened" ||
+				involved["kind"] != "Pod" || involved["name"] != "connector-0" || involved["namespace"] != "connectors" {
+				t.Errorf("sent event %v", event)
+			}
+		})
+	}
+}
+
+func TestInClusterEventRecorderRotatedToken(t *testing.T) {
+	server, ca, received := eventsAPIServer(t, http.StatusCreated)
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := ioutil.WriteFile(tokenFile, []byte("first"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	recorder, err := newInClusterEventRecorder(server, ca, tokenFile, "connectors", "connector-0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder.Event(EventTypeWarning, EventReasonRetriesExhausted, "one")
+	if err := ioutil.WriteFile(tokenFile, []byte("second"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	recorder.Event(EventTypeWarning, EventReasonRetriesExhausted, "two")
+	if tokens, _ := received(); !reflect.DeepEqual(tokens, []string{"Bearer first", "Bearer second"}) {
+		t.Errorf("sent tokens %v, want the token read again for every event", tokens)
+	}
+}
+
+func TestNewInClusterEventRecorderInvalid(t *testing.T) {
+	dir := t.TempDir()
+	tokenFile := filepath.Join(dir, "token")
+	if err := ioutil.WriteFile(tokenFile, []byte("token"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name      string
+		namespace string
+		pod       string
+		tokenFile string
+	}{
+		{name: "missing namespace", pod: "connector-0", tokenFile: tokenFile},
+		{name: "missing pod", namespace: "connectors", tokenFile: tokenFile},
+		{name: "missing token", namespace: "connectors", pod: "connector-0", tokenFile: filepath.Join(dir, "missing")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := newInClusterEventRecorder("https://127.0.0.1:6443", "", tt.tokenFile, tt.namespace, tt.pod); err == nil {
+				t.Error("newInClusterEventRecorder() succeeded")
+			}
+		})
+	}
+	setEnv(t, map[string]string{"KUBERNETES_SERVICE_HOST": "", "KUBERNETES_SERVICE_PORT": ""})
+	if _, err := NewInClusterEventRecorder("connectors", "connector-0"); err == nil {
+		t.Error("NewInClusterEventRecorder() succeeded outside a cluster")
+	}
+}
@@ -0,0 +1,100 @@
+package common
+
+import (
+	"os"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+	"go.uber.org/zap"
+)
+
+// ErrorForwarder routes the ErrorResponses of failed invocations, as Forwarder.ForwardError does to the error topic
+type ErrorForwarder interface {
+	ForwardError(key string, errorResponse ErrorResponse) error
+}
+
+// SQSFallbackQueue is an ErrorForwarder sending the original message of invocations which failed because the
+// endpoint was down after all retries to an SQS queue for later reprocessing, instead of dead-lettering it.
+// Other failures, which reprocessing won't fix, are handed to the next ErrorForwarder, as are failures without the
+// original message, such as streams consumed by the invocation, since SQS rejects empty messages.
+type SQSFallbackQueue struct {
+	client   sqsiface.SQSAPI
+	queueURL string
+	next     ErrorForwarder
+	logger   *zap.Logger
+}
+
+// NewSQSFallbackQueue returns an SQSFallbackQueue sending to the queue at queueURL with cfg, e.g. from GetAwsConfig,
+// and handing other failures to next, dropping them if nil
+func NewSQSFallbackQueue(cfg *aws.Config, queueURL string, next ErrorForwarder, logger *zap.Logger) (*SQSFallbackQueue, error) {
+	sess, err := session.NewSession(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &SQSFallbackQueue{
+		client:   sqs.New(sess),
+		queueURL: queueURL,
+		next:     next,
+		logger:   logger,
+	}, nil
+}
+
+// NewSQSFallbackQueueFromEnv returns an SQSFallbackQueue sending to the queue named by the FALLBACK_SQS_QUEUE_URL
+// environment variable with the config of GetAwsConfig, or nil if it isn't set
+func NewSQSFallbackQueueFromEnv(next ErrorForwarder, logger *zap.Logger) (*SQSFallbackQueue, error) {
+	queueURL := os.Getenv("FALLBACK_SQS_QUEUE_URL")
+	if queueURL == "" {
+		return nil, nil
+	}
+	cfg, err := GetAwsConfig()
+	if err != nil {
+		return nil, err
+	}
+	return NewSQSFallbackQueue(cfg, queueURL, next, logger)
+}
+
+// ForwardError implements ErrorForwarder, sending the original message of retryable failures to the queue with
+// the failure described in message attributes
+func (q *SQSFallbackQueue) ForwardError(key string, errorResponse ErrorResponse) error {
+	if !errorResponse.IsRetryable() {
+		return q.forwardNext(key, errorResponse)
+	}
+	if errorResponse.Request == "" {
+		q.logger.Warn("skipping fallback queue for failure without original message",
+			zap.String("key", key),
+			zap.String("http_endpoint", errorResponse.HttpEndpoint),
+			zap.String("source", errorResponse.Source))
+		return q.forwardNext(key, errorResponse)
+	}
+	attributes := map[string]*sqs.MessageAttributeValue{
+		"status": {DataType: aws.String("Number"), StringValue: aws.String(strconv.Itoa(errorResponse.Status))},
+	}
+	for name, value := range map[string]string{
+		"message":       errorResponse.Message,
+		"http_endpoint": errorResponse.HttpEndpoint,
+		"source":        errorResponse.Source,
+		"error_kind":    string(errorResponse.ErrorKind),
+		"key":           key,
+	} {
+		if value != "" {
+			attributes[name] = &sqs.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String(value)}
+		}
+	}
+	_, err := q.client.SendMessage(&sqs.SendMessageInput{
+		QueueUrl:          aws.String(q.queueURL),
+		MessageBody:       aws.String(errorResponse.Request),
+		MessageAttributes: attributes,
+	})
+	return err
+}
+
+// forwardNext hands errorResponse to the next ErrorForwarder, dropping it if there is none
+func (q *SQSFallbackQueue) forwardNext(key string, errorResponse ErrorResponse) error {
+	if q.next == nil {
+		return nil
+	}
+	return q.next.ForwardError(key, errorResponse)
+}
@@ -0,0 +1,121 @@
+package common
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// stubSQS records the messages sent to it, failing with err when set; other SQS calls panic
+type stubSQS struct {
+	sqsiface.SQSAPI
+	err  error
+	sent []*sqs.SendMessageInput
+}
+
+func (s *stubSQS) SendMessage(input *sqs.SendMessageInput) (*sqs.SendMessageOutput, error) {
+	s.sent = append(s.sent, input)
+	if s.err != nil {
+		return nil, s.err
+	}
+	return &sqs.SendMessageOutput{MessageId: aws.String("id")}, nil
+}
+
+// recordingErrorForwarder records the keys of the error responses forwarded to it
+type recordingErrorForwarder struct {
+	keys []string
+}
+
+func (f *recordingErrorForwarder) ForwardError(key string, errorResponse ErrorResponse) error {
+	f.keys = append(f.keys, key)
+	return nil
+}
+
+func TestSQSFallbackQueue(t *testing.T) {
+	endpointDown := ErrorResponse{
+		Status:       503,
+		Message:      "connection refused",
+		HttpEndpoint: "http://function",
+		Source:       "KafkaConnector",
+		Request:      `{"id":1}`,
+		ErrorKind:    ErrorKindTransport,
+	}
+	withoutRequest := endpointDown
+	withoutRequest.Request = ""
+	tests := []struct {
+		name          string
+		errorResponse ErrorResponse
+		sendErr       error
+		noNext        bool
+		wantSent      bool
+		wantNext      bool
+		wantErr       bool
+		wantWarning   bool
+	}{
+		{name: "endpoint down", errorResponse: endpointDown, wantSent: true},
+		{name: "send failure", errorResponse: endpointDown, sendErr: errors.New("queue unavailable"), wantSent: true, wantErr: true},
+		{name: "not retryable", errorResponse: ErrorResponse{Status: 400, Request: `{"id":1}`, ErrorKind: ErrorKindResponse}, wantNext: true},
+		{name: "not retryable without next", errorResponse: ErrorResponse{Status: 400, Request: `{"id":1}`, ErrorKind: ErrorKindResponse}, noNext: true},
+		{name: "without original message", errorResponse: withoutRequest, wantNext: true, wantWarning: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &stubSQS{err: tt.sendErr}
+			next := &recordingErrorForwarder{}
+			core, logs := observer.New(zapcore.WarnLevel)
+			queue := &SQSFallbackQueue{client: client, queueURL: "https://sqs.us-east-1.amazonaws.com/123456789012/fallback", logger: zap.New(core)}
+			if !tt.noNext {
+				queue.next = next
+			}
+			if err := queue.ForwardError("k1", tt.errorResponse); (err != nil) != tt.wantErr {
+				t.Errorf("ForwardError() error = %v, want error %v", err, tt.wantErr)
+			}
+			if (len(client.sent) == 1) != tt.wantSent {
+				t.Errorf("sent %v messages to the queue, want sent %v", len(client.sent), tt.wantSent)
+			}
+			if (len(next.keys) == 1) != tt.wantNext {
+				t.Errorf("forwarded %v to the next forwarder, want forwarded %v", next.keys, tt.wantNext)
+			}
+			if got := logs.FilterMessage("skipping fallback queue for failure without original message").Len() == 1; got != tt.wantWarning {
+				t.Errorf("logged %v, want warning %v", logs.All(), tt.wantWarning)
+			}
+			if !tt.wantSent {
+				return
+			}
+			input := client.sent[0]
+			if aws.StringValue(input.QueueUrl) != queue.queueURL || aws.StringValue(input.MessageBody) != tt.errorResponse.Request {
+				t.Errorf("sent %v to %v, want the original message to the queue", aws.StringValue(input.MessageBody), aws.StringValue(input.QueueUrl))
+			}
+			attributes := map[string]string{}
+			for name, value := range input.MessageAttributes {
+				attributes[name] = aws.StringValue(value.StringValue)
+			}
+			want := map[string]string{
+				"status":        "503",
+				"message":       "connection refused",
+				"http_endpoint": "http://function",
+				"source":        "KafkaConnector",
+				"error_kind":    "transport",
+				"key":           "k1",
+			}
+			if !reflect.DeepEqual(attributes, want) {
+				t.Errorf("message attributes = %v, want %v", attributes, want)
+			}
+		})
+	}
+}
+
+func TestNewSQSFallbackQueueFromEnvUnset(t *testing.T) {
+	setEnv(t, map[string]string{"FALLBACK_SQS_QUEUE_URL": ""})
+	queue, err := NewSQSFallbackQueueFromEnv(nil, zap.NewNop())
+	if queue != nil || err != nil {
+		t.Errorf("NewSQSFallbackQueueFromEnv() = %v, %v, want no queue", queue, err)
+	}
+}
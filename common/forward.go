@@ -0,0 +1,246 @@
+package common
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// PublishFunc publishes value with key and headers to topic using the connector's messaging client
+type PublishFunc func(topic, key string, value []byte, headers http.Header) error
+
+// ErrForwarderClosed is returned when forwarding through a closed Forwarder
+var ErrForwarderClosed = errors.New("forwarder closed")
+
+// forwardQueueSize is the number of messages waiting per worker before forwarding blocks
+const forwardQueueSize = 64
+
+// DefaultErrorBatchInterval bounds how long error responses wait for a batch unless configured otherwise
+const DefaultErrorBatchInterval = time.Second
+
+// errorBatchInterval returns how long error responses wait for a batch
+func (m ConnectorMetadata) errorBatchInterval() time.Duration {
+	if m.ErrorBatchInterval > 0 {
+		return m.ErrorBatchInterval
+	}
+	return DefaultErrorBatchInterval
+}
+
+// Forwarder publishes function responses and errors to the response and error topics with a bounded number of
+// concurrent publishes. Messages sharing a key are published by the same worker, preserving their order.
+type Forwarder struct {
+	publish PublishFunc
+	data    ConnectorMetadata
+	logger  *zap.Logger
+
+	mu      sync.RWMutex
+	closed  bool
+	queues  []chan forwardedMessage
+	next    uint32
+	workers sync.WaitGroup
+
+	// errorBatch batches ErrorResponses into JSON arrays when ErrorBatchSize is above 1, nil otherwise
+	errorBatch *batcher
+}
+
+type forwardedMessage struct {
+	topic   string
+	key     string
+	value   []byte
+	headers http.Header
+}
+
+// NewForwarder returns a Forwarder publishing with publish through data.ForwardConcurrency workers, at least one
+func NewForwarder(publish PublishFunc, data ConnectorMetadata, logger *zap.Logger) *Forwarder {
+	concurrency := data.ForwardConcurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	f := &Forwarder{
+		publish: publish,
+		data:    data,
+		logger:  logger,
+		queues:  make([]chan forwardedMessage, concurrency),
+	}
+	for i := range f.queues {
+		f.queues[i] = make(chan forwardedMessage, forwardQueueSize)
+		f.workers.Add(1)
+		go f.work(f.queues[i])
+	}
+	if data.ErrorBatchSize > 1 {
+		f.errorBatch = newBatcher(data.ErrorBatchSize, data.errorBatchInterval(), f.forwardErrorBatch)
+	}
+	return f
+}
+
+func (f *Forwarder) work(queue chan forwardedMessage) {
+	defer f.workers.Done()
+	for msg := range queue {
+		if err := f.publish(msg.topic, msg.key, msg.value, msg.headers); err != nil {
+			f.logger.Error("failed to forward message",
+				zap.Error(err),
+				zap.String("topic", msg.topic),
+				zap.String("key", msg.key),
+				zap.String("source", f.data.SourceName))
+		}
+	}
+}
+
+// ForwardResponse queues the function response body, transformed by ResponseTransformer if configured,
+// for publishing to the response topic, if one is configured
+func (f *Forwarder) ForwardResponse(key string, body []byte, headers http.Header) error {
+	return f.forwardResponse(key, body, headers, nil)
+}
+
+// ForwardResponseFor forwards the function response like ForwardResponse, attaching the source coordinates of the
+// message with the incoming headers like ForwardError does
+func (f *Forwarder) ForwardResponseFor(key string, body []byte, headers http.Header, incoming http.Header) error {
+	return f.forwardResponse(key, body, headers, f.data.SourceCoordinates(incoming))
+}
+
+func (f *Forwarder) forwardResponse(key string, body []byte, headers http.Header, coordinates *SourceCoordinates) error {
+	if f.data.ResponseTopic == "" {
+		return nil
+	}
+	if f.data.ResponseTransformer != nil {
+		transformed, err := f.data.ResponseTransformer(body, headers)
+		if err != nil {
+			return fmt.Errorf("failed to transform function response: %v", err)
+		}
+		body = transformed
+	}
+	return f.enqueue(forwardedMessage{topic: f.data.ResponseTopic, key: key, value: body, headers: withCoordinates(headers, coordinates)})
+}
+
+// withCoordinates returns a copy of headers carrying the source coordinates, or headers unchanged without coordinates
+func withCoordinates(headers http.Header, coordinates *SourceCoordinates) http.Header {
+	if coordinates == nil {
+		return headers
+	}
+	merged := headers.Clone()
+	if merged == nil {
+		merged = make(http.Header)
+	}
+	for key, vals := range coordinates.Header() {
+		merged[key] = vals
+	}
+	return merged
+}
+
+// ForwardPartialSuccess forwards a successful function response like ForwardResponseFor. When PartialFailureField is
+// configured and holds a non-empty value in the JSON body, the failed portion is forwarded as an error
+// with the ErrorKindPartial kind and the remaining body as the response.
+// report is the report of the invocation and incoming the headers of the source message.
+func (f *Forwarder) ForwardPartialSuccess(key string, body []byte, headers http.Header, report InvocationReport, incoming http.Header) error {
+	coordinates := f.data.SourceCoordinates(incoming)
+	if f.data.PartialFailureField == "" {
+		return f.forwardResponse(key, body, headers, coordinates)
+	}
+	rest, failures, ok := extractJSONPath(body, f.data.PartialFailureField)
+	if !ok || isEmptyJSON(failures) {
+		return f.forwardResponse(key, body, headers, coordinates)
+	}
+	if err := f.forwardResponse(key, rest, headers, coordinates); err != nil {
+		return err
+	}
+	errorResponse := ErrorResponse{
+		Status:       report.StatusCode,
+		Message:      "function reported a partial failure",
+		HttpEndpoint: report.Endpoint,
+		Source:       f.data.SourceName,
+		Coordinates:  coordinates,
+		ErrorKind:    ErrorKindPartial,
+		Version:      Version,
+	}
+	errorResponse.setBody(failures)
+	return f.ForwardError(key, errorResponse)
+}
+
+// isEmptyJSON tells whether value is JSON null, false, an empty string, array or object
+func isEmptyJSON(value []byte) bool {
+	switch string(value) {
+	case "null", "false", `""`, "[]", "{}":
+		return true
+	}
+	return false
+}
+
+// ForwardError queues errorResponse, encoded according to ErrorEncoding, for publishing to the error topic, if one is configured.
+// With ErrorBatchSize above 1, error responses are published together as a JSON array without key instead.
+func (f *Forwarder) ForwardError(key string, errorResponse ErrorResponse) error {
+	if f.data.ErrorTopic == "" {
+		return nil
+	}
+	if f.errorBatch != nil {
+		value, err := json.Marshal(errorResponse)
+		if err != nil {
+			return err
+		}
+		if !f.errorBatch.add(string(value)) {
+			return ErrForwarderClosed
+		}
+		return nil
+	}
+	value, contentType, err := encodeErrorResponse(errorResponse, f.data.ErrorEncoding)
+	if err != nil {
+		return err
+	}
+	headers := withCoordinates(http.Header{"Content-Type": {contentType}}, errorResponse.Coordinates)
+	return f.enqueue(forwardedMessage{topic: f.data.ErrorTopic, key: key, value: value, headers: headers})
+}
+
+// forwardErrorBatch queues the JSON array of the batched error responses values for publishing to the error topic
+func (f *Forwarder) forwardErrorBatch(values []string) {
+	value := []byte(encodeBatch(values))
+	headers := http.Header{"Content-Type": {"application/json"}}
+	if err := f.enqueue(forwardedMessage{topic: f.data.ErrorTopic, value: value, headers: headers}); err != nil {
+		f.logger.Error("failed to forward error batch",
+			zap.Error(err),
+			zap.Int("errors", len(values)),
+			zap.String("source", f.data.SourceName))
+	}
+}
+
+// enqueue hands msg to the worker owning its key, or to the next worker if it has none, waiting while its queue is full
+func (f *Forwarder) enqueue(msg forwardedMessage) error {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if f.closed {
+		return ErrForwarderClosed
+	}
+	var index uint32
+	if msg.key != "" {
+		hash := fnv.New32a()
+		hash.Write([]byte(msg.key))
+		index = hash.Sum32()
+	} else {
+		index = atomic.AddUint32(&f.next, 1)
+	}
+	start := now()
+	f.queues[index%uint32(len(f.queues))] <- msg
+	limiterWaitSeconds.WithLabelValues(f.data.SourceName, limiterForwardQueue).Observe(since(start).Seconds())
+	return nil
+}
+
+// Close stops accepting messages and waits for the queued ones to be published
+func (f *Forwarder) Close() {
+	if f.errorBatch != nil {
+		f.errorBatch.close()
+	}
+	f.mu.Lock()
+	if !f.closed {
+		f.closed = true
+		for _, queue := range f.queues {
+			close(queue)
+		}
+	}
+	f.mu.Unlock()
+	f.workers.Wait()
+}
@@ -0,0 +1,321 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// slowPublisher records published messages after a delay, tracking the most publishes in flight at once
+type slowPublisher struct {
+	recordingPublisher
+	delay    time.Duration
+	inFlight int32
+	max      int32
+}
+
+func (p *slowPublisher) publish(topic, key string, value []byte, headers http.Header) error {
+	current := atomic.AddInt32(&p.inFlight, 1)
+	defer atomic.AddInt32(&p.inFlight, -1)
+	for {
+		max := atomic.LoadInt32(&p.max)
+		if current <= max || atomic.CompareAndSwapInt32(&p.max, max, current) {
+			break
+		}
+	}
+	time.Sleep(p.delay)
+	return p.recordingPublisher.publish(topic, key, value, headers)
+}
+
+func TestForwarderConcurrencyBounded(t *testing.T) {
+	tests := []struct {
+		name        string
+		concurrency int
+		want        int32
+	}{
+		{name: "serial by default", concurrency: 0, want: 1},
+		{name: "bounded", concurrency: 3, want: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			publisher := &slowPublisher{delay: 5 * time.Millisecond}
+			data := testMetadata(t, "http://function", WithResponseTopic("responses"), WithForwardConcurrency(tt.concurrency))
+			f := NewForwarder(publisher.publish, data, zap.NewNop())
+			for i := 0; i < 30; i++ {
+				if err := f.ForwardResponse("", []byte(strconv.Itoa(i)), nil); err != nil {
+					t.Fatalf("ForwardResponse() error = %v", err)
+				}
+			}
+			f.Close()
+			if got := len(publisher.published()); got != 30 {
+				t.Errorf("published %v messages, want 30", got)
+			}
+			if publisher.max != tt.want {
+				t.Errorf("%v publishes in flight at most, want %v", publisher.max, tt.want)
+			}
+		})
+	}
+}
+
+func TestForwarderKeyOrder(t *testing.T) {
+	publisher := &slowPublisher{delay: time.Millisecond}
+	data := testMetadata(t, "http://function", WithResponseTopic("responses"), WithForwardConcurrency(4))
+	f := NewForwarder(publisher.publish, data, zap.NewNop())
+	keys := []string{"a", "b", "c", "d", "e"}
+	var wg sync.WaitGroup
+	for _, key := range keys {
+		wg.Add(1)
+		go func(key string) {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				f.ForwardResponse(key, []byte(strconv.Itoa(i)), nil)
+			}
+		}(key)
+	}
+	wg.Wait()
+	f.Close()
+	next := make(map[string]int)
+	for _, msg := range publisher.published() {
+		if want := strconv.Itoa(next[msg.key]); msg.value != want {
+			t.Fatalf("published %v for key %v, want %v", msg.value, msg.key, want)
+		}
+		next[msg.key]++
+	}
+	for _, key := range keys {
+		if next[key] != 20 {
+			t.Errorf("published %v messages for key %v, want 20", next[key], key)
+		}
+	}
+}
+
+func TestForwarderClosed(t *testing.T) {
+	publisher := &recordingPublisher{}
+	data := testMetadata(t, "http://function", WithResponseTopic("responses"), WithErrorTopic("errors"))
+	f := NewForwarder(publisher.publish, data, zap.NewNop())
+	f.Close()
+	if err := f.ForwardResponse("k", []byte("{}"), nil); err != ErrForwarderClosed {
+		t.Errorf("ForwardResponse() error = %v, want %v", err, ErrForwarderClosed)
+	}
+	if err := f.ForwardError("k", ErrorResponse{Status: 500}); err != ErrForwarderClosed {
+		t.Errorf("ForwardError() error = %v, want %v", err, ErrForwarderClosed)
+	}
+	// Closing again is harmless
+	f.Close()
+}
+
+func TestForwarderWithoutTopics(t *testing.T) {
+	publisher := &recordingPublisher{}
+	f := NewForwarder(publisher.publish, testMetadata(t, "http://function"), zap.NewNop())
+	defer f.Close()
+	for i, err := range []error{
+		f.ForwardResponse("k", []byte("{}"), nil),
+		f.ForwardError("k", ErrorResponse{Status: 500}),
+	} {
+		if err != nil {
+			t.Errorf("forward %v error = %v", i, err)
+		}
+	}
+	if got := publisher.published(); len(got) != 0 {
+		t.Errorf("published %v without topics", fmt.Sprint(got))
+	}
+}
+
+func TestForwardPartialSuccess(t *testing.T) {
+	tests := []struct {
+		name         string
+		field        string
+		body         string
+		wantResponse string
+		wantFailures string
+	}{
+		{name: "not configured", body: `{"ok":[1],"failed":[2]}`, wantResponse: `{"ok":[1],"failed":[2]}`},
+		{name: "field missing", field: "failed", body: `{"ok":[1,2]}`, wantResponse: `{"ok":[1,2]}`},
+		{name: "no failures", field: "failed", body: `{"ok":[1,2],"failed":[]}`, wantResponse: `{"ok":[1,2],"failed":[]}`},
+		{name: "not json", field: "failed", body: "done", wantResponse: "done"},
+		{name: "partial failure", field: "failed", body: `{"ok":[1],"failed":[2]}`, wantResponse: `{"ok":[1]}`, wantFailures: "[2]"},
+		{name: "nested partial failure", field: "result.failed", body: `{"result":{"ok":[1],"failed":[{"id":2}]}}`, wantResponse: `{"result":{"ok":[1]}}`, wantFailures: `[{"id":2}]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			publisher := &recordingPublisher{}
+			data := testMetadata(t, "http://function",
+				WithResponseTopic("responses"),
+				WithErrorTopic("errors"),
+				WithPartialFailureField(tt.field),
+				WithSourceCoordinateHeaders(SourceCoordinateHeaders{Offset: "X-Offset"}))
+			f := NewForwarder(publisher.publish, data, zap.NewNop())
+			report := InvocationReport{Outcome: OutcomeSuccess, StatusCode: http.StatusOK, Endpoint: "http://function"}
+			incoming := http.Header{"X-Offset": {"12"}}
+			if err := f.ForwardPartialSuccess("key", []byte(tt.body), http.Header{}, report, incoming); err != nil {
+				t.Fatalf("ForwardPartialSuccess() error = %v", err)
+			}
+			f.Close()
+			var response, failure *publishedMessage
+			for _, msg := range publisher.published() {
+				msg := msg
+				switch msg.topic {
+				case "responses":
+					response = &msg
+				case "errors":
+					failure = &msg
+				}
+			}
+			if response == nil || response.value != tt.wantResponse {
+				t.Fatalf("published response %+v, want %q", response, tt.wantResponse)
+			}
+			if tt.wantFailures == "" {
+				if failure != nil {
+					t.Errorf("published error %+v, want none", failure)
+				}
+				return
+			}
+			if failure == nil {
+				t.Fatal("published no error for the failed portion")
+			}
+			var errorResponse ErrorResponse
+			if err := json.Unmarshal([]byte(failure.value), &errorResponse); err != nil {
+				t.Fatal(err)
+			}
+			if errorResponse.ErrorKind != ErrorKindPartial || errorResponse.Body != tt.wantFailures || errorResponse.Status != http.StatusOK {
+				t.Errorf("published error %+v, want a partial failure with body %v", errorResponse, tt.wantFailures)
+			}
+			if errorResponse.Coordinates == nil || errorResponse.Coordinates.Offset != "12" {
+				t.Errorf("error coordinates = %+v, want offset 12", errorResponse.Coordinates)
+			}
+			if got := response.headers.Get(SourceOffsetHeader); got != "12" {
+				t.Errorf("response offset header = %q, want 12", got)
+			}
+		})
+	}
+}
+
+// waitForPublished waits until publisher published n messages, returning them
+func waitForPublished(t *testing.T, publisher *recordingPublisher, n int) []publishedMessage {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(publisher.published()) < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("published %v messages, want %v", len(publisher.published()), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return publisher.published()
+}
+
+// batchStatuses returns the statuses of the error responses in each published JSON array
+func batchStatuses(t *testing.T, messages []publishedMessage) [][]int {
+	t.Helper()
+	var batches [][]int
+	for _, msg := range messages {
+		if msg.topic != "errors" || msg.key != "" || msg.headers.Get("Content-Type") != "application/json" {
+			t.Errorf("published %+v, want a JSON array without key to the error topic", msg)
+		}
+		var batch []ErrorResponse
+		if err := json.Unmarshal([]byte(msg.value), &batch); err != nil {
+			t.Fatalf("published %q, not a JSON array of error responses: %v", msg.value, err)
+		}
+		statuses := []int{}
+		for _, errorResponse := range batch {
+			statuses = append(statuses, errorResponse.Status)
+		}
+		batches = append(batches, statuses)
+	}
+	return batches
+}
+
+func TestForwardErrorBatching(t *testing.T) {
+	tests := []struct {
+		name     string
+		errors   int
+		advance  bool
+		want     [][]int
+		wantOpen [][]int
+	}{
+		{name: "full batch", errors: 3, wantOpen: [][]int{{500, 501, 502}}, want: [][]int{{500, 501, 502}}},
+		{name: "batches in order", errors: 7, wantOpen: [][]int{{500, 501, 502}, {503, 504, 505}}, want: [][]int{{500, 501, 502}, {503, 504, 505}, {506}}},
+		{name: "flushed after interval", errors: 2, advance: true, wantOpen: [][]int{{500, 501}}, want: [][]int{{500, 501}}},
+		{name: "flushed on close", errors: 2, want: [][]int{{500, 501}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := useFakeClock(t)
+			publisher := &recordingPublisher{}
+			data := testMetadata(t, "http://function", WithErrorTopic("errors"), WithErrorBatching(3, time.Second))
+			f := NewForwarder(publisher.publish, data, zap.NewNop())
+			for i := 0; i < tt.errors; i++ {
+				if err := f.ForwardError(strconv.Itoa(i), ErrorResponse{Status: 500 + i}); err != nil {
+					t.Fatalf("ForwardError() error = %v", err)
+				}
+			}
+			if tt.advance {
+				waitForTimers(t, clock, 1)
+				clock.Advance(time.Second)
+			}
+			if got := batchStatuses(t, waitForPublished(t, publisher, len(tt.wantOpen))); !reflect.DeepEqual(got, tt.wantOpen) {
+				t.Errorf("published %v before closing, want %v", got, tt.wantOpen)
+			}
+			f.Close()
+			if got := batchStatuses(t, publisher.published()); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("published %v, want %v", got, tt.want)
+			}
+			if err := f.ForwardError("k", ErrorResponse{Status: 500}); err != ErrForwarderClosed {
+				t.Errorf("ForwardError() after close error = %v, want %v", err, ErrForwarderClosed)
+			}
+		})
+	}
+}
+
+func TestErrorBatchingRequiresJSON(t *testing.T) {
+	data := testMetadata(t, "http://function", WithErrorBatching(10, 0))
+	data.ErrorEncoding = ErrorEncodingForm
+	if err := data.Validate(); err == nil {
+		t.Error("Validate() accepted batching form encoded errors")
+	}
+}
+
+func TestParseConnectorMetadataErrorBatching(t *testing.T) {
+	tests := []struct {
+		name         string
+		env          map[string]string
+		wantSize     int
+		wantInterval time.Duration
+		wantErr      bool
+	}{
+		{name: "unset", env: map[string]string{}},
+		{name: "size", env: map[string]string{"ERROR_BATCH_SIZE": "50"}, wantSize: 50},
+		{name: "interval", env: map[string]string{"ERROR_BATCH_SIZE": "50", "ERROR_BATCH_INTERVAL": "5s"}, wantSize: 50, wantInterval: 5 * time.Second},
+		{name: "invalid size", env: map[string]string{"ERROR_BATCH_SIZE": "many"}, wantErr: true},
+		{name: "invalid interval", env: map[string]string{"ERROR_BATCH_INTERVAL": "soon"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := map[string]string{
+				"TOPIC":                "topic",
+				"HTTP_ENDPOINT":        "http://function.default",
+				"MAX_RETRIES":          "3",
+				"CONTENT_TYPE":         "application/json",
+				"ERROR_BATCH_SIZE":     "",
+				"ERROR_BATCH_INTERVAL": "",
+			}
+			for name, value := range tt.env {
+				env[name] = value
+			}
+			setEnv(t, env)
+			meta, err := ParseConnectorMetadata()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseConnectorMetadata() error = %v, want error %v", err, tt.wantErr)
+			}
+			if meta.ErrorBatchSize != tt.wantSize || meta.ErrorBatchInterval != tt.wantInterval {
+				t.Errorf("error batching = %v every %v, want %v every %v", meta.ErrorBatchSize, meta.ErrorBatchInterval, tt.wantSize, tt.wantInterval)
+			}
+		})
+	}
+}
@@ -5,5 +5,6 @@ go 1.15
 require (
 	github.com/aws/aws-sdk-go v1.34.25
 	github.com/pkg/errors v0.9.1
+	github.com/prometheus/client_golang v1.11.1
 	go.uber.org/zap v1.16.0
 )
@@ -0,0 +1,129 @@
+package common
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultHedgeLimit bounds the number of hedged requests in flight unless configured otherwise
+const DefaultHedgeLimit = 10
+
+// hedgeLimit returns the number of hedged requests allowed in flight
+func (m ConnectorMetadata) hedgeLimit() int {
+	if m.HedgeLimit > 0 {
+		return m.HedgeLimit
+	}
+	return DefaultHedgeLimit
+}
+
+// activeHedges counts the hedged requests in flight
+var activeHedges int32
+
+type hedgeResult struct {
+	index int
+	resp  *http.Response
+	err   error
+}
+
+// doHedged sends req with client and, if no response arrived after delay and fewer than limit hedges are in flight,
+// sends it a second time, using whichever response arrives first and cancelling the other request.
+// Requests whose body can't be sent again are never hedged.
+func doHedged(client *http.Client, req *http.Request, delay time.Duration, limit int) (*http.Response, error) {
+	if req.GetBody == nil && req.Body != nil && req.Body != http.NoBody {
+		return client.Do(req)
+	}
+	results := make(chan hedgeResult, 2)
+	var cancels []context.CancelFunc
+	send := func(req *http.Request, hedge bool) {
+		ctx, cancel := context.WithCancel(req.Context())
+		index := len(cancels)
+		cancels = append(cancels, cancel)
+		go func() {
+			resp, err := client.Do(req.WithContext(ctx))
+			if hedge {
+				// The hedge is in flight until its response is closed, whether it won or was discarded
+				if resp != nil {
+					resp.Body = &releaseOnClose{ReadCloser: resp.Body, release: releaseHedge}
+				} else {
+					releaseHedge()
+				}
+			}
+			results <- hedgeResult{index: index, resp: resp, err: err}
+		}()
+	}
+	send(req, false)
+	inFlight := 1
+	timer := newTimer(delay)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C():
+			if atomic.AddInt32(&activeHedges, 1) > int32(limit) {
+				atomic.AddInt32(&activeHedges, -1)
+				continue
+			}
+			hedge := req.Clone(req.Context())
+			if req.GetBody != nil {
+				body, err := req.GetBody()
+				if err != nil {
+					releaseHedge()
+					continue
+				}
+				hedge.Body = body
+			}
+			send(hedge, true)
+			inFlight++
+		case result := <-results:
+			inFlight--
+			if result.err != nil && inFlight > 0 {
+				// The other request may still succeed
+				cancels[result.index]()
+				continue
+			}
+			for index, cancel := range cancels {
+				if index != result.index {
+					cancel()
+				}
+			}
+			for ; inFlight > 0; inFlight-- {
+				go discardHedge(results)
+			}
+			if result.resp == nil {
+				cancels[result.index]()
+				return nil, result.err
+			}
+			// The response body is read after returning, so the request is only released once it is closed
+			result.resp.Body = &cancelOnClose{ReadCloser: result.resp.Body, cancel: cancels[result.index]}
+			return result.resp, nil
+		}
+	}
+}
+
+// releaseHedge counts a hedged request out of activeHedges
+func releaseHedge() {
+	atomic.AddInt32(&activeHedges, -1)
+}
+
+// releaseOnClose calls release once the body is first closed
+type releaseOnClose struct {
+	io.ReadCloser
+	release func()
+	once    sync.Once
+}
+
+func (r *releaseOnClose) Close() error {
+	err := r.ReadCloser.Close()
+	r.once.Do(r.release)
+	return err
+}
+
+// discardHedge releases the response of the cancelled request losing a hedge
+func discardHedge(results chan hedgeResult) {
+	if result := <-results; result.resp != nil {
+		result.resp.Body.Close()
+	}
+}
@@ -0,0 +1,91 @@
+package common
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// hedgedServer starts a server whose first request answers "primary" after primaryDelay, or once cancelled,
+// and whose later requests answer "hedge" immediately. It returns the number of requests received and a channel
+// receiving once the first request was cancelled.
+func hedgedServer(t *testing.T, primaryDelay time.Duration) (*httptest.Server, *int32, chan struct{}) {
+	t.Helper()
+	var requests int32
+	cancelled := make(chan struct{}, 1)
+	srv := newServer(t, func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		if atomic.AddInt32(&requests, 1) > 1 {
+			w.Write([]byte("hedge"))
+			return
+		}
+		select {
+		case <-time.After(primaryDelay):
+			w.Write([]byte("primary"))
+		case <-r.Context().Done():
+			cancelled <- struct{}{}
+		}
+	})
+	return srv, &requests, cancelled
+}
+
+func TestHedging(t *testing.T) {
+	const delay = 20 * time.Millisecond
+	tests := []struct {
+		name         string
+		primaryDelay time.Duration
+		busyHedges   int32
+		stream       bool
+		want         string
+		wantRequests int32
+		wantCancel   bool
+	}{
+		{name: "hedge beats a slow primary", primaryDelay: time.Minute, want: "hedge", wantRequests: 2, wantCancel: true},
+		{name: "fast primary not hedged", primaryDelay: 0, want: "primary", wantRequests: 1},
+		{name: "hedge limit reached", primaryDelay: 5 * delay, busyHedges: 2, want: "primary", wantRequests: 1},
+		{name: "stream not hedged", primaryDelay: 5 * delay, stream: true, want: "primary", wantRequests: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, requests, cancelled := hedgedServer(t, tt.primaryDelay)
+			atomic.AddInt32(&activeHedges, tt.busyHedges)
+			defer atomic.AddInt32(&activeHedges, -tt.busyHedges)
+			data := testMetadata(t, srv.URL, WithHedging(delay, 2), WithChunkedTransfer(tt.stream))
+			var resp *http.Response
+			var err error
+			if tt.stream {
+				resp, err = HandleHTTPRequestStream(strings.NewReader("{}"), http.Header{}, data, zap.NewNop())
+			} else {
+				resp, err = HandleHTTPRequest("{}", http.Header{}, data, zap.NewNop())
+			}
+			if err != nil {
+				t.Fatalf("invocation failed: %v", err)
+			}
+			if got := atomic.LoadInt32(&activeHedges) - tt.busyHedges; got != tt.wantRequests-1 {
+				t.Errorf("%v hedges in flight before the response is closed, want %v", got, tt.wantRequests-1)
+			}
+			if body, err := ResponseString(resp); err != nil || body != tt.want {
+				t.Errorf("body = %q with error %v, want %q", body, err, tt.want)
+			}
+			if got := atomic.LoadInt32(requests); got != tt.wantRequests {
+				t.Errorf("server received %v requests, want %v", got, tt.wantRequests)
+			}
+			if tt.wantCancel {
+				select {
+				case <-cancelled:
+				case <-time.After(5 * time.Second):
+					t.Error("losing request not cancelled")
+				}
+			}
+			if got := atomic.LoadInt32(&activeHedges) - tt.busyHedges; got != 0 {
+				t.Errorf("%v hedges in flight once the response is closed, want none", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,36 @@
+package common
+
+import (
+	"fmt"
+	"net/http"
+
+	"go.uber.org/zap"
+)
+
+// Hooks contains optional callbacks invoked while handling a function invocation
+type Hooks struct {
+	// BeforeAttempt is called before every attempt with the request about to be sent; returning an error aborts the invocation
+	BeforeAttempt func(req *http.Request, attempt int) error
+	// OnRetry is called after a failed attempt when another attempt is going to be made; resp or err may be nil
+	OnRetry func(attempt int, resp *http.Response, err error)
+	// StatusHandlers are called for responses with a matching status code; returning an error aborts the invocation with that error
+	StatusHandlers map[int]func(resp *http.Response) error
+	// OnPayloadTooLarge is called with the message rejected with 413 Payload Too Large, other than batches which are
+	// split instead; returning true sends the reduced message in its place, e.g. stripping a large field, and the
+	// message is dead-lettered if still too large
+	OnPayloadTooLarge func(message []byte) (reduced []byte, retry bool)
+}
+
+// callHook runs a user provided hook, converting a panic into an error so a misbehaving hook can't crash the connector
+func callHook(name string, logger *zap.Logger, hook func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			logger.Error("recovered from panic in hook",
+				zap.String("hook", name),
+				zap.Any("panic", r),
+				zap.Stack("stack"))
+			err = fmt.Errorf("%v hook panicked: %v", name, r)
+		}
+	}()
+	return hook()
+}
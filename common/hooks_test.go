@@ -0,0 +1,146 @@
+package common
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"sync"
+	"testing"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestHookPanicFailsInvocation(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		hooks  Hooks
+	}{
+		{
+			name:   "BeforeAttempt",
+			status: http.StatusOK,
+			hooks:  Hooks{BeforeAttempt: func(*http.Request, int) error { panic("boom") }},
+		},
+		{
+			name:   "OnRetry",
+			status: http.StatusInternalServerError,
+			hooks:  Hooks{OnRetry: func(int, *http.Response, error) { panic("boom") }},
+		},
+		{
+			name:   "StatusHandler",
+			status: http.StatusTeapot,
+			hooks:  Hooks{StatusHandlers: map[int]func(*http.Response) error{http.StatusTeapot: func(*http.Response) error { panic("boom") }}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, _ := statusServer(t, tt.status)
+			core, logs := observer.New(zapcore.ErrorLevel)
+			data := testMetadata(t, srv.URL, WithMaxRetries(1), WithHooks(tt.hooks))
+			resp, _, err := InvokeHTTPRequest(context.Background(), "{}", http.Header{}, data, zap.New(core))
+			if err == nil {
+				resp.Body.Close()
+				t.Fatal("expected the panicking hook to fail the invocation")
+			}
+			entries := logs.FilterMessage("recovered from panic in hook").All()
+			if len(entries) != 1 {
+				t.Fatalf("logged %v panics, want 1", len(entries))
+			}
+			if hook := entries[0].ContextMap()["hook"]; hook != tt.name {
+				t.Errorf("logged hook %v, want %v", hook, tt.name)
+			}
+		})
+	}
+}
+
+func TestCallHook(t *testing.T) {
+	tests := []struct {
+		name    string
+		hook    func() error
+		wantErr bool
+	}{
+		{name: "returns", hook: func() error { return nil }},
+		{name: "fails", hook: func() error { return context.Canceled }, wantErr: true},
+		{name: "panics", hook: func() error { panic("boom") }, wantErr: true},
+		{name: "panics with nil map", hook: func() error { var m map[string]int; m["x"]++; return nil }, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := callHook(tt.name, zap.NewNop(), tt.hook); (err != nil) != tt.wantErr {
+				t.Errorf("callHook() error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestOnPayloadTooLarge(t *testing.T) {
+	const message = `{"id":1,"attachment":"aaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"}`
+	tests := []struct {
+		name       string
+		hook       func([]byte) ([]byte, bool)
+		wantBodies []string
+		wantErr    bool
+	}{
+		{
+			name:       "reduced payload accepted",
+			hook:       func([]byte) ([]byte, bool) { return []byte(`{"id":1}`), true },
+			wantBodies: []string{message, `{"id":1}`},
+		},
+		{
+			name:       "reduced payload still too large",
+			hook:       func([]byte) ([]byte, bool) { return []byte(`{"id":1,"attachment":"aaa"}`), true },
+			wantBodies: []string{message, `{"id":1,"attachment":"aaa"}`},
+			wantErr:    true,
+		},
+		{
+			name:       "hook declines",
+			hook:       func([]byte) ([]byte, bool) { return nil, false },
+			wantBodies: []string{message, message, message},
+			wantErr:    true,
+		},
+		{
+			name:       "hook panics",
+			hook:       func([]byte) ([]byte, bool) { panic("boom") },
+			wantBodies: []string{message, message, message},
+			wantErr:    true,
+		},
+		{name: "no hook", wantBodies: []string{message, message, message}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var bodies []string
+			srv := newServer(t, func(w http.ResponseWriter, r *http.Request) {
+				raw, _ := ioutil.ReadAll(r.Body)
+				mu.Lock()
+				bodies = append(bodies, string(raw))
+				mu.Unlock()
+				if len(raw) > 20 {
+					w.WriteHeader(http.StatusRequestEntityTooLarge)
+				}
+			})
+			data := testMetadata(t, srv.URL, WithMaxRetries(2), WithHooks(Hooks{OnPayloadTooLarge: tt.hook}))
+			resp, report, err := InvokeHTTPRequest(context.Background(), message, http.Header{}, data, zap.NewNop())
+			if !reflect.DeepEqual(bodies, tt.wantBodies) {
+				t.Errorf("server received %q, want %q", bodies, tt.wantBodies)
+			}
+			if !tt.wantErr {
+				if err != nil {
+					t.Fatalf("InvokeHTTPRequest() error = %v", err)
+				}
+				resp.Body.Close()
+				return
+			}
+			errorResponse := errorResponseOf(t, err)
+			if errorResponse.Status != http.StatusRequestEntityTooLarge || errorResponse.Request != message {
+				t.Errorf("error status %v for request %q, want 413 for the original message", errorResponse.Status, errorResponse.Request)
+			}
+			if report.Outcome != OutcomeFailure {
+				t.Errorf("outcome = %v, want %v", report.Outcome, OutcomeFailure)
+			}
+		})
+	}
+}
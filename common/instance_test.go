@@ -0,0 +1,85 @@
+package common
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestInstanceIdentity(t *testing.T) {
+	tests := []struct {
+		name         string
+		instance     string
+		header       string
+		wantHeader   string
+		wantInstance string
+	}{
+		{name: "header and error", instance: "connector-0", header: DefaultInstanceHeader, wantHeader: "connector-0", wantInstance: "connector-0"},
+		{name: "error only", instance: "connector-0", wantInstance: "connector-0"},
+		{name: "not configured", header: DefaultInstanceHeader},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			headers := make(chan http.Header, 1)
+			srv := newServer(t, func(w http.ResponseWriter, r *http.Request) {
+				headers <- r.Header.Clone()
+				w.WriteHeader(http.StatusInternalServerError)
+			})
+			data := testMetadata(t, srv.URL, WithInstance(tt.instance, tt.header))
+			_, _, err := InvokeHTTPRequest(context.Background(), "{}", http.Header{}, data, zap.NewNop())
+			if got := errorResponseOf(t, err).Instance; got != tt.wantInstance {
+				t.Errorf("error instance = %q, want %q", got, tt.wantInstance)
+			}
+			if got := (<-headers).Get(DefaultInstanceHeader); got != tt.wantHeader {
+				t.Errorf("instance header = %q, want %q", got, tt.wantHeader)
+			}
+		})
+	}
+}
+
+func TestParseConnectorMetadataInstance(t *testing.T) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name         string
+		env          map[string]string
+		wantInstance string
+		wantHeader   string
+		wantErr      bool
+	}{
+		{name: "disabled", env: map[string]string{"POD_NAME": "connector-0"}},
+		{name: "pod name", env: map[string]string{"INSTANCE_IDENTITY": "true", "POD_NAME": "connector-0"}, wantInstance: "connector-0", wantHeader: DefaultInstanceHeader},
+		{name: "hostname", env: map[string]string{"INSTANCE_IDENTITY": "true"}, wantInstance: hostname, wantHeader: DefaultInstanceHeader},
+		{name: "header", env: map[string]string{"INSTANCE_IDENTITY": "true", "POD_NAME": "connector-0", "INSTANCE_HEADER": "X-Pod"}, wantInstance: "connector-0", wantHeader: "X-Pod"},
+		{name: "invalid", env: map[string]string{"INSTANCE_IDENTITY": "maybe"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := map[string]string{
+				"TOPIC":             "topic",
+				"HTTP_ENDPOINT":     "http://function.default",
+				"MAX_RETRIES":       "3",
+				"CONTENT_TYPE":      "application/json",
+				"INSTANCE_IDENTITY": "",
+				"INSTANCE_HEADER":   "",
+				"POD_NAME":          "",
+			}
+			for name, value := range tt.env {
+				env[name] = value
+			}
+			setEnv(t, env)
+			meta, err := ParseConnectorMetadata()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseConnectorMetadata() error = %v, want error %v", err, tt.wantErr)
+			}
+			if meta.Instance != tt.wantInstance || meta.InstanceHeader != tt.wantHeader {
+				t.Errorf("instance = %q in %q, want %q in %q", meta.Instance, meta.InstanceHeader, tt.wantInstance, tt.wantHeader)
+			}
+		})
+	}
+}
@@ -0,0 +1,915 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// Outcome classifies how a function invocation ended, so the connector can decide what to do with the message
+type Outcome int
+
+const (
+	// OutcomeSuccess means the function processed the message; the message should be acked
+	OutcomeSuccess Outcome = iota
+	// OutcomeFailure means the invocation failed definitively; the message should be forwarded to the error topic or dead-lettered
+	OutcomeFailure
+	// OutcomeIncomplete means the context was cancelled (e.g. on shutdown) before a definitive result was obtained.
+	// The function may or may not have processed the message; nacking it so it gets redelivered is recommended,
+	// since acking risks losing the message whereas nacking only risks a duplicate delivery.
+	OutcomeIncomplete
+	// OutcomeRetry means the function asked for the message to be redelivered later; the message should be nacked
+	OutcomeRetry
+	// OutcomeDuplicate means the message was already processed successfully and the function wasn't invoked; the message should be acked
+	OutcomeDuplicate
+	// OutcomeQueued means the message was persisted to the OutboundQueue to be sent later; the message should be acked
+	OutcomeQueued
+)
+
+func (o Outcome) String() string {
+	switch o {
+	case OutcomeSuccess:
+		return "success"
+	case OutcomeFailure:
+		return "failure"
+	case OutcomeIncomplete:
+		return "incomplete"
+	case OutcomeRetry:
+		return "retry"
+	case OutcomeDuplicate:
+		return "duplicate"
+	case OutcomeQueued:
+		return "queued"
+	default:
+		return fmt.Sprintf("Outcome(%d)", int(o))
+	}
+}
+
+// InvocationReport describes how a function invocation went
+type InvocationReport struct {
+	Outcome  Outcome
+	Attempts int
+	// Endpoint is the endpoint of the last attempt, i.e. the one which served the request on success
+	Endpoint string
+	// Duration of the whole invocation including retries
+	Duration time.Duration
+	// StatusCode of the response to the last attempt, zero if none was received
+	StatusCode int
+	// ErrorKind tells what kind of failure ended a failed invocation
+	ErrorKind ErrorKind
+	// Replayed tells whether the function reported through IdempotencyReplayHeader that it had already processed
+	// the message, responding with the result of the earlier processing
+	Replayed bool
+}
+
+// InvokeHTTPRequest sends message and headers data to HTTP endpoint using POST method like HandleHTTPRequest, stopping once ctx is done.
+// Along with the response or error it returns a report whose Outcome tells whether the message should be acked, forwarded as an error or nacked.
+func InvokeHTTPRequest(ctx context.Context, message string, headers http.Header, data ConnectorMetadata, logger *zap.Logger) (*http.Response, InvocationReport, error) {
+	body := payload{
+		open:    func() io.Reader { return strings.NewReader(message) },
+		length:  int64(len(message)),
+		message: func() string { return message },
+	}
+	return handleHTTPRequest(ctx, body, headers, data, logger)
+}
+
+// InvokeHTTPRequestToSink invokes the function like InvokeHTTPRequest and copies the body of a successful response
+// to sink without buffering it, e.g. to pipe large responses to disk or to an S3 upload through io.Pipe.
+// The response body is always closed; the number of bytes copied is returned.
+func InvokeHTTPRequestToSink(ctx context.Context, message string, headers http.Header, sink io.Writer, data ConnectorMetadata, logger *zap.Logger) (int64, InvocationReport, error) {
+	resp, report, err := InvokeHTTPRequest(ctx, message, headers, data, logger)
+	if err != nil {
+		return 0, report, err
+	}
+	defer resp.Body.Close()
+	written, err := io.Copy(sink, resp.Body)
+	if err != nil {
+		return written, report, errors.Wrapf(err, "failed to copy function response to sink. http_endpoint: %v, source: %v", report.Endpoint, data.SourceName)
+	}
+	return written, report, nil
+}
+
+// ResponseString returns the body of a successful function response as a string, closing it.
+// 204 No Content and 304 Not Modified responses have no body, an empty string is returned without reading it.
+func ResponseString(resp *http.Response) (string, error) {
+	if resp == nil {
+		return "", nil
+	}
+	if resp.Body == nil || resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusNotModified {
+		if resp.Body != nil {
+			resp.Body.Close()
+		}
+		return "", nil
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	return string(body), nil
+}
+
+// payload describes the request body sent on every attempt
+type payload struct {
+	open       func() io.Reader // returns the body reader for an attempt
+	length     int64            // size of the body or -1 if unknown
+	once       bool             // body can only be read once, so it is never retried
+	message    func() string    // returns the body to report in case of failure
+	splittable bool             // body is a batch split on 413 Payload Too Large, see InvokeHTTPBatch
+	queued     bool             // body is replayed from the OutboundQueue, see RunOutboundQueue
+	batched    bool             // body is part of a batch split on 413 Payload Too Large, failing if still too large
+}
+
+// handleHTTPRequest invokes the function, skipping messages already processed according to the DedupeStore,
+// and reports the outcome to the OutcomeReporter
+func handleHTTPRequest(ctx context.Context, body payload, headers http.Header, data ConnectorMetadata, logger *zap.Logger) (*http.Response, InvocationReport, error) {
+	start := now()
+	if data.AdaptiveLogging != nil {
+		logger = data.AdaptiveLogging.wrap(logger)
+	}
+	if data.Limits != nil && data.Limits.isReached() {
+		report := InvocationReport{Outcome: OutcomeIncomplete}
+		reportOutcome(report, data, logger)
+		return nil, report, ErrLimitReached
+	}
+	if data.MaxMessageAge > 0 {
+		if age, ok := data.messageAge(headers); ok && age > data.MaxMessageAge {
+			report := InvocationReport{Outcome: OutcomeFailure, Duration: since(start)}
+			err := reportStale(body, headers, age, data, logger)
+			reportOutcome(report, data, logger)
+			return nil, report, err
+		}
+	}
+	var fingerprint string
+	if data.DedupeStore != nil && !body.once {
+		fingerprint = MessageFingerprint(body.message())
+		if seen, err := data.DedupeStore.Seen(fingerprint); err != nil {
+			logger.Warn("failed to look up message fingerprint, invoking function anyway",
+				zap.Error(err),
+				zap.String("source", data.SourceName))
+		} else if seen {
+			report := InvocationReport{Outcome: OutcomeDuplicate, Duration: since(start)}
+			reportOutcome(report, data, logger)
+			return nil, report, ErrDuplicateMessage
+		}
+	}
+	failures, _ := data.DedupeStore.(FailureStore)
+	if fingerprint != "" && failures != nil && data.PoisonThreshold > 0 {
+		if count, err := failures.Failures(fingerprint); err != nil {
+			logger.Warn("failed to look up message failures, invoking function anyway",
+				zap.Error(err),
+				zap.String("source", data.SourceName))
+		} else if count >= data.PoisonThreshold {
+			report := InvocationReport{Outcome: OutcomeFailure, Duration: since(start)}
+			err := reportPoison(body, headers, count, data, logger)
+			reportOutcome(report, data, logger)
+			return nil, report, err
+		}
+	}
+
+	if data.CircuitBreaker != nil {
+		// Streams can't be replayed and replayed messages are already queued, neither is queued again
+		queueable := data.OutboundQueue != nil && !body.once && !body.queued
+		if queueable && (data.OutboundQueue.Len() > 0 || !data.CircuitBreaker.Allow()) {
+			// Queue behind the messages already queued to preserve their order
+			report := InvocationReport{Outcome: OutcomeQueued}
+			err := data.OutboundQueue.push(body.message(), headers)
+			if err == nil {
+				report.Duration = since(start)
+				reportOutcome(report, data, logger)
+				return nil, report, ErrMessageQueued
+			}
+			logger.Warn("failed to queue message",
+				zap.Error(err),
+				zap.String("source", data.SourceName))
+			report = InvocationReport{Outcome: OutcomeIncomplete, Duration: since(start)}
+			reportOutcome(report, data, logger)
+			return nil, report, ErrCircuitOpen
+		} else if !queueable && !data.CircuitBreaker.Allow() {
+			report := InvocationReport{Outcome: OutcomeIncomplete, Duration: since(start)}
+			reportOutcome(report, data, logger)
+			return nil, report, ErrCircuitOpen
+		}
+	}
+
+	if data.PriorityLimits != nil {
+		release, err := data.acquirePriority(ctx, headers)
+		if err != nil {
+			report := InvocationReport{Outcome: OutcomeIncomplete, Duration: since(start)}
+			reportOutcome(report, data, logger)
+			return nil, report, err
+		}
+		defer release()
+	}
+
+	ctx, trace := withTrace(ctx, data)
+	resp, report, err := invokeThroughBreaker(ctx, body, headers, data, logger)
+	report.Duration = since(start)
+	if report.Outcome == OutcomeFailure && report.ErrorKind == "" {
+		report.ErrorKind = data.errorKindFor(report.StatusCode)
+	}
+	if data.Limits != nil && report.Outcome != OutcomeIncomplete {
+		data.Limits.count(body.length)
+	}
+	if fingerprint != "" && report.Outcome == OutcomeSuccess {
+		if err := data.DedupeStore.Record(fingerprint, data.DedupeTTL); err != nil {
+			logger.Warn("failed to record message fingerprint",
+				zap.Error(err),
+				zap.String("source", data.SourceName))
+		}
+	}
+	if fingerprint != "" && failures != nil && data.PoisonThreshold > 0 {
+		trackFailures(failures, fingerprint, report.Outcome, data, logger)
+	}
+	if data.Events != nil {
+		data.Events.observe(report, data, logger)
+	}
+	if data.AdaptiveLogging != nil {
+		data.AdaptiveLogging.observe(report.Outcome, logger)
+	}
+	writeTrace(trace, start, report, data, logger)
+	reportOutcome(report, data, logger)
+	return resp, report, err
+}
+
+// invokeThroughBreaker invokes the function, recording the outcome in the CircuitBreaker if configured.
+// Only failures without a response or with a 5xx response count towards opening the breaker.
+func invokeThroughBreaker(ctx context.Context, body payload, headers http.Header, data ConnectorMetadata, logger *zap.Logger) (*http.Response, InvocationReport, error) {
+	resp, report, err := invokeWithTimeout(ctx, body, headers, data, logger)
+	if data.CircuitBreaker == nil {
+		return resp, report, err
+	}
+	switch {
+	case report.Outcome == OutcomeIncomplete || err == errBatchTooLarge:
+		// A batch rejected as too large is split, its parts deciding the state of the breaker
+		data.CircuitBreaker.Abort()
+	case report.Outcome == OutcomeFailure && (report.StatusCode == 0 || report.StatusCode >= 500):
+		if data.CircuitBreaker.Failure() {
+			logger.Warn("circuit breaker opened",
+				zap.String("http_endpoint", report.Endpoint),
+				zap.String("source", data.SourceName))
+			if data.Events != nil {
+				data.Events.breakerOpened(report.Endpoint, data, logger)
+			}
+		}
+	default:
+		data.CircuitBreaker.Success()
+	}
+	return resp, report, err
+}
+
+// trackFailures counts the consecutive failures of the message identified by fingerprint according to outcome
+func trackFailures(failures FailureStore, fingerprint string, outcome Outcome, data ConnectorMetadata, logger *zap.Logger) {
+	var err error
+	switch outcome {
+	case OutcomeSuccess:
+		err = failures.ResetFailures(fingerprint)
+	case OutcomeFailure:
+		var count int
+		if count, err = failures.RecordFailure(fingerprint, data.DedupeTTL); err == nil && count == data.PoisonThreshold {
+			logger.Warn("message failed repeatedly, further deliveries will be dead-lettered",
+				zap.Int("failures", count),
+				zap.String("source", data.SourceName))
+		}
+	}
+	if err != nil {
+		logger.Warn("failed to record message failure",
+			zap.Error(err),
+			zap.String("source", data.SourceName))
+	}
+}
+
+// reportPoison reports a message dead-lettered without invoking the function after count consecutive failures
+func reportPoison(body payload, headers http.Header, count int, data ConnectorMetadata, logger *zap.Logger) error {
+	return reportError(ErrorResponse{
+		Message:      fmt.Sprintf("message failed %v consecutive deliveries, dead-lettered without invoking the function", count),
+		HttpEndpoint: data.endpoints()[0],
+		Source:       data.SourceName,
+		Request:      body.message(),
+		Coordinates:  data.SourceCoordinates(headers),
+		ErrorKind:    ErrorKindPoison,
+	}, data, logger)
+}
+
+// invokeWithTimeout invokes the function bounding the whole invocation, including reading the response body, by RequestTotalTimeout if set
+func invokeWithTimeout(ctx context.Context, body payload, headers http.Header, data ConnectorMetadata, logger *zap.Logger) (*http.Response, InvocationReport, error) {
+	if data.RequestTotalTimeout <= 0 {
+		return invokeWithRetries(ctx, body, headers, data, logger)
+	}
+	ctx, cancel := context.WithTimeout(ctx, data.RequestTotalTimeout)
+	resp, report, err := invokeWithRetries(ctx, body, headers, data, logger)
+	if resp == nil {
+		cancel()
+		return nil, report, err
+	}
+	// The response body is read after returning, so the context is only released once it is closed
+	resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+	return resp, report, err
+}
+
+// cancelOnClose cancels a context once the body is closed
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
+
+func invokeWithRetries(ctx context.Context, body payload, headers http.Header, data ConnectorMetadata, logger *zap.Logger) (*http.Response, InvocationReport, error) {
+
+	maxRetries := data.maxRetries(logger)
+	if body.once {
+		maxRetries = 0
+	}
+	incoming := headers
+	coordinates := data.SourceCoordinates(incoming)
+	body, headers, err := withBodyHeaders(body, incoming, data)
+	if err != nil {
+		logger.Debug("headers not injected into the request body",
+			zap.Error(err),
+			zap.String("source", data.SourceName))
+	}
+	if headers, err = withBodyFieldHeaders(body, headers, data); err != nil {
+		logger.Debug("body fields not extracted into headers",
+			zap.Error(err),
+			zap.String("source", data.SourceName))
+	}
+	headers = mapHeaders(headers, data.HeaderMapping)
+	headers = mergeDefaultHeaders(headers, data.DefaultHeaders, data.DefaultHeadersPolicy)
+	uncompressed := headers
+	if body, headers, err = withCompression(body, headers, data); err != nil {
+		logger.Debug("request body not compressed",
+			zap.Error(err),
+			zap.String("source", data.SourceName))
+	}
+	report := InvocationReport{Outcome: OutcomeFailure}
+	endpoints := data.endpoints()
+	endpoint := endpoints[0]
+	start := now()
+	// Failures report the original message even once reduced by OnPayloadTooLarge
+	message := body.message
+	newErrorResponse := func() ErrorResponse {
+		return ErrorResponse{
+			HttpEndpoint: endpoint,
+			Source:       data.SourceName,
+			Request:      message(),
+			Coordinates:  coordinates,
+			LatencyMs:    since(start).Milliseconds(),
+		}
+	}
+	var subpath string
+	if data.EndpointPathHeader != "" {
+		subpath = incoming.Get(data.EndpointPathHeader)
+		if err := validateSubpath(subpath); err != nil {
+			return nil, report, errors.Wrapf(err, "failed to build HTTP request to invoke function. http_endpoint: %v, source: %v", endpoint, data.SourceName)
+		}
+	}
+	var resp *http.Response
+	// violation is why the last successful response wasn't accepted, if it wasn't
+	var violation *responseViolation
+	// reduced tells whether the body was replaced by OnPayloadTooLarge
+	var reduced bool
+	var timeline retryTimeline
+	for attempt := 0; attempt <= maxRetries; attempt++ {
+		if ctx.Err() != nil {
+			return incomplete(ctx, report, endpoint, data, logger)
+		}
+
+		// Fail over to the next endpoint on every attempt
+		endpoint = endpoints[attempt%len(endpoints)]
+		client, err := data.clientFor(endpoint)
+		if err != nil {
+			return nil, report, errors.Wrapf(err, "failed to configure HTTP client to invoke function. http_endpoint: %v, source: %v", endpoint, data.SourceName)
+		}
+		if data.RateLimitThrottle {
+			waitStart := now()
+			if delay := rateLimitDelay(endpoint, waitStart); delay > 0 {
+				logger.Debug("throttling requests according to the endpoint rate limit",
+					zap.Duration("delay", delay),
+					zap.String("http_endpoint", endpoint),
+					zap.String("source", data.SourceName))
+				err := sleepContext(ctx, delay)
+				limiterWaitSeconds.WithLabelValues(data.SourceName, limiterRateLimit).Observe(since(waitStart).Seconds())
+				if err != nil {
+					return incomplete(ctx, report, endpoint, data, logger)
+				}
+			} else {
+				limiterWaitSeconds.WithLabelValues(data.SourceName, limiterRateLimit).Observe(0)
+			}
+		}
+
+		// Create request
+		var req *http.Request
+		var reqBody io.ReadCloser = http.NoBody
+		if body.length != 0 {
+			reqBody = toReadCloser(body.open())
+		}
+		target, err := joinEndpointPath(endpoint, subpath)
+		if err == nil {
+			req, err = http.NewRequest("POST", target, reqBody)
+		}
+		if err != nil {
+			reqBody.Close()
+			return nil, report, errors.Wrapf(err, "failed to create HTTP request to invoke function. http_endpoint: %v, source: %v", endpoint, data.SourceName)
+		}
+		req = req.WithContext(ctx)
+		if data.ForceHTTP10 {
+			req.Close = true
+		} else if data.WarmupBeforeSend {
+			warmup(ctx, client, endpoint, target, data, logger)
+			req = req.WithContext(traceConnections(ctx, endpoint))
+		}
+		if data.ConnMaxLifetime > 0 {
+			req = req.WithContext(retireExpiredConns(req.Context(), data.ConnMaxLifetime))
+		}
+		var wrote int32
+		if data.SkipPostWriteTimeoutRetry {
+			req = req.WithContext(traceWrites(req.Context(), &wrote))
+		}
+		if reqBody != http.NoBody {
+			if data.ChunkedTransfer && body.once || body.length < 0 {
+				// Streams and bodies without a known length are sent using chunked transfer encoding
+				req.ContentLength = -1
+				req.TransferEncoding = []string{"chunked"}
+			} else {
+				req.ContentLength = body.length
+			}
+			if !body.once {
+				req.GetBody = func() (io.ReadCloser, error) { return toReadCloser(body.open()), nil }
+			}
+		}
+
+		// Add headers
+		for key, vals := range headers {
+			if data.JoinHeaders && len(vals) > 1 {
+				req.Header.Add(key, strings.Join(vals, ", "))
+				continue
+			}
+			for _, val := range vals {
+				req.Header.Add(key, val)
+			}
+		}
+		if data.InstanceHeader != "" && data.Instance != "" {
+			req.Header.Set(data.InstanceHeader, data.Instance)
+		}
+		if data.DeadlineHeader != "" {
+			if deadline, ok := ctx.Deadline(); ok {
+				req.Header.Set(data.DeadlineHeader, formatDeadline(data.DeadlineHeader, deadline))
+			}
+		}
+		if data.ContentTypeHeader != "" {
+			if contentType := headers.Get(data.ContentTypeHeader); contentType != "" {
+				req.Header.Set("Content-Type", contentType)
+			}
+		}
+		if data.NormalizeContentType {
+			if req.Header.Get("Content-Type") == "" && data.ContentType != "" {
+				req.Header.Set("Content-Type", data.ContentType)
+			}
+			if contentType := req.Header.Get("Content-Type"); contentType != "" {
+				req.Header.Set("Content-Type", normalizeContentType(contentType))
+			}
+		}
+		if attempt == 0 && data.ShadowEndpoint != "" {
+			sendShadow(req, body, subpath, data, logger)
+		}
+
+		if data.Hooks.BeforeAttempt != nil {
+			attempt := attempt
+			if err := callHook("BeforeAttempt", logger, func() error { return data.Hooks.BeforeAttempt(req, attempt) }); err != nil {
+				req.Body.Close()
+				return nil, report, errors.Wrapf(err, "function invocation aborted. http_endpoint: %v, source: %v", endpoint, data.SourceName)
+			}
+		}
+
+		// Make the request
+		report.Attempts++
+		report.Endpoint = endpoint
+		report.StatusCode = 0
+		violation = nil
+		attemptStart := now()
+		if data.HedgeDelay > 0 {
+			resp, err = doHedged(client, req, data.HedgeDelay, data.hedgeLimit())
+		} else {
+			resp, err = client.Do(req)
+		}
+		if ctx.Err() == nil {
+			observeAttempt(resp, endpoint, since(attemptStart), data)
+		}
+		traceAttempt(ctx, attemptStart, endpoint, resp, err)
+		if data.LogRetryTimeline {
+			timeline.record(attemptStart, endpoint, resp, err)
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return incomplete(ctx, report, endpoint, data, logger)
+			}
+			if data.WarmupBeforeSend {
+				// The connection may have been dropped, make sure the next attempt warms up again
+				setWarm(endpoint, false)
+			}
+			logger.Error("sending function invocation request failed",
+				zap.Error(err),
+				zap.String("http_endpoint", endpoint),
+				zap.String("source", data.SourceName))
+			if data.AbortOnTLSTrustError && isTLSTrustError(err) {
+				errorResponse := newErrorResponse()
+				errorResponse.Status = http.StatusServiceUnavailable
+				errorResponse.Message = fmt.Sprintf("server certificate not trusted, not retried: %v", err)
+				errorResponse.ErrorKind = ErrorKindTLS
+				report.ErrorKind = ErrorKindTLS
+				return nil, report, reportError(errorResponse, data, logger)
+			}
+			if redirect, ok := asRedirectError(err); ok {
+				// The redirects would be followed the same way on every retry
+				errorResponse := newErrorResponse()
+				errorResponse.Status = http.StatusBadGateway
+				if redirect.loop {
+					errorResponse.Status = http.StatusLoopDetected
+				}
+				errorResponse.Message = fmt.Sprintf("function invocation aborted, not retried: %v", redirect)
+				errorResponse.ErrorKind = ErrorKindRedirect
+				report.ErrorKind = ErrorKindRedirect
+				return nil, report, reportError(errorResponse, data, logger)
+			}
+			if data.SkipPostWriteTimeoutRetry && atomic.LoadInt32(&wrote) == 1 && isTimeout(err) {
+				// The function may have processed the request, retrying risks a duplicate
+				errorResponse := newErrorResponse()
+				errorResponse.Status = http.StatusGatewayTimeout
+				errorResponse.Message = "function invocation timed out after the request was sent; not retried to avoid a duplicate"
+				errorResponse.ErrorKind = ErrorKindTransport
+				return nil, report, reportError(errorResponse, data, logger)
+			}
+		}
+		if resp != nil {
+			report.StatusCode = resp.StatusCode
+			if data.RateLimitThrottle {
+				observeRateLimit(endpoint, resp.Header, now())
+			}
+			applyDefaultContentType(resp, data)
+			if resp.ProtoMajor == 1 && resp.ProtoMinor == 0 && !data.ForceHTTP10 {
+				logger.Debug("endpoint responded with HTTP/1.0, consider enabling HTTP_FORCE_HTTP10",
+					zap.String("http_endpoint", endpoint),
+					zap.String("source", data.SourceName))
+			}
+			if handler, ok := data.Hooks.StatusHandlers[resp.StatusCode]; ok {
+				if err := callHook("StatusHandler", logger, func() error { return handler(resp) }); err != nil {
+					resp.Body.Close()
+					return nil, report, errors.Wrapf(err, "function invocation aborted. http_endpoint: %v, source: %v", endpoint, data.SourceName)
+				}
+			}
+			if resp.StatusCode == http.StatusRequestEntityTooLarge {
+				if body.splittable {
+					resp.Body.Close()
+					report.Outcome = OutcomeFailure
+					return nil, report, errBatchTooLarge
+				}
+				if data.Hooks.OnPayloadTooLarge != nil && !body.once && !reduced {
+					if smaller, smallerHeaders, ok := reducePayload(body, uncompressed, data, logger); ok {
+						logger.Info("payload too large, retrying with the reduced payload",
+							zap.Int64("length", body.length),
+							zap.Int64("reduced_length", smaller.length),
+							zap.String("http_endpoint", endpoint),
+							zap.String("source", data.SourceName))
+						resp.Body.Close()
+						body, headers, reduced = smaller, smallerHeaders, true
+						// The reduced payload is sent right away on an attempt of its own
+						maxRetries++
+						continue
+					}
+				}
+				if reduced || body.batched {
+					// Still too large once reduced or split down to a single message, retrying won't help
+					report.Outcome = OutcomeFailure
+					return nil, report, responseError(resp, newErrorResponse(), data, logger)
+				}
+			}
+			if outcome, retry := evaluateResponse(resp, data); !retry {
+				if outcome == OutcomeSuccess && data.alreadyProcessed(resp) {
+					// The function had kept the outcome of processing the message, whatever it responds now
+					report.Outcome = outcome
+					report.Replayed = true
+					return resp, report, nil
+				}
+				if outcome == OutcomeSuccess {
+					if violation = checkResponse(resp, data); violation == nil {
+						// Success, quit retrying
+						report.Outcome = outcome
+						if data.IdempotencyReplayHeader != "" {
+							report.Replayed, _ = strconv.ParseBool(resp.Header.Get(data.IdempotencyReplayHeader))
+						}
+						return resp, report, nil
+					}
+					if !violation.retryable {
+						report.ErrorKind = violation.kind
+						return nil, report, violationError(resp, violation, newErrorResponse(), data, logger)
+					}
+				} else {
+					report.Outcome = outcome
+					return nil, report, responseError(resp, newErrorResponse(), data, logger)
+				}
+			}
+		}
+
+		if attempt == maxRetries {
+			break
+		}
+		if data.Hooks.OnRetry != nil {
+			attempt, resp, err := attempt, resp, err
+			if err := callHook("OnRetry", logger, func() error { data.Hooks.OnRetry(attempt, resp, err); return nil }); err != nil {
+				if resp != nil {
+					resp.Body.Close()
+				}
+				return nil, report, errors.Wrapf(err, "function invocation aborted. http_endpoint: %v, source: %v", endpoint, data.SourceName)
+			}
+		}
+		if resp != nil {
+			// Release the failed response before retrying
+			resp.Body.Close()
+		}
+		delay := data.retryDelay(attempt + 1)
+		timeline.delayed(delay)
+		if err := sleepContext(ctx, delay); err != nil {
+			return incomplete(ctx, report, endpoint, data, logger)
+		}
+	}
+
+	logRetryTimeline(timeline, data, logger)
+
+	if resp == nil {
+		errorResponce := newErrorResponse()
+		errorResponce.Status = 503
+		errorResponce.Message = "every function invocation retry failed; final retry gave empty response."
+		errorResponce.ErrorKind = ErrorKindTransport
+		return nil, report, reportError(errorResponce, data, logger)
+	}
+	if violation != nil {
+		report.ErrorKind = violation.kind
+		return nil, report, violationError(resp, violation, newErrorResponse(), data, logger)
+	}
+	return nil, report, responseError(resp, newErrorResponse(), data, logger)
+}
+
+// reducePayload returns the payload reduced by the OnPayloadTooLarge hook and the headers to send along, compressing
+// it like the original, or false if the hook declined to reduce it
+func reducePayload(body payload, headers http.Header, data ConnectorMetadata, logger *zap.Logger) (payload, http.Header, bool) {
+	var message []byte
+	var retry bool
+	if err := callHook("OnPayloadTooLarge", logger, func() error {
+		message, retry = data.Hooks.OnPayloadTooLarge([]byte(body.message()))
+		return nil
+	}); err != nil || !retry {
+		return body, headers, false
+	}
+	reduced := payload{
+		open:    func() io.Reader { return bytes.NewReader(message) },
+		length:  int64(len(message)),
+		message: func() string { return string(message) },
+	}
+	reduced, headers, err := withCompression(reduced, headers, data)
+	if err != nil {
+		logger.Debug("request body not compressed",
+			zap.Error(err),
+			zap.String("source", data.SourceName))
+	}
+	return reduced, headers, true
+}
+
+// toReadCloser returns r as an io.ReadCloser, keeping its Close method if it has one
+func toReadCloser(r io.Reader) io.ReadCloser {
+	if rc, ok := r.(io.ReadCloser); ok {
+		return rc
+	}
+	return ioutil.NopCloser(r)
+}
+
+// applyDefaultContentType sets the Content-Type of a response lacking one to DefaultResponseContentType if configured,
+// so that forwarding or parsing it behaves deterministically
+func applyDefaultContentType(resp *http.Response, data ConnectorMetadata) {
+	if data.DefaultResponseContentType != "" && resp.Header.Get("Content-Type") == "" {
+		if resp.Header == nil {
+			resp.Header = make(http.Header)
+		}
+		resp.Header.Set("Content-Type", data.DefaultResponseContentType)
+	}
+}
+
+// normalizeContentType returns contentType with a lowercase media type and canonically formatted parameters,
+// or contentType unchanged if it can't be parsed
+func normalizeContentType(contentType string) string {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return contentType
+	}
+	if normalized := mime.FormatMediaType(mediaType, params); normalized != "" {
+		return normalized
+	}
+	return contentType
+}
+
+// evaluateResponse decides how the response of an attempt ends the invocation: retry reports whether another attempt
+// should be made, otherwise outcome is the final outcome of the invocation
+func evaluateResponse(resp *http.Response, data ConnectorMetadata) (outcome Outcome, retry bool) {
+	if data.alreadyProcessed(resp) {
+		return OutcomeSuccess, false
+	}
+	if data.ResponseActionField != "" {
+		if outcome, ok := responseAction(resp, data.ResponseActionField); ok {
+			return outcome, false
+		}
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 && !containsStatus(data.Retryable2xx, resp.StatusCode) {
+		return OutcomeSuccess, false
+	}
+	if data.NoRetryHeader != "" {
+		if noRetry, _ := strconv.ParseBool(resp.Header.Get(data.NoRetryHeader)); noRetry {
+			return OutcomeFailure, false
+		}
+	}
+	return OutcomeFailure, true
+}
+
+// alreadyProcessed tells whether the function signaled with resp that it had already processed the message
+func (m ConnectorMetadata) alreadyProcessed(resp *http.Response) bool {
+	if containsStatus(m.AlreadyProcessedStatuses, resp.StatusCode) {
+		return true
+	}
+	if m.AlreadyProcessedHeader == "" {
+		return false
+	}
+	processed, _ := strconv.ParseBool(resp.Header.Get(m.AlreadyProcessedHeader))
+	return processed
+}
+
+// containsStatus tells whether status is listed in statuses
+func containsStatus(statuses []int, status int) bool {
+	for _, s := range statuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// responseAction looks up the action requested by the function in field of a JSON response body, leaving the body readable
+func responseAction(resp *http.Response, field string) (Outcome, bool) {
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return 0, false
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return 0, false
+	}
+	action, _ := fields[field].(string)
+	switch strings.ToLower(action) {
+	case "ack":
+		return OutcomeSuccess, true
+	case "retry":
+		return OutcomeRetry, true
+	case "dead-letter", "deadletter", "dead_letter":
+		return OutcomeFailure, true
+	default:
+		return 0, false
+	}
+}
+
+// responseError completes errorBody with the failed response and returns it as an error, closing the response body
+func responseError(resp *http.Response, errorBody ErrorResponse, data ConnectorMetadata, logger *zap.Logger) error {
+	defer resp.Body.Close()
+	errorBody.Status = resp.StatusCode
+	errorBody.Message = "request returned failure"
+	if streamer, ok := data.ErrorWriter.(ErrorBodyStreamer); ok {
+		errorBody.ErrorKind = data.errorKindFor(resp.StatusCode)
+		errorBody.Headers = stripHeaders(resp.Header, data.ResponseHeaderDenylist)
+		if errorBody.Version == "" {
+			errorBody.Version = Version
+		}
+		if errorBody.Instance == "" {
+			errorBody.Instance = data.Instance
+		}
+		streamErrorBody(streamer, errorBody, resp.Body, data, logger)
+		// the streamer published the error response along with its body
+		data.ErrorWriter = nil
+		return reportError(errorBody, data, logger)
+	}
+
+	respBody, _ := readAllPooled(resp.Body)
+	if data.ErrorMessagePath != "" {
+		if message, ok := lookupJSONString(respBody, data.ErrorMessagePath); ok && message != "" {
+			errorBody.Message = message
+		}
+	}
+	errorBody.ErrorKind = data.errorKindFor(resp.StatusCode)
+	truncated, cut := truncateErrorBody(respBody, data)
+	errorBody.setBody(truncated)
+	errorBody.BodyTruncated = cut
+	errorBody.Headers = stripHeaders(resp.Header, data.ResponseHeaderDenylist)
+	return reportError(errorBody, data, logger)
+}
+
+// responseViolation tells why a successful response wasn't accepted
+type responseViolation struct {
+	kind      ErrorKind
+	retryable bool
+	message   string
+}
+
+// checkResponse checks that the successful response resp holds RequiredResponseHeaders and conforms to
+// ResponseSchema, leaving its body readable
+func checkResponse(resp *http.Response, data ConnectorMetadata) *responseViolation {
+	for _, header := range data.RequiredResponseHeaders {
+		if resp.Header.Get(header) == "" {
+			return &responseViolation{
+				kind:      ErrorKindMissingHeader,
+				retryable: data.RequiredResponseHeadersRetryable,
+				message:   fmt.Sprintf("response lacks required header %v", header),
+			}
+		}
+	}
+	if err := validateResponse(resp, data); err != nil {
+		return &responseViolation{
+			kind:      ErrorKindSchema,
+			retryable: data.ResponseSchemaRetryable,
+			message:   fmt.Sprintf("response violates the schema: %v", err),
+		}
+	}
+	return nil
+}
+
+// violationError completes errorBody with the successful response which wasn't accepted and returns it as an error,
+// closing the response body
+func violationError(resp *http.Response, violation *responseViolation, errorBody ErrorResponse, data ConnectorMetadata, logger *zap.Logger) error {
+	defer resp.Body.Close()
+	respBody, _ := readAllPooled(resp.Body)
+
+	errorBody.Status = resp.StatusCode
+	errorBody.Message = violation.message
+	errorBody.ErrorKind = violation.kind
+	truncated, cut := truncateErrorBody(respBody, data)
+	errorBody.setBody(truncated)
+	errorBody.BodyTruncated = cut
+	errorBody.Headers = stripHeaders(resp.Header, data.ResponseHeaderDenylist)
+	return reportError(errorBody, data, logger)
+}
+
+// errorWriterMu serializes writes to ErrorWriter so that lines of concurrent invocations don't interleave
+var errorWriterMu sync.Mutex
+
+// reportError logs errorResponse, writes it as a JSON line to data.ErrorWriter and buffers it in data.ErrorBuffer if set
+// and returns it as an error
+func reportError(errorResponse ErrorResponse, data ConnectorMetadata, logger *zap.Logger) error {
+	if errorResponse.Version == "" {
+		errorResponse.Version = Version
+	}
+	if errorResponse.Instance == "" {
+		errorResponse.Instance = data.Instance
+	}
+	jsonString, _ := json.Marshal(errorResponse)
+	logger.Info(string(jsonString))
+	if data.RecentErrors != nil {
+		data.RecentErrors.add(errorResponse)
+	}
+	if data.ErrorBuffer != nil && data.ErrorBuffer.Add(errorResponse) {
+		logger.Warn("error buffer full, dropped an error response", zap.Uint64("dropped", data.ErrorBuffer.Dropped()))
+	}
+	if data.ErrorWriter != nil {
+		errorWriterMu.Lock()
+		_, err := data.ErrorWriter.Write(append(jsonString, '\n'))
+		errorWriterMu.Unlock()
+		if err != nil {
+			logger.Warn("failed to write error response", zap.Error(err))
+		}
+	}
+	return fmt.Errorf(string(jsonString))
+}
+
+// incomplete returns the report and error for an invocation interrupted by ctx being done
+func incomplete(ctx context.Context, report InvocationReport, endpoint string, data ConnectorMetadata, logger *zap.Logger) (*http.Response, InvocationReport, error) {
+	report.Outcome = OutcomeIncomplete
+	logger.Warn("function invocation interrupted before completion",
+		zap.Error(ctx.Err()),
+		zap.Int("attempts", report.Attempts),
+		zap.String("http_endpoint", endpoint),
+		zap.String("source", data.SourceName))
+	return nil, report, errors.Wrapf(ctx.Err(), "function invocation interrupted. http_endpoint: %v, source: %v", endpoint, data.SourceName)
+}
@@ -0,0 +1,917 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestInvokeHTTPRequestCancelledMidRetry(t *testing.T) {
+	tests := []struct {
+		name    string
+		backoff time.Duration
+		cancel  func(cancel context.CancelFunc) Option
+	}{
+		{
+			name:    "while backing off",
+			backoff: time.Hour,
+			cancel: func(cancel context.CancelFunc) Option {
+				return WithHooks(Hooks{OnRetry: func(int, *http.Response, error) { cancel() }})
+			},
+		},
+		{
+			name: "before the next attempt",
+			cancel: func(cancel context.CancelFunc) Option {
+				return WithHooks(Hooks{BeforeAttempt: func(_ *http.Request, attempt int) error {
+					if attempt == 1 {
+						cancel()
+					}
+					return nil
+				}})
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, requests := statusServer(t, http.StatusInternalServerError)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			data := testMetadata(t, srv.URL, WithMaxRetries(3), WithRetryBackoff(tt.backoff, 0, 0), tt.cancel(cancel))
+			_, report, err := InvokeHTTPRequest(ctx, "{}", http.Header{}, data, zap.NewNop())
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			if report.Outcome != OutcomeIncomplete {
+				t.Errorf("outcome = %v, want %v", report.Outcome, OutcomeIncomplete)
+			}
+			if *requests != 1 {
+				t.Errorf("server received %v requests, want 1", *requests)
+			}
+		})
+	}
+}
+
+func TestInvokeHTTPRequestCancelledInFlight(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	srv := newServer(t, func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		cancel()
+		<-r.Context().Done()
+	})
+	data := testMetadata(t, srv.URL, WithMaxRetries(3))
+	_, report, err := InvokeHTTPRequest(ctx, "{}", http.Header{}, data, zap.NewNop())
+	if err == nil || report.Outcome != OutcomeIncomplete {
+		t.Errorf("outcome = %v with error %v, want %v", report.Outcome, err, OutcomeIncomplete)
+	}
+}
+
+func TestOutcomeString(t *testing.T) {
+	tests := []struct {
+		outcome Outcome
+		want    string
+	}{
+		{OutcomeSuccess, "success"},
+		{OutcomeFailure, "failure"},
+		{OutcomeIncomplete, "incomplete"},
+		{OutcomeRetry, "retry"},
+		{OutcomeDuplicate, "duplicate"},
+		{OutcomeQueued, "queued"},
+		{Outcome(42), "Outcome(42)"},
+	}
+	for _, tt := range tests {
+		if got := tt.outcome.String(); got != tt.want {
+			t.Errorf("Outcome(%d).String() = %q, want %q", int(tt.outcome), got, tt.want)
+		}
+	}
+}
+
+func TestResponseActionField(t *testing.T) {
+	tests := []struct {
+		name         string
+		status       int
+		body         string
+		want         Outcome
+		wantRequests int32
+	}{
+		{name: "ack overrides failure", status: http.StatusInternalServerError, body: `{"action":"ack"}`, want: OutcomeSuccess, wantRequests: 1},
+		{name: "retry overrides success", status: http.StatusOK, body: `{"action":"retry"}`, want: OutcomeRetry, wantRequests: 1},
+		{name: "dead-letter", status: http.StatusOK, body: `{"action":"dead-letter"}`, want: OutcomeFailure, wantRequests: 1},
+		{name: "dead_letter", status: http.StatusOK, body: `{"action":"DEAD_LETTER"}`, want: OutcomeFailure, wantRequests: 1},
+		{name: "unknown action uses status", status: http.StatusOK, body: `{"action":"later"}`, want: OutcomeSuccess, wantRequests: 1},
+		{name: "non JSON body uses status", status: http.StatusInternalServerError, body: `oops`, want: OutcomeFailure, wantRequests: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var requests int32
+			srv := newServer(t, func(w http.ResponseWriter, r *http.Request) {
+				atomic.AddInt32(&requests, 1)
+				w.WriteHeader(tt.status)
+				w.Write([]byte(tt.body))
+			})
+			data := testMetadata(t, srv.URL, WithMaxRetries(1), WithResponseActionField("action"))
+			resp, report, err := InvokeHTTPRequest(context.Background(), "{}", http.Header{}, data, zap.NewNop())
+			if report.Outcome != tt.want {
+				t.Errorf("outcome = %v, want %v", report.Outcome, tt.want)
+			}
+			if (err == nil) != (tt.want == OutcomeSuccess) {
+				t.Errorf("error = %v with outcome %v", err, report.Outcome)
+			}
+			if err == nil {
+				// The body stays readable once the action was looked up
+				if body, _ := ResponseString(resp); body != tt.body {
+					t.Errorf("body = %q, want %q", body, tt.body)
+				}
+			}
+			if requests != tt.wantRequests {
+				t.Errorf("server received %v requests, want %v", requests, tt.wantRequests)
+			}
+		})
+	}
+}
+
+func TestErrorWriter(t *testing.T) {
+	tests := []struct {
+		name      string
+		messages  int
+		status    int
+		wantLines int
+	}{
+		{name: "failures written", messages: 3, status: http.StatusBadRequest, wantLines: 3},
+		{name: "successes not written", messages: 2, status: http.StatusOK, wantLines: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, _ := statusServer(t, tt.status)
+			var out bytes.Buffer
+			data := testMetadata(t, srv.URL, WithErrorWriter(&out))
+			for i := 0; i < tt.messages; i++ {
+				if resp, err := HandleHTTPRequest(fmt.Sprintf(`{"n":%d}`, i), http.Header{}, data, zap.NewNop()); err == nil {
+					resp.Body.Close()
+				}
+			}
+			lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+			if out.Len() == 0 {
+				lines = nil
+			}
+			if len(lines) != tt.wantLines {
+				t.Fatalf("wrote %v lines, want %v: %q", len(lines), tt.wantLines, out.String())
+			}
+			for i, line := range lines {
+				var errorResponse ErrorResponse
+				if err := json.Unmarshal([]byte(line), &errorResponse); err != nil {
+					t.Fatalf("line %v isn't JSON: %v", i, err)
+				}
+				if errorResponse.Status != tt.status || errorResponse.Request != fmt.Sprintf(`{"n":%d}`, i) {
+					t.Errorf("line %v = %+v", i, errorResponse)
+				}
+			}
+		})
+	}
+}
+
+func TestNormalizeContentType(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{in: "application/JSON", want: "application/json"},
+		{in: "Application/Json ; charset=UTF-8", want: "application/json; charset=UTF-8"},
+		{in: "text/plain;charset=\"utf-8\"", want: "text/plain; charset=utf-8"},
+		{in: "multipart/form-data; Boundary=abc", want: "multipart/form-data; boundary=abc"},
+		{in: "not a media type;;", want: "not a media type;;"},
+	}
+	for _, tt := range tests {
+		if got := normalizeContentType(tt.in); got != tt.want {
+			t.Errorf("normalizeContentType(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestContentTypeHeaderNormalization(t *testing.T) {
+	tests := []struct {
+		name      string
+		normalize bool
+		incoming  string
+		want      string
+	}{
+		{name: "disabled sends incoming as is", normalize: false, incoming: "Application/JSON", want: "Application/JSON"},
+		{name: "disabled doesn't default", normalize: false, incoming: "", want: ""},
+		{name: "normalized", normalize: true, incoming: "Application/JSON ; Charset=UTF-8", want: "application/json; charset=UTF-8"},
+		{name: "defaulted to content type", normalize: true, incoming: "", want: "application/json"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got string
+			srv := newServer(t, func(w http.ResponseWriter, r *http.Request) { got = r.Header.Get("Content-Type") })
+			data := testMetadata(t, srv.URL, WithNormalizeContentType(tt.normalize))
+			headers := http.Header{}
+			if tt.incoming != "" {
+				headers.Set("Content-Type", tt.incoming)
+			}
+			resp, err := HandleHTTPRequest("{}", headers, data, zap.NewNop())
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			resp.Body.Close()
+			if got != tt.want {
+				t.Errorf("Content-Type = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPerMessageContentType(t *testing.T) {
+	tests := []struct {
+		name       string
+		configured string
+		normalize  bool
+		incoming   http.Header
+		want       string
+	}{
+		{name: "from header", configured: "X-Payload-Type", incoming: http.Header{"X-Payload-Type": {"application/avro"}}, want: "application/avro"},
+		{name: "overrides incoming content type", configured: "X-Payload-Type", incoming: http.Header{"X-Payload-Type": {"text/csv"}, "Content-Type": {"text/plain"}}, want: "text/csv"},
+		{name: "normalized", configured: "X-Payload-Type", normalize: true, incoming: http.Header{"X-Payload-Type": {"Text/CSV"}}, want: "text/csv"},
+		{name: "header missing", configured: "X-Payload-Type", normalize: true, incoming: http.Header{}, want: "application/json"},
+		{name: "not configured", normalize: true, incoming: http.Header{"X-Payload-Type": {"application/avro"}}, want: "application/json"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got string
+			srv := newServer(t, func(w http.ResponseWriter, r *http.Request) { got = r.Header.Get("Content-Type") })
+			data := testMetadata(t, srv.URL, WithContentTypeHeader(tt.configured), WithNormalizeContentType(tt.normalize))
+			resp, err := HandleHTTPRequest("{}", tt.incoming, data, zap.NewNop())
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			resp.Body.Close()
+			if got != tt.want {
+				t.Errorf("Content-Type = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReportedEndpoint(t *testing.T) {
+	down, _ := statusServer(t, http.StatusServiceUnavailable)
+	up, _ := statusServer(t, http.StatusOK)
+	tests := []struct {
+		name         string
+		endpoints    []string
+		retries      int
+		want         string
+		wantAttempts int
+		wantOutcome  Outcome
+	}{
+		{name: "first endpoint serves", endpoints: []string{up.URL, down.URL}, retries: 2, want: up.URL, wantAttempts: 1},
+		{name: "failed over", endpoints: []string{down.URL, up.URL}, retries: 2, want: up.URL, wantAttempts: 2},
+		{name: "last failed endpoint", endpoints: []string{down.URL}, retries: 1, want: down.URL, wantAttempts: 2, wantOutcome: OutcomeFailure},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := testMetadata(t, tt.endpoints[0], WithEndpoints(tt.endpoints...), WithMaxRetries(tt.retries))
+			resp, report, err := InvokeHTTPRequest(context.Background(), "{}", http.Header{}, data, zap.NewNop())
+			if err == nil {
+				resp.Body.Close()
+			}
+			if report.Outcome != tt.wantOutcome || report.Endpoint != tt.want || report.Attempts != tt.wantAttempts {
+				t.Errorf("report = %+v, want outcome %v from %v after %v attempts", report, tt.wantOutcome, tt.want, tt.wantAttempts)
+			}
+		})
+	}
+}
+
+func TestRequestTotalTimeout(t *testing.T) {
+	const timeout = 100 * time.Millisecond
+	tests := []struct {
+		name    string
+		delay   time.Duration
+		status  int
+		wantErr bool
+	}{
+		{name: "fast server", delay: 0, status: http.StatusOK},
+		{name: "slow server", delay: time.Minute, status: http.StatusOK, wantErr: true},
+		{name: "retries beyond timeout", delay: 30 * time.Millisecond, status: http.StatusInternalServerError, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newServer(t, func(w http.ResponseWriter, r *http.Request) {
+				ioutil.ReadAll(r.Body)
+				select {
+				case <-time.After(tt.delay):
+				case <-r.Context().Done():
+				}
+				w.WriteHeader(tt.status)
+			})
+			data := testMetadata(t, srv.URL, WithMaxRetries(MaxRetriesLimit), WithRequestTotalTimeout(timeout))
+			start := time.Now()
+			resp, err := HandleHTTPRequest("{}", http.Header{}, data, zap.NewNop())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("HandleHTTPRequest() error = %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil {
+				// The body stays readable until closed although the invocation returned
+				if _, err := ResponseString(resp); err != nil {
+					t.Errorf("failed to read response: %v", err)
+				}
+			}
+			if elapsed := time.Since(start); elapsed > 10*timeout {
+				t.Errorf("invocation returned after %v, want about %v", elapsed, timeout)
+			}
+		})
+	}
+}
+
+func TestJoinHeaders(t *testing.T) {
+	tests := []struct {
+		name string
+		join bool
+		want []string
+	}{
+		{name: "repeated by default", join: false, want: []string{"v1", "v2"}},
+		{name: "joined", join: true, want: []string{"v1, v2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			srv := newServer(t, func(w http.ResponseWriter, r *http.Request) { got = r.Header["X-Multi"] })
+			data := testMetadata(t, srv.URL, WithJoinHeaders(tt.join))
+			headers := http.Header{"X-Multi": {"v1", "v2"}, "X-Single": {"v"}}
+			resp, err := HandleHTTPRequest("{}", headers, data, zap.NewNop())
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			resp.Body.Close()
+			if strings.Join(got, "|") != strings.Join(tt.want, "|") {
+				t.Errorf("X-Multi = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDefaultResponseContentType(t *testing.T) {
+	tests := []struct {
+		name        string
+		defaultType string
+		sent        string
+		want        string
+	}{
+		{name: "absent header defaulted", defaultType: "application/json", want: "application/json"},
+		{name: "present header kept", defaultType: "application/json", sent: "text/csv", want: "text/csv"},
+		{name: "no default configured", want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newServer(t, func(w http.ResponseWriter, r *http.Request) {
+				if tt.sent != "" {
+					w.Header().Set("Content-Type", tt.sent)
+				} else {
+					// Keep the server from sniffing a Content-Type
+					w.Header()["Content-Type"] = nil
+				}
+				w.Write([]byte("{}"))
+			})
+			data := testMetadata(t, srv.URL, WithDefaultResponseContentType(tt.defaultType))
+			resp, err := HandleHTTPRequest("{}", http.Header{}, data, zap.NewNop())
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			resp.Body.Close()
+			if got := resp.Header.Get("Content-Type"); got != tt.want {
+				t.Errorf("Content-Type = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestZeroRetriesSingleAttempt(t *testing.T) {
+	secondary, secondaryRequests := statusServer(t, http.StatusOK)
+	tests := []struct {
+		name       string
+		maxRetries int
+		opts       func(endpoint string, breaker *CircuitBreaker, retries *int32) []Option
+	}{
+		{name: "backoff", opts: func(string, *CircuitBreaker, *int32) []Option {
+			return []Option{WithRetryBackoff(time.Hour, 2, 0)}
+		}},
+		{name: "immediate first retry", opts: func(string, *CircuitBreaker, *int32) []Option {
+			return []Option{WithRetryBackoff(time.Hour, 2, 0), WithRetryImmediateFirst(true)}
+		}},
+		{name: "OnRetry hook", opts: func(_ string, _ *CircuitBreaker, retries *int32) []Option {
+			return []Option{WithHooks(Hooks{OnRetry: func(int, *http.Response, error) { atomic.AddInt32(retries, 1) }})}
+		}},
+		{name: "failover endpoints", opts: func(endpoint string, _ *CircuitBreaker, _ *int32) []Option {
+			return []Option{WithEndpoints(endpoint, secondary.URL)}
+		}},
+		{name: "circuit breaker", opts: func(_ string, breaker *CircuitBreaker, _ *int32) []Option {
+			return []Option{WithCircuitBreaker(breaker)}
+		}},
+		{name: "negative max retries", maxRetries: -5, opts: func(string, *CircuitBreaker, *int32) []Option { return nil }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := useFakeClock(t)
+			srv, requests := statusServer(t, http.StatusServiceUnavailable)
+			breaker := NewCircuitBreaker(1, time.Minute)
+			var retries int32
+			data := testMetadata(t, srv.URL, tt.opts(srv.URL, breaker, &retries)...)
+			// Negative values are only accepted from the environment
+			data.MaxRetries = tt.maxRetries
+			done := make(chan struct{})
+			var report InvocationReport
+			go func() {
+				defer close(done)
+				_, report, _ = InvokeHTTPRequest(context.Background(), "{}", http.Header{}, data, zap.NewNop())
+			}()
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatalf("invocation still running with %v timers pending, want no backoff sleep", clock.Timers())
+			}
+			if report.Outcome != OutcomeFailure || report.Attempts != 1 || *requests != 1 {
+				t.Errorf("%v after %v attempts and %v requests, want a single failed attempt", report.Outcome, report.Attempts, *requests)
+			}
+			if retries != 0 || atomic.LoadInt32(secondaryRequests) != 0 {
+				t.Errorf("OnRetry called %v times and secondary endpoint invoked %v times, want none", retries, *secondaryRequests)
+			}
+			if tt.name == "circuit breaker" && breaker.State() != BreakerOpen {
+				t.Errorf("breaker %v after the failed attempt, want open", breaker.State())
+			}
+		})
+	}
+}
+
+// failingWriter fails every write
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) {
+	return 0, fmt.Errorf("sink full")
+}
+
+func TestInvokeHTTPRequestToSink(t *testing.T) {
+	large := bytes.Repeat([]byte("0123456789abcdef\x00\xff"), 1<<18)
+	tests := []struct {
+		name        string
+		status      int
+		sink        func(*bytes.Buffer) io.Writer
+		wantWritten int
+		wantErr     bool
+	}{
+		{name: "large response", status: http.StatusOK, sink: func(b *bytes.Buffer) io.Writer { return b }, wantWritten: len(large)},
+		{name: "failed invocation", status: http.StatusInternalServerError, sink: func(b *bytes.Buffer) io.Writer { return b }, wantErr: true},
+		{name: "failing sink", status: http.StatusOK, sink: func(*bytes.Buffer) io.Writer { return failingWriter{} }, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newServer(t, func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				w.Write(large)
+			})
+			data := testMetadata(t, srv.URL)
+			var sink bytes.Buffer
+			written, _, err := InvokeHTTPRequestToSink(context.Background(), "{}", http.Header{}, tt.sink(&sink), data, zap.NewNop())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("InvokeHTTPRequestToSink() error = %v, want error %v", err, tt.wantErr)
+			}
+			if written != int64(tt.wantWritten) {
+				t.Errorf("wrote %v bytes, want %v", written, tt.wantWritten)
+			}
+			if tt.wantWritten > 0 && !bytes.Equal(sink.Bytes(), large) {
+				t.Errorf("sink content differs from the response body")
+			}
+		})
+	}
+}
+
+func TestErrorMessagePath(t *testing.T) {
+	tests := []struct {
+		name        string
+		path        string
+		body        string
+		wantMessage string
+	}{
+		{name: "nested field", path: "error.message", body: `{"error":{"message":"quota exceeded"}}`, wantMessage: "quota exceeded"},
+		{name: "array index", path: "errors.0.detail", body: `{"errors":[{"detail":"bad id"}]}`, wantMessage: "bad id"},
+		{name: "number", path: "code", body: `{"code":42}`, wantMessage: "42"},
+		{name: "missing field", path: "error.message", body: `{"error":{}}`, wantMessage: "request returned failure"},
+		{name: "empty field", path: "message", body: `{"message":""}`, wantMessage: "request returned failure"},
+		{name: "object field", path: "error", body: `{"error":{"message":"x"}}`, wantMessage: "request returned failure"},
+		{name: "not JSON", path: "message", body: `Internal Server Error`, wantMessage: "request returned failure"},
+		{name: "not configured", body: `{"message":"ignored"}`, wantMessage: "request returned failure"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newServer(t, func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(tt.body))
+			})
+			data := testMetadata(t, srv.URL, WithErrorMessagePath(tt.path))
+			_, err := HandleHTTPRequest("{}", http.Header{}, data, zap.NewNop())
+			errorResponse := errorResponseOf(t, err)
+			if errorResponse.Message != tt.wantMessage {
+				t.Errorf("message = %q, want %q", errorResponse.Message, tt.wantMessage)
+			}
+			// The raw body is kept along with the extracted message
+			if errorResponse.Body != tt.body {
+				t.Errorf("body = %q, want %q", errorResponse.Body, tt.body)
+			}
+		})
+	}
+}
+
+func TestRetryable2xx(t *testing.T) {
+	tests := []struct {
+		name         string
+		retryable    []int
+		statuses     []int
+		want         Outcome
+		wantRequests int32
+	}{
+		{name: "207 success unless listed", statuses: []int{http.StatusMultiStatus}, want: OutcomeSuccess, wantRequests: 1},
+		{name: "207 retried when listed", retryable: []int{207}, statuses: []int{http.StatusMultiStatus, http.StatusOK}, want: OutcomeSuccess, wantRequests: 2},
+		{name: "207 fails once retries are exhausted", retryable: []int{207}, statuses: []int{http.StatusMultiStatus}, want: OutcomeFailure, wantRequests: 3},
+		{name: "other 2xx unaffected", retryable: []int{207}, statuses: []int{http.StatusAccepted}, want: OutcomeSuccess, wantRequests: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, requests := statusServer(t, tt.statuses...)
+			data := testMetadata(t, srv.URL, WithMaxRetries(2), WithRetryable2xx(tt.retryable...))
+			resp, report, err := InvokeHTTPRequest(context.Background(), "{}", http.Header{}, data, zap.NewNop())
+			if err == nil {
+				resp.Body.Close()
+			}
+			if report.Outcome != tt.want || *requests != tt.wantRequests {
+				t.Errorf("outcome %v after %v requests, want %v after %v", report.Outcome, *requests, tt.want, tt.wantRequests)
+			}
+		})
+	}
+}
+
+func TestRetryable2xxEnv(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    []int
+		wantErr bool
+	}{
+		{value: "", want: nil},
+		{value: "207", want: []int{207}},
+		{value: "202, 207", want: []int{202, 207}},
+		{value: "multi", wantErr: true},
+		{value: "500", wantErr: true},
+	}
+	for _, tt := range tests {
+		setEnv(t, map[string]string{
+			"TOPIC":         "topic",
+			"HTTP_ENDPOINT": "http://function",
+			"MAX_RETRIES":   "3",
+			"CONTENT_TYPE":  "application/json",
+			"RETRYABLE_2XX": tt.value,
+		})
+		meta, err := ParseConnectorMetadata()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("RETRYABLE_2XX=%q error = %v, want error %v", tt.value, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && fmt.Sprint(meta.Retryable2xx) != fmt.Sprint(tt.want) {
+			t.Errorf("RETRYABLE_2XX=%q parsed %v, want %v", tt.value, meta.Retryable2xx, tt.want)
+		}
+	}
+}
+
+func TestNoRetryHeader(t *testing.T) {
+	tests := []struct {
+		name         string
+		configured   string
+		value        string
+		wantRequests int32
+	}{
+		{name: "permanent failure not retried", configured: "X-No-Retry", value: "true", wantRequests: 1},
+		{name: "false value retried", configured: "X-No-Retry", value: "false", wantRequests: 3},
+		{name: "invalid value retried", configured: "X-No-Retry", value: "maybe", wantRequests: 3},
+		{name: "absent header retried", configured: "X-No-Retry", wantRequests: 3},
+		{name: "not configured", value: "true", wantRequests: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var requests int32
+			srv := newServer(t, func(w http.ResponseWriter, r *http.Request) {
+				atomic.AddInt32(&requests, 1)
+				if tt.value != "" {
+					w.Header().Set("X-No-Retry", tt.value)
+				}
+				w.WriteHeader(http.StatusInternalServerError)
+			})
+			data := testMetadata(t, srv.URL, WithMaxRetries(2), WithNoRetryHeader(tt.configured))
+			_, report, err := InvokeHTTPRequest(context.Background(), "{}", http.Header{}, data, zap.NewNop())
+			if err == nil || report.Outcome != OutcomeFailure {
+				t.Errorf("outcome = %v with error %v, want a failure", report.Outcome, err)
+			}
+			if requests != tt.wantRequests {
+				t.Errorf("server received %v requests, want %v", requests, tt.wantRequests)
+			}
+		})
+	}
+}
+
+// trackedBody is a response body recording whether it was read and closed, failing reads
+type trackedBody struct {
+	read   bool
+	closed bool
+}
+
+func (b *trackedBody) Read([]byte) (int, error) {
+	b.read = true
+	return 0, fmt.Errorf("body read")
+}
+
+func (b *trackedBody) Close() error {
+	b.closed = true
+	return nil
+}
+
+func TestResponseStringWithoutBody(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   int
+		wantRead bool
+		wantErr  bool
+	}{
+		{name: "no content", status: http.StatusNoContent},
+		{name: "not modified", status: http.StatusNotModified},
+		{name: "ok", status: http.StatusOK, wantRead: true, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := &trackedBody{}
+			got, err := ResponseString(&http.Response{StatusCode: tt.status, Body: body})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ResponseString() error = %v, want error %v", err, tt.wantErr)
+			}
+			if got != "" {
+				t.Errorf("ResponseString() = %q, want empty", got)
+			}
+			if body.read != tt.wantRead || !body.closed {
+				t.Errorf("body read = %v and closed = %v, want read = %v and closed", body.read, body.closed, tt.wantRead)
+			}
+		})
+	}
+	if got, err := ResponseString(nil); got != "" || err != nil {
+		t.Errorf("ResponseString(nil) = %q, %v", got, err)
+	}
+	if got, err := ResponseString(&http.Response{StatusCode: http.StatusOK}); got != "" || err != nil {
+		t.Errorf("ResponseString() without body = %q, %v", got, err)
+	}
+}
+
+func TestResponseStringFromServer(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		want   string
+	}{
+		{name: "no content", status: http.StatusNoContent},
+		{name: "ok", status: http.StatusOK, want: "done"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newServer(t, func(w http.ResponseWriter, r *http.Request) {
+				ioutil.ReadAll(r.Body)
+				w.WriteHeader(tt.status)
+				w.Write([]byte("done"))
+			})
+			resp, err := HandleHTTPRequest("{}", http.Header{}, testMetadata(t, srv.URL), zap.NewNop())
+			if err != nil {
+				t.Fatalf("HandleHTTPRequest() error = %v", err)
+			}
+			if got, err := ResponseString(resp); err != nil || got != tt.want {
+				t.Errorf("ResponseString() = %q, %v, want %q", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestErrorResponseLatency(t *testing.T) {
+	tests := []struct {
+		name    string
+		retries int
+		backoff time.Duration
+		want    int64
+	}{
+		{name: "single attempt", want: 250},
+		{name: "attempts and backoff", retries: 2, backoff: time.Second, want: 3*250 + 1000 + 2000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := useFakeClock(t)
+			srv := newServer(t, func(w http.ResponseWriter, r *http.Request) {
+				ioutil.ReadAll(r.Body)
+				// Every attempt takes 250ms of the fake clock
+				clock.Advance(250 * time.Millisecond)
+				w.WriteHeader(http.StatusInternalServerError)
+			})
+			data := testMetadata(t, srv.URL, WithMaxRetries(tt.retries), WithRetryBackoff(tt.backoff, 2, 0))
+			done := make(chan error, 1)
+			go func() {
+				_, err := HandleHTTPRequest("{}", http.Header{}, data, zap.NewNop())
+				done <- err
+			}()
+			delay := tt.backoff
+			for i := 0; i < tt.retries; i++ {
+				waitForTimers(t, clock, 1)
+				clock.Advance(delay)
+				delay *= 2
+			}
+			if got := errorResponseOf(t, <-done).LatencyMs; got != tt.want {
+				t.Errorf("latency = %vms, want %vms", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRequiredResponseHeaders(t *testing.T) {
+	tests := []struct {
+		name         string
+		receipts     []string
+		retryable    bool
+		wantErr      bool
+		wantRequests int32
+	}{
+		{name: "present", receipts: []string{"r-1"}, wantRequests: 1},
+		{name: "missing fails", receipts: []string{"", "r-1"}, wantErr: true, wantRequests: 1},
+		{name: "missing retried", receipts: []string{"", "r-1"}, retryable: true, wantRequests: 2},
+		{name: "missing retried until exhausted", receipts: []string{""}, retryable: true, wantErr: true, wantRequests: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var requests int32
+			srv := newServer(t, func(w http.ResponseWriter, r *http.Request) {
+				n := int(atomic.AddInt32(&requests, 1))
+				if n > len(tt.receipts) {
+					n = len(tt.receipts)
+				}
+				w.Header().Set("X-Trace", "t-1")
+				if receipt := tt.receipts[n-1]; receipt != "" {
+					w.Header().Set("X-Receipt", receipt)
+				}
+				w.Write([]byte("processed"))
+			})
+			data := testMetadata(t, srv.URL, WithMaxRetries(2), WithRequiredResponseHeaders(tt.retryable, "X-Trace", "X-Receipt"))
+			resp, report, err := InvokeHTTPRequest(context.Background(), "{}", http.Header{}, data, zap.NewNop())
+			if got := atomic.LoadInt32(&requests); got != tt.wantRequests {
+				t.Errorf("sent %v requests, want %v", got, tt.wantRequests)
+			}
+			if !tt.wantErr {
+				if err != nil {
+					t.Fatalf("InvokeHTTPRequest() error = %v", err)
+				}
+				resp.Body.Close()
+				return
+			}
+			errorResponse := errorResponseOf(t, err)
+			if errorResponse.ErrorKind != ErrorKindMissingHeader || report.ErrorKind != ErrorKindMissingHeader {
+				t.Errorf("error kind = %v and reported %v, want %v", errorResponse.ErrorKind, report.ErrorKind, ErrorKindMissingHeader)
+			}
+			if errorResponse.Status != http.StatusOK || errorResponse.Body != "processed" || errorResponse.Message != "response lacks required header X-Receipt" {
+				t.Errorf("error = %+v", errorResponse)
+			}
+		})
+	}
+}
+
+func TestParseConnectorMetadataRequiredResponseHeaders(t *testing.T) {
+	tests := []struct {
+		name          string
+		env           map[string]string
+		wantHeaders   []string
+		wantRetryable bool
+		wantErr       bool
+	}{
+		{name: "unset", env: map[string]string{}},
+		{name: "headers", env: map[string]string{"REQUIRED_RESPONSE_HEADERS": "X-Receipt, X-Trace"}, wantHeaders: []string{"X-Receipt", "X-Trace"}},
+		{name: "retried", env: map[string]string{"REQUIRED_RESPONSE_HEADERS": "X-Receipt", "REQUIRED_RESPONSE_HEADERS_RETRY": "true"}, wantHeaders: []string{"X-Receipt"}, wantRetryable: true},
+		{name: "invalid retry", env: map[string]string{"REQUIRED_RESPONSE_HEADERS_RETRY": "twice"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := map[string]string{
+				"TOPIC":                           "topic",
+				"HTTP_ENDPOINT":                   "http://function.default",
+				"MAX_RETRIES":                     "3",
+				"CONTENT_TYPE":                    "application/json",
+				"REQUIRED_RESPONSE_HEADERS":       "",
+				"REQUIRED_RESPONSE_HEADERS_RETRY": "",
+			}
+			for name, value := range tt.env {
+				env[name] = value
+			}
+			setEnv(t, env)
+			meta, err := ParseConnectorMetadata()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseConnectorMetadata() error = %v, want error %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(meta.RequiredResponseHeaders, tt.wantHeaders) || meta.RequiredResponseHeadersRetryable != tt.wantRetryable {
+				t.Errorf("required headers %v retryable %v, want %v retryable %v", meta.RequiredResponseHeaders, meta.RequiredResponseHeadersRetryable, tt.wantHeaders, tt.wantRetryable)
+			}
+		})
+	}
+}
+
+func TestAlreadyProcessed(t *testing.T) {
+	tests := []struct {
+		name         string
+		status       int
+		header       string
+		statuses     []int
+		wantReplayed bool
+		wantErr      bool
+		wantRequests int32
+	}{
+		{name: "configured status", status: http.StatusConflict, statuses: []int{http.StatusConflict}, wantReplayed: true, wantRequests: 1},
+		{name: "header on failure", status: http.StatusInternalServerError, header: "true", wantReplayed: true, wantRequests: 1},
+		{name: "header on success", status: http.StatusOK, header: "1", wantReplayed: true, wantRequests: 1},
+		{name: "header false", status: http.StatusInternalServerError, header: "false", wantErr: true, wantRequests: 3},
+		{name: "status not configured", status: http.StatusConflict, statuses: []int{http.StatusGone}, wantErr: true, wantRequests: 3},
+		// A new success is still checked for the required header
+		{name: "new success checked", status: http.StatusOK, wantErr: true, wantRequests: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var requests int32
+			srv := newServer(t, func(w http.ResponseWriter, r *http.Request) {
+				atomic.AddInt32(&requests, 1)
+				if tt.header != "" {
+					w.Header().Set("X-Already-Processed", tt.header)
+				}
+				w.WriteHeader(tt.status)
+			})
+			// Replayed responses are accepted without the checks of new successes
+			data := testMetadata(t, srv.URL, WithMaxRetries(2), WithAlreadyProcessed("X-Already-Processed", tt.statuses...),
+				WithRequiredResponseHeaders(false, "X-Already-Processed"))
+			resp, report, err := InvokeHTTPRequest(context.Background(), "{}", http.Header{}, data, zap.NewNop())
+			if got := atomic.LoadInt32(&requests); got != tt.wantRequests {
+				t.Errorf("sent %v requests, want %v", got, tt.wantRequests)
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("InvokeHTTPRequest() error = %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil {
+				resp.Body.Close()
+			}
+			if report.Replayed != tt.wantReplayed {
+				t.Errorf("replayed = %v, want %v", report.Replayed, tt.wantReplayed)
+			}
+			if tt.wantReplayed && report.Outcome != OutcomeSuccess {
+				t.Errorf("outcome = %v, want %v", report.Outcome, OutcomeSuccess)
+			}
+		})
+	}
+}
+
+func TestParseConnectorMetadataAlreadyProcessed(t *testing.T) {
+	tests := []struct {
+		name         string
+		env          map[string]string
+		wantStatuses []int
+		wantHeader   string
+		wantErr      bool
+	}{
+		{name: "unset", env: map[string]string{}},
+		{name: "statuses and header", env: map[string]string{"ALREADY_PROCESSED_STATUSES": "409, 410", "ALREADY_PROCESSED_HEADER": "X-Duplicate"}, wantStatuses: []int{409, 410}, wantHeader: "X-Duplicate"},
+		{name: "invalid status", env: map[string]string{"ALREADY_PROCESSED_STATUSES": "conflict"}, wantErr: true},
+		{name: "out of range status", env: map[string]string{"ALREADY_PROCESSED_STATUSES": "999"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := map[string]string{
+				"TOPIC":                      "topic",
+				"HTTP_ENDPOINT":              "http://function.default",
+				"MAX_RETRIES":                "3",
+				"CONTENT_TYPE":               "application/json",
+				"ALREADY_PROCESSED_STATUSES": "",
+				"ALREADY_PROCESSED_HEADER":   "",
+			}
+			for name, value := range tt.env {
+				env[name] = value
+			}
+			setEnv(t, env)
+			meta, err := ParseConnectorMetadata()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseConnectorMetadata() error = %v, want error %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(meta.AlreadyProcessedStatuses, tt.wantStatuses) || meta.AlreadyProcessedHeader != tt.wantHeader {
+				t.Errorf("already processed statuses %v and header %q, want %v and %q", meta.AlreadyProcessedStatuses, meta.AlreadyProcessedHeader, tt.wantStatuses, tt.wantHeader)
+			}
+		})
+	}
+}
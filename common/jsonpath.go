@@ -0,0 +1,97 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// lookupJSONPath returns the value found in a JSON document at a dot separated path such as "error.details.0.message",
+// where numeric segments index arrays
+func lookupJSONPath(document []byte, path string) (interface{}, bool) {
+	var value interface{}
+	if err := json.Unmarshal(document, &value); err != nil {
+		return nil, false
+	}
+	return walkJSONPath(value, path)
+}
+
+// walkJSONPath returns the value found in a decoded JSON document at a dot separated path like lookupJSONPath
+func walkJSONPath(value interface{}, path string) (interface{}, bool) {
+	for _, segment := range strings.Split(path, ".") {
+		switch node := value.(type) {
+		case map[string]interface{}:
+			var ok bool
+			if value, ok = node[segment]; !ok {
+				return nil, false
+			}
+		case []interface{}:
+			index, err := strconv.Atoi(segment)
+			if err != nil || index < 0 || index >= len(node) {
+				return nil, false
+			}
+			value = node[index]
+		default:
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// lookupJSONString returns the scalar found in a JSON document at path formatted as a string
+func lookupJSONString(document []byte, path string) (string, bool) {
+	value, ok := lookupJSONPath(document, path)
+	if !ok {
+		return "", false
+	}
+	return jsonScalarString(value)
+}
+
+// jsonScalarString formats a decoded JSON scalar as a string
+func jsonScalarString(value interface{}) (string, bool) {
+	switch v := value.(type) {
+	case string:
+		return v, true
+	case float64, bool:
+		return fmt.Sprint(v), true
+	default:
+		return "", false
+	}
+}
+
+// extractJSONPath removes the value found in a JSON document at a dot separated path of object fields,
+// returning the document without it and the value, both re-encoded as JSON
+func extractJSONPath(document []byte, path string) (rest []byte, extracted []byte, ok bool) {
+	decoder := json.NewDecoder(strings.NewReader(string(document)))
+	decoder.UseNumber()
+	var root interface{}
+	if err := decoder.Decode(&root); err != nil {
+		return nil, nil, false
+	}
+	segments := strings.Split(path, ".")
+	node, isObject := root.(map[string]interface{})
+	for _, segment := range segments[:len(segments)-1] {
+		if !isObject {
+			return nil, nil, false
+		}
+		node, isObject = node[segment].(map[string]interface{})
+	}
+	if !isObject {
+		return nil, nil, false
+	}
+	last := segments[len(segments)-1]
+	value, found := node[last]
+	if !found {
+		return nil, nil, false
+	}
+	delete(node, last)
+	var err error
+	if rest, err = json.Marshal(root); err != nil {
+		return nil, nil, false
+	}
+	if extracted, err = json.Marshal(value); err != nil {
+		return nil, nil, false
+	}
+	return rest, extracted, true
+}
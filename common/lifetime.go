@@ -0,0 +1,128 @@
+package common
+
+import (
+	"context"
+	"net"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// dialFunc dials a connection the way http.Transport.DialContext does
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// dialedConns tracks each open connection subject to a maximum lifetime, keyed by its addresses
+// so that connections wrapped by TLS can be looked up too
+var dialedConns = struct {
+	sync.Mutex
+	byKey map[string]*dialedConn
+}{byKey: make(map[string]*dialedConn)}
+
+// dialedConn is the state of a connection subject to a maximum lifetime
+type dialedConn struct {
+	dialedAt time.Time
+	idle     bool
+	expiry   Timer
+	stop     chan struct{} // closed once the connection is closed, ending the wait for expiry
+}
+
+// connKey identifies conn by its local and remote addresses
+func connKey(conn net.Conn) string {
+	return conn.LocalAddr().String() + "->" + conn.RemoteAddr().String()
+}
+
+// lifetimeConn forgets its state once closed
+type lifetimeConn struct {
+	net.Conn
+	key  string
+	once sync.Once
+}
+
+func (c *lifetimeConn) Close() error {
+	c.once.Do(func() {
+		dialedConns.Lock()
+		if state, ok := dialedConns.byKey[c.key]; ok && state.expiry != nil {
+			state.expiry.Stop()
+			close(state.stop)
+		}
+		delete(dialedConns.byKey, c.key)
+		dialedConns.Unlock()
+	})
+	return c.Conn.Close()
+}
+
+// withConnLifetime returns dial recording when connections are dialed, so that retireExpiredConns can close them
+func withConnLifetime(dial dialFunc) dialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		key := connKey(conn)
+		dialedConns.Lock()
+		dialedConns.byKey[key] = &dialedConn{dialedAt: now()}
+		dialedConns.Unlock()
+		return &lifetimeConn{Conn: conn, key: key}, nil
+	}
+}
+
+// setConnIdle records whether conn is idle in the pool. A connection older than lifetime is closed once idle,
+// either right away or when its lifetime elapses; closing an idle connection makes the transport drop it from the pool.
+func setConnIdle(conn net.Conn, idle bool, lifetime time.Duration) {
+	dialedConns.Lock()
+	defer dialedConns.Unlock()
+	state, ok := dialedConns.byKey[connKey(conn)]
+	if !ok {
+		return
+	}
+	state.idle = idle
+	if !idle {
+		return
+	}
+	remaining := lifetime - since(state.dialedAt)
+	if remaining <= 0 {
+		go conn.Close()
+		return
+	}
+	if state.expiry == nil {
+		state.expiry = newTimer(remaining)
+		state.stop = make(chan struct{})
+		go closeOnExpiry(conn, state, state.expiry, state.stop)
+	}
+}
+
+// closeOnExpiry closes conn when expiry fires if it's still idle, unless stop is closed first because conn was closed
+func closeOnExpiry(conn net.Conn, state *dialedConn, expiry Timer, stop chan struct{}) {
+	select {
+	case <-expiry.C():
+		dialedConns.Lock()
+		idle := state.idle
+		dialedConns.Unlock()
+		if idle {
+			conn.Close()
+		}
+	case <-stop:
+	}
+}
+
+// retireExpiredConns traces the request made with ctx to retire its connection once idle and older than lifetime,
+// as the transport has no maximum connection lifetime. In-flight requests are never interrupted.
+func retireExpiredConns(ctx context.Context, lifetime time.Duration) context.Context {
+	var mu sync.Mutex
+	var conn net.Conn
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			mu.Lock()
+			conn = info.Conn
+			mu.Unlock()
+			setConnIdle(info.Conn, false, lifetime)
+		},
+		PutIdleConn: func(err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			if err == nil && conn != nil {
+				setConnIdle(conn, true, lifetime)
+			}
+		},
+	})
+}
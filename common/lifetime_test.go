@@ -0,0 +1,99 @@
+package common
+
+import (
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// connServer starts a server running handler and counting the connections it accepted and saw closed
+func connServer(t *testing.T, handler http.HandlerFunc) (string, *int32, *int32) {
+	t.Helper()
+	var opened, closed int32
+	srv := newConnStateServer(t, handler, func(conn net.Conn, state http.ConnState) {
+		switch state {
+		case http.StateNew:
+			atomic.AddInt32(&opened, 1)
+		case http.StateClosed:
+			atomic.AddInt32(&closed, 1)
+		}
+	})
+	return srv.URL, &opened, &closed
+}
+
+// waitForCount waits until count reaches want
+func waitForCount(t *testing.T, count *int32, want int32) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(count) < want {
+		if time.Now().After(deadline) {
+			t.Fatalf("count is %v, want %v", atomic.LoadInt32(count), want)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestConnMaxLifetime(t *testing.T) {
+	clock := useFakeClock(t)
+	var slow int32
+	endpoint, opened, closed := connServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if atomic.CompareAndSwapInt32(&slow, 1, 0) {
+			// The connection outlives its lifetime while the request is in flight
+			clock.Advance(2 * time.Minute)
+		}
+	})
+	data := testMetadata(t, endpoint, WithConnMaxLifetime(time.Minute))
+	invoke := func() {
+		t.Helper()
+		resp, err := HandleHTTPRequest("{}", http.Header{}, data, zap.NewNop())
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		ResponseString(resp)
+	}
+
+	invoke()
+	clock.Advance(30 * time.Second)
+	invoke()
+	if got := atomic.LoadInt32(opened); got != 1 {
+		t.Fatalf("opened %v connections, want the young connection reused", got)
+	}
+
+	// The idle connection is closed once its lifetime elapses
+	clock.Advance(31 * time.Second)
+	waitForCount(t, closed, 1)
+	invoke()
+	if got := atomic.LoadInt32(opened); got != 2 {
+		t.Fatalf("opened %v connections, want a new one once the first expired", got)
+	}
+
+	// A connection expiring in flight completes its request and is closed once idle
+	atomic.StoreInt32(&slow, 1)
+	invoke()
+	waitForCount(t, closed, 2)
+	invoke()
+	if got := atomic.LoadInt32(opened); got != 3 {
+		t.Errorf("opened %v connections, want a new one after the in-flight expiry", got)
+	}
+}
+
+func TestConnWithoutMaxLifetime(t *testing.T) {
+	clock := useFakeClock(t)
+	endpoint, opened, _ := connServer(t, func(w http.ResponseWriter, r *http.Request) {})
+	data := testMetadata(t, endpoint)
+	for i := 0; i < 3; i++ {
+		resp, err := HandleHTTPRequest("{}", http.Header{}, data, zap.NewNop())
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		ResponseString(resp)
+		clock.Advance(time.Hour)
+	}
+	if got := atomic.LoadInt32(opened); got != 1 {
+		t.Errorf("opened %v connections, want one reused", got)
+	}
+}
@@ -0,0 +1,86 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"go.uber.org/zap"
+)
+
+// ErrLimitReached is returned instead of invoking the function once the ProcessingLimits are reached; the message should be nacked
+var ErrLimitReached = errors.New("processing limit reached")
+
+// ProcessingLimits stops the connector after a total number of messages or bytes was processed,
+// e.g. for cost control in test environments
+type ProcessingLimits struct {
+	maxMessages int64
+	maxBytes    int64
+
+	messages int64
+	bytes    int64
+	once     sync.Once
+	reached  chan struct{}
+}
+
+// NewProcessingLimits returns ProcessingLimits reached after maxMessages messages or maxBytes bytes, zero meaning unlimited
+func NewProcessingLimits(maxMessages, maxBytes int64) *ProcessingLimits {
+	return &ProcessingLimits{maxMessages: maxMessages, maxBytes: maxBytes, reached: make(chan struct{})}
+}
+
+// Reached returns a channel closed once the limits are reached
+func (l *ProcessingLimits) Reached() <-chan struct{} {
+	return l.reached
+}
+
+// isReached tells whether the limits were reached
+func (l *ProcessingLimits) isReached() bool {
+	select {
+	case <-l.reached:
+		return true
+	default:
+		return false
+	}
+}
+
+// count records a processed message of size bytes, size being negative if unknown
+func (l *ProcessingLimits) count(size int64) {
+	messages := atomic.AddInt64(&l.messages, 1)
+	var bytes int64
+	if size > 0 {
+		bytes = atomic.AddInt64(&l.bytes, size)
+	} else {
+		bytes = atomic.LoadInt64(&l.bytes)
+	}
+	if (l.maxMessages > 0 && messages >= l.maxMessages) || (l.maxBytes > 0 && bytes >= l.maxBytes) {
+		l.once.Do(func() { close(l.reached) })
+	}
+}
+
+// NewShutdownContext returns a context cancelled on SIGINT or SIGTERM, or once data.Limits are reached,
+// for connectors to stop consuming gracefully. Invocations in flight with the context end as OutcomeIncomplete.
+func NewShutdownContext(parent context.Context, data ConnectorMetadata, logger *zap.Logger) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(parent)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	var reached <-chan struct{}
+	if data.Limits != nil {
+		reached = data.Limits.Reached()
+	}
+	go func() {
+		defer signal.Stop(signals)
+		select {
+		case sig := <-signals:
+			logger.Info("shutting down", zap.String("signal", sig.String()), zap.String("source", data.SourceName))
+		case <-reached:
+			logger.Info("shutting down, processing limit reached", zap.String("source", data.SourceName))
+		case <-ctx.Done():
+		}
+		cancel()
+	}()
+	return ctx, cancel
+}
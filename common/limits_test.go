@@ -0,0 +1,145 @@
+package common
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestProcessingLimits(t *testing.T) {
+	tests := []struct {
+		name         string
+		maxMessages  int64
+		maxBytes     int64
+		wantInvoked  int32
+		wantReached  bool
+		wantRejected int
+	}{
+		{name: "unlimited", wantInvoked: 4},
+		{name: "message limit", maxMessages: 2, wantInvoked: 2, wantReached: true, wantRejected: 2},
+		{name: "byte limit", maxBytes: 40, wantInvoked: 3, wantReached: true, wantRejected: 1},
+		{name: "limits above traffic", maxMessages: 10, maxBytes: 1000, wantInvoked: 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, invoked := statusServer(t, http.StatusOK)
+			limits := NewProcessingLimits(tt.maxMessages, tt.maxBytes)
+			data := testMetadata(t, srv.URL, WithLimits(limits))
+			var rejected int
+			for i := 0; i < 4; i++ {
+				resp, err := HandleHTTPRequest(`{"message":"hello"}`, http.Header{}, data, zap.NewNop())
+				if err == ErrLimitReached {
+					rejected++
+					continue
+				}
+				if err != nil {
+					t.Fatalf("message %v failed: %v", i, err)
+				}
+				resp.Body.Close()
+			}
+			if got := atomic.LoadInt32(invoked); got != tt.wantInvoked {
+				t.Errorf("invoked the function %v times, want %v", got, tt.wantInvoked)
+			}
+			if rejected != tt.wantRejected {
+				t.Errorf("rejected %v messages, want %v", rejected, tt.wantRejected)
+			}
+			if got := limits.isReached(); got != tt.wantReached {
+				t.Errorf("limits reached = %v, want %v", got, tt.wantReached)
+			}
+		})
+	}
+}
+
+func TestInvalidProcessingLimits(t *testing.T) {
+	tests := []struct {
+		name        string
+		maxMessages int64
+		maxBytes    int64
+	}{
+		{name: "negative messages", maxMessages: -1},
+		{name: "negative bytes", maxBytes: -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewConnectorMetadata(
+				WithTopic("topic"),
+				WithEndpoint("http://function.default"),
+				WithContentType("application/json"),
+				WithLimits(NewProcessingLimits(tt.maxMessages, tt.maxBytes)),
+			)
+			if err == nil {
+				t.Error("NewConnectorMetadata() accepted negative limits")
+			}
+		})
+	}
+}
+
+func TestShutdownContextOnLimitReached(t *testing.T) {
+	srv, _ := statusServer(t, http.StatusOK)
+	data := testMetadata(t, srv.URL, WithLimits(NewProcessingLimits(1, 0)))
+	ctx, cancel := NewShutdownContext(context.Background(), data, zap.NewNop())
+	defer cancel()
+	select {
+	case <-ctx.Done():
+		t.Fatal("shutdown context cancelled before the limit was reached")
+	default:
+	}
+	resp, err := HandleHTTPRequest("{}", http.Header{}, data, zap.NewNop())
+	if err != nil {
+		t.Fatalf("HandleHTTPRequest() error = %v", err)
+	}
+	resp.Body.Close()
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("shutdown context not cancelled once the limit was reached")
+	}
+}
+
+func TestParseConnectorMetadataLimits(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		want    *ProcessingLimits
+		wantErr bool
+	}{
+		{name: "unset", env: map[string]string{}},
+		{name: "messages", env: map[string]string{"MAX_TOTAL_MESSAGES": "100"}, want: &ProcessingLimits{maxMessages: 100}},
+		{name: "bytes", env: map[string]string{"MAX_TOTAL_BYTES": "1048576"}, want: &ProcessingLimits{maxBytes: 1048576}},
+		{name: "invalid messages", env: map[string]string{"MAX_TOTAL_MESSAGES": "many"}, wantErr: true},
+		{name: "negative bytes", env: map[string]string{"MAX_TOTAL_BYTES": "-1"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := map[string]string{
+				"TOPIC":              "topic",
+				"HTTP_ENDPOINT":      "http://function.default",
+				"MAX_RETRIES":        "3",
+				"CONTENT_TYPE":       "application/json",
+				"MAX_TOTAL_MESSAGES": "",
+				"MAX_TOTAL_BYTES":    "",
+			}
+			for name, value := range tt.env {
+				env[name] = value
+			}
+			setEnv(t, env)
+			meta, err := ParseConnectorMetadata()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseConnectorMetadata() error = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if (meta.Limits == nil) != (tt.want == nil) {
+				t.Fatalf("limits = %+v, want %+v", meta.Limits, tt.want)
+			}
+			if tt.want != nil && (meta.Limits.maxMessages != tt.want.maxMessages || meta.Limits.maxBytes != tt.want.maxBytes) {
+				t.Errorf("limits = %v messages and %v bytes, want %v and %v", meta.Limits.maxMessages, meta.Limits.maxBytes, tt.want.maxMessages, tt.want.maxBytes)
+			}
+		})
+	}
+}
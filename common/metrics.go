@@ -0,0 +1,41 @@
+package common
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// metricsNamespace prefixes the names of the metrics exposed by connectors
+const metricsNamespace = "keda_connector"
+
+var errorBufferDroppedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: metricsNamespace,
+	Name:      "error_buffer_dropped_total",
+	Help:      "Number of error responses dropped because the error buffer was full.",
+}, []string{"policy"})
+
+var awsCredentialErrorsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: metricsNamespace,
+	Name:      "aws_credential_errors_total",
+	Help:      "Number of failed AWS credential retrievals and refreshes.",
+}, []string{"provider"})
+
+var limiterWaitSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: metricsNamespace,
+	Name:      "limiter_wait_seconds",
+	Help:      "Time spent waiting on rate limits and concurrency caps before sending or forwarding.",
+	Buckets:   prometheus.DefBuckets,
+}, []string{"source", "limiter"})
+
+var slaInvocationsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: metricsNamespace,
+	Name:      "sla_invocations_total",
+	Help:      "Number of completed function invocations by compliance with the SLA latency target.",
+}, []string{"source", "result"})
+
+// Limiters labelling the limiter_wait_seconds metric
+const (
+	limiterRateLimit    = "rate_limit"
+	limiterForwardQueue = "forward_queue"
+	limiterPriority     = "priority"
+)
@@ -0,0 +1,74 @@
+package common
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+// histogramOf returns the sample count and sum of the histogram named name, without the namespace, whose labels
+// match labels, gathered from the default registry
+func histogramOf(t *testing.T, name string, labels map[string]string) (uint64, float64) {
+	t.Helper()
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		if family.GetName() != metricsNamespace+"_"+name {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			matched := 0
+			for _, label := range metric.GetLabel() {
+				if value, ok := labels[label.GetName()]; ok && value == label.GetValue() {
+					matched++
+				}
+			}
+			if matched == len(labels) {
+				return metric.GetHistogram().GetSampleCount(), metric.GetHistogram().GetSampleSum()
+			}
+		}
+	}
+	return 0, 0
+}
+
+func TestLimiterWaitSeconds(t *testing.T) {
+	clock := useFakeClock(t)
+	srv := newServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(RateLimitRemainingHeader, "0")
+		w.Header().Set(RateLimitResetHeader, "30")
+	})
+	data := testMetadata(t, srv.URL, WithRateLimitThrottle(true), WithSourceName("limiter-wait"))
+	labels := map[string]string{"source": "limiter-wait", "limiter": limiterRateLimit}
+	invoke := func() {
+		resp, err := HandleHTTPRequest("{}", http.Header{}, data, zap.NewNop())
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+			return
+		}
+		resp.Body.Close()
+	}
+
+	// The counts are cumulative when the test runs several times
+	countBefore, sumBefore := histogramOf(t, "limiter_wait_seconds", labels)
+	invoke()
+	if count, sum := histogramOf(t, "limiter_wait_seconds", labels); count-countBefore != 1 || sum-sumBefore != 0 {
+		t.Errorf("recorded %v waits totalling %vs before the limit was known, want a single 0s wait", count-countBefore, sum-sumBefore)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		invoke()
+	}()
+	waitForTimers(t, clock, 1)
+	clock.Advance(30 * time.Second)
+	<-done
+	if count, sum := histogramOf(t, "limiter_wait_seconds", labels); count-countBefore != 2 || sum-sumBefore != 30 {
+		t.Errorf("recorded %v waits totalling %vs, want the 30s throttling recorded", count-countBefore, sum-sumBefore)
+	}
+}
@@ -0,0 +1,623 @@
+package common
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Option configures a ConnectorMetadata built with NewConnectorMetadata
+type Option func(*ConnectorMetadata)
+
+// NewConnectorMetadata builds a ConnectorMetadata from opts and validates it, so that connectors embedding
+// this package or tests don't have to assemble the struct by hand
+func NewConnectorMetadata(opts ...Option) (ConnectorMetadata, error) {
+	meta := ConnectorMetadata{
+		SourceName: "KEDAConnector",
+	}
+	for _, opt := range opts {
+		opt(&meta)
+	}
+	meta.defaultPrimaryEndpoint()
+	if err := meta.Validate(); err != nil {
+		return ConnectorMetadata{}, err
+	}
+	return meta, nil
+}
+
+// defaultPrimaryEndpoint makes the first of HTTPEndpoints the primary HTTPEndpoint when only the list is configured
+func (m *ConnectorMetadata) defaultPrimaryEndpoint() {
+	if m.HTTPEndpoint == "" && len(m.HTTPEndpoints) > 0 {
+		m.HTTPEndpoint = m.HTTPEndpoints[0]
+	}
+}
+
+// Validate checks that the metadata holds a usable configuration
+func (m ConnectorMetadata) Validate() error {
+	if m.Topic == "" {
+		return fmt.Errorf("topic is required")
+	}
+	if m.HTTPEndpoint == "" && len(m.HTTPEndpoints) == 0 {
+		return fmt.Errorf("http endpoint is required")
+	}
+	endpoints := m.HTTPEndpoints
+	if m.HTTPEndpoint != "" {
+		endpoints = append([]string{m.HTTPEndpoint}, endpoints...)
+	}
+	for _, endpoint := range endpoints {
+		if err := validateEndpoint(endpoint); err != nil {
+			return err
+		}
+	}
+	if m.MaxRetries < 0 {
+		return fmt.Errorf("max retries must not be negative, got %v", m.MaxRetries)
+	}
+	if m.ContentType == "" {
+		return fmt.Errorf("content type is required")
+	}
+	return m.validateOptions()
+}
+
+// validateOptions checks the optional settings, leaving alone the endpoints and retries which
+// ParseConnectorMetadata always accepted, e.g. relative endpoints or negative MAX_RETRIES
+func (m ConnectorMetadata) validateOptions() error {
+	if err := m.TLS.validate(); err != nil {
+		return fmt.Errorf("invalid tls configuration: %v", err)
+	}
+	for endpoint, config := range m.EndpointTLS {
+		if err := config.validate(); err != nil {
+			return fmt.Errorf("invalid tls configuration for endpoint %v: %v", endpoint, err)
+		}
+	}
+	for _, status := range m.Retryable2xx {
+		if status < 200 || status >= 300 {
+			return fmt.Errorf("retryable 2xx status must be within 200-299, got %v", status)
+		}
+	}
+	for _, status := range m.AlreadyProcessedStatuses {
+		if status < 100 || status > 599 {
+			return fmt.Errorf("already processed status must be a valid HTTP status, got %v", status)
+		}
+	}
+	switch m.DefaultHeadersPolicy {
+	case "", DefaultHeadersIncoming, DefaultHeadersAppend:
+	default:
+		return fmt.Errorf("unknown default headers policy %q, expected %v or %v", m.DefaultHeadersPolicy, DefaultHeadersIncoming, DefaultHeadersAppend)
+	}
+	if err := validateErrorEncoding(m.ErrorEncoding); err != nil {
+		return err
+	}
+	if err := validateCompressAlgorithm(m.CompressAlgorithm); err != nil {
+		return err
+	}
+	if m.ForwardConcurrency < 0 {
+		return fmt.Errorf("forward concurrency must not be negative, got %v", m.ForwardConcurrency)
+	}
+	if m.CircuitBreaker != nil && m.CircuitBreaker.threshold < 1 {
+		return fmt.Errorf("circuit breaker failure threshold must be positive, got %v", m.CircuitBreaker.threshold)
+	}
+	if m.OutboundQueue != nil {
+		if m.CircuitBreaker == nil {
+			return fmt.Errorf("outbound queue requires a circuit breaker")
+		}
+		if m.OutboundQueue.size < 1 {
+			return fmt.Errorf("outbound queue size must be positive, got %v", m.OutboundQueue.size)
+		}
+	}
+	if m.Limits != nil && (m.Limits.maxMessages < 0 || m.Limits.maxBytes < 0) {
+		return fmt.Errorf("processing limits must not be negative")
+	}
+	if m.MaxMessageAge > 0 && m.EventTimeHeader == "" {
+		return fmt.Errorf("maximum message age requires an event time header")
+	}
+	if m.HedgeLimit < 0 {
+		return fmt.Errorf("hedge limit must not be negative, got %v", m.HedgeLimit)
+	}
+	if m.ErrorBatchSize > 1 && m.ErrorEncoding == ErrorEncodingForm {
+		return fmt.Errorf("error batching requires the JSON error encoding")
+	}
+	if m.ShadowEndpoint != "" {
+		if err := validateEndpoint(m.ShadowEndpoint); err != nil {
+			return fmt.Errorf("invalid shadow endpoint: %v", err)
+		}
+	}
+	if m.ShadowConcurrency < 0 {
+		return fmt.Errorf("shadow concurrency must not be negative, got %v", m.ShadowConcurrency)
+	}
+	if m.MaxRedirects < 0 {
+		return fmt.Errorf("maximum redirects must not be negative, got %v", m.MaxRedirects)
+	}
+	if m.MaxErrorBodySize < 0 {
+		return fmt.Errorf("maximum error body size must not be negative, got %v", m.MaxErrorBodySize)
+	}
+	if m.ErrorBodyStreamLimit < 0 {
+		return fmt.Errorf("error body stream limit must not be negative, got %v", m.ErrorBodyStreamLimit)
+	}
+	if m.PoisonThreshold < 0 {
+		return fmt.Errorf("poison threshold must not be negative, got %v", m.PoisonThreshold)
+	}
+	if m.PoisonThreshold > 0 {
+		if _, ok := m.DedupeStore.(FailureStore); !ok {
+			return fmt.Errorf("poison message detection requires a dedupe store counting failures")
+		}
+	}
+	if m.DedupeStore != nil && m.DedupeTTL <= 0 {
+		return fmt.Errorf("dedupe ttl must be positive when a dedupe store is set")
+	}
+	if m.RetryBackoffMultiplier != 0 && !(m.RetryBackoffMultiplier >= 1) {
+		return fmt.Errorf("retry backoff multiplier must be at least 1, got %v", m.RetryBackoffMultiplier)
+	}
+	return nil
+}
+
+// validateEndpoint checks that endpoint is an absolute http or https URL
+func validateEndpoint(endpoint string) error {
+	parsed, err := url.Parse(endpoint)
+	if err != nil {
+		return fmt.Errorf("invalid http endpoint %v: %v", endpoint, err)
+	}
+	if parsed.Scheme != "http" && parsed.Scheme != "https" || parsed.Host == "" {
+		return fmt.Errorf("invalid http endpoint %v: an absolute http or https URL is required", endpoint)
+	}
+	return nil
+}
+
+// WithTopic sets the topic messages are consumed from
+func WithTopic(topic string) Option {
+	return func(m *ConnectorMetadata) { m.Topic = topic }
+}
+
+// WithResponseTopic sets the topic function responses are published to
+func WithResponseTopic(topic string) Option {
+	return func(m *ConnectorMetadata) { m.ResponseTopic = topic }
+}
+
+// WithErrorTopic sets the topic errors are published to
+func WithErrorTopic(topic string) Option {
+	return func(m *ConnectorMetadata) { m.ErrorTopic = topic }
+}
+
+// WithEndpoint sets the HTTP endpoint of the function
+func WithEndpoint(endpoint string) Option {
+	return func(m *ConnectorMetadata) { m.HTTPEndpoint = endpoint }
+}
+
+// WithMaxRetries sets how many times a failed invocation is retried
+func WithMaxRetries(maxRetries int) Option {
+	return func(m *ConnectorMetadata) { m.MaxRetries = maxRetries }
+}
+
+// WithContentType sets the content type of the messages
+func WithContentType(contentType string) Option {
+	return func(m *ConnectorMetadata) { m.ContentType = contentType }
+}
+
+// WithSourceName sets the source name reported in errors
+func WithSourceName(sourceName string) Option {
+	return func(m *ConnectorMetadata) { m.SourceName = sourceName }
+}
+
+// WithChunkedTransfer enables chunked transfer encoding of request bodies streamed by HandleHTTPRequestStream
+func WithChunkedTransfer(chunked bool) Option {
+	return func(m *ConnectorMetadata) { m.ChunkedTransfer = chunked }
+}
+
+// WithHeaderMapping sets how incoming headers are renamed on outgoing requests
+func WithHeaderMapping(mapping map[string]string) Option {
+	return func(m *ConnectorMetadata) { m.HeaderMapping = mapping }
+}
+
+// WithHooks sets the callbacks invoked while handling a function invocation
+func WithHooks(hooks Hooks) Option {
+	return func(m *ConnectorMetadata) { m.Hooks = hooks }
+}
+
+// WithResponseCache sets the cache used for idempotent requests made with FetchHTTP
+func WithResponseCache(cache *ResponseCache) Option {
+	return func(m *ConnectorMetadata) { m.ResponseCache = cache }
+}
+
+// WithResponseHeaderDenylist sets the response headers removed before logging or storing them in ErrorResponse
+func WithResponseHeaderDenylist(denylist []string) Option {
+	return func(m *ConnectorMetadata) { m.ResponseHeaderDenylist = denylist }
+}
+
+// WithEndpoints sets the endpoints attempts fail over to in turn
+func WithEndpoints(endpoints ...string) Option {
+	return func(m *ConnectorMetadata) { m.HTTPEndpoints = endpoints }
+}
+
+// WithTLS sets the TLS configuration used to connect to endpoints
+func WithTLS(config TLSConfig) Option {
+	return func(m *ConnectorMetadata) { m.TLS = config }
+}
+
+// WithEndpointTLS sets the TLS configuration used to connect to a specific endpoint
+func WithEndpointTLS(endpoint string, config TLSConfig) Option {
+	return func(m *ConnectorMetadata) {
+		if m.EndpointTLS == nil {
+			m.EndpointTLS = make(map[string]TLSConfig)
+		}
+		m.EndpointTLS[endpoint] = config
+	}
+}
+
+// WithStartupJitter sets the bound of the random delay applied by WaitStartupJitter
+func WithStartupJitter(jitter time.Duration) Option {
+	return func(m *ConnectorMetadata) { m.StartupJitter = jitter }
+}
+
+// WithResponseActionField sets the JSON response field through which the function can decide the outcome of the invocation
+func WithResponseActionField(field string) Option {
+	return func(m *ConnectorMetadata) { m.ResponseActionField = field }
+}
+
+// WithResponseHeaderTimeout limits the time waiting for response headers
+func WithResponseHeaderTimeout(timeout time.Duration) Option {
+	return func(m *ConnectorMetadata) { m.ResponseHeaderTimeout = timeout }
+}
+
+// WithIOTimeout limits the time a single read or write on a connection may make no progress
+func WithIOTimeout(timeout time.Duration) Option {
+	return func(m *ConnectorMetadata) { m.IOTimeout = timeout }
+}
+
+// WithErrorWriter sets the writer receiving every ErrorResponse as a JSON line
+func WithErrorWriter(w io.Writer) Option {
+	return func(m *ConnectorMetadata) { m.ErrorWriter = w }
+}
+
+// WithNormalizeContentType enables rewriting the request Content-Type in canonical form
+func WithNormalizeContentType(normalize bool) Option {
+	return func(m *ConnectorMetadata) { m.NormalizeContentType = normalize }
+}
+
+// WithRetryBackoff sets the delay before the first retry, its multiplier for further retries and the maximum delay
+func WithRetryBackoff(base time.Duration, multiplier float64, maxDelay time.Duration) Option {
+	return func(m *ConnectorMetadata) {
+		m.RetryBackoff = base
+		m.RetryBackoffMultiplier = multiplier
+		m.RetryMaxDelay = maxDelay
+	}
+}
+
+// WithRequestTotalTimeout bounds a whole invocation including retries
+func WithRequestTotalTimeout(timeout time.Duration) Option {
+	return func(m *ConnectorMetadata) { m.RequestTotalTimeout = timeout }
+}
+
+// WithSourceCoordinateHeaders sets the incoming headers carrying the source coordinates of messages
+func WithSourceCoordinateHeaders(headers SourceCoordinateHeaders) Option {
+	return func(m *ConnectorMetadata) { m.SourceCoordinateHeaders = headers }
+}
+
+// WithForceHTTP10 applies HTTP/1.0 semantics for legacy endpoints
+func WithForceHTTP10(force bool) Option {
+	return func(m *ConnectorMetadata) { m.ForceHTTP10 = force }
+}
+
+// WithEndpointPathHeader sets the incoming header holding a subpath appended to the endpoint
+func WithEndpointPathHeader(header string) Option {
+	return func(m *ConnectorMetadata) { m.EndpointPathHeader = header }
+}
+
+// WithErrorBuffer sets the buffer collecting every ErrorResponse
+func WithErrorBuffer(buffer *ErrorBuffer) Option {
+	return func(m *ConnectorMetadata) { m.ErrorBuffer = buffer }
+}
+
+// WithJoinHeaders enables sending multi-valued headers as a single comma separated value
+func WithJoinHeaders(join bool) Option {
+	return func(m *ConnectorMetadata) { m.JoinHeaders = join }
+}
+
+// WithOutcomeReporter sets the reporter receiving the outcome of every invocation
+func WithOutcomeReporter(reporter OutcomeReporter) Option {
+	return func(m *ConnectorMetadata) { m.OutcomeReporter = reporter }
+}
+
+// WithDefaultResponseContentType sets the Content-Type assumed for responses lacking one
+func WithDefaultResponseContentType(contentType string) Option {
+	return func(m *ConnectorMetadata) { m.DefaultResponseContentType = contentType }
+}
+
+// WithWarmupBeforeSend enables warming up the endpoint before invoking it on cold connections
+func WithWarmupBeforeSend(warmup bool) Option {
+	return func(m *ConnectorMetadata) { m.WarmupBeforeSend = warmup }
+}
+
+// WithBodyHeaders sets the incoming headers injected into the field of JSON request bodies, and whether they are
+// no longer sent as HTTP headers
+func WithBodyHeaders(headers []string, field string, only bool) Option {
+	return func(m *ConnectorMetadata) {
+		m.BodyHeaders = headers
+		m.BodyHeadersField = field
+		m.BodyHeadersOnly = only
+	}
+}
+
+// WithDedupe sets the store recording processed messages and how long they are remembered
+func WithDedupe(store DedupeStore, ttl time.Duration) Option {
+	return func(m *ConnectorMetadata) {
+		m.DedupeStore = store
+		m.DedupeTTL = ttl
+	}
+}
+
+// WithErrorMessagePath sets the path of the field of JSON error bodies used as ErrorResponse.Message
+func WithErrorMessagePath(path string) Option {
+	return func(m *ConnectorMetadata) { m.ErrorMessagePath = path }
+}
+
+// WithForwardConcurrency bounds the number of concurrent publishes of a Forwarder
+func WithForwardConcurrency(concurrency int) Option {
+	return func(m *ConnectorMetadata) { m.ForwardConcurrency = concurrency }
+}
+
+// WithRetryable2xx sets the 2xx statuses treated as failures to retry
+func WithRetryable2xx(statuses ...int) Option {
+	return func(m *ConnectorMetadata) { m.Retryable2xx = statuses }
+}
+
+// WithNoRetryHeader sets the response header whose truthy value stops retrying a failed response
+func WithNoRetryHeader(name string) Option {
+	return func(m *ConnectorMetadata) { m.NoRetryHeader = name }
+}
+
+// WithCompressAlgorithm sets the algorithm request bodies are compressed with
+func WithCompressAlgorithm(algorithm string) Option {
+	return func(m *ConnectorMetadata) { m.CompressAlgorithm = algorithm }
+}
+
+// WithRateLimitThrottle sets whether requests are throttled according to the rate limit headers of responses
+func WithRateLimitThrottle(throttle bool) Option {
+	return func(m *ConnectorMetadata) { m.RateLimitThrottle = throttle }
+}
+
+// WithErrorEncoding sets how ForwardError encodes the ErrorResponse
+func WithErrorEncoding(encoding string) Option {
+	return func(m *ConnectorMetadata) { m.ErrorEncoding = encoding }
+}
+
+// WithConnMaxLifetime sets the maximum age of pooled connections
+func WithConnMaxLifetime(lifetime time.Duration) Option {
+	return func(m *ConnectorMetadata) { m.ConnMaxLifetime = lifetime }
+}
+
+// WithPoisonThreshold sets the number of consecutive failed deliveries after which a message is dead-lettered
+func WithPoisonThreshold(threshold int) Option {
+	return func(m *ConnectorMetadata) { m.PoisonThreshold = threshold }
+}
+
+// WithDNSCacheTTL sets how long resolved endpoint addresses are reused
+func WithDNSCacheTTL(ttl time.Duration) Option {
+	return func(m *ConnectorMetadata) { m.DNSCacheTTL = ttl }
+}
+
+// WithCircuitBreaker sets the circuit breaker stopping invocations after consecutive failures
+func WithCircuitBreaker(breaker *CircuitBreaker) Option {
+	return func(m *ConnectorMetadata) { m.CircuitBreaker = breaker }
+}
+
+// WithOutboundQueue sets the queue persisting messages while the circuit breaker is open
+func WithOutboundQueue(queue *OutboundQueue) Option {
+	return func(m *ConnectorMetadata) { m.OutboundQueue = queue }
+}
+
+// WithLimits sets the limits after which the connector stops processing
+func WithLimits(limits *ProcessingLimits) Option {
+	return func(m *ConnectorMetadata) { m.Limits = limits }
+}
+
+// WithSkipPostWriteTimeoutRetry sets whether timeouts after the request was sent are retried
+func WithSkipPostWriteTimeoutRetry(skip bool) Option {
+	return func(m *ConnectorMetadata) { m.SkipPostWriteTimeoutRetry = skip }
+}
+
+// WithRecentErrors sets the ring of last error responses exposed by its debug handler and the token it requires
+func WithRecentErrors(recent *RecentErrors, token string) Option {
+	return func(m *ConnectorMetadata) {
+		m.RecentErrors = recent
+		m.DebugToken = token
+	}
+}
+
+// WithResponseTransformer sets the transformation applied to responses before they are forwarded
+func WithResponseTransformer(transformer BodyTransformer) Option {
+	return func(m *ConnectorMetadata) { m.ResponseTransformer = transformer }
+}
+
+// WithPartialFailureField sets the response field listing failed parts of successfully processed messages
+func WithPartialFailureField(field string) Option {
+	return func(m *ConnectorMetadata) { m.PartialFailureField = field }
+}
+
+// WithDefaultHeaders sets the headers sent along every invocation and how they merge with incoming ones
+func WithDefaultHeaders(headers http.Header, policy string) Option {
+	return func(m *ConnectorMetadata) {
+		m.DefaultHeaders = headers
+		m.DefaultHeadersPolicy = policy
+	}
+}
+
+// WithHedging sets the delay after which attempts are hedged and the number of hedged requests allowed in flight
+func WithHedging(delay time.Duration, limit int) Option {
+	return func(m *ConnectorMetadata) {
+		m.HedgeDelay = delay
+		m.HedgeLimit = limit
+	}
+}
+
+// WithMaxMessageAge sets the header holding the event time of messages and the age after which they are dead-lettered
+func WithMaxMessageAge(header string, maxAge time.Duration) Option {
+	return func(m *ConnectorMetadata) {
+		m.EventTimeHeader = header
+		m.MaxMessageAge = maxAge
+	}
+}
+
+// WithGatewayStatuses sets the statuses of responses from gateways rather than the function
+func WithGatewayStatuses(statuses ...int) Option {
+	return func(m *ConnectorMetadata) { m.GatewayStatuses = statuses }
+}
+
+// WithDeadlineHeader sets the header carrying the invocation deadline to the function
+func WithDeadlineHeader(header string) Option {
+	return func(m *ConnectorMetadata) { m.DeadlineHeader = header }
+}
+
+// WithAbortOnTLSTrustError sets whether untrusted server certificates stop retries
+func WithAbortOnTLSTrustError(abort bool) Option {
+	return func(m *ConnectorMetadata) { m.AbortOnTLSTrustError = abort }
+}
+
+// WithErrorBodyStreamLimit sets the bytes of failed response bodies streamed to an ErrorBodyStreamer
+func WithErrorBodyStreamLimit(limit int64) Option {
+	return func(m *ConnectorMetadata) { m.ErrorBodyStreamLimit = limit }
+}
+
+// WithTraceFile sets the file receiving a record of every invocation
+func WithTraceFile(traces *TraceFile) Option {
+	return func(m *ConnectorMetadata) { m.Traces = traces }
+}
+
+// WithRetryImmediateFirst sets whether the first retry is made without waiting
+func WithRetryImmediateFirst(immediate bool) Option {
+	return func(m *ConnectorMetadata) { m.RetryImmediateFirst = immediate }
+}
+
+// WithMaxErrorBodySize sets the size ErrorResponse bodies are cut to and whether cut JSON bodies stay valid JSON
+func WithMaxErrorBodySize(size int, keepJSON bool) Option {
+	return func(m *ConnectorMetadata) {
+		m.MaxErrorBodySize = size
+		m.TruncateErrorBodyJSON = keepJSON
+	}
+}
+
+// WithSplitBatchOnTooLarge sets whether batches rejected as too large are split in halves
+func WithSplitBatchOnTooLarge(split bool) Option {
+	return func(m *ConnectorMetadata) { m.SplitBatchOnTooLarge = split }
+}
+
+// WithFailureEvents sets the Kubernetes events emitted on sustained failures
+func WithFailureEvents(events *FailureEvents) Option {
+	return func(m *ConnectorMetadata) { m.Events = events }
+}
+
+// WithResponseSchema sets the JSON Schema successful responses must conform to and whether violations are retried
+func WithResponseSchema(schema *JSONSchema, retryable bool) Option {
+	return func(m *ConnectorMetadata) {
+		m.ResponseSchema = schema
+		m.ResponseSchemaRetryable = retryable
+	}
+}
+
+// WithIdempotencyReplayHeader sets the response header telling that the function had already processed the message
+func WithIdempotencyReplayHeader(header string) Option {
+	return func(m *ConnectorMetadata) { m.IdempotencyReplayHeader = header }
+}
+
+// WithAdaptiveLogging sets the adaptive logging quieting logs while invocations are healthy
+func WithAdaptiveLogging(adaptive *AdaptiveLogging) Option {
+	return func(m *ConnectorMetadata) { m.AdaptiveLogging = adaptive }
+}
+
+// WithInstance sets the identity of the connector instance and the header carrying it to the function
+func WithInstance(instance, header string) Option {
+	return func(m *ConnectorMetadata) {
+		m.Instance = instance
+		m.InstanceHeader = header
+	}
+}
+
+// WithErrorBatching sets the number of error responses published together and how long they wait for a batch
+func WithErrorBatching(size int, interval time.Duration) Option {
+	return func(m *ConnectorMetadata) {
+		m.ErrorBatchSize = size
+		m.ErrorBatchInterval = interval
+	}
+}
+
+// WithFollowRedirects sets whether redirects are followed with loop detection and how many at most
+func WithFollowRedirects(follow bool, maxRedirects int) Option {
+	return func(m *ConnectorMetadata) {
+		m.FollowRedirects = follow
+		m.MaxRedirects = maxRedirects
+	}
+}
+
+// WithContentTypeHeader sets the incoming header holding the Content-Type of each message
+func WithContentTypeHeader(header string) Option {
+	return func(m *ConnectorMetadata) { m.ContentTypeHeader = header }
+}
+
+// WithRequiredResponseHeaders sets the headers successful responses must hold and whether responses lacking one
+// are retried
+func WithRequiredResponseHeaders(retryable bool, headers ...string) Option {
+	return func(m *ConnectorMetadata) {
+		m.RequiredResponseHeaders = headers
+		m.RequiredResponseHeadersRetryable = retryable
+	}
+}
+
+// WithSLALatencyTarget sets the latency successful invocations must complete within to comply with the SLA
+func WithSLALatencyTarget(target time.Duration) Option {
+	return func(m *ConnectorMetadata) { m.SLALatencyTarget = target }
+}
+
+// WithShadowEndpoint sets the endpoint receiving a copy of every request and the number of copies in flight
+func WithShadowEndpoint(endpoint string, concurrency int) Option {
+	return func(m *ConnectorMetadata) {
+		m.ShadowEndpoint = endpoint
+		m.ShadowConcurrency = concurrency
+	}
+}
+
+// WithBodyFieldHeaders sets the headers sent with the value of JSON body fields, mapping header names to field paths
+func WithBodyFieldHeaders(fields map[string]string) Option {
+	return func(m *ConnectorMetadata) {
+		m.BodyFieldHeaders = make(http.Header, len(fields))
+		for header, path := range fields {
+			m.BodyFieldHeaders.Set(header, path)
+		}
+	}
+}
+
+// WithPriorityLimits sets the header carrying the priority of messages, the priority of messages without it and
+// the limits per priority
+func WithPriorityLimits(header, defaultPriority string, limits *PriorityLimits) Option {
+	return func(m *ConnectorMetadata) {
+		m.PriorityHeader = header
+		m.DefaultPriority = defaultPriority
+		m.PriorityLimits = limits
+	}
+}
+
+// WithPprof exposes runtime profiles with PprofHandler, requiring token as a bearer token unless empty
+func WithPprof(token string) Option {
+	return func(m *ConnectorMetadata) {
+		m.EnablePprof = true
+		m.PprofToken = token
+	}
+}
+
+// WithAlreadyProcessed sets the response header and statuses by which the function signals it had already processed
+// the message
+func WithAlreadyProcessed(header string, statuses ...int) Option {
+	return func(m *ConnectorMetadata) {
+		m.AlreadyProcessedHeader = header
+		m.AlreadyProcessedStatuses = statuses
+	}
+}
+
+// WithRetryTimeline sets whether the timeline of every attempt is logged once retries are exhausted
+func WithRetryTimeline(enabled bool) Option {
+	return func(m *ConnectorMetadata) { m.LogRetryTimeline = enabled }
+}
+
+// WithDebugIncludeBodies sets whether the debug handler exposes the request and response bodies of errors
+func WithDebugIncludeBodies(include bool) Option {
+	return func(m *ConnectorMetadata) { m.DebugIncludeBodies = include }
+}
@@ -0,0 +1,136 @@
+package common
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestNewConnectorMetadata(t *testing.T) {
+	valid := []Option{
+		WithTopic("topic"),
+		WithEndpoint("http://function.default"),
+		WithMaxRetries(3),
+		WithContentType("application/json"),
+	}
+	tests := []struct {
+		name    string
+		opts    []Option
+		wantErr bool
+	}{
+		{name: "valid", opts: valid},
+		{name: "missing topic", opts: append(valid, WithTopic("")), wantErr: true},
+		{name: "missing endpoint", opts: append(valid, WithEndpoint("")), wantErr: true},
+		{name: "relative endpoint", opts: append(valid, WithEndpoint("function.default")), wantErr: true},
+		{name: "unsupported scheme", opts: append(valid, WithEndpoint("ftp://function.default")), wantErr: true},
+		{name: "negative retries", opts: append(valid, WithMaxRetries(-1)), wantErr: true},
+		{name: "missing content type", opts: append(valid, WithContentType("")), wantErr: true},
+		{name: "endpoint list only", opts: append(valid, WithEndpoint(""), WithEndpoints("http://a", "http://b"))},
+		{name: "invalid endpoint in list", opts: append(valid, WithEndpoints("http://a", "b")), wantErr: true},
+		{name: "dedupe store without ttl", opts: append(valid, WithDedupe(NewMemoryDedupeStore(), 0)), wantErr: true},
+		{name: "outbound queue without breaker", opts: append(valid, WithOutboundQueue(&OutboundQueue{size: 1})), wantErr: true},
+		{name: "invalid default headers policy", opts: append(valid, WithDefaultHeaders(nil, "replace")), wantErr: true},
+		{name: "backoff multiplier below 1", opts: append(valid, WithRetryBackoff(0, 0.5, 0)), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			meta, err := NewConnectorMetadata(tt.opts...)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewConnectorMetadata() error = %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil && meta.SourceName != "KEDAConnector" {
+				t.Errorf("source name = %q, want the default", meta.SourceName)
+			}
+		})
+	}
+}
+
+func TestParseConnectorMetadataKeepsAcceptingLegacyValues(t *testing.T) {
+	tests := []struct {
+		name     string
+		endpoint string
+		retries  string
+	}{
+		{name: "host only endpoint", endpoint: "function.default", retries: "3"},
+		{name: "relative endpoint", endpoint: "/function", retries: "3"},
+		{name: "negative retries", endpoint: "http://function.default", retries: "-1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setEnv(t, map[string]string{
+				"TOPIC":         "topic",
+				"HTTP_ENDPOINT": tt.endpoint,
+				"MAX_RETRIES":   tt.retries,
+				"CONTENT_TYPE":  "application/json",
+			})
+			if _, err := ParseConnectorMetadata(); err != nil {
+				t.Errorf("ParseConnectorMetadata() error = %v", err)
+			}
+		})
+	}
+}
+
+func TestParseConnectorMetadataEndpoints(t *testing.T) {
+	tests := []struct {
+		name          string
+		endpoint      string
+		endpoints     string
+		wantEndpoint  string
+		wantEndpoints []string
+		wantErr       bool
+	}{
+		{name: "single endpoint only", endpoint: "http://a", wantEndpoint: "http://a"},
+		{name: "endpoint list only", endpoints: "http://a, http://b", wantEndpoint: "http://a", wantEndpoints: []string{"http://a", "http://b"}},
+		{name: "both", endpoint: "http://primary", endpoints: "http://a,http://b", wantEndpoint: "http://primary", wantEndpoints: []string{"http://a", "http://b"}},
+		{name: "neither", wantErr: true},
+		{name: "empty list entries", endpoints: " , ", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setEnv(t, map[string]string{
+				"TOPIC":          "topic",
+				"HTTP_ENDPOINT":  tt.endpoint,
+				"HTTP_ENDPOINTS": tt.endpoints,
+				"MAX_RETRIES":    "3",
+				"CONTENT_TYPE":   "application/json",
+			})
+			meta, err := ParseConnectorMetadata()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseConnectorMetadata() error = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if meta.HTTPEndpoint != tt.wantEndpoint {
+				t.Errorf("primary endpoint = %q, want %q", meta.HTTPEndpoint, tt.wantEndpoint)
+			}
+			if !reflect.DeepEqual(meta.HTTPEndpoints, tt.wantEndpoints) {
+				t.Errorf("endpoints = %q, want %q", meta.HTTPEndpoints, tt.wantEndpoints)
+			}
+		})
+	}
+}
+
+func TestEndpointListOnlyFailsOver(t *testing.T) {
+	down, _ := statusServer(t, http.StatusServiceUnavailable)
+	up, _ := statusServer(t, http.StatusOK)
+	meta, err := NewConnectorMetadata(
+		WithTopic("topic"),
+		WithEndpoints(down.URL, up.URL),
+		WithMaxRetries(1),
+		WithContentType("application/json"),
+	)
+	if err != nil {
+		t.Fatalf("NewConnectorMetadata() error = %v", err)
+	}
+	if meta.HTTPEndpoint != down.URL {
+		t.Errorf("primary endpoint = %q, want the first of the list", meta.HTTPEndpoint)
+	}
+	resp, err := HandleHTTPRequest("{}", http.Header{}, meta, zap.NewNop())
+	if err != nil {
+		t.Fatalf("HandleHTTPRequest() error = %v", err)
+	}
+	resp.Body.Close()
+}
@@ -0,0 +1,42 @@
+package common
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// validateSubpath checks that a subpath taken from a message stays below the endpoint it is joined to
+func validateSubpath(subpath string) error {
+	decoded, err := url.PathUnescape(subpath)
+	if err != nil {
+		return fmt.Errorf("invalid subpath %q: %v", subpath, err)
+	}
+	if strings.ContainsAny(decoded, "?#\\") {
+		return fmt.Errorf("invalid subpath %q: only a path is allowed", subpath)
+	}
+	for _, segment := range strings.Split(decoded, "/") {
+		if segment == ".." {
+			return fmt.Errorf("invalid subpath %q: path traversal is not allowed", subpath)
+		}
+	}
+	return nil
+}
+
+// joinEndpointPath appends a validated subpath to the path of endpoint, with exactly one slash between them
+func joinEndpointPath(endpoint, subpath string) (string, error) {
+	if subpath == "" {
+		return endpoint, nil
+	}
+	base, err := url.Parse(endpoint)
+	if err != nil {
+		return "", fmt.Errorf("invalid http endpoint %v: %v", endpoint, err)
+	}
+	joined, err := url.Parse(strings.TrimRight(base.EscapedPath(), "/") + "/" + strings.TrimLeft(subpath, "/"))
+	if err != nil {
+		return "", fmt.Errorf("invalid subpath %q: %v", subpath, err)
+	}
+	base.Path = joined.Path
+	base.RawPath = joined.RawPath
+	return base.String(), nil
+}
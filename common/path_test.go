@@ -0,0 +1,99 @@
+package common
+
+import (
+	"net/http"
+	"sync/atomic"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestJoinEndpointPath(t *testing.T) {
+	tests := []struct {
+		endpoint string
+		subpath  string
+		want     string
+	}{
+		{endpoint: "http://function", subpath: "", want: "http://function"},
+		{endpoint: "http://function", subpath: "orders", want: "http://function/orders"},
+		{endpoint: "http://function/", subpath: "/orders", want: "http://function/orders"},
+		{endpoint: "http://function/api//", subpath: "//orders/new", want: "http://function/api/orders/new"},
+		{endpoint: "http://function/api?v=1", subpath: "orders", want: "http://function/api/orders?v=1"},
+		{endpoint: "http://function/api", subpath: "a%2Fb", want: "http://function/api/a%2Fb"},
+	}
+	for _, tt := range tests {
+		got, err := joinEndpointPath(tt.endpoint, tt.subpath)
+		if err != nil {
+			t.Errorf("joinEndpointPath(%q, %q) error = %v", tt.endpoint, tt.subpath, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("joinEndpointPath(%q, %q) = %q, want %q", tt.endpoint, tt.subpath, got, tt.want)
+		}
+	}
+}
+
+func TestValidateSubpath(t *testing.T) {
+	tests := []struct {
+		subpath string
+		wantErr bool
+	}{
+		{subpath: "orders/new"},
+		{subpath: "orders..new"},
+		{subpath: "../admin", wantErr: true},
+		{subpath: "orders/../../admin", wantErr: true},
+		{subpath: "%2e%2e/admin", wantErr: true},
+		{subpath: "..", wantErr: true},
+		{subpath: "orders?admin=true", wantErr: true},
+		{subpath: "orders#fragment", wantErr: true},
+		{subpath: "..\\admin", wantErr: true},
+		{subpath: "%zz", wantErr: true},
+	}
+	for _, tt := range tests {
+		if err := validateSubpath(tt.subpath); (err != nil) != tt.wantErr {
+			t.Errorf("validateSubpath(%q) error = %v, want error %v", tt.subpath, err, tt.wantErr)
+		}
+	}
+}
+
+func TestEndpointPathHeader(t *testing.T) {
+	tests := []struct {
+		name     string
+		subpath  string
+		wantPath string
+		wantErr  bool
+	}{
+		{name: "joined", subpath: "orders/new", wantPath: "/api/orders/new"},
+		{name: "without header", subpath: "", wantPath: "/api"},
+		{name: "traversal rejected", subpath: "../admin", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var requests int32
+			var gotPath string
+			srv := newServer(t, func(w http.ResponseWriter, r *http.Request) {
+				atomic.AddInt32(&requests, 1)
+				gotPath = r.URL.Path
+			})
+			data := testMetadata(t, srv.URL+"/api", WithEndpointPathHeader("X-Path"))
+			headers := http.Header{}
+			if tt.subpath != "" {
+				headers.Set("X-Path", tt.subpath)
+			}
+			resp, err := HandleHTTPRequest("{}", headers, data, zap.NewNop())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("HandleHTTPRequest() error = %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				if requests != 0 {
+					t.Errorf("server received %v requests for a rejected subpath", requests)
+				}
+				return
+			}
+			resp.Body.Close()
+			if gotPath != tt.wantPath {
+				t.Errorf("path = %q, want %q", gotPath, tt.wantPath)
+			}
+		})
+	}
+}
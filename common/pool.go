@@ -0,0 +1,76 @@
+package common
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// maxPooledBufferSize bounds the capacity of buffers kept in the pool, so that an occasional huge message doesn't pin memory
+const maxPooledBufferSize = 1 << 20
+
+// bufferPool recycles the buffers holding request and error bodies to reduce allocations under load
+var bufferPool = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
+}
+
+// getBuffer returns an empty buffer from the pool
+func getBuffer() *bytes.Buffer {
+	buf := bufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	return buf
+}
+
+// putBuffer returns buf to the pool, buf must not be used afterwards
+func putBuffer(buf *bytes.Buffer) {
+	if buf.Cap() > maxPooledBufferSize {
+		return
+	}
+	bufferPool.Put(buf)
+}
+
+// sharedBuffer is a pooled buffer read by the request bodies of every attempt of an invocation.
+// The transport may still read a request body after the response is returned, so the buffer only goes back
+// to the pool once the invocation released it and every body handed out has been closed.
+type sharedBuffer struct {
+	buf  *bytes.Buffer
+	refs int32
+}
+
+// newSharedBuffer returns a shared buffer holding a reference released by release
+func newSharedBuffer(buf *bytes.Buffer) *sharedBuffer {
+	return &sharedBuffer{buf: buf, refs: 1}
+}
+
+// reader returns a body reading the buffer content, which must be closed
+func (b *sharedBuffer) reader() io.ReadCloser {
+	atomic.AddInt32(&b.refs, 1)
+	return &sharedReader{Reader: bytes.NewReader(b.buf.Bytes()), owner: b}
+}
+
+// release drops a reference, returning the buffer to the pool with the last one
+func (b *sharedBuffer) release() {
+	if atomic.AddInt32(&b.refs, -1) == 0 {
+		putBuffer(b.buf)
+	}
+}
+
+type sharedReader struct {
+	*bytes.Reader
+	owner *sharedBuffer
+	once  sync.Once
+}
+
+func (r *sharedReader) Close() error {
+	r.once.Do(r.owner.release)
+	return nil
+}
+
+// readAllPooled reads r to the end through a pooled buffer and returns a copy of the content
+func readAllPooled(r io.Reader) ([]byte, error) {
+	buf := getBuffer()
+	defer putBuffer(buf)
+	_, err := buf.ReadFrom(r)
+	return append([]byte(nil), buf.Bytes()...), err
+}
@@ -0,0 +1,139 @@
+package common
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestReadAllPooled(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+	}{
+		{name: "empty", body: ""},
+		{name: "small", body: "small body"},
+		{name: "large", body: strings.Repeat("x", 64<<10)},
+		{name: "above pooled size", body: strings.Repeat("y", maxPooledBufferSize+1)},
+	}
+	var results [][]byte
+	for _, tt := range tests {
+		got, err := readAllPooled(strings.NewReader(tt.body))
+		if err != nil {
+			t.Fatalf("%v: readAllPooled() error = %v", tt.name, err)
+		}
+		results = append(results, got)
+	}
+	// Results must not share the pooled buffers reused by later reads
+	for i, tt := range tests {
+		if string(results[i]) != tt.body {
+			t.Errorf("%v: content changed once the buffer was reused", tt.name)
+		}
+	}
+}
+
+func TestSharedBufferReleasedOnceClosed(t *testing.T) {
+	buf := getBuffer()
+	buf.WriteString("request body")
+	shared := newSharedBuffer(buf)
+	first, second := shared.reader(), shared.reader()
+	shared.release()
+	first.Close()
+	first.Close()
+	// The second body is still open, the buffer must not have been reused
+	reused := getBuffer()
+	reused.WriteString("overwritten")
+	defer putBuffer(reused)
+	got, _ := ioutil.ReadAll(second)
+	second.Close()
+	if string(got) != "request body" {
+		t.Errorf("open body read %q, want %q", got, "request body")
+	}
+	if shared.refs != 0 {
+		t.Errorf("%v references left, want 0", shared.refs)
+	}
+}
+
+func TestBufferedStreamReusedAcrossInvocations(t *testing.T) {
+	var mu sync.Mutex
+	attempts := make(map[string]int)
+	srv := newServer(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		attempts[string(body)]++
+		n := attempts[string(body)]
+		mu.Unlock()
+		if n == 1 {
+			// Fail the first attempt so that the pooled body is sent again
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write(body)
+	})
+	data := testMetadata(t, srv.URL, WithMaxRetries(1))
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			message := fmt.Sprintf(`{"message":%d,"padding":%q}`, i, strings.Repeat("p", i*100))
+			resp, err := HandleHTTPRequestStream(strings.NewReader(message), http.Header{}, data, zap.NewNop())
+			if err != nil {
+				t.Errorf("message %v failed: %v", i, err)
+				return
+			}
+			if got, _ := ResponseString(resp); got != message {
+				t.Errorf("message %v echoed as %q", i, got)
+			}
+		}(i)
+	}
+	wg.Wait()
+	for message, n := range attempts {
+		if n != 2 {
+			t.Errorf("message %.20q sent %v times, want 2", message, n)
+		}
+	}
+}
+
+func BenchmarkReadErrorBody(b *testing.B) {
+	body := bytes.Repeat([]byte("error body "), 1000)
+	b.Run("ioutil.ReadAll", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			ioutil.ReadAll(bytes.NewReader(body))
+		}
+	})
+	b.Run("readAllPooled", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			readAllPooled(bytes.NewReader(body))
+		}
+	})
+}
+
+func BenchmarkHandleHTTPRequestStream(b *testing.B) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { ioutil.ReadAll(r.Body) }))
+	defer srv.Close()
+	data := ConnectorMetadata{Topic: "topic", HTTPEndpoint: srv.URL, ContentType: "application/json", OutcomeReporter: nopReporter{}}
+	message := strings.Repeat("m", 16<<10)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		resp, err := HandleHTTPRequestStream(strings.NewReader(message), http.Header{}, data, zap.NewNop())
+		if err != nil {
+			b.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+}
+
+// nopReporter is an OutcomeReporter ignoring outcomes, keeping metrics out of benchmarks
+type nopReporter struct{}
+
+func (nopReporter) Report(Outcome, ConnectorMetadata, InvocationReport) {}
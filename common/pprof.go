@@ -0,0 +1,94 @@
+package common
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"runtime"
+	"runtime/pprof"
+	"runtime/trace"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Durations of the CPU profile and execution trace unless requested otherwise with the seconds parameter
+const (
+	defaultCPUProfileDuration = 30 * time.Second
+	defaultTraceDuration      = time.Second
+)
+
+// PprofHandler returns the handler serving runtime profiles in the format of net/http/pprof, to be mounted at
+// /debug/pprof/, authenticated with PprofToken, or one responding 404 Not Found unless EnablePprof is set. Unlike importing net/http/pprof,
+// it doesn't register the profiles on http.DefaultServeMux, so they are only exposed where mounted.
+func (m ConnectorMetadata) PprofHandler() http.Handler {
+	if !m.EnablePprof {
+		return http.NotFoundHandler()
+	}
+	return requireToken(m.PprofToken, http.HandlerFunc(servePprof))
+}
+
+// servePprof serves the profile named by the last element of the request path, or the list of profiles
+func servePprof(w http.ResponseWriter, req *http.Request) {
+	switch name := path.Base(req.URL.Path); name {
+	case "profile":
+		serveTimed(w, req, defaultCPUProfileDuration, pprof.StartCPUProfile, pprof.StopCPUProfile)
+	case "trace":
+		serveTimed(w, req, defaultTraceDuration, trace.Start, trace.Stop)
+	case "cmdline":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprint(w, strings.Join(os.Args, "\x00"))
+	case "pprof", "/", ".":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		for _, profile := range pprof.Profiles() {
+			fmt.Fprintf(w, "%v %v\n", profile.Count(), profile.Name())
+		}
+		fmt.Fprintln(w, "profile")
+		fmt.Fprintln(w, "trace")
+	default:
+		profile := pprof.Lookup(name)
+		if profile == nil {
+			http.Error(w, fmt.Sprintf("unknown profile %q", name), http.StatusNotFound)
+			return
+		}
+		debug, _ := strconv.Atoi(req.FormValue("debug"))
+		if name == "heap" && req.FormValue("gc") != "" {
+			runtime.GC()
+		}
+		if debug != 0 {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		} else {
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+		}
+		profile.WriteTo(w, debug)
+	}
+}
+
+// serveTimed records a profile between start and stop for the duration in the seconds parameter, fallback if missing
+func serveTimed(w http.ResponseWriter, req *http.Request, fallback time.Duration, start func(w io.Writer) error, stop func()) {
+	duration := fallback
+	if raw := req.FormValue("seconds"); raw != "" {
+		seconds, err := strconv.ParseFloat(raw, 64)
+		if err != nil || seconds <= 0 {
+			http.Error(w, fmt.Sprintf("invalid seconds parameter %q", raw), http.StatusBadRequest)
+			return
+		}
+		duration = time.Duration(seconds * float64(time.Second))
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", `attachment; filename="profile"`)
+	if err := start(w); err != nil {
+		// Only one CPU profile or trace can be recorded at a time
+		w.Header().Del("Content-Disposition")
+		http.Error(w, fmt.Sprintf("could not start profiling: %v", err), http.StatusInternalServerError)
+		return
+	}
+	select {
+	case <-time.After(duration):
+	case <-req.Context().Done():
+	}
+	stop()
+}
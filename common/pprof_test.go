@@ -0,0 +1,106 @@
+package common
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestPprofHandler(t *testing.T) {
+	tests := []struct {
+		name            string
+		enabled         bool
+		token           string
+		path            string
+		auth            string
+		wantStatus      int
+		wantContentType string
+		wantBody        string
+	}{
+		{name: "disabled", path: "/debug/pprof/", wantStatus: http.StatusNotFound},
+		{name: "disabled profile", path: "/debug/pprof/heap", wantStatus: http.StatusNotFound},
+		{name: "index", enabled: true, path: "/debug/pprof/", wantStatus: http.StatusOK, wantContentType: "text/plain; charset=utf-8", wantBody: "goroutine"},
+		{name: "missing token", enabled: true, token: "s3cret", path: "/debug/pprof/", wantStatus: http.StatusUnauthorized},
+		{name: "wrong token", enabled: true, token: "s3cret", path: "/debug/pprof/", auth: "Bearer guess", wantStatus: http.StatusUnauthorized},
+		{name: "token", enabled: true, token: "s3cret", path: "/debug/pprof/", auth: "Bearer s3cret", wantStatus: http.StatusOK, wantBody: "heap"},
+		{name: "text profile", enabled: true, path: "/debug/pprof/goroutine?debug=1", wantStatus: http.StatusOK, wantContentType: "text/plain; charset=utf-8", wantBody: "goroutine profile"},
+		{name: "binary profile", enabled: true, path: "/debug/pprof/heap?gc=1", wantStatus: http.StatusOK, wantContentType: "application/octet-stream"},
+		{name: "unknown profile", enabled: true, path: "/debug/pprof/unknown", wantStatus: http.StatusNotFound},
+		{name: "cmdline", enabled: true, path: "/debug/pprof/cmdline", wantStatus: http.StatusOK, wantBody: ".test"},
+		{name: "cpu profile", enabled: true, path: "/debug/pprof/profile?seconds=0.05", wantStatus: http.StatusOK, wantContentType: "application/octet-stream"},
+		{name: "trace", enabled: true, path: "/debug/pprof/trace?seconds=0.05", wantStatus: http.StatusOK, wantContentType: "application/octet-stream"},
+		{name: "invalid seconds", enabled: true, path: "/debug/pprof/profile?seconds=soon", wantStatus: http.StatusBadRequest},
+		{name: "negative seconds", enabled: true, path: "/debug/pprof/trace?seconds=-1", wantStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := ConnectorMetadata{EnablePprof: tt.enabled, PprofToken: tt.token}
+			mux := http.NewServeMux()
+			mux.Handle("/debug/pprof/", data.PprofHandler())
+			srv := newServer(t, mux.ServeHTTP)
+			req, err := http.NewRequest(http.MethodGet, srv.URL+tt.path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.auth != "" {
+				req.Header.Set("Authorization", tt.auth)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, _ := ioutil.ReadAll(resp.Body)
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("status = %v, want %v: %s", resp.StatusCode, tt.wantStatus, body)
+			}
+			if tt.wantContentType != "" && resp.Header.Get("Content-Type") != tt.wantContentType {
+				t.Errorf("Content-Type = %q, want %q", resp.Header.Get("Content-Type"), tt.wantContentType)
+			}
+			if !strings.Contains(string(body), tt.wantBody) {
+				t.Errorf("body = %.200q, want it to contain %q", body, tt.wantBody)
+			}
+			if tt.wantContentType == "application/octet-stream" && len(body) == 0 {
+				t.Error("empty profile")
+			}
+		})
+	}
+}
+
+func TestParseConnectorMetadataPprof(t *testing.T) {
+	tests := []struct {
+		name        string
+		env         map[string]string
+		wantEnabled bool
+		wantToken   string
+		wantErr     bool
+	}{
+		{name: "unset", env: map[string]string{}},
+		{name: "enabled", env: map[string]string{"ENABLE_PPROF": "true", "PPROF_TOKEN": "s3cret"}, wantEnabled: true, wantToken: "s3cret"},
+		{name: "invalid", env: map[string]string{"ENABLE_PPROF": "on demand"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := map[string]string{
+				"TOPIC":         "topic",
+				"HTTP_ENDPOINT": "http://function.default",
+				"MAX_RETRIES":   "3",
+				"CONTENT_TYPE":  "application/json",
+				"ENABLE_PPROF":  "",
+				"PPROF_TOKEN":   "",
+			}
+			for name, value := range tt.env {
+				env[name] = value
+			}
+			setEnv(t, env)
+			meta, err := ParseConnectorMetadata()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseConnectorMetadata() error = %v, want error %v", err, tt.wantErr)
+			}
+			if meta.EnablePprof != tt.wantEnabled || meta.PprofToken != tt.wantToken {
+				t.Errorf("pprof enabled %v with token %q, want %v with %q", meta.EnablePprof, meta.PprofToken, tt.wantEnabled, tt.wantToken)
+			}
+		})
+	}
+}
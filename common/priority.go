@@ -0,0 +1,155 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PriorityLimits caps the concurrency and rate of invocations per priority, read from PriorityHeader, so that
+// bulk low priority messages can't starve high priority ones. Priorities without limits are never throttled.
+type PriorityLimits struct {
+	mu     sync.Mutex
+	limits map[string]*priorityLimit
+}
+
+type priorityLimit struct {
+	slots    chan struct{} // held by invocations in flight, nil without concurrency limit
+	interval time.Duration // between invocations, zero without rate limit
+	next     time.Time     // earliest time the next invocation may start
+}
+
+// NewPriorityLimits returns PriorityLimits allowing concurrency[p] invocations of priority p in flight and
+// rates[p] invocations per second. Priorities missing from concurrency have no concurrency limit, those missing from
+// rates or with a zero rate no rate limit.
+func NewPriorityLimits(concurrency map[string]int, rates map[string]float64) (*PriorityLimits, error) {
+	p := &PriorityLimits{limits: make(map[string]*priorityLimit)}
+	limit := func(priority string) *priorityLimit {
+		if _, ok := p.limits[priority]; !ok {
+			p.limits[priority] = &priorityLimit{}
+		}
+		return p.limits[priority]
+	}
+	for priority, n := range concurrency {
+		if n < 1 {
+			return nil, fmt.Errorf("concurrency of priority %q must be at least 1, got %v", priority, n)
+		}
+		limit(priority).slots = make(chan struct{}, n)
+	}
+	for priority, rate := range rates {
+		if !(rate >= 0) || math.IsInf(rate, 0) {
+			return nil, fmt.Errorf("rate of priority %q must be a non-negative number, got %v", priority, rate)
+		}
+		if rate > 0 {
+			limit(priority).interval = time.Duration(float64(time.Second) / rate)
+		}
+	}
+	return p, nil
+}
+
+// acquire waits until an invocation of priority may start, returning the function to call once it completed,
+// or the context error if ctx is done first
+func (p *PriorityLimits) acquire(ctx context.Context, priority string) (func(), error) {
+	limit, ok := p.limits[priority]
+	if !ok {
+		return func() {}, nil
+	}
+	if limit.slots != nil {
+		select {
+		case limit.slots <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	release := func() {
+		if limit.slots != nil {
+			<-limit.slots
+		}
+	}
+	if limit.interval > 0 {
+		p.mu.Lock()
+		current := now()
+		if limit.next.Before(current) {
+			limit.next = current
+		}
+		delay := limit.next.Sub(current)
+		limit.next = limit.next.Add(limit.interval)
+		p.mu.Unlock()
+		if err := sleepContext(ctx, delay); err != nil {
+			release()
+			return nil, err
+		}
+	}
+	return release, nil
+}
+
+// getPriorityLimitsEnv returns the PriorityLimits configured by the PRIORITY_CONCURRENCY and PRIORITY_RATE_LIMIT
+// environment variables, comma separated priority=value pairs such as "bulk=2,low=10", or nil if neither is set
+func getPriorityLimitsEnv() (*PriorityLimits, error) {
+	concurrency := make(map[string]int)
+	err := parsePriorityValues("PRIORITY_CONCURRENCY", func(priority, raw string) error {
+		n, err := strconv.Atoi(raw)
+		if err != nil {
+			return err
+		}
+		if n < 1 {
+			return fmt.Errorf("concurrency of priority %q must be at least 1, got %v", priority, n)
+		}
+		concurrency[priority] = n
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	rates := make(map[string]float64)
+	err = parsePriorityValues("PRIORITY_RATE_LIMIT", func(priority, raw string) error {
+		rate, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return err
+		}
+		rates[priority] = rate
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(concurrency) == 0 && len(rates) == 0 {
+		return nil, nil
+	}
+	return NewPriorityLimits(concurrency, rates)
+}
+
+// parsePriorityValues calls parse with each priority=value pair of environment variable name
+func parsePriorityValues(name string, parse func(priority, value string) error) error {
+	for _, pair := range splitList(os.Getenv(name)) {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			return fmt.Errorf("failed to parse value from %v environment variable: invalid priority value %q", name, pair)
+		}
+		if err := parse(strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])); err != nil {
+			return fmt.Errorf("failed to parse value from %v environment variable %v", name, err)
+		}
+	}
+	return nil
+}
+
+// acquirePriority waits on PriorityLimits for the priority of the message in PriorityHeader, DefaultPriority if
+// missing, recording the wait in the limiter_wait_seconds metric
+func (m ConnectorMetadata) acquirePriority(ctx context.Context, headers http.Header) (func(), error) {
+	priority := m.DefaultPriority
+	if m.PriorityHeader != "" {
+		if value := strings.TrimSpace(headers.Get(m.PriorityHeader)); value != "" {
+			priority = value
+		}
+	}
+	start := now()
+	release, err := m.PriorityLimits.acquire(ctx, priority)
+	limiterWaitSeconds.WithLabelValues(m.SourceName, limiterPriority).Observe(since(start).Seconds())
+	return release, err
+}
@@ -0,0 +1,180 @@
+package common
+
+import (
+	"context"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestPriorityConcurrency(t *testing.T) {
+	arrived := make(chan string, 8)
+	release := make(chan struct{})
+	srv := newServer(t, func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		arrived <- r.Header.Get("X-Priority")
+		if r.Header.Get("X-Priority") == "bulk" {
+			<-release
+		}
+	})
+	limits, err := NewPriorityLimits(map[string]int{"bulk": 1}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := testMetadata(t, srv.URL, WithPriorityLimits("X-Priority", "bulk", limits))
+	invoke := func(ctx context.Context, priority string) chan error {
+		done := make(chan error, 1)
+		headers := http.Header{}
+		if priority != "" {
+			headers.Set("X-Priority", priority)
+		}
+		go func() {
+			resp, _, err := InvokeHTTPRequest(ctx, "{}", headers, data, zap.NewNop())
+			if err == nil {
+				resp.Body.Close()
+			}
+			done <- err
+		}()
+		return done
+	}
+
+	first := invoke(context.Background(), "bulk")
+	if got := <-arrived; got != "bulk" {
+		t.Fatalf("first request has priority %q", got)
+	}
+	// Messages without priority header have the default priority, waiting for the bulk slot
+	second := invoke(context.Background(), "")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancelled := invoke(ctx, "bulk")
+	// Other priorities aren't starved by bulk messages
+	if err := <-invoke(context.Background(), "high"); err != nil {
+		t.Fatalf("high priority invocation failed: %v", err)
+	}
+	if got := <-arrived; got != "high" {
+		t.Fatalf("request with priority %q arrived while the bulk slot is held", got)
+	}
+	cancel()
+	if err := <-cancelled; err != context.Canceled {
+		t.Errorf("invocation waiting for a slot error = %v, want %v", err, context.Canceled)
+	}
+	select {
+	case got := <-arrived:
+		t.Fatalf("request with priority %q arrived while the bulk slot is held", got)
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(release)
+	for i, done := range []chan error{first, second} {
+		if err := <-done; err != nil {
+			t.Errorf("bulk invocation %v failed: %v", i, err)
+		}
+	}
+}
+
+func TestPriorityRate(t *testing.T) {
+	clock := useFakeClock(t)
+	limits, err := NewPriorityLimits(nil, map[string]float64{"bulk": 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	release, err := limits.acquire(context.Background(), "bulk")
+	if err != nil {
+		t.Fatalf("acquire() error = %v", err)
+	}
+	release()
+	acquired := make(chan error, 1)
+	go func() {
+		release, err := limits.acquire(context.Background(), "bulk")
+		if err == nil {
+			release()
+		}
+		acquired <- err
+	}()
+	// 10 invocations per second start 100ms apart
+	waitForTimers(t, clock, 1)
+	clock.Advance(50 * time.Millisecond)
+	select {
+	case <-acquired:
+		t.Fatal("acquired before the rate allows it")
+	case <-time.After(20 * time.Millisecond):
+	}
+	clock.Advance(50 * time.Millisecond)
+	if err := <-acquired; err != nil {
+		t.Errorf("acquire() error = %v", err)
+	}
+	if release, err := limits.acquire(context.Background(), "unlimited"); err != nil {
+		t.Errorf("acquire() of a priority without limits error = %v", err)
+	} else {
+		release()
+	}
+}
+
+func TestNewPriorityLimitsInvalid(t *testing.T) {
+	tests := []struct {
+		name        string
+		concurrency map[string]int
+		rates       map[string]float64
+	}{
+		{name: "zero concurrency", concurrency: map[string]int{"bulk": 0}},
+		{name: "negative concurrency", concurrency: map[string]int{"bulk": -1}},
+		{name: "negative rate", rates: map[string]float64{"bulk": -1}},
+		{name: "NaN rate", rates: map[string]float64{"bulk": math.NaN()}},
+		{name: "infinite rate", rates: map[string]float64{"bulk": math.Inf(1)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewPriorityLimits(tt.concurrency, tt.rates); err == nil {
+				t.Error("NewPriorityLimits() succeeded")
+			}
+		})
+	}
+}
+
+func TestGetPriorityLimitsEnv(t *testing.T) {
+	tests := []struct {
+		name         string
+		concurrency  string
+		rates        string
+		wantSlots    map[string]int
+		wantInterval map[string]time.Duration
+		wantNil      bool
+		wantErr      bool
+	}{
+		{name: "unset", wantNil: true},
+		{name: "concurrency", concurrency: "bulk=2, low=10", wantSlots: map[string]int{"bulk": 2, "low": 10}},
+		{name: "rates", rates: "bulk=4,low=0", wantInterval: map[string]time.Duration{"bulk": 250 * time.Millisecond}},
+		{name: "fractional concurrency", concurrency: "bulk=1.5", wantErr: true},
+		{name: "zero concurrency", concurrency: "bulk=0", wantErr: true},
+		{name: "missing value", concurrency: "bulk", wantErr: true},
+		{name: "missing priority", concurrency: "=2", wantErr: true},
+		{name: "invalid rate", rates: "bulk=fast", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setEnv(t, map[string]string{"PRIORITY_CONCURRENCY": tt.concurrency, "PRIORITY_RATE_LIMIT": tt.rates})
+			limits, err := getPriorityLimitsEnv()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("getPriorityLimitsEnv() error = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if (limits == nil) != tt.wantNil {
+				t.Fatalf("getPriorityLimitsEnv() = %v, want nil %v", limits, tt.wantNil)
+			}
+			for priority, want := range tt.wantSlots {
+				if got := cap(limits.limits[priority].slots); got != want {
+					t.Errorf("concurrency of %v = %v, want %v", priority, got, want)
+				}
+			}
+			for priority, want := range tt.wantInterval {
+				if got := limits.limits[priority].interval; got != want {
+					t.Errorf("interval of %v = %v, want %v", priority, got, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,187 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// ErrMessageQueued is returned instead of invoking the function when the message was persisted to the
+// OutboundQueue to be sent once the endpoint recovers; the message should be acked
+var ErrMessageQueued = errors.New("message queued until the endpoint recovers")
+
+// ErrQueueFull is returned when queueing a message to a full OutboundQueue
+var ErrQueueFull = errors.New("outbound queue full")
+
+// DefaultOutboundQueueSize bounds the number of messages of an OutboundQueue unless configured otherwise
+const DefaultOutboundQueueSize = 1000
+
+// outboundQueuePollInterval is how often RunOutboundQueue checks whether queued messages can be sent
+const outboundQueuePollInterval = time.Second
+
+// queuedMessage is a message persisted by an OutboundQueue
+type queuedMessage struct {
+	Message string      `json:"message"`
+	Headers http.Header `json:"headers,omitempty"`
+}
+
+// OutboundQueue persists messages to a directory, one file per message named after its sequence number,
+// while the circuit breaker is open, so that they are delivered in order once the endpoint recovers
+type OutboundQueue struct {
+	dir  string
+	size int
+
+	mu      sync.Mutex
+	pending []uint64
+	next    uint64
+}
+
+// NewOutboundQueue returns an OutboundQueue holding up to size messages in dir, resuming the messages left in it
+func NewOutboundQueue(dir string, size int) (*OutboundQueue, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	q := &OutboundQueue{dir: dir, size: size}
+	for _, file := range files {
+		seq, err := strconv.ParseUint(strings.TrimSuffix(file.Name(), ".json"), 10, 64)
+		if err != nil || !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+		q.pending = append(q.pending, seq)
+		if seq >= q.next {
+			q.next = seq + 1
+		}
+	}
+	sort.Slice(q.pending, func(i, j int) bool { return q.pending[i] < q.pending[j] })
+	return q, nil
+}
+
+func (q *OutboundQueue) path(seq uint64) string {
+	return filepath.Join(q.dir, fmt.Sprintf("%020d.json", seq))
+}
+
+// Len returns the number of queued messages
+func (q *OutboundQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.pending)
+}
+
+// push persists message and headers at the tail of the queue
+func (q *OutboundQueue) push(message string, headers http.Header) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.pending) >= q.size {
+		return ErrQueueFull
+	}
+	raw, err := json.Marshal(queuedMessage{Message: message, Headers: headers})
+	if err != nil {
+		return err
+	}
+	seq := q.next
+	// Write to a temporary file first so that a crash never leaves a partial message behind
+	tmp := q.path(seq) + ".tmp"
+	if err := ioutil.WriteFile(tmp, raw, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, q.path(seq)); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	q.next++
+	q.pending = append(q.pending, seq)
+	return nil
+}
+
+// peek returns the message at the head of the queue, if any
+func (q *OutboundQueue) peek() (queuedMessage, bool, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var msg queuedMessage
+	if len(q.pending) == 0 {
+		return msg, false, nil
+	}
+	raw, err := ioutil.ReadFile(q.path(q.pending[0]))
+	if err != nil {
+		return msg, false, err
+	}
+	return msg, true, json.Unmarshal(raw, &msg)
+}
+
+// pop removes the message at the head of the queue
+func (q *OutboundQueue) pop() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.pending) == 0 {
+		return nil
+	}
+	if err := os.Remove(q.path(q.pending[0])); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	q.pending = q.pending[1:]
+	return nil
+}
+
+// RunOutboundQueue sends the messages of data.OutboundQueue in order whenever the circuit breaker lets invocations through,
+// until ctx is done. Messages are invoked like messages consumed directly, going through dedupe, limits, outcome
+// reporting and tracing. handle is called with the outcome of each sent message, e.g. to forward the response or the error.
+// A message is kept queued if it can't be read, its invocation is incomplete or reopens the breaker.
+func RunOutboundQueue(ctx context.Context, data ConnectorMetadata, logger *zap.Logger, handle func(message string, resp *http.Response, report InvocationReport, err error)) error {
+	queue := data.OutboundQueue
+	if queue == nil {
+		return nil
+	}
+	for {
+		for queue.Len() > 0 && ctx.Err() == nil && data.CircuitBreaker.State() != BreakerOpen {
+			msg, ok, err := queue.peek()
+			if err != nil {
+				logger.Error("failed to read queued message, retrying later",
+					zap.Error(err),
+					zap.String("source", data.SourceName))
+				break
+			}
+			if !ok {
+				break
+			}
+			body := payload{
+				open:    func() io.Reader { return strings.NewReader(msg.Message) },
+				length:  int64(len(msg.Message)),
+				message: func() string { return msg.Message },
+				queued:  true,
+			}
+			resp, report, err := handleHTTPRequest(ctx, body, msg.Headers, data, logger)
+			if report.Outcome == OutcomeIncomplete || data.CircuitBreaker.State() == BreakerOpen {
+				if resp != nil {
+					resp.Body.Close()
+				}
+				break
+			}
+			if err := queue.pop(); err != nil {
+				logger.Error("failed to remove sent message from the outbound queue",
+					zap.Error(err),
+					zap.String("source", data.SourceName))
+			}
+			handle(msg.Message, resp, report, err)
+		}
+		if err := sleepContext(ctx, outboundQueuePollInterval); err != nil {
+			return err
+		}
+	}
+}
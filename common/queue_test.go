@@ -0,0 +1,237 @@
+package common
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// outageServer starts a server responding 503 until up is set, recording the bodies it received while up
+type outageServer struct {
+	up     int32
+	mu     sync.Mutex
+	bodies []string
+}
+
+func newOutageServer(t *testing.T) (*outageServer, string) {
+	t.Helper()
+	s := &outageServer{}
+	srv := newServer(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if atomic.LoadInt32(&s.up) == 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.bodies = append(s.bodies, string(body))
+	})
+	return s, srv.URL
+}
+
+func (s *outageServer) received() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.bodies...)
+}
+
+// runQueue runs RunOutboundQueue until the test completes, returning the messages it handled so far
+func runQueue(t *testing.T, data ConnectorMetadata) func() []string {
+	t.Helper()
+	var mu sync.Mutex
+	var handled []string
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- RunOutboundQueue(ctx, data, zap.NewNop(), func(message string, resp *http.Response, report InvocationReport, err error) {
+			if resp != nil {
+				resp.Body.Close()
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			handled = append(handled, message)
+		})
+	}()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-done; err != context.Canceled {
+			t.Errorf("RunOutboundQueue() error = %v, want %v", err, context.Canceled)
+		}
+	})
+	return func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), handled...)
+	}
+}
+
+// waitForMessages waits until get returns n messages
+func waitForMessages(t *testing.T, get func() []string, n int) []string {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		messages := get()
+		if len(messages) >= n {
+			return messages
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got %v messages, want %v", messages, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestOutboundQueueOutageThenRecovery(t *testing.T) {
+	clock := useFakeClock(t)
+	srv, endpoint := newOutageServer(t)
+	queue, err := NewOutboundQueue(t.TempDir(), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	breaker := NewCircuitBreaker(1, 30*time.Second)
+	data := testMetadata(t, endpoint, WithCircuitBreaker(breaker), WithOutboundQueue(queue))
+
+	// The failure opens the breaker, the following messages are queued
+	if _, err := HandleHTTPRequest("m0", http.Header{}, data, zap.NewNop()); err == nil {
+		t.Fatal("expected the first message to fail")
+	}
+	for _, message := range []string{"m1", "m2", "m3"} {
+		if _, err := HandleHTTPRequest(message, http.Header{}, data, zap.NewNop()); err != ErrMessageQueued {
+			t.Fatalf("%v: error = %v, want %v", message, err, ErrMessageQueued)
+		}
+	}
+	// Chunked streams can't be queued, they fail fast
+	chunked := data
+	chunked.ChunkedTransfer = true
+	if _, err := HandleHTTPRequestStream(strings.NewReader("stream"), http.Header{}, chunked, zap.NewNop()); err != ErrCircuitOpen {
+		t.Errorf("stream error = %v, want %v", err, ErrCircuitOpen)
+	}
+	if queue.Len() != 3 {
+		t.Fatalf("queued %v messages, want 3", queue.Len())
+	}
+
+	atomic.StoreInt32(&srv.up, 1)
+	handled := runQueue(t, data)
+	// Nothing is sent until the breaker cooldown elapses
+	waitForTimers(t, clock, 1)
+	if got := srv.received(); len(got) != 0 {
+		t.Fatalf("sent %v while the breaker was open", got)
+	}
+	clock.Advance(30 * time.Second)
+	want := []string{"m1", "m2", "m3"}
+	if got := waitForMessages(t, handled, 3); !reflect.DeepEqual(got, want) {
+		t.Errorf("handled %v, want %v", got, want)
+	}
+	if got := srv.received(); !reflect.DeepEqual(got, want) {
+		t.Errorf("delivered %v, want %v", got, want)
+	}
+	if queue.Len() != 0 || breaker.State() != BreakerClosed {
+		t.Errorf("%v messages left queued with the breaker %v, want none and closed", queue.Len(), breaker.State())
+	}
+}
+
+func TestOutboundQueuePeekErrorKeepsMessage(t *testing.T) {
+	clock := useFakeClock(t)
+	srv, endpoint := newOutageServer(t)
+	atomic.StoreInt32(&srv.up, 1)
+	queue, err := NewOutboundQueue(t.TempDir(), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := queue.push("m0", nil); err != nil {
+		t.Fatal(err)
+	}
+	// Make the queued message unreadable
+	path := queue.path(0)
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(path)
+	os.Mkdir(path, 0700)
+
+	data := testMetadata(t, endpoint, WithCircuitBreaker(NewCircuitBreaker(1, time.Minute)), WithOutboundQueue(queue))
+	handled := runQueue(t, data)
+	waitForTimers(t, clock, 1)
+	if queue.Len() != 1 || len(srv.received()) != 0 {
+		t.Fatalf("%v messages queued and %v sent after the read failure, want the message kept", queue.Len(), srv.received())
+	}
+
+	os.Remove(path)
+	if err := ioutil.WriteFile(path, raw, 0600); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(outboundQueuePollInterval)
+	if got := waitForMessages(t, handled, 1); !reflect.DeepEqual(got, []string{"m0"}) {
+		t.Errorf("handled %v, want the message sent once readable", got)
+	}
+}
+
+func TestOutboundQueueBounded(t *testing.T) {
+	_, endpoint := newOutageServer(t)
+	queue, err := NewOutboundQueue(t.TempDir(), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := testMetadata(t, endpoint, WithCircuitBreaker(NewCircuitBreaker(1, time.Hour)), WithOutboundQueue(queue))
+	HandleHTTPRequest("m0", http.Header{}, data, zap.NewNop())
+	for i, want := range []error{ErrMessageQueued, ErrMessageQueued, ErrCircuitOpen} {
+		if _, err := HandleHTTPRequest("m", http.Header{}, data, zap.NewNop()); err != want {
+			t.Errorf("message %v error = %v, want %v", i, err, want)
+		}
+	}
+	if queue.Len() != 2 {
+		t.Errorf("queued %v messages, want 2", queue.Len())
+	}
+}
+
+func TestOutboundQueueResumed(t *testing.T) {
+	dir := t.TempDir()
+	queue, err := NewOutboundQueue(dir, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, message := range []string{"m0", "m1", "m2"} {
+		if err := queue.push(message, http.Header{"X-Id": {message}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	queue.pop()
+	// A temporary file left behind by a crash isn't resumed
+	ioutil.WriteFile(queue.path(7)+".tmp", []byte("{"), 0600)
+
+	resumed, err := NewOutboundQueue(dir, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for resumed.Len() > 0 {
+		msg, ok, err := resumed.peek()
+		if err != nil || !ok {
+			t.Fatalf("peek() = %v, %v", ok, err)
+		}
+		if msg.Headers.Get("X-Id") != msg.Message {
+			t.Errorf("message %v resumed with headers %v", msg.Message, msg.Headers)
+		}
+		got = append(got, msg.Message)
+		resumed.pop()
+	}
+	if want := []string{"m1", "m2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("resumed %v, want %v", got, want)
+	}
+	if err := resumed.push("m3", nil); err != nil {
+		t.Errorf("push() after resuming error = %v", err)
+	}
+	if _, err := os.Stat(resumed.path(3)); err != nil {
+		t.Errorf("message pushed after resuming not numbered after the resumed ones: %v", err)
+	}
+}
@@ -0,0 +1,84 @@
+package common
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Rate limit headers exposed by gateways, the reset being either seconds until the window resets or a unix time
+const (
+	RateLimitRemainingHeader = "X-RateLimit-Remaining"
+	RateLimitResetHeader     = "X-RateLimit-Reset"
+)
+
+// rateLimitLowWatermark is the remaining request count below which requests are spread over the rest of the window
+const rateLimitLowWatermark = 10
+
+// unixResetThreshold separates reset values given in seconds from unix times
+const unixResetThreshold = 1000000000
+
+// rateLimit is the last rate limit state advertised by an endpoint
+type rateLimit struct {
+	remaining int
+	reset     time.Time
+}
+
+// rateLimits records the rate limit state of each endpoint
+var rateLimits = struct {
+	sync.Mutex
+	endpoints map[string]rateLimit
+}{endpoints: make(map[string]rateLimit)}
+
+// observeRateLimit records the rate limit state advertised by the headers of a response of endpoint
+func observeRateLimit(endpoint string, header http.Header, now time.Time) {
+	remaining, err := strconv.Atoi(strings.TrimSpace(header.Get(RateLimitRemainingHeader)))
+	if err != nil {
+		return
+	}
+	reset, err := strconv.ParseInt(strings.TrimSpace(header.Get(RateLimitResetHeader)), 10, 64)
+	if err != nil || reset < 0 {
+		return
+	}
+	limit := rateLimit{remaining: remaining}
+	if reset >= unixResetThreshold {
+		limit.reset = time.Unix(reset, 0)
+	} else {
+		limit.reset = now.Add(time.Duration(reset) * time.Second)
+	}
+	rateLimits.Lock()
+	defer rateLimits.Unlock()
+	rateLimits.endpoints[endpoint] = limit
+}
+
+// rateLimitDelay returns how long to wait before sending a request to endpoint: until the window resets when no
+// requests remain, spreading the last requests evenly over the window otherwise
+func rateLimitDelay(endpoint string, now time.Time) time.Duration {
+	rateLimits.Lock()
+	defer rateLimits.Unlock()
+	limit, ok := rateLimits.endpoints[endpoint]
+	if !ok {
+		return 0
+	}
+	untilReset := limit.reset.Sub(now)
+	if untilReset <= 0 {
+		delete(rateLimits.endpoints, endpoint)
+		return 0
+	}
+	if untilReset > MaxRetryDelayLimit {
+		untilReset = MaxRetryDelayLimit
+	}
+	if limit.remaining <= 0 {
+		return untilReset
+	}
+	if limit.remaining >= rateLimitLowWatermark {
+		return 0
+	}
+	// Account for the request about to be sent until the next response updates the state
+	delay := untilReset / time.Duration(limit.remaining+1)
+	limit.remaining--
+	rateLimits.endpoints[endpoint] = limit
+	return delay
+}
@@ -0,0 +1,97 @@
+package common
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestRateLimitDelay(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name      string
+		remaining string
+		reset     string
+		want      []time.Duration
+	}{
+		{name: "exhausted", remaining: "0", reset: "30", want: []time.Duration{30 * time.Second, 30 * time.Second}},
+		{name: "plenty remaining", remaining: "50", reset: "30", want: []time.Duration{0}},
+		{name: "spread below the watermark", remaining: "4", reset: "10", want: []time.Duration{2 * time.Second, 2500 * time.Millisecond}},
+		{name: "unix reset", remaining: "0", reset: strconv.FormatInt(start.Add(time.Minute).Unix(), 10), want: []time.Duration{time.Minute}},
+		{name: "reset elapsed", remaining: "0", reset: strconv.FormatInt(start.Add(-time.Minute).Unix(), 10), want: []time.Duration{0}},
+		{name: "capped", remaining: "0", reset: "86400", want: []time.Duration{MaxRetryDelayLimit}},
+		{name: "invalid remaining", remaining: "many", reset: "30", want: []time.Duration{0}},
+		{name: "negative reset", remaining: "0", reset: "-1", want: []time.Duration{0}},
+		{name: "no headers", want: []time.Duration{0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			endpoint := "http://" + tt.name
+			header := http.Header{}
+			if tt.remaining != "" {
+				header.Set(RateLimitRemainingHeader, tt.remaining)
+				header.Set(RateLimitResetHeader, tt.reset)
+			}
+			observeRateLimit(endpoint, header, start)
+			for i, want := range tt.want {
+				if got := rateLimitDelay(endpoint, start); got != want {
+					t.Errorf("delay %v = %v, want %v", i, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestRateLimitThrottle(t *testing.T) {
+	tests := []struct {
+		name      string
+		throttle  bool
+		wantSleep bool
+	}{
+		{name: "throttled", throttle: true, wantSleep: true},
+		{name: "disabled", throttle: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := useFakeClock(t)
+			srv := newServer(t, func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set(RateLimitRemainingHeader, "0")
+				w.Header().Set(RateLimitResetHeader, "30")
+			})
+			data := testMetadata(t, srv.URL, WithRateLimitThrottle(tt.throttle))
+			resp, err := HandleHTTPRequest("{}", http.Header{}, data, zap.NewNop())
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			resp.Body.Close()
+			done := make(chan error, 1)
+			go func() {
+				resp, err := HandleHTTPRequest("{}", http.Header{}, data, zap.NewNop())
+				if err == nil {
+					resp.Body.Close()
+				}
+				done <- err
+			}()
+			if tt.wantSleep {
+				waitForTimers(t, clock, 1)
+				select {
+				case err := <-done:
+					t.Fatalf("request sent before the rate limit window reset, error %v", err)
+				default:
+				}
+				clock.Advance(30 * time.Second)
+			}
+			select {
+			case err := <-done:
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("request still throttled")
+			}
+		})
+	}
+}
@@ -0,0 +1,40 @@
+package common
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// ReadinessCheck returns an error while the connector isn't ready to receive traffic
+type ReadinessCheck func() error
+
+// ReadinessHandler returns an HTTP handler for readiness probes, responding 200 when every check passes
+// and 503 with the first failure otherwise
+func ReadinessHandler(checks ...ReadinessCheck) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, check := range checks {
+			if err := check(); err != nil {
+				http.Error(w, err.Error(), http.StatusServiceUnavailable)
+				return
+			}
+		}
+		w.Write([]byte("ok"))
+	})
+}
+
+// AwsCredentialsReady returns a ReadinessCheck failing while the credentials of cfg don't resolve, so that pods
+// with broken AWS authentication don't receive traffic. Credentials are only retrieved again once expired,
+// keeping the check lightweight. A config without credentials, e.g. using AWS_ENDPOINT, is always ready.
+func AwsCredentialsReady(cfg *aws.Config) ReadinessCheck {
+	return func() error {
+		if cfg == nil || cfg.Credentials == nil {
+			return nil
+		}
+		if _, err := cfg.Credentials.Get(); err != nil {
+			return fmt.Errorf("aws credentials not resolved: %v", err)
+		}
+		return nil
+	}
+}
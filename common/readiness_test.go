@@ -0,0 +1,94 @@
+package common
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+)
+
+// cachingProvider is a credentials provider counting retrievals, whose credentials expire only when told to
+type cachingProvider struct {
+	stubProvider
+	retrievals int
+	expired    bool
+}
+
+func (p *cachingProvider) Retrieve() (credentials.Value, error) {
+	p.retrievals++
+	p.expired = p.err != nil
+	return p.stubProvider.Retrieve()
+}
+
+func (p *cachingProvider) IsExpired() bool {
+	return p.expired
+}
+
+func TestReadinessHandler(t *testing.T) {
+	valid := credentials.Value{AccessKeyID: "AKID", SecretAccessKey: "secret"}
+	tests := []struct {
+		name       string
+		checks     []ReadinessCheck
+		wantStatus int
+		wantBody   string
+	}{
+		{name: "no checks", wantStatus: http.StatusOK, wantBody: "ok"},
+		{name: "nil config", checks: []ReadinessCheck{AwsCredentialsReady(nil)}, wantStatus: http.StatusOK},
+		{name: "config without credentials", checks: []ReadinessCheck{AwsCredentialsReady(&aws.Config{Endpoint: aws.String("http://localstack:4566")})}, wantStatus: http.StatusOK},
+		{
+			name:       "valid credentials",
+			checks:     []ReadinessCheck{AwsCredentialsReady(&aws.Config{Credentials: credentials.NewCredentials(&stubProvider{value: valid})})},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "failing credentials",
+			checks:     []ReadinessCheck{AwsCredentialsReady(&aws.Config{Credentials: credentials.NewCredentials(&stubProvider{err: errors.New("no role")})})},
+			wantStatus: http.StatusServiceUnavailable,
+			wantBody:   "aws credentials not resolved",
+		},
+		{
+			name: "first failure reported",
+			checks: []ReadinessCheck{
+				func() error { return nil },
+				func() error { return errors.New("queue unreachable") },
+				func() error { return errors.New("never reached") },
+			},
+			wantStatus: http.StatusServiceUnavailable,
+			wantBody:   "queue unreachable",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			ReadinessHandler(tt.checks...).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/ready", nil))
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %v, want %v", rec.Code, tt.wantStatus)
+			}
+			if !strings.Contains(rec.Body.String(), tt.wantBody) {
+				t.Errorf("body = %q, want it to contain %q", rec.Body.String(), tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestAwsCredentialsReadyRecovers(t *testing.T) {
+	provider := &cachingProvider{stubProvider: stubProvider{err: errors.New("no role")}}
+	check := AwsCredentialsReady(&aws.Config{Credentials: credentials.NewCredentials(provider)})
+	if err := check(); err == nil {
+		t.Fatal("ready while credentials fail to resolve")
+	}
+	provider.err = nil
+	provider.value = credentials.Value{AccessKeyID: "AKID", SecretAccessKey: "secret"}
+	for i := 0; i < 3; i++ {
+		if err := check(); err != nil {
+			t.Fatalf("check %v error = %v once credentials resolve", i, err)
+		}
+	}
+	if provider.retrievals != 2 {
+		t.Errorf("retrieved credentials %v times, want them cached once resolved", provider.retrievals)
+	}
+}
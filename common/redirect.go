@@ -0,0 +1,58 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// DefaultMaxRedirects caps the redirects followed when FollowRedirects is set unless configured otherwise
+const DefaultMaxRedirects = 10
+
+// maxRedirects returns the number of redirects followed, zero leaving the default policy of net/http
+func (m ConnectorMetadata) maxRedirects() int {
+	if !m.FollowRedirects {
+		return 0
+	}
+	if m.MaxRedirects > 0 {
+		return m.MaxRedirects
+	}
+	return DefaultMaxRedirects
+}
+
+// redirectError aborts following redirects which loop back to a request already made or exceed the cap
+type redirectError struct {
+	loop      bool
+	url       string
+	redirects int
+}
+
+func (e *redirectError) Error() string {
+	if e.loop {
+		return fmt.Sprintf("redirect loop detected after %v redirects, %v was already requested", e.redirects, e.url)
+	}
+	return fmt.Sprintf("stopped after %v redirects, last to %v", e.redirects, e.url)
+}
+
+// checkRedirect returns the redirect policy of an http.Client following up to max redirects, aborting as soon as
+// a redirect leads to a request already made
+func checkRedirect(max int) func(req *http.Request, via []*http.Request) error {
+	return func(req *http.Request, via []*http.Request) error {
+		for _, previous := range via {
+			if previous.Method == req.Method && previous.URL.String() == req.URL.String() {
+				return &redirectError{loop: true, url: req.URL.String(), redirects: len(via)}
+			}
+		}
+		if len(via) > max {
+			return &redirectError{url: req.URL.String(), redirects: len(via) - 1}
+		}
+		return nil
+	}
+}
+
+// asRedirectError returns the redirectError aborting the request which failed with err, if any
+func asRedirectError(err error) (*redirectError, bool) {
+	var redirect *redirectError
+	ok := errors.As(err, &redirect)
+	return redirect, ok
+}
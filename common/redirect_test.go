@@ -0,0 +1,164 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+// redirectServer starts a server redirecting /loop to /loop/back and back to /loop, /chain/n to /chain/n+1
+// forever and /ok/n down to /ok/0, which responds 200, returning its URL and the number of requests it received
+func redirectServer(t *testing.T) (string, *int32) {
+	t.Helper()
+	var requests int32
+	srv := newServer(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		switch {
+		case r.URL.Path == "/loop":
+			http.Redirect(w, r, "/loop/back", http.StatusTemporaryRedirect)
+		case r.URL.Path == "/loop/back":
+			http.Redirect(w, r, "/loop", http.StatusTemporaryRedirect)
+		case strings.HasPrefix(r.URL.Path, "/chain/"):
+			n, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/chain/"))
+			http.Redirect(w, r, fmt.Sprintf("/chain/%v", n+1), http.StatusTemporaryRedirect)
+		case r.URL.Path == "/ok/0":
+			w.WriteHeader(http.StatusOK)
+		case strings.HasPrefix(r.URL.Path, "/ok/"):
+			n, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/ok/"))
+			http.Redirect(w, r, fmt.Sprintf("/ok/%v", n-1), http.StatusTemporaryRedirect)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+	return srv.URL, &requests
+}
+
+func TestFollowRedirects(t *testing.T) {
+	tests := []struct {
+		name         string
+		path         string
+		follow       bool
+		max          int
+		wantStatus   int
+		wantKind     ErrorKind
+		wantRequests int32
+	}{
+		{name: "followed", path: "/ok/3", follow: true, wantStatus: http.StatusOK, wantRequests: 4},
+		{name: "loop detected", path: "/loop", follow: true, wantStatus: http.StatusLoopDetected, wantKind: ErrorKindRedirect, wantRequests: 2},
+		{name: "cap exceeded", path: "/chain/0", follow: true, max: 2, wantStatus: http.StatusBadGateway, wantKind: ErrorKindRedirect, wantRequests: 3},
+		{name: "default cap", path: "/chain/0", follow: true, wantStatus: http.StatusBadGateway, wantKind: ErrorKindRedirect, wantRequests: DefaultMaxRedirects + 1},
+		{name: "within cap", path: "/ok/2", follow: true, max: 2, wantStatus: http.StatusOK, wantRequests: 3},
+		// net/http stops after 10 redirects, returning the last redirect response which is retried
+		{name: "not followed", path: "/loop", wantStatus: http.StatusTemporaryRedirect, wantKind: ErrorKindResponse, wantRequests: 3 * 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			url, requests := redirectServer(t)
+			data := testMetadata(t, url+tt.path, WithMaxRetries(2), WithFollowRedirects(tt.follow, tt.max))
+			resp, report, err := InvokeHTTPRequest(context.Background(), "{}", http.Header{}, data, zap.NewNop())
+			if got := atomic.LoadInt32(requests); got != tt.wantRequests {
+				t.Errorf("server received %v requests, want %v", got, tt.wantRequests)
+			}
+			if tt.wantKind == "" {
+				if err != nil {
+					t.Fatalf("InvokeHTTPRequest() error = %v", err)
+				}
+				resp.Body.Close()
+				if resp.StatusCode != tt.wantStatus {
+					t.Errorf("status = %v, want %v", resp.StatusCode, tt.wantStatus)
+				}
+				return
+			}
+			errorResponse := errorResponseOf(t, err)
+			if errorResponse.ErrorKind != tt.wantKind || report.ErrorKind != tt.wantKind {
+				t.Errorf("error kind = %v and reported %v, want %v", errorResponse.ErrorKind, report.ErrorKind, tt.wantKind)
+			}
+			if tt.wantStatus != 0 && errorResponse.Status != tt.wantStatus {
+				t.Errorf("error status = %v, want %v", errorResponse.Status, tt.wantStatus)
+			}
+			if tt.wantKind == ErrorKindRedirect && errorResponse.IsRetryable() {
+				t.Error("redirect error is retryable")
+			}
+		})
+	}
+}
+
+func TestCheckRedirect(t *testing.T) {
+	request := func(method, url string) *http.Request {
+		req, err := http.NewRequest(method, url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return req
+	}
+	tests := []struct {
+		name     string
+		req      *http.Request
+		via      []*http.Request
+		wantErr  bool
+		wantLoop bool
+	}{
+		{name: "first redirect", req: request("POST", "http://b"), via: []*http.Request{request("POST", "http://a")}},
+		{name: "loop", req: request("POST", "http://a"), via: []*http.Request{request("POST", "http://a"), request("POST", "http://b")}, wantErr: true, wantLoop: true},
+		{name: "same URL with another method", req: request("GET", "http://a"), via: []*http.Request{request("POST", "http://a")}},
+		{name: "cap reached", req: request("POST", "http://d"), via: []*http.Request{request("POST", "http://a"), request("POST", "http://b"), request("POST", "http://c")}},
+		{name: "cap exceeded", req: request("POST", "http://e"), via: []*http.Request{request("POST", "http://a"), request("POST", "http://b"), request("POST", "http://c"), request("POST", "http://d")}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkRedirect(3)(tt.req, tt.via)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("checkRedirect() error = %v, want error %v", err, tt.wantErr)
+			}
+			if redirect, ok := asRedirectError(err); ok != tt.wantErr || ok && redirect.loop != tt.wantLoop {
+				t.Errorf("redirect error = %+v, want loop %v", redirect, tt.wantLoop)
+			}
+		})
+	}
+}
+
+func TestParseConnectorMetadataRedirects(t *testing.T) {
+	tests := []struct {
+		name       string
+		env        map[string]string
+		wantFollow bool
+		wantMax    int
+		wantErr    bool
+	}{
+		{name: "unset", env: map[string]string{}},
+		{name: "followed", env: map[string]string{"FOLLOW_REDIRECTS": "true"}, wantFollow: true},
+		{name: "capped", env: map[string]string{"FOLLOW_REDIRECTS": "true", "MAX_REDIRECTS": "3"}, wantFollow: true, wantMax: 3},
+		{name: "invalid follow", env: map[string]string{"FOLLOW_REDIRECTS": "often"}, wantErr: true},
+		{name: "invalid cap", env: map[string]string{"MAX_REDIRECTS": "few"}, wantErr: true},
+		{name: "negative cap", env: map[string]string{"FOLLOW_REDIRECTS": "true", "MAX_REDIRECTS": "-1"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := map[string]string{
+				"TOPIC":            "topic",
+				"HTTP_ENDPOINT":    "http://function.default",
+				"MAX_RETRIES":      "3",
+				"CONTENT_TYPE":     "application/json",
+				"FOLLOW_REDIRECTS": "",
+				"MAX_REDIRECTS":    "",
+			}
+			for name, value := range tt.env {
+				env[name] = value
+			}
+			setEnv(t, env)
+			meta, err := ParseConnectorMetadata()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseConnectorMetadata() error = %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil && (meta.FollowRedirects != tt.wantFollow || meta.MaxRedirects != tt.wantMax) {
+				t.Errorf("follow redirects %v up to %v, want %v up to %v", meta.FollowRedirects, meta.MaxRedirects, tt.wantFollow, tt.wantMax)
+			}
+		})
+	}
+}
@@ -0,0 +1,203 @@
+package common
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// redisKeyPrefix namespaces the keys written to Redis
+const redisKeyPrefix = "keda-connector:"
+
+// redisClient is a minimal client speaking the Redis protocol over a single connection, reconnecting after failures
+type redisClient struct {
+	addr     string
+	password string
+	timeout  time.Duration
+
+	mu   sync.Mutex
+	conn net.Conn
+	rd   *bufio.Reader
+}
+
+// do sends a command and returns its reply: a string, an int64, nil or a []interface{} of those
+func (c *redisClient) do(args ...string) (interface{}, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == nil {
+		if err := c.connect(); err != nil {
+			return nil, err
+		}
+	}
+	reply, err := c.roundTrip(args)
+	if err != nil {
+		if _, ok := err.(redisError); !ok {
+			// The connection is in an unknown state, start over with a new one
+			c.conn.Close()
+			c.conn = nil
+		}
+		return nil, err
+	}
+	return reply, nil
+}
+
+func (c *redisClient) connect() error {
+	conn, err := net.DialTimeout("tcp", c.addr, c.timeout)
+	if err != nil {
+		return fmt.Errorf("failed to connect to redis %v: %v", c.addr, err)
+	}
+	c.conn = conn
+	c.rd = bufio.NewReader(conn)
+	if c.password != "" {
+		if _, err := c.roundTrip([]string{"AUTH", c.password}); err != nil {
+			conn.Close()
+			c.conn = nil
+			return fmt.Errorf("failed to authenticate to redis %v: %v", c.addr, err)
+		}
+	}
+	return nil
+}
+
+func (c *redisClient) roundTrip(args []string) (interface{}, error) {
+	if err := c.conn.SetDeadline(time.Now().Add(c.timeout)); err != nil {
+		return nil, err
+	}
+	var cmd strings.Builder
+	fmt.Fprintf(&cmd, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&cmd, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := io.WriteString(c.conn, cmd.String()); err != nil {
+		return nil, err
+	}
+	return readRedisReply(c.rd)
+}
+
+// redisError is an error reply sent by the server, which leaves the connection usable
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+func readRedisReply(rd *bufio.Reader) (interface{}, error) {
+	line, err := rd.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, fmt.Errorf("invalid redis reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(rd, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:size]), nil
+	case '*':
+		count, err := strconv.Atoi(line[1:])
+		if err != nil || count < 0 {
+			return nil, err
+		}
+		items := make([]interface{}, count)
+		for i := range items {
+			if items[i], err = readRedisReply(rd); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	default:
+		return nil, fmt.Errorf("invalid redis reply %q", line)
+	}
+}
+
+// RedisDedupeStore is a DedupeStore shared by every pod connecting to the same Redis server
+type RedisDedupeStore struct {
+	client *redisClient
+}
+
+// DefaultRedisTimeout bounds connecting to Redis and every command unless configured otherwise
+const DefaultRedisTimeout = 5 * time.Second
+
+// NewRedisDedupeStore returns a RedisDedupeStore using the Redis server at addr, bounding connecting and every
+// command by timeout, DefaultRedisTimeout when zero
+func NewRedisDedupeStore(addr, password string, timeout time.Duration) *RedisDedupeStore {
+	if timeout <= 0 {
+		timeout = DefaultRedisTimeout
+	}
+	return &RedisDedupeStore{client: &redisClient{
+		addr:     addr,
+		password: password,
+		timeout:  timeout,
+	}}
+}
+
+// redisMillis formats ttl in milliseconds for PX and PEXPIRE, at least 1 since Redis rejects 0
+func redisMillis(ttl time.Duration) string {
+	millis := ttl.Milliseconds()
+	if millis < 1 {
+		millis = 1
+	}
+	return strconv.FormatInt(millis, 10)
+}
+
+// Seen implements DedupeStore
+func (s *RedisDedupeStore) Seen(fingerprint string) (bool, error) {
+	reply, err := s.client.do("EXISTS", redisKeyPrefix+"dedupe:"+fingerprint)
+	if err != nil {
+		return false, err
+	}
+	count, _ := reply.(int64)
+	return count > 0, nil
+}
+
+// Record implements DedupeStore
+func (s *RedisDedupeStore) Record(fingerprint string, ttl time.Duration) error {
+	_, err := s.client.do("SET", redisKeyPrefix+"dedupe:"+fingerprint, "1", "PX", redisMillis(ttl))
+	return err
+}
+
+// Failures implements FailureStore
+func (s *RedisDedupeStore) Failures(fingerprint string) (int, error) {
+	reply, err := s.client.do("GET", redisKeyPrefix+"failures:"+fingerprint)
+	if err != nil || reply == nil {
+		return 0, err
+	}
+	raw, _ := reply.(string)
+	return strconv.Atoi(raw)
+}
+
+// RecordFailure implements FailureStore
+func (s *RedisDedupeStore) RecordFailure(fingerprint string, ttl time.Duration) (int, error) {
+	key := redisKeyPrefix + "failures:" + fingerprint
+	reply, err := s.client.do("INCR", key)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := s.client.do("PEXPIRE", key, redisMillis(ttl)); err != nil {
+		return 0, err
+	}
+	count, _ := reply.(int64)
+	return int(count), nil
+}
+
+// ResetFailures implements FailureStore
+func (s *RedisDedupeStore) ResetFailures(fingerprint string) error {
+	_, err := s.client.do("DEL", redisKeyPrefix+"failures:"+fingerprint)
+	return err
+}
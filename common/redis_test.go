@@ -0,0 +1,246 @@
+package common
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// fakeRedis is a Redis server holding keys in memory and expiring them by the package clock, speaking enough of the
+// protocol for RedisDedupeStore
+type fakeRedis struct {
+	addr     string
+	password string
+
+	mu      sync.Mutex
+	values  map[string]string
+	expires map[string]time.Time
+	ttls    []string
+}
+
+func newFakeRedis(t *testing.T, password string) *fakeRedis {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	r := &fakeRedis{
+		addr:     listener.Addr().String(),
+		password: password,
+		values:   make(map[string]string),
+		expires:  make(map[string]time.Time),
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go r.serve(conn)
+		}
+	}()
+	return r
+}
+
+func (r *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	rd := bufio.NewReader(conn)
+	authenticated := r.password == ""
+	for {
+		reply, err := readRedisReply(rd)
+		if err != nil {
+			return
+		}
+		items, _ := reply.([]interface{})
+		var args []string
+		for _, item := range items {
+			arg, _ := item.(string)
+			args = append(args, arg)
+		}
+		if len(args) == 0 {
+			return
+		}
+		cmd := strings.ToUpper(args[0])
+		switch {
+		case cmd == "AUTH":
+			authenticated = len(args) == 2 && args[1] == r.password
+			if !authenticated {
+				fmt.Fprint(conn, "-WRONGPASS invalid password\r\n")
+				continue
+			}
+			fmt.Fprint(conn, "+OK\r\n")
+		case !authenticated:
+			fmt.Fprint(conn, "-NOAUTH Authentication required.\r\n")
+		default:
+			fmt.Fprint(conn, r.command(cmd, args[1:]))
+		}
+	}
+}
+
+// command executes cmd, returning the encoded reply
+func (r *fakeRedis) command(cmd string, args []string) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for key, expires := range r.expires {
+		if !now().Before(expires) {
+			delete(r.values, key)
+			delete(r.expires, key)
+		}
+	}
+	switch cmd {
+	case "EXISTS":
+		if _, ok := r.values[args[0]]; ok {
+			return ":1\r\n"
+		}
+		return ":0\r\n"
+	case "GET":
+		value, ok := r.values[args[0]]
+		if !ok {
+			return "$-1\r\n"
+		}
+		return fmt.Sprintf("$%d\r\n%s\r\n", len(value), value)
+	case "SET":
+		r.values[args[0]] = args[1]
+		delete(r.expires, args[0])
+		if len(args) == 4 && strings.ToUpper(args[2]) == "PX" {
+			if !r.expire(args[0], args[3]) {
+				return "-ERR invalid expire time in 'set' command\r\n"
+			}
+		}
+		return "+OK\r\n"
+	case "INCR":
+		count, _ := strconv.Atoi(r.values[args[0]])
+		count++
+		r.values[args[0]] = strconv.Itoa(count)
+		return fmt.Sprintf(":%d\r\n", count)
+	case "PEXPIRE":
+		if _, ok := r.values[args[0]]; !ok {
+			return ":0\r\n"
+		}
+		if !r.expire(args[0], args[1]) {
+			return "-ERR invalid expire time in 'pexpire' command\r\n"
+		}
+		return ":1\r\n"
+	case "DEL":
+		_, ok := r.values[args[0]]
+		delete(r.values, args[0])
+		delete(r.expires, args[0])
+		if ok {
+			return ":1\r\n"
+		}
+		return ":0\r\n"
+	default:
+		return "-ERR unknown command\r\n"
+	}
+}
+
+// expire sets key to expire in millis milliseconds, rejecting non-positive values like Redis
+func (r *fakeRedis) expire(key, millis string) bool {
+	r.ttls = append(r.ttls, millis)
+	ms, err := strconv.ParseInt(millis, 10, 64)
+	if err != nil || ms <= 0 {
+		return false
+	}
+	r.expires[key] = now().Add(time.Duration(ms) * time.Millisecond)
+	return true
+}
+
+func TestRedisDedupeStoreAcrossPods(t *testing.T) {
+	clock := useFakeClock(t)
+	redis := newFakeRedis(t, "secret")
+	srv, requests := statusServer(t, http.StatusOK)
+	// Each pod has a store of its own sharing the Redis server
+	pods := []ConnectorMetadata{
+		testMetadata(t, srv.URL, WithDedupe(NewRedisDedupeStore(redis.addr, "secret", 0), time.Minute)),
+		testMetadata(t, srv.URL, WithDedupe(NewRedisDedupeStore(redis.addr, "secret", 0), time.Minute)),
+	}
+	tests := []struct {
+		name         string
+		pod          int
+		advance      time.Duration
+		wantErr      error
+		wantRequests int32
+	}{
+		{name: "first delivery", pod: 0, wantRequests: 1},
+		{name: "redelivered to another pod", pod: 1, wantErr: ErrDuplicateMessage, wantRequests: 1},
+		{name: "redelivered to the same pod", pod: 0, wantErr: ErrDuplicateMessage, wantRequests: 1},
+		{name: "redelivered after the ttl", pod: 1, advance: time.Minute, wantRequests: 2},
+	}
+	for _, tt := range tests {
+		clock.Advance(tt.advance)
+		resp, err := HandleHTTPRequest(`{"id":1}`, http.Header{}, pods[tt.pod], zap.NewNop())
+		if err != tt.wantErr {
+			t.Errorf("%v: error = %v, want %v", tt.name, err, tt.wantErr)
+		}
+		if err == nil {
+			resp.Body.Close()
+		}
+		if *requests != tt.wantRequests {
+			t.Errorf("%v: function invoked %v times, want %v", tt.name, *requests, tt.wantRequests)
+		}
+	}
+}
+
+func TestRedisDedupeStoreFailures(t *testing.T) {
+	useFakeClock(t)
+	redis := newFakeRedis(t, "")
+	store := NewRedisDedupeStore(redis.addr, "", 0)
+	for want := 1; want <= 3; want++ {
+		if got, err := store.RecordFailure("fp", time.Minute); err != nil || got != want {
+			t.Fatalf("RecordFailure() = %v with error %v, want %v", got, err, want)
+		}
+	}
+	if got, err := store.Failures("fp"); err != nil || got != 3 {
+		t.Errorf("Failures() = %v with error %v, want 3", got, err)
+	}
+	if err := store.ResetFailures("fp"); err != nil {
+		t.Fatalf("ResetFailures() error = %v", err)
+	}
+	if got, err := store.Failures("fp"); err != nil || got != 0 {
+		t.Errorf("Failures() after reset = %v with error %v, want 0", got, err)
+	}
+}
+
+func TestRedisDedupeStoreTTLClamped(t *testing.T) {
+	useFakeClock(t)
+	redis := newFakeRedis(t, "")
+	store := NewRedisDedupeStore(redis.addr, "", 0)
+	for _, ttl := range []time.Duration{time.Microsecond, 0, 1500 * time.Millisecond} {
+		if err := store.Record("fp", ttl); err != nil {
+			t.Errorf("Record() with ttl %v error = %v", ttl, err)
+		}
+	}
+	redis.mu.Lock()
+	defer redis.mu.Unlock()
+	if got := strings.Join(redis.ttls, ","); got != "1,1,1500" {
+		t.Errorf("expire times sent = %v, want 1,1,1500", got)
+	}
+}
+
+func TestRedisDedupeStoreErrors(t *testing.T) {
+	redis := newFakeRedis(t, "secret")
+	tests := []struct {
+		name  string
+		store *RedisDedupeStore
+	}{
+		{name: "wrong password", store: NewRedisDedupeStore(redis.addr, "wrong", 0)},
+		{name: "missing password", store: NewRedisDedupeStore(redis.addr, "", 0)},
+		{name: "unreachable", store: NewRedisDedupeStore("127.0.0.1:1", "", time.Second)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := tt.store.Seen("fp"); err == nil {
+				t.Error("Seen() succeeded, want an error")
+			}
+		})
+	}
+}
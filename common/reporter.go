@@ -0,0 +1,108 @@
+package common
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+)
+
+// OutcomeReporter receives the outcome of every function invocation, e.g. to route it to a monitoring system
+type OutcomeReporter interface {
+	Report(outcome Outcome, data ConnectorMetadata, report InvocationReport)
+}
+
+// PrometheusReporter is the default OutcomeReporter, exposing invocation outcomes as Prometheus metrics
+type PrometheusReporter struct{}
+
+var (
+	invocationsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "invocations_total",
+		Help:      "Number of function invocations by outcome.",
+	}, []string{"source", "outcome"})
+	invocationAttempts = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "invocation_attempts",
+		Help:      "Number of attempts made per function invocation by outcome.",
+		Buckets:   []float64{1, 2, 3, 5, 8, 13},
+	}, []string{"source", "outcome"})
+	endpointAttemptsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "endpoint_attempts_total",
+		Help:      "Number of attempts made to each endpoint in failover mode by result.",
+	}, []string{"source", "endpoint", "result"})
+	endpointAttemptDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "endpoint_attempt_duration_seconds",
+		Help:      "Time until each endpoint responded to an attempt in failover mode by result.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"source", "endpoint", "result"})
+	invocationDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "invocation_duration_seconds",
+		Help:      "Duration of function invocations including retries by outcome.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"source", "outcome"})
+)
+
+// Report implements OutcomeReporter
+func (PrometheusReporter) Report(outcome Outcome, data ConnectorMetadata, report InvocationReport) {
+	label := outcome.String()
+	if outcome == OutcomeFailure && report.ErrorKind == ErrorKindGateway {
+		// The function never ran, don't count it as a function error
+		label = "gateway_failure"
+	}
+	if outcome == OutcomeSuccess && report.Replayed {
+		// The function had already processed the message, don't count it as a new processing
+		label = "replayed"
+	}
+	invocationsTotal.WithLabelValues(data.SourceName, label).Inc()
+	invocationAttempts.WithLabelValues(data.SourceName, label).Observe(float64(report.Attempts))
+	invocationDuration.WithLabelValues(data.SourceName, label).Observe(report.Duration.Seconds())
+}
+
+// reportOutcome hands the report to the configured OutcomeReporter, PrometheusReporter if none is set
+func reportOutcome(report InvocationReport, data ConnectorMetadata, logger *zap.Logger) {
+	observeSLA(report, data)
+	var reporter OutcomeReporter = PrometheusReporter{}
+	if data.OutcomeReporter != nil {
+		reporter = data.OutcomeReporter
+	}
+	_ = callHook("OutcomeReporter", logger, func() error {
+		reporter.Report(report.Outcome, data, report)
+		return nil
+	})
+}
+
+// observeSLA records whether a completed invocation met the SLA latency target if configured: "compliant" for
+// successes within SLALatencyTarget, "violating" for slower successes and failures
+func observeSLA(report InvocationReport, data ConnectorMetadata) {
+	if data.SLALatencyTarget <= 0 || report.Outcome != OutcomeSuccess && report.Outcome != OutcomeFailure {
+		return
+	}
+	result := "violating"
+	if report.Outcome == OutcomeSuccess && report.Duration <= data.SLALatencyTarget {
+		result = "compliant"
+	}
+	slaInvocationsTotal.WithLabelValues(data.SourceName, result).Inc()
+}
+
+// observeAttempt records the result of an attempt to endpoint in the per-endpoint metrics when attempts fail over
+// between several endpoints: "success" for 2xx responses, "failure" for other responses and "error" without response
+func observeAttempt(resp *http.Response, endpoint string, duration time.Duration, data ConnectorMetadata) {
+	if len(data.endpoints()) < 2 {
+		return
+	}
+	result := "error"
+	if resp != nil {
+		result = "failure"
+		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			result = "success"
+		}
+	}
+	endpointAttemptsTotal.WithLabelValues(data.SourceName, endpoint, result).Inc()
+	endpointAttemptDuration.WithLabelValues(data.SourceName, endpoint, result).Observe(duration.Seconds())
+}
@@ -0,0 +1,284 @@
+package common
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.uber.org/zap"
+)
+
+// fakeReporter captures the reported outcomes
+type fakeReporter struct {
+	mu      sync.Mutex
+	reports []InvocationReport
+}
+
+func (r *fakeReporter) Report(outcome Outcome, data ConnectorMetadata, report InvocationReport) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.reports = append(r.reports, report)
+}
+
+func (r *fakeReporter) outcomes() []Outcome {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var outcomes []Outcome
+	for _, report := range r.reports {
+		outcomes = append(outcomes, report.Outcome)
+	}
+	return outcomes
+}
+
+// panickingReporter panics on every report
+type panickingReporter struct{}
+
+func (panickingReporter) Report(Outcome, ConnectorMetadata, InvocationReport) {
+	panic("boom")
+}
+
+func TestOutcomeReporter(t *testing.T) {
+	tests := []struct {
+		name         string
+		statuses     []int
+		retries      int
+		want         Outcome
+		wantAttempts int
+	}{
+		{name: "success", statuses: []int{http.StatusOK}, want: OutcomeSuccess, wantAttempts: 1},
+		{name: "success after retry", statuses: []int{http.StatusInternalServerError, http.StatusOK}, retries: 1, want: OutcomeSuccess, wantAttempts: 2},
+		{name: "failure", statuses: []int{http.StatusBadRequest}, want: OutcomeFailure, wantAttempts: 1},
+		{name: "retries exhausted", statuses: []int{http.StatusInternalServerError}, retries: 2, want: OutcomeFailure, wantAttempts: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, _ := statusServer(t, tt.statuses...)
+			reporter := &fakeReporter{}
+			data := testMetadata(t, srv.URL, WithMaxRetries(tt.retries), WithOutcomeReporter(reporter))
+			resp, _, err := InvokeHTTPRequest(context.Background(), "{}", http.Header{}, data, zap.NewNop())
+			if err == nil {
+				resp.Body.Close()
+			}
+			if len(reporter.reports) != 1 {
+				t.Fatalf("reported %v outcomes, want 1", reporter.outcomes())
+			}
+			if got := reporter.reports[0]; got.Outcome != tt.want || got.Attempts != tt.wantAttempts {
+				t.Errorf("reported %v after %v attempts, want %v after %v", got.Outcome, got.Attempts, tt.want, tt.wantAttempts)
+			}
+		})
+	}
+}
+
+func TestOutcomeReporterPanicDoesNotFailInvocation(t *testing.T) {
+	srv, _ := statusServer(t, http.StatusOK)
+	data := testMetadata(t, srv.URL, WithOutcomeReporter(panickingReporter{}))
+	resp, err := HandleHTTPRequest("{}", http.Header{}, data, zap.NewNop())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resp.Body.Close()
+}
+
+func TestEndpointAttemptMetrics(t *testing.T) {
+	down, _ := statusServer(t, http.StatusServiceUnavailable)
+	up, _ := statusServer(t, http.StatusOK)
+	closed := newServer(t, func(http.ResponseWriter, *http.Request) {})
+	closed.Close()
+	type result struct {
+		endpoint string
+		result   string
+	}
+	tests := []struct {
+		name      string
+		endpoints []string
+		want      map[result]float64
+	}{
+		{
+			name:      "failover",
+			endpoints: []string{down.URL, closed.URL, up.URL},
+			want: map[result]float64{
+				{down.URL, "failure"}: 1,
+				{closed.URL, "error"}: 1,
+				{up.URL, "success"}:   1,
+			},
+		},
+		{
+			name:      "single endpoint",
+			endpoints: []string{up.URL},
+			want:      map[result]float64{{up.URL, "success"}: 0},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			source := "endpoint-attempts-" + tt.name
+			data := testMetadata(t, tt.endpoints[0], WithEndpoints(tt.endpoints...), WithMaxRetries(len(tt.endpoints)-1), WithSourceName(source))
+			resp, err := HandleHTTPRequest("{}", http.Header{}, data, zap.NewNop())
+			if err != nil {
+				t.Fatalf("HandleHTTPRequest() error = %v", err)
+			}
+			resp.Body.Close()
+			for key, want := range tt.want {
+				if got := testutil.ToFloat64(endpointAttemptsTotal.WithLabelValues(source, key.endpoint, key.result)); got != want {
+					t.Errorf("counted %v %v attempts to %v, want %v", got, key.result, key.endpoint, want)
+				}
+				count, _ := histogramOf(t, "endpoint_attempt_duration_seconds", map[string]string{"source": source, "endpoint": key.endpoint, "result": key.result})
+				if float64(count) != want {
+					t.Errorf("observed %v %v attempt durations of %v, want %v", count, key.result, key.endpoint, want)
+				}
+			}
+		})
+	}
+}
+
+func TestGatewayFailures(t *testing.T) {
+	tests := []struct {
+		name      string
+		status    int
+		statuses  []int
+		wantKind  ErrorKind
+		wantLabel string
+	}{
+		{name: "function error", status: http.StatusInternalServerError, wantKind: ErrorKindResponse, wantLabel: "failure"},
+		{name: "bad gateway", status: http.StatusBadGateway, wantKind: ErrorKindGateway, wantLabel: "gateway_failure"},
+		{name: "gateway timeout", status: http.StatusGatewayTimeout, wantKind: ErrorKindGateway, wantLabel: "gateway_failure"},
+		{name: "configured gateway status", status: http.StatusServiceUnavailable, statuses: []int{http.StatusServiceUnavailable}, wantKind: ErrorKindGateway, wantLabel: "gateway_failure"},
+		{name: "default statuses replaced", status: http.StatusBadGateway, statuses: []int{http.StatusServiceUnavailable}, wantKind: ErrorKindResponse, wantLabel: "failure"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, _ := statusServer(t, tt.status)
+			source := "gateway-" + tt.name
+			data := testMetadata(t, srv.URL, WithSourceName(source), WithGatewayStatuses(tt.statuses...))
+			before := map[string]float64{}
+			for _, label := range []string{"failure", "gateway_failure"} {
+				before[label] = testutil.ToFloat64(invocationsTotal.WithLabelValues(source, label))
+			}
+			_, report, err := InvokeHTTPRequest(context.Background(), "{}", http.Header{}, data, zap.NewNop())
+			if got := errorResponseOf(t, err).ErrorKind; got != tt.wantKind {
+				t.Errorf("error kind = %v, want %v", got, tt.wantKind)
+			}
+			if report.ErrorKind != tt.wantKind {
+				t.Errorf("report error kind = %v, want %v", report.ErrorKind, tt.wantKind)
+			}
+			for _, label := range []string{"failure", "gateway_failure"} {
+				want := 0.0
+				if label == tt.wantLabel {
+					want = 1
+				}
+				if got := testutil.ToFloat64(invocationsTotal.WithLabelValues(source, label)) - before[label]; got != want {
+					t.Errorf("counted %v %v invocations, want %v", got, label, want)
+				}
+			}
+		})
+	}
+}
+
+func TestIdempotencyReplay(t *testing.T) {
+	tests := []struct {
+		name         string
+		configured   string
+		header       string
+		wantReplayed bool
+	}{
+		{name: "replayed", configured: "Idempotency-Replayed", header: "true", wantReplayed: true},
+		{name: "processed", configured: "Idempotency-Replayed", header: "false"},
+		{name: "header missing", configured: "Idempotency-Replayed"},
+		{name: "invalid header", configured: "Idempotency-Replayed", header: "yes please"},
+		{name: "not configured", header: "true"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newServer(t, func(w http.ResponseWriter, r *http.Request) {
+				if tt.header != "" {
+					w.Header().Set("Idempotency-Replayed", tt.header)
+				}
+			})
+			source := "replay-" + tt.name
+			data := testMetadata(t, srv.URL, WithSourceName(source), WithIdempotencyReplayHeader(tt.configured))
+			before := map[string]float64{}
+			for _, label := range []string{"success", "replayed"} {
+				before[label] = testutil.ToFloat64(invocationsTotal.WithLabelValues(source, label))
+			}
+			resp, report, err := InvokeHTTPRequest(context.Background(), "{}", http.Header{}, data, zap.NewNop())
+			if err != nil {
+				t.Fatalf("InvokeHTTPRequest() error = %v", err)
+			}
+			resp.Body.Close()
+			if report.Outcome != OutcomeSuccess || report.Replayed != tt.wantReplayed {
+				t.Errorf("reported %v replayed %v, want a success replayed %v", report.Outcome, report.Replayed, tt.wantReplayed)
+			}
+			wantLabel := "success"
+			if tt.wantReplayed {
+				wantLabel = "replayed"
+			}
+			for _, label := range []string{"success", "replayed"} {
+				want := 0.0
+				if label == wantLabel {
+					want = 1
+				}
+				if got := testutil.ToFloat64(invocationsTotal.WithLabelValues(source, label)) - before[label]; got != want {
+					t.Errorf("counted %v %v invocations, want %v", got, label, want)
+				}
+			}
+		})
+	}
+}
+
+func TestSLAInvocations(t *testing.T) {
+	tests := []struct {
+		name          string
+		target        time.Duration
+		latency       time.Duration
+		status        int
+		wantCompliant float64
+		wantViolating float64
+	}{
+		{name: "within target", target: time.Second, latency: 200 * time.Millisecond, status: http.StatusOK, wantCompliant: 1},
+		{name: "at target", target: time.Second, latency: time.Second, status: http.StatusOK, wantCompliant: 1},
+		{name: "slower than target", target: time.Second, latency: 1500 * time.Millisecond, status: http.StatusOK, wantViolating: 1},
+		{name: "fast failure", target: time.Second, latency: time.Millisecond, status: http.StatusBadRequest, wantViolating: 1},
+		{name: "disabled", latency: time.Hour, status: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := useFakeClock(t)
+			srv := newServer(t, func(w http.ResponseWriter, r *http.Request) {
+				clock.Advance(tt.latency)
+				w.WriteHeader(tt.status)
+			})
+			source := "sla-" + tt.name
+			data := testMetadata(t, srv.URL, WithSourceName(source), WithSLALatencyTarget(tt.target))
+			compliant := slaInvocationsTotal.WithLabelValues(source, "compliant")
+			violating := slaInvocationsTotal.WithLabelValues(source, "violating")
+			compliantBefore, violatingBefore := testutil.ToFloat64(compliant), testutil.ToFloat64(violating)
+			if resp, err := HandleHTTPRequest("{}", http.Header{}, data, zap.NewNop()); err == nil {
+				resp.Body.Close()
+			}
+			if got := testutil.ToFloat64(compliant) - compliantBefore; got != tt.wantCompliant {
+				t.Errorf("counted %v compliant invocations, want %v", got, tt.wantCompliant)
+			}
+			if got := testutil.ToFloat64(violating) - violatingBefore; got != tt.wantViolating {
+				t.Errorf("counted %v violating invocations, want %v", got, tt.wantViolating)
+			}
+		})
+	}
+}
+
+func TestSLAIgnoresIncompleteInvocations(t *testing.T) {
+	data := ConnectorMetadata{SourceName: "sla-incomplete", SLALatencyTarget: time.Second}
+	before := map[string]float64{}
+	for _, result := range []string{"compliant", "violating"} {
+		before[result] = testutil.ToFloat64(slaInvocationsTotal.WithLabelValues(data.SourceName, result))
+	}
+	for _, outcome := range []Outcome{OutcomeIncomplete, OutcomeRetry} {
+		observeSLA(InvocationReport{Outcome: outcome, Duration: time.Hour}, data)
+	}
+	for _, result := range []string{"compliant", "violating"} {
+		if got := testutil.ToFloat64(slaInvocationsTotal.WithLabelValues(data.SourceName, result)) - before[result]; got != 0 {
+			t.Errorf("counted %v %v invocations, want none", got, result)
+		}
+	}
+}
@@ -0,0 +1,252 @@
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// JSONSchema is a JSON Schema supporting the keywords type, enum, properties, required, additionalProperties,
+// items, minItems, maxItems, minLength, maxLength, pattern, minimum and maximum; other keywords are ignored
+type JSONSchema struct {
+	Type                 schemaTypes            `json:"type"`
+	Enum                 []interface{}          `json:"enum"`
+	Properties           map[string]*JSONSchema `json:"properties"`
+	Required             []string               `json:"required"`
+	AdditionalProperties *additionalProperties  `json:"additionalProperties"`
+	Items                *JSONSchema            `json:"items"`
+	MinItems             *int                   `json:"minItems"`
+	MaxItems             *int                   `json:"maxItems"`
+	MinLength            *int                   `json:"minLength"`
+	MaxLength            *int                   `json:"maxLength"`
+	Pattern              string                 `json:"pattern"`
+	Minimum              *float64               `json:"minimum"`
+	Maximum              *float64               `json:"maximum"`
+
+	pattern *regexp.Regexp
+}
+
+// schemaTypes holds the type keyword, either a single type or a list of types
+type schemaTypes []string
+
+func (t *schemaTypes) UnmarshalJSON(raw []byte) error {
+	var single string
+	if err := json.Unmarshal(raw, &single); err == nil {
+		*t = schemaTypes{single}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(raw, &list); err != nil {
+		return fmt.Errorf("type must be a string or a list of strings")
+	}
+	*t = list
+	return nil
+}
+
+// additionalProperties holds the additionalProperties keyword, either a boolean or a schema
+type additionalProperties struct {
+	allowed bool
+	schema  *JSONSchema
+}
+
+func (a *additionalProperties) UnmarshalJSON(raw []byte) error {
+	if err := json.Unmarshal(raw, &a.allowed); err == nil {
+		return nil
+	}
+	a.allowed = true
+	return json.Unmarshal(raw, &a.schema)
+}
+
+// ParseJSONSchema parses a JSON Schema, compiling its patterns
+func ParseJSONSchema(raw []byte) (*JSONSchema, error) {
+	var schema JSONSchema
+	if err := json.Unmarshal(raw, &schema); err != nil {
+		return nil, err
+	}
+	if err := schema.compile(); err != nil {
+		return nil, err
+	}
+	return &schema, nil
+}
+
+// LoadJSONSchema reads and parses the JSON Schema in file path
+func LoadJSONSchema(path string) (*JSONSchema, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseJSONSchema(raw)
+}
+
+func (s *JSONSchema) compile() error {
+	if s.Pattern != "" {
+		pattern, err := regexp.Compile(s.Pattern)
+		if err != nil {
+			return fmt.Errorf("invalid pattern %q: %v", s.Pattern, err)
+		}
+		s.pattern = pattern
+	}
+	for _, property := range s.Properties {
+		if property == nil {
+			continue
+		}
+		if err := property.compile(); err != nil {
+			return err
+		}
+	}
+	if s.AdditionalProperties != nil && s.AdditionalProperties.schema != nil {
+		if err := s.AdditionalProperties.schema.compile(); err != nil {
+			return err
+		}
+	}
+	if s.Items != nil {
+		return s.Items.compile()
+	}
+	return nil
+}
+
+// Validate checks that the JSON document raw conforms to the schema, returning the first violation found
+func (s *JSONSchema) Validate(raw []byte) error {
+	var value interface{}
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return fmt.Errorf("invalid JSON: %v", err)
+	}
+	return s.validate("$", value)
+}
+
+func (s *JSONSchema) validate(path string, value interface{}) error {
+	if s == nil {
+		return nil
+	}
+	if len(s.Type) > 0 && !s.Type.match(value) {
+		return fmt.Errorf("%v: expected %v, got %v", path, strings.Join(s.Type, " or "), jsonType(value))
+	}
+	if len(s.Enum) > 0 && !containsValue(s.Enum, value) {
+		return fmt.Errorf("%v: value not in enum", path)
+	}
+	switch value := value.(type) {
+	case map[string]interface{}:
+		return s.validateObject(path, value)
+	case []interface{}:
+		if s.MinItems != nil && len(value) < *s.MinItems {
+			return fmt.Errorf("%v: expected at least %v items, got %v", path, *s.MinItems, len(value))
+		}
+		if s.MaxItems != nil && len(value) > *s.MaxItems {
+			return fmt.Errorf("%v: expected at most %v items, got %v", path, *s.MaxItems, len(value))
+		}
+		for i, item := range value {
+			if err := s.Items.validate(fmt.Sprintf("%v[%v]", path, i), item); err != nil {
+				return err
+			}
+		}
+	case string:
+		length := utf8.RuneCountInString(value)
+		if s.MinLength != nil && length < *s.MinLength {
+			return fmt.Errorf("%v: expected at least %v characters, got %v", path, *s.MinLength, length)
+		}
+		if s.MaxLength != nil && length > *s.MaxLength {
+			return fmt.Errorf("%v: expected at most %v characters, got %v", path, *s.MaxLength, length)
+		}
+		if s.pattern != nil && !s.pattern.MatchString(value) {
+			return fmt.Errorf("%v: doesn't match pattern %q", path, s.Pattern)
+		}
+	case float64:
+		if s.Minimum != nil && value < *s.Minimum {
+			return fmt.Errorf("%v: expected at least %v, got %v", path, *s.Minimum, value)
+		}
+		if s.Maximum != nil && value > *s.Maximum {
+			return fmt.Errorf("%v: expected at most %v, got %v", path, *s.Maximum, value)
+		}
+	}
+	return nil
+}
+
+func (s *JSONSchema) validateObject(path string, value map[string]interface{}) error {
+	for _, name := range s.Required {
+		if _, ok := value[name]; !ok {
+			return fmt.Errorf("%v: missing required property %q", path, name)
+		}
+	}
+	// Validate in a stable order so that the reported violation doesn't vary
+	names := make([]string, 0, len(value))
+	for name := range value {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		property, ok := s.Properties[name]
+		if !ok && s.AdditionalProperties != nil {
+			if !s.AdditionalProperties.allowed {
+				return fmt.Errorf("%v: unexpected property %q", path, name)
+			}
+			property = s.AdditionalProperties.schema
+		}
+		if err := property.validate(path+"."+name, value[name]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// match tells whether value has one of the types
+func (t schemaTypes) match(value interface{}) bool {
+	actual := jsonType(value)
+	for _, expected := range t {
+		if expected == actual || expected == "number" && actual == "integer" {
+			return true
+		}
+	}
+	return false
+}
+
+// jsonType returns the JSON Schema type of a decoded JSON value, numbers without fraction being integers
+func jsonType(value interface{}) string {
+	switch value := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		if value == math.Trunc(value) {
+			return "integer"
+		}
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	default:
+		return "object"
+	}
+}
+
+func containsValue(values []interface{}, value interface{}) bool {
+	for _, v := range values {
+		if reflect.DeepEqual(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// validateResponse checks the body of resp against data.ResponseSchema if set, leaving the body readable
+func validateResponse(resp *http.Response, data ConnectorMetadata) error {
+	if data.ResponseSchema == nil {
+		return nil
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	return data.ResponseSchema.Validate(body)
+}
@@ -0,0 +1,211 @@
+package common
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+const orderSchema = `{
+	"type": "object",
+	"required": ["id", "status"],
+	"additionalProperties": false,
+	"properties": {
+		"id": {"type": "integer", "minimum": 1},
+		"status": {"enum": ["accepted", "rejected"]},
+		"ref": {"type": ["string", "null"], "pattern": "^[A-Z]{3}-[0-9]+$", "maxLength": 10},
+		"tags": {"type": "array", "minItems": 1, "maxItems": 2, "items": {"type": "string", "minLength": 2}},
+		"score": {"type": "number", "maximum": 1}
+	}
+}`
+
+func TestJSONSchemaValidate(t *testing.T) {
+	schema, err := ParseJSONSchema([]byte(orderSchema))
+	if err != nil {
+		t.Fatalf("ParseJSONSchema() error = %v", err)
+	}
+	tests := []struct {
+		name    string
+		doc     string
+		wantErr string
+	}{
+		{name: "minimal", doc: `{"id": 1, "status": "accepted"}`},
+		{name: "complete", doc: `{"id": 2, "status": "rejected", "ref": "ABC-12", "tags": ["ab", "cd"], "score": 0.5}`},
+		{name: "null in type list", doc: `{"id": 1, "status": "accepted", "ref": null}`},
+		{name: "integer is a number", doc: `{"id": 1, "status": "accepted", "score": 1}`},
+		{name: "invalid JSON", doc: `{"id": `, wantErr: "invalid JSON"},
+		{name: "wrong root type", doc: `[]`, wantErr: "$: expected object, got array"},
+		{name: "missing required", doc: `{"id": 1}`, wantErr: `missing required property "status"`},
+		{name: "not an integer", doc: `{"id": 1.5, "status": "accepted"}`, wantErr: "$.id: expected integer, got number"},
+		{name: "below minimum", doc: `{"id": 0, "status": "accepted"}`, wantErr: "$.id: expected at least 1"},
+		{name: "above maximum", doc: `{"id": 1, "status": "accepted", "score": 1.5}`, wantErr: "$.score: expected at most 1"},
+		{name: "not in enum", doc: `{"id": 1, "status": "pending"}`, wantErr: "$.status: value not in enum"},
+		{name: "additional property", doc: `{"id": 1, "status": "accepted", "extra": true}`, wantErr: `unexpected property "extra"`},
+		{name: "pattern", doc: `{"id": 1, "status": "accepted", "ref": "abc"}`, wantErr: "$.ref: doesn't match pattern"},
+		{name: "too long", doc: `{"id": 1, "status": "accepted", "ref": "ABC-1234567"}`, wantErr: "$.ref: expected at most 10 characters"},
+		{name: "too few items", doc: `{"id": 1, "status": "accepted", "tags": []}`, wantErr: "$.tags: expected at least 1 items"},
+		{name: "too many items", doc: `{"id": 1, "status": "accepted", "tags": ["ab", "cd", "ef"]}`, wantErr: "$.tags: expected at most 2 items"},
+		{name: "invalid item", doc: `{"id": 1, "status": "accepted", "tags": ["ab", "c"]}`, wantErr: "$.tags[1]: expected at least 2 characters"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := schema.Validate([]byte(tt.doc))
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("Validate() error = %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("Validate() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestJSONSchemaAdditionalPropertiesSchema(t *testing.T) {
+	schema, err := ParseJSONSchema([]byte(`{"properties": {"id": {}}, "additionalProperties": {"type": "string", "pattern": "^x"}}`))
+	if err != nil {
+		t.Fatalf("ParseJSONSchema() error = %v", err)
+	}
+	if err := schema.Validate([]byte(`{"id": 1, "a": "xy"}`)); err != nil {
+		t.Errorf("Validate() error = %v", err)
+	}
+	if err := schema.Validate([]byte(`{"id": 1, "a": "yx"}`)); err == nil {
+		t.Error("Validate() accepted an additional property violating its schema")
+	}
+}
+
+func TestParseJSONSchemaInvalid(t *testing.T) {
+	tests := []struct {
+		name   string
+		schema string
+	}{
+		{name: "invalid JSON", schema: `{"type": `},
+		{name: "invalid type", schema: `{"type": 1}`},
+		{name: "invalid pattern", schema: `{"pattern": "("}`},
+		{name: "invalid nested pattern", schema: `{"properties": {"a": {"items": {"pattern": "["}}}}`},
+		{name: "invalid additional properties pattern", schema: `{"additionalProperties": {"pattern": "("}}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ParseJSONSchema([]byte(tt.schema)); err == nil {
+				t.Error("ParseJSONSchema() succeeded")
+			}
+		})
+	}
+}
+
+// bodyServer starts a server responding 200 with bodies in turn, repeating the last one, and counting the requests
+func bodyServer(t *testing.T, bodies ...string) (string, *int32) {
+	t.Helper()
+	var requests int32
+	srv := newServer(t, func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		n := int(atomic.AddInt32(&requests, 1))
+		if n > len(bodies) {
+			n = len(bodies)
+		}
+		w.Write([]byte(bodies[n-1]))
+	})
+	return srv.URL, &requests
+}
+
+func TestResponseSchema(t *testing.T) {
+	schema, err := ParseJSONSchema([]byte(orderSchema))
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid, invalid := `{"id": 1, "status": "accepted"}`, `{"id": 1, "status": "pending"}`
+	tests := []struct {
+		name         string
+		bodies       []string
+		retryable    bool
+		wantErr      bool
+		wantAttempts int32
+	}{
+		{name: "conforming", bodies: []string{valid}, wantAttempts: 1},
+		{name: "violation fails", bodies: []string{invalid, valid}, wantErr: true, wantAttempts: 1},
+		{name: "violation retried", bodies: []string{invalid, valid}, retryable: true, wantAttempts: 2},
+		{name: "violation retried until exhausted", bodies: []string{invalid}, retryable: true, wantErr: true, wantAttempts: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			url, requests := bodyServer(t, tt.bodies...)
+			data := testMetadata(t, url, WithMaxRetries(2), WithResponseSchema(schema, tt.retryable))
+			resp, report, err := InvokeHTTPRequest(context.Background(), "{}", http.Header{}, data, zap.NewNop())
+			if got := atomic.LoadInt32(requests); got != tt.wantAttempts {
+				t.Errorf("sent %v requests, want %v", got, tt.wantAttempts)
+			}
+			if !tt.wantErr {
+				if err != nil {
+					t.Fatalf("InvokeHTTPRequest() error = %v", err)
+				}
+				defer resp.Body.Close()
+				if body, _ := ioutil.ReadAll(resp.Body); string(body) != valid {
+					t.Errorf("response body = %q, want it readable after validation", body)
+				}
+				return
+			}
+			errorResponse := errorResponseOf(t, err)
+			if errorResponse.ErrorKind != ErrorKindSchema || report.ErrorKind != ErrorKindSchema {
+				t.Errorf("error kind = %v and reported %v, want %v", errorResponse.ErrorKind, report.ErrorKind, ErrorKindSchema)
+			}
+			if errorResponse.Status != http.StatusOK || errorResponse.Body != invalid || !strings.Contains(errorResponse.Message, "$.status: value not in enum") {
+				t.Errorf("error = %+v", errorResponse)
+			}
+		})
+	}
+}
+
+func TestParseConnectorMetadataResponseSchema(t *testing.T) {
+	dir := t.TempDir()
+	valid := filepath.Join(dir, "schema.json")
+	if err := ioutil.WriteFile(valid, []byte(orderSchema), 0600); err != nil {
+		t.Fatal(err)
+	}
+	invalid := filepath.Join(dir, "invalid.json")
+	if err := ioutil.WriteFile(invalid, []byte(`{"pattern": "("}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name          string
+		env           map[string]string
+		wantSchema    bool
+		wantRetryable bool
+		wantErr       bool
+	}{
+		{name: "unset", env: map[string]string{}},
+		{name: "schema", env: map[string]string{"RESPONSE_SCHEMA_FILE": valid}, wantSchema: true},
+		{name: "retried", env: map[string]string{"RESPONSE_SCHEMA_FILE": valid, "RESPONSE_SCHEMA_RETRY": "true"}, wantSchema: true, wantRetryable: true},
+		{name: "missing file", env: map[string]string{"RESPONSE_SCHEMA_FILE": filepath.Join(dir, "missing.json")}, wantErr: true},
+		{name: "invalid schema", env: map[string]string{"RESPONSE_SCHEMA_FILE": invalid}, wantErr: true},
+		{name: "invalid retry", env: map[string]string{"RESPONSE_SCHEMA_RETRY": "sometimes"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := map[string]string{
+				"TOPIC":                 "topic",
+				"HTTP_ENDPOINT":         "http://function.default",
+				"MAX_RETRIES":           "3",
+				"CONTENT_TYPE":          "application/json",
+				"RESPONSE_SCHEMA_FILE":  "",
+				"RESPONSE_SCHEMA_RETRY": "",
+			}
+			for name, value := range tt.env {
+				env[name] = value
+			}
+			setEnv(t, env)
+			meta, err := ParseConnectorMetadata()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseConnectorMetadata() error = %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil && ((meta.ResponseSchema != nil) != tt.wantSchema || meta.ResponseSchemaRetryable != tt.wantRetryable) {
+				t.Errorf("schema set %v and retryable %v, want %v and %v", meta.ResponseSchema != nil, meta.ResponseSchemaRetryable, tt.wantSchema, tt.wantRetryable)
+			}
+		})
+	}
+}
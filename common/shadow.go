@@ -0,0 +1,88 @@
+package common
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// DefaultShadowConcurrency bounds the number of shadow requests in flight unless configured otherwise
+const DefaultShadowConcurrency = 10
+
+// shadowTimeout bounds a shadow request, which is detached from the invocation context
+const shadowTimeout = 30 * time.Second
+
+// shadowConcurrency returns the number of shadow requests allowed in flight
+func (m ConnectorMetadata) shadowConcurrency() int {
+	if m.ShadowConcurrency > 0 {
+		return m.ShadowConcurrency
+	}
+	return DefaultShadowConcurrency
+}
+
+// activeShadows counts the shadow requests in flight
+var activeShadows int32
+
+// sendShadow sends a copy of req, whose body is described by body, to ShadowEndpoint in the background, ignoring
+// the response. Copies are dropped while the shadow concurrency is reached and shadow failures are only logged,
+// so that the shadow never affects the invocation.
+func sendShadow(req *http.Request, body payload, subpath string, data ConnectorMetadata, logger *zap.Logger) {
+	if body.once {
+		// The body can't be read a second time
+		return
+	}
+	if atomic.AddInt32(&activeShadows, 1) > int32(data.shadowConcurrency()) {
+		atomic.AddInt32(&activeShadows, -1)
+		logger.Debug("shadow concurrency reached, not sending the request to the shadow endpoint",
+			zap.String("shadow_endpoint", data.ShadowEndpoint),
+			zap.String("source", data.SourceName))
+		return
+	}
+	headers := req.Header.Clone()
+	// The body is opened before returning, while the buffer it reads is still held by the invocation
+	reader := toReadCloser(body.open())
+	go func() {
+		defer atomic.AddInt32(&activeShadows, -1)
+		defer reader.Close()
+		if err := shadow(headers, reader, body.length, subpath, data); err != nil {
+			logger.Debug("shadow request failed",
+				zap.Error(err),
+				zap.String("shadow_endpoint", data.ShadowEndpoint),
+				zap.String("source", data.SourceName))
+		}
+	}()
+}
+
+// shadow sends body, of length bytes or -1 if unknown, and headers to ShadowEndpoint, discarding the response
+func shadow(headers http.Header, body io.ReadCloser, length int64, subpath string, data ConnectorMetadata) error {
+	client, err := data.clientFor(data.ShadowEndpoint)
+	if err != nil {
+		return err
+	}
+	target, err := joinEndpointPath(data.ShadowEndpoint, subpath)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), shadowTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", target, body)
+	if err != nil {
+		return err
+	}
+	req.Header = headers
+	if length >= 0 {
+		req.ContentLength = length
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, err = io.Copy(ioutil.Discard, resp.Body)
+	return err
+}
@@ -0,0 +1,149 @@
+package common
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// shadowCopy is a request received by the shadow endpoint
+type shadowCopy struct {
+	path   string
+	body   string
+	header string
+}
+
+// shadowServer starts a shadow endpoint responding status once release is closed, sending the requests it
+// receives to the returned channel
+func shadowServer(t *testing.T, status int, release chan struct{}) (string, chan shadowCopy) {
+	t.Helper()
+	copies := make(chan shadowCopy, 16)
+	srv := newServer(t, func(w http.ResponseWriter, r *http.Request) {
+		raw, _ := ioutil.ReadAll(r.Body)
+		copies <- shadowCopy{path: r.URL.Path, body: string(raw), header: r.Header.Get("X-Request-Id")}
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+		w.WriteHeader(status)
+	})
+	return srv.URL, copies
+}
+
+// waitForShadows waits until no shadow request is in flight
+func waitForShadows(t *testing.T) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&activeShadows) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%v shadow requests still in flight", atomic.LoadInt32(&activeShadows))
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestShadowEndpoint(t *testing.T) {
+	tests := []struct {
+		name          string
+		primaryStatus int
+		shadowStatus  int
+		stream        bool
+		wantErr       bool
+		wantCopies    int
+	}{
+		{name: "copied", primaryStatus: http.StatusOK, shadowStatus: http.StatusOK, wantCopies: 1},
+		{name: "shadow failure ignored", primaryStatus: http.StatusOK, shadowStatus: http.StatusInternalServerError, wantCopies: 1},
+		{name: "copied once despite retries", primaryStatus: http.StatusInternalServerError, shadowStatus: http.StatusOK, wantErr: true, wantCopies: 1},
+		{name: "stream not copied", primaryStatus: http.StatusOK, shadowStatus: http.StatusOK, stream: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			release := make(chan struct{})
+			close(release)
+			shadowURL, copies := shadowServer(t, tt.shadowStatus, release)
+			primary, requests := statusServer(t, tt.primaryStatus)
+			data := testMetadata(t, primary.URL, WithMaxRetries(2), WithShadowEndpoint(shadowURL, 0),
+				WithEndpointPathHeader("X-Path"), WithChunkedTransfer(tt.stream))
+			headers := http.Header{"X-Path": {"orders"}, "X-Request-Id": {"r-1"}}
+			var resp *http.Response
+			var err error
+			if tt.stream {
+				resp, err = HandleHTTPRequestStream(strings.NewReader(`{"id":1}`), headers, data, zap.NewNop())
+			} else {
+				resp, err = HandleHTTPRequest(`{"id":1}`, headers, data, zap.NewNop())
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("HandleHTTPRequest() error = %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil {
+				resp.Body.Close()
+			}
+			waitForShadows(t)
+			if len(copies) != tt.wantCopies {
+				t.Fatalf("shadow received %v copies, want %v", len(copies), tt.wantCopies)
+			}
+			if tt.wantCopies == 0 {
+				return
+			}
+			if got, want := (<-copies), (shadowCopy{path: "/orders", body: `{"id":1}`, header: "r-1"}); got != want {
+				t.Errorf("shadow received %+v, want %+v", got, want)
+			}
+			if got := atomic.LoadInt32(requests); tt.wantErr && got != 3 {
+				t.Errorf("primary received %v requests, want every retry", got)
+			}
+		})
+	}
+}
+
+func TestShadowConcurrency(t *testing.T) {
+	release := make(chan struct{})
+	shadowURL, copies := shadowServer(t, http.StatusOK, release)
+	primary, _ := statusServer(t, http.StatusOK)
+	data := testMetadata(t, primary.URL, WithShadowEndpoint(shadowURL, 1))
+	for i := 0; i < 3; i++ {
+		resp, err := HandleHTTPRequest("{}", http.Header{}, data, zap.NewNop())
+		if err != nil {
+			t.Fatalf("invocation %v with the shadow busy failed: %v", i, err)
+		}
+		resp.Body.Close()
+		if i == 0 {
+			// Wait for the first copy to occupy the shadow
+			<-copies
+		}
+	}
+	if got := atomic.LoadInt32(&activeShadows); got != 1 {
+		t.Errorf("%v shadow requests in flight, want the concurrency of 1", got)
+	}
+	close(release)
+	waitForShadows(t)
+	if len(copies) != 0 {
+		t.Errorf("shadow received %v copies while busy, want them dropped", len(copies))
+	}
+}
+
+func TestShadowEndpointValidation(t *testing.T) {
+	tests := []struct {
+		name        string
+		endpoint    string
+		concurrency int
+		wantErr     bool
+	}{
+		{name: "valid", endpoint: "http://function-v2.default", concurrency: 5},
+		{name: "invalid endpoint", endpoint: "function-v2", wantErr: true},
+		{name: "negative concurrency", endpoint: "http://function-v2.default", concurrency: -1, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := testMetadata(t, "http://function.default")
+			WithShadowEndpoint(tt.endpoint, tt.concurrency)(&data)
+			if err := data.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,17 @@
+package common
+
+import (
+	"context"
+	"math/rand"
+	"time"
+)
+
+// WaitStartupJitter delays the caller by a random duration below data.StartupJitter, so pods scaled up at the same time
+// don't all consume or probe the endpoint at once. It returns early with the context error if ctx is done first.
+func WaitStartupJitter(ctx context.Context, data ConnectorMetadata) error {
+	if data.StartupJitter <= 0 {
+		return nil
+	}
+	delay := time.Duration(rand.New(rand.NewSource(time.Now().UnixNano())).Int63n(int64(data.StartupJitter)))
+	return sleepContext(ctx, delay)
+}
@@ -0,0 +1,56 @@
+package common
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestWaitStartupJitter(t *testing.T) {
+	const jitter = time.Minute
+	tests := []struct {
+		name    string
+		jitter  time.Duration
+		cancel  bool
+		wantErr error
+	}{
+		{name: "disabled", jitter: 0},
+		{name: "within bound", jitter: jitter},
+		{name: "cancelled", jitter: jitter, cancel: true, wantErr: context.Canceled},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := useFakeClock(t)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			done := make(chan error, 1)
+			go func() { done <- WaitStartupJitter(ctx, ConnectorMetadata{StartupJitter: tt.jitter}) }()
+			select {
+			case err := <-done:
+				// No delay was drawn
+				if err != nil {
+					t.Fatalf("WaitStartupJitter() error = %v", err)
+				}
+				return
+			case <-time.After(10 * time.Millisecond):
+			}
+			if tt.jitter == 0 {
+				t.Fatal("WaitStartupJitter() waited without jitter")
+			}
+			waitForTimers(t, clock, 1)
+			if tt.cancel {
+				cancel()
+			} else {
+				clock.Advance(tt.jitter)
+			}
+			select {
+			case err := <-done:
+				if err != tt.wantErr {
+					t.Errorf("WaitStartupJitter() error = %v, want %v", err, tt.wantErr)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("WaitStartupJitter() waited beyond the jitter bound")
+			}
+		})
+	}
+}
@@ -0,0 +1,49 @@
+package common
+
+import (
+	"io"
+	"io/ioutil"
+
+	"go.uber.org/zap"
+)
+
+// DefaultErrorBodyStreamLimit bounds the bytes of a failed response body streamed to an ErrorBodyStreamer
+// unless configured otherwise
+const DefaultErrorBodyStreamLimit = 10 << 20
+
+// ErrorBodyStreamer is implemented by dead-letter publishers set as ErrorWriter able to publish the body of a failed
+// response while it's read, instead of receiving it buffered in the ErrorResponse
+type ErrorBodyStreamer interface {
+	// StreamErrorBody publishes errorResponse, which has no body, along with the body read from body
+	StreamErrorBody(errorResponse ErrorResponse, body io.Reader) error
+}
+
+// errorBodyStreamLimit returns the bytes of a failed response body streamed to an ErrorBodyStreamer
+func (m ConnectorMetadata) errorBodyStreamLimit() int64 {
+	if m.ErrorBodyStreamLimit > 0 {
+		return m.ErrorBodyStreamLimit
+	}
+	return DefaultErrorBodyStreamLimit
+}
+
+// streamErrorBody streams body to streamer truncated to the stream limit, logging failures and truncation
+func streamErrorBody(streamer ErrorBodyStreamer, errorResponse ErrorResponse, body io.Reader, data ConnectorMetadata, logger *zap.Logger) {
+	limit := data.errorBodyStreamLimit()
+	limited := &io.LimitedReader{R: body, N: limit}
+	if err := streamer.StreamErrorBody(errorResponse, limited); err != nil {
+		logger.Warn("failed to stream error response body",
+			zap.Error(err),
+			zap.String("http_endpoint", errorResponse.HttpEndpoint),
+			zap.String("source", data.SourceName))
+		return
+	}
+	// the streamer may stop before the limit, only a body left unread past it was truncated
+	if limited.N == 0 {
+		if n, _ := io.CopyN(ioutil.Discard, body, 1); n > 0 {
+			logger.Warn("error response body truncated",
+				zap.Int64("limit", limit),
+				zap.String("http_endpoint", errorResponse.HttpEndpoint),
+				zap.String("source", data.SourceName))
+		}
+	}
+}
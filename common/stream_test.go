@@ -0,0 +1,141 @@
+package common
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// streamingSink is an ErrorBodyStreamer recording the streamed error responses and bodies, signalling first once
+// the first bytes of a body were read
+type streamingSink struct {
+	err   error
+	first chan struct{}
+
+	mu       sync.Mutex
+	streamed []ErrorResponse
+	bodies   []string
+	lines    int
+}
+
+func (s *streamingSink) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lines++
+	return len(p), nil
+}
+
+func (s *streamingSink) StreamErrorBody(errorResponse ErrorResponse, body io.Reader) error {
+	if s.err != nil {
+		return s.err
+	}
+	var read strings.Builder
+	buf := make([]byte, 64)
+	for {
+		n, err := body.Read(buf)
+		read.Write(buf[:n])
+		if n > 0 && s.first != nil {
+			close(s.first)
+			s.first = nil
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.streamed = append(s.streamed, errorResponse)
+	s.bodies = append(s.bodies, read.String())
+	return nil
+}
+
+func TestStreamErrorBody(t *testing.T) {
+	tests := []struct {
+		name          string
+		size          int
+		limit         int64
+		sinkErr       error
+		wantBody      int
+		wantTruncated bool
+		wantFailed    bool
+	}{
+		{name: "within the limit", size: 500, limit: 1000, wantBody: 500},
+		{name: "exactly the limit", size: 1000, limit: 1000, wantBody: 1000},
+		{name: "truncated to the limit", size: 5000, limit: 1000, wantBody: 1000, wantTruncated: true},
+		{name: "default limit", size: 5000, wantBody: 5000},
+		{name: "streamer failure", size: 500, limit: 1000, sinkErr: errors.New("publish failed"), wantFailed: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := strings.Repeat("x", tt.size)
+			srv := newServer(t, func(w http.ResponseWriter, r *http.Request) {
+				ioutil.ReadAll(r.Body)
+				w.Header().Set("X-Trace", "abc")
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write([]byte(body))
+			})
+			sink := &streamingSink{err: tt.sinkErr}
+			core, logs := observer.New(zapcore.WarnLevel)
+			data := testMetadata(t, srv.URL, WithErrorWriter(sink), WithErrorBodyStreamLimit(tt.limit))
+			_, err := HandleHTTPRequest("{}", http.Header{}, data, zap.New(core))
+			if got := errorResponseOf(t, err); got.Status != http.StatusInternalServerError || got.Body != "" {
+				t.Errorf("returned error response %+v, want status 500 without body", got)
+			}
+			if sink.lines != 0 {
+				t.Errorf("wrote %v buffered error lines besides streaming", sink.lines)
+			}
+			if got := logs.FilterMessage("error response body truncated").Len(); (got != 0) != tt.wantTruncated {
+				t.Errorf("logged %v truncations, want truncated %v", got, tt.wantTruncated)
+			}
+			if got := logs.FilterMessage("failed to stream error response body").Len(); (got != 0) != tt.wantFailed {
+				t.Errorf("logged %v streaming failures, want failed %v", got, tt.wantFailed)
+			}
+			if tt.wantFailed {
+				return
+			}
+			if len(sink.bodies) != 1 || len(sink.bodies[0]) != tt.wantBody {
+				t.Fatalf("streamed %v bodies, want one of %v bytes", len(sink.bodies), tt.wantBody)
+			}
+			streamed := sink.streamed[0]
+			if streamed.Status != http.StatusInternalServerError || streamed.Body != "" || streamed.Headers.Get("X-Trace") != "abc" {
+				t.Errorf("streamed error response %+v, want status, headers and no body", streamed)
+			}
+		})
+	}
+}
+
+func TestStreamErrorBodyWithoutBuffering(t *testing.T) {
+	sink := &streamingSink{first: make(chan struct{})}
+	first := sink.first
+	srv := newServer(t, func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("head"))
+		w.(http.Flusher).Flush()
+		// The rest of the body is only sent once the sink received its head, which buffering would never do
+		select {
+		case <-first:
+			w.Write([]byte("tail"))
+		case <-time.After(5 * time.Second):
+		}
+	})
+	data := testMetadata(t, srv.URL, WithErrorWriter(sink))
+	if _, err := HandleHTTPRequest("{}", http.Header{}, data, zap.NewNop()); err == nil {
+		t.Fatal("expected the invocation to fail")
+	}
+	if len(sink.bodies) != 1 || sink.bodies[0] != "headtail" {
+		t.Errorf("streamed %q, want the head before the tail was sent", sink.bodies)
+	}
+}
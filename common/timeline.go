@@ -0,0 +1,80 @@
+package common
+
+import (
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// retryTimeline records the attempts of an invocation, logged in a single entry once retries are exhausted so that
+// alerting pipelines get the whole picture from one line
+type retryTimeline []timelineAttempt
+
+// timelineAttempt describes an attempt of a retryTimeline
+type timelineAttempt struct {
+	start    time.Time
+	duration time.Duration
+	endpoint string
+	status   int
+	err      error
+	delay    time.Duration // before the next attempt
+}
+
+// record appends the attempt started at start to endpoint, which got resp or failed with err
+func (t *retryTimeline) record(start time.Time, endpoint string, resp *http.Response, err error) {
+	attempt := timelineAttempt{
+		start:    start,
+		duration: since(start),
+		endpoint: endpoint,
+		err:      err,
+	}
+	if resp != nil {
+		attempt.status = resp.StatusCode
+	}
+	*t = append(*t, attempt)
+}
+
+// delayed records the delay after the last attempt before the next one
+func (t retryTimeline) delayed(delay time.Duration) {
+	if len(t) > 0 {
+		t[len(t)-1].delay = delay
+	}
+}
+
+func (t retryTimeline) MarshalLogArray(enc zapcore.ArrayEncoder) error {
+	for _, attempt := range t {
+		if err := enc.AppendObject(attempt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (a timelineAttempt) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+	enc.AddTime("start", a.start)
+	enc.AddInt64("duration_ms", a.duration.Milliseconds())
+	enc.AddString("endpoint", a.endpoint)
+	if a.status != 0 {
+		enc.AddInt("status_code", a.status)
+	}
+	if a.err != nil {
+		enc.AddString("error", a.err.Error())
+	}
+	if a.delay > 0 {
+		enc.AddInt64("delay_ms", a.delay.Milliseconds())
+	}
+	return nil
+}
+
+// logRetryTimeline logs the timeline of an invocation whose retries were exhausted if LogRetryTimeline is set
+func logRetryTimeline(timeline retryTimeline, data ConnectorMetadata, logger *zap.Logger) {
+	if !data.LogRetryTimeline {
+		return
+	}
+	logger.Error("function invocation retries exhausted",
+		zap.Int("attempts", len(timeline)),
+		zap.Array("timeline", timeline),
+		zap.String("source", data.SourceName))
+}
@@ -0,0 +1,123 @@
+package common
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestRetryTimeline(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		statuses []int
+		enabled  bool
+		delays   []time.Duration
+		want     []interface{}
+	}{
+		{
+			name:     "retries exhausted",
+			statuses: []int{500, 502, 503},
+			enabled:  true,
+			delays:   []time.Duration{time.Second, 2 * time.Second},
+			want: []interface{}{
+				map[string]interface{}{"start": start, "duration_ms": int64(100), "status_code": int(500), "delay_ms": int64(1000)},
+				map[string]interface{}{"start": start.Add(1100 * time.Millisecond), "duration_ms": int64(100), "status_code": int(502), "delay_ms": int64(2000)},
+				map[string]interface{}{"start": start.Add(3200 * time.Millisecond), "duration_ms": int64(100), "status_code": int(503)},
+			},
+		},
+		{name: "succeeded after retries", statuses: []int{500, 200}, enabled: true, delays: []time.Duration{time.Second}},
+		{name: "disabled", statuses: []int{500}, delays: []time.Duration{time.Second, 2 * time.Second}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := useFakeClock(t)
+			var requests int32
+			srv := newServer(t, func(w http.ResponseWriter, r *http.Request) {
+				n := int(atomic.AddInt32(&requests, 1))
+				if n > len(tt.statuses) {
+					n = len(tt.statuses)
+				}
+				clock.Advance(100 * time.Millisecond)
+				w.WriteHeader(tt.statuses[n-1])
+			})
+			core, logs := observer.New(zapcore.ErrorLevel)
+			data := testMetadata(t, srv.URL, WithMaxRetries(2), WithRetryBackoff(time.Second, 2, time.Minute), WithRetryTimeline(tt.enabled))
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				if resp, _, err := InvokeHTTPRequest(context.Background(), "{}", http.Header{}, data, zap.New(core)); err == nil {
+					resp.Body.Close()
+				}
+			}()
+			for _, delay := range tt.delays {
+				waitForTimers(t, clock, 1)
+				clock.Advance(delay)
+			}
+			<-done
+			entries := logs.FilterMessage("function invocation retries exhausted").All()
+			if tt.want == nil {
+				if len(entries) != 0 {
+					t.Errorf("logged %v timelines, want none", len(entries))
+				}
+				return
+			}
+			if len(entries) != 1 {
+				t.Fatalf("logged %v timelines, want 1", len(entries))
+			}
+			fields := entries[0].ContextMap()
+			if fields["attempts"] != int64(len(tt.want)) {
+				t.Errorf("logged %v attempts, want %v", fields["attempts"], len(tt.want))
+			}
+			timeline, _ := fields["timeline"].([]interface{})
+			for _, attempt := range timeline {
+				// The endpoint is the random address of the test server
+				if attempt.(map[string]interface{})["endpoint"] != srv.URL {
+					t.Errorf("attempt endpoint = %v, want %v", attempt.(map[string]interface{})["endpoint"], srv.URL)
+				}
+				delete(attempt.(map[string]interface{}), "endpoint")
+			}
+			if !reflect.DeepEqual(timeline, tt.want) {
+				t.Errorf("timeline = %v, want %v", timeline, tt.want)
+			}
+		})
+	}
+}
+
+func TestTimelineAttemptFields(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		attempt timelineAttempt
+		want    map[string]interface{}
+	}{
+		{
+			name:    "response",
+			attempt: timelineAttempt{start: start, duration: 250 * time.Millisecond, endpoint: "http://function", status: 500, delay: time.Second},
+			want:    map[string]interface{}{"start": start, "duration_ms": int64(250), "endpoint": "http://function", "status_code": 500, "delay_ms": int64(1000)},
+		},
+		{
+			name:    "transport error",
+			attempt: timelineAttempt{start: start, duration: 3 * time.Second, endpoint: "http://function", err: context.DeadlineExceeded},
+			want:    map[string]interface{}{"start": start, "duration_ms": int64(3000), "endpoint": "http://function", "error": "context deadline exceeded"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			enc := zapcore.NewMapObjectEncoder()
+			if err := tt.attempt.MarshalLogObject(enc); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(enc.Fields, tt.want) {
+				t.Errorf("fields = %v, want %v", enc.Fields, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,45 @@
+package common
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// GRPCTimeoutHeader is the deadline header formatted like gRPC, as the remaining time in milliseconds, e.g. "1500m"
+const GRPCTimeoutHeader = "Grpc-Timeout"
+
+// traceWrites traces the request made with ctx to set wrote once the request was fully written,
+// telling timeouts before the server got the request apart from timeouts after it did
+func traceWrites(ctx context.Context, wrote *int32) context.Context {
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		WroteRequest: func(info httptrace.WroteRequestInfo) {
+			if info.Err == nil {
+				atomic.StoreInt32(wrote, 1)
+			}
+		},
+	})
+}
+
+// isTimeout tells whether err is a timeout
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
+
+// formatDeadline formats deadline for the header named header: as the remaining time for GRPCTimeoutHeader,
+// as an RFC 3339 timestamp otherwise
+func formatDeadline(header string, deadline time.Time) string {
+	if http.CanonicalHeaderKey(header) == GRPCTimeoutHeader {
+		remaining := deadline.Sub(now()).Milliseconds()
+		if remaining < 0 {
+			remaining = 0
+		}
+		return strconv.FormatInt(remaining, 10) + "m"
+	}
+	return deadline.UTC().Format(time.RFC3339Nano)
+}
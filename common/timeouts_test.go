@@ -0,0 +1,190 @@
+package common
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// unreadServer accepts connections without ever reading from them, returning its URL and the number of
+// connections it accepted, so that sending a large request times out before it is fully written
+func unreadServer(t *testing.T) (string, *int32) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var conns int32
+	done := make(chan struct{})
+	accepted := make(chan net.Conn, 16)
+	t.Cleanup(func() {
+		listener.Close()
+		close(done)
+		for {
+			select {
+			case conn := <-accepted:
+				conn.Close()
+			default:
+				return
+			}
+		}
+	})
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&conns, 1)
+			select {
+			case accepted <- conn:
+			case <-done:
+				conn.Close()
+			}
+		}
+	}()
+	return "http://" + listener.Addr().String(), &conns
+}
+
+// stalledResponseServer starts a server reading requests but never responding until the test completes,
+// returning its URL and the number of requests it received
+func stalledResponseServer(t *testing.T) (string, *int32) {
+	t.Helper()
+	var requests int32
+	release := make(chan struct{})
+	srv := newServer(t, func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		atomic.AddInt32(&requests, 1)
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	})
+	t.Cleanup(func() { close(release) })
+	return srv.URL, &requests
+}
+
+func TestTimeoutPhases(t *testing.T) {
+	const timeout = 50 * time.Millisecond
+	tests := []struct {
+		name         string
+		afterWrite   bool
+		skip         bool
+		wantAttempts int32
+		wantStatus   int
+	}{
+		{name: "after write retried", afterWrite: true, wantAttempts: 3},
+		{name: "after write not retried", afterWrite: true, skip: true, wantAttempts: 1, wantStatus: http.StatusGatewayTimeout},
+		{name: "before write retried", wantAttempts: 3},
+		{name: "before write retried despite skipping", skip: true, wantAttempts: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var endpoint string
+			var attempts *int32
+			body := "{}"
+			if tt.afterWrite {
+				endpoint, attempts = stalledResponseServer(t)
+			} else {
+				endpoint, attempts = unreadServer(t)
+				// Large enough not to fit in the socket buffers, the write stalls
+				body = `"` + strings.Repeat("x", 64<<20) + `"`
+			}
+			data := testMetadata(t, endpoint, WithMaxRetries(2), WithIOTimeout(timeout), WithSkipPostWriteTimeoutRetry(tt.skip))
+			_, err := HandleHTTPRequest(body, http.Header{}, data, zap.NewNop())
+			if err == nil {
+				t.Fatal("expected the timed out invocation to fail")
+			}
+			if tt.wantStatus != 0 {
+				if got := errorResponseOf(t, err).Status; got != tt.wantStatus {
+					t.Errorf("status = %v, want %v", got, tt.wantStatus)
+				}
+			}
+			if got := atomic.LoadInt32(attempts); got != tt.wantAttempts {
+				t.Errorf("made %v attempts, want %v", got, tt.wantAttempts)
+			}
+		})
+	}
+}
+
+func TestFormatDeadline(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		header   string
+		deadline time.Time
+		want     string
+	}{
+		{name: "timestamp", header: "X-Request-Deadline", deadline: start.Add(1500 * time.Millisecond), want: "2020-01-01T00:00:01.5Z"},
+		{name: "timestamp in utc", header: "X-Request-Deadline", deadline: start.Add(time.Second).In(time.FixedZone("CET", 3600)), want: "2020-01-01T00:00:01Z"},
+		{name: "grpc timeout", header: GRPCTimeoutHeader, deadline: start.Add(1500 * time.Millisecond), want: "1500m"},
+		{name: "grpc timeout header case", header: "grpc-timeout", deadline: start.Add(2 * time.Second), want: "2000m"},
+		{name: "grpc timeout passed", header: GRPCTimeoutHeader, deadline: start.Add(-time.Second), want: "0m"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useFakeClock(t)
+			if got := formatDeadline(tt.header, tt.deadline); got != tt.want {
+				t.Errorf("formatDeadline() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDeadlineHeader(t *testing.T) {
+	deadline := time.Now().Add(time.Minute)
+	tests := []struct {
+		name     string
+		header   string
+		deadline bool
+		want     string
+	}{
+		{name: "context deadline", header: "X-Request-Deadline", deadline: true, want: deadline.UTC().Format(time.RFC3339Nano)},
+		{name: "without deadline", header: "X-Request-Deadline"},
+		{name: "not configured", deadline: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got http.Header
+			srv := newServer(t, func(w http.ResponseWriter, r *http.Request) { got = r.Header })
+			data := testMetadata(t, srv.URL, WithDeadlineHeader(tt.header))
+			ctx := context.Background()
+			if tt.deadline {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithDeadline(ctx, deadline)
+				defer cancel()
+			}
+			resp, _, err := InvokeHTTPRequest(ctx, "{}", http.Header{}, data, zap.NewNop())
+			if err != nil {
+				t.Fatalf("InvokeHTTPRequest() error = %v", err)
+			}
+			resp.Body.Close()
+			if value := got.Get("X-Request-Deadline"); value != tt.want {
+				t.Errorf("deadline header = %q, want %q", value, tt.want)
+			}
+		})
+	}
+}
+
+func TestDeadlineHeaderFromTotalTimeout(t *testing.T) {
+	var got string
+	srv := newServer(t, func(w http.ResponseWriter, r *http.Request) { got = r.Header.Get(GRPCTimeoutHeader) })
+	data := testMetadata(t, srv.URL, WithDeadlineHeader(GRPCTimeoutHeader), WithRequestTotalTimeout(10*time.Second))
+	resp, err := HandleHTTPRequest("{}", http.Header{}, data, zap.NewNop())
+	if err != nil {
+		t.Fatalf("HandleHTTPRequest() error = %v", err)
+	}
+	resp.Body.Close()
+	remaining, err := strconv.Atoi(strings.TrimSuffix(got, "m"))
+	if err != nil || !strings.HasSuffix(got, "m") || remaining <= 9000 || remaining > 10000 {
+		t.Errorf("deadline header = %q, want about 10000m", got)
+	}
+}
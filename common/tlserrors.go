@@ -0,0 +1,15 @@
+package common
+
+import (
+	"crypto/x509"
+	"errors"
+)
+
+// isTLSTrustError tells whether err is a TLS handshake failure caused by the server certificate not being trusted,
+// e.g. issued by an unknown CA, expired or for another host, which retrying won't fix unlike transient negotiation failures
+func isTLSTrustError(err error) bool {
+	var unknownAuthority x509.UnknownAuthorityError
+	var invalid x509.CertificateInvalidError
+	var hostname x509.HostnameError
+	return errors.As(err, &unknownAuthority) || errors.As(err, &invalid) || errors.As(err, &hostname)
+}
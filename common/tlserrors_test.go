@@ -0,0 +1,92 @@
+package common
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestIsTLSTrustError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "unknown authority", err: x509.UnknownAuthorityError{}, want: true},
+		{name: "expired", err: x509.CertificateInvalidError{Reason: x509.Expired}, want: true},
+		{name: "hostname", err: x509.HostnameError{Host: "function"}, want: true},
+		{name: "wrapped", err: fmt.Errorf("Post: %w", x509.UnknownAuthorityError{}), want: true},
+		{name: "handshake failure", err: errors.New("remote error: tls: protocol version not supported")},
+		{name: "nil"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isTLSTrustError(tt.err); got != tt.want {
+				t.Errorf("isTLSTrustError() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAbortOnTLSTrustError(t *testing.T) {
+	tests := []struct {
+		name         string
+		trusted      bool
+		host         string
+		server       func(*tls.Config)
+		minVersion   string
+		abort        bool
+		wantAttempts int32
+		wantKind     ErrorKind
+	}{
+		{name: "untrusted retried", abort: false, wantAttempts: 3, wantKind: ErrorKindTransport},
+		{name: "untrusted aborted", abort: true, wantAttempts: 1, wantKind: ErrorKindTLS},
+		{name: "wrong host aborted", trusted: true, host: "localhost", abort: true, wantAttempts: 1, wantKind: ErrorKindTLS},
+		{
+			name:         "transient handshake failure retried",
+			trusted:      true,
+			server:       func(c *tls.Config) { c.MaxVersion = tls.VersionTLS12 },
+			minVersion:   "1.3",
+			abort:        true,
+			wantAttempts: 3,
+			wantKind:     ErrorKindTransport,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var handshakes int32
+			srv, ca := newConfiguredTLSServer(t, func(w http.ResponseWriter, r *http.Request) {}, func(c *tls.Config) {
+				if tt.server != nil {
+					tt.server(c)
+				}
+				c.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+					atomic.AddInt32(&handshakes, 1)
+					return nil, nil
+				}
+			})
+			client := TLSConfig{MinVersion: tt.minVersion}
+			if tt.trusted {
+				client.CAFile = ca
+			}
+			endpoint := srv.URL
+			if tt.host != "" {
+				endpoint = strings.Replace(endpoint, "127.0.0.1", tt.host, 1)
+			}
+			data := testMetadata(t, endpoint, WithTLS(client), WithMaxRetries(2), WithAbortOnTLSTrustError(tt.abort))
+			_, err := HandleHTTPRequest("{}", http.Header{}, data, zap.NewNop())
+			if got := errorResponseOf(t, err).ErrorKind; got != tt.wantKind {
+				t.Errorf("error kind = %v, want %v", got, tt.wantKind)
+			}
+			if got := atomic.LoadInt32(&handshakes); got != tt.wantAttempts {
+				t.Errorf("made %v handshakes, want %v", got, tt.wantAttempts)
+			}
+		})
+	}
+}
@@ -0,0 +1,200 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// DefaultTraceFileMaxSize bounds the size of a TraceFile before it's rotated unless configured otherwise
+const DefaultTraceFileMaxSize = 100 << 20
+
+// DefaultTraceFileBackups is the number of rotated files kept by a TraceFile unless configured otherwise
+const DefaultTraceFileBackups = 3
+
+// TraceAttempt describes an attempt of a traced invocation
+type TraceAttempt struct {
+	Start      time.Time `json:"start"`
+	DurationMs int64     `json:"duration_ms"`
+	Endpoint   string    `json:"endpoint"`
+	StatusCode int       `json:"status_code,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// TraceRecord describes a traced invocation of the function, written as a JSON line by a TraceFile
+type TraceRecord struct {
+	Start      time.Time      `json:"start"`
+	End        time.Time      `json:"end"`
+	DurationMs int64          `json:"duration_ms"`
+	Source     string         `json:"source"`
+	Endpoint   string         `json:"endpoint"`
+	Outcome    string         `json:"outcome"`
+	StatusCode int            `json:"status_code,omitempty"`
+	ErrorKind  ErrorKind      `json:"error_kind,omitempty"`
+	Attempts   []TraceAttempt `json:"attempts"`
+}
+
+// TraceFile writes TraceRecords as JSON lines to a file for offline analysis where no tracing backend is available,
+// renaming it with a numbered suffix once it would exceed its maximum size and keeping a bounded number of them
+type TraceFile struct {
+	path    string
+	maxSize int64
+	backups int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+// NewTraceFile returns a TraceFile appending to path, rotated past maxSize bytes keeping backups rotated files
+func NewTraceFile(path string, maxSize int64, backups int) (*TraceFile, error) {
+	if maxSize < 1 {
+		return nil, fmt.Errorf("trace file maximum size must be positive, got %v", maxSize)
+	}
+	if backups < 0 {
+		return nil, fmt.Errorf("trace file backups must not be negative, got %v", backups)
+	}
+	t := &TraceFile{
+		path:    path,
+		maxSize: maxSize,
+		backups: backups,
+	}
+	if err := t.open(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *TraceFile) open() error {
+	file, err := os.OpenFile(t.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	t.file = file
+	t.size = info.Size()
+	return nil
+}
+
+// rotate shifts the rotated files, path.1 being the most recent, and starts a new file
+func (t *TraceFile) rotate() error {
+	if err := t.file.Close(); err != nil {
+		return err
+	}
+	if t.backups == 0 {
+		if err := os.Remove(t.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return t.open()
+	}
+	for i := t.backups - 1; i > 0; i-- {
+		if err := os.Rename(fmt.Sprintf("%v.%v", t.path, i), fmt.Sprintf("%v.%v", t.path, i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := os.Rename(t.path, t.path+".1"); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return t.open()
+}
+
+// Write writes record as a JSON line, rotating the file first if the line would exceed the maximum size
+func (t *TraceFile) Write(record TraceRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.size > 0 && t.size+int64(len(line)) > t.maxSize {
+		if err := t.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := t.file.Write(line)
+	t.size += int64(n)
+	return err
+}
+
+// Close closes the file
+func (t *TraceFile) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.file.Close()
+}
+
+// invocationTrace collects the attempts of a traced invocation
+type invocationTrace struct {
+	mu       sync.Mutex
+	attempts []TraceAttempt
+}
+
+type traceKey struct{}
+
+// withTrace returns ctx collecting the attempts of the invocation if data.Traces is set
+func withTrace(ctx context.Context, data ConnectorMetadata) (context.Context, *invocationTrace) {
+	if data.Traces == nil {
+		return ctx, nil
+	}
+	trace := &invocationTrace{}
+	return context.WithValue(ctx, traceKey{}, trace), trace
+}
+
+// traceAttempt records an attempt to endpoint started at start in the trace of ctx, if any
+func traceAttempt(ctx context.Context, start time.Time, endpoint string, resp *http.Response, err error) {
+	trace, _ := ctx.Value(traceKey{}).(*invocationTrace)
+	if trace == nil {
+		return
+	}
+	attempt := TraceAttempt{
+		Start:      start,
+		DurationMs: since(start).Milliseconds(),
+		Endpoint:   endpoint,
+	}
+	if resp != nil {
+		attempt.StatusCode = resp.StatusCode
+	}
+	if err != nil {
+		attempt.Error = err.Error()
+	}
+	trace.mu.Lock()
+	trace.attempts = append(trace.attempts, attempt)
+	trace.mu.Unlock()
+}
+
+// writeTrace writes the trace of the invocation started at start and described by report to data.Traces
+func writeTrace(trace *invocationTrace, start time.Time, report InvocationReport, data ConnectorMetadata, logger *zap.Logger) {
+	if trace == nil {
+		return
+	}
+	trace.mu.Lock()
+	attempts := append([]TraceAttempt{}, trace.attempts...)
+	trace.mu.Unlock()
+	record := TraceRecord{
+		Start:      start,
+		End:        start.Add(report.Duration),
+		DurationMs: report.Duration.Milliseconds(),
+		Source:     data.SourceName,
+		Endpoint:   report.Endpoint,
+		Outcome:    report.Outcome.String(),
+		StatusCode: report.StatusCode,
+		ErrorKind:  report.ErrorKind,
+		Attempts:   attempts,
+	}
+	if err := data.Traces.Write(record); err != nil {
+		logger.Warn("failed to write invocation trace",
+			zap.Error(err),
+			zap.String("source", data.SourceName))
+	}
+}
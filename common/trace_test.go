@@ -0,0 +1,241 @@
+package common
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// readTraces returns the records of the trace file at path
+func readTraces(t *testing.T, path string) []TraceRecord {
+	t.Helper()
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var records []TraceRecord
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var record TraceRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("invalid trace line %q: %v", scanner.Text(), err)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestTraceFileRecordsInvocations(t *testing.T) {
+	const attemptDuration = 100 * time.Millisecond
+	tests := []struct {
+		name         string
+		statuses     []int
+		retries      int
+		wantOutcome  string
+		wantStatuses []int
+		wantKind     ErrorKind
+	}{
+		{name: "success", statuses: []int{http.StatusOK}, wantOutcome: OutcomeSuccess.String(), wantStatuses: []int{200}},
+		{name: "retried", statuses: []int{http.StatusServiceUnavailable, http.StatusOK}, retries: 2, wantOutcome: OutcomeSuccess.String(), wantStatuses: []int{503, 200}},
+		{name: "failure", statuses: []int{http.StatusBadGateway}, retries: 1, wantOutcome: OutcomeFailure.String(), wantStatuses: []int{502, 502}, wantKind: ErrorKindGateway},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := useFakeClock(t)
+			start := clock.Now()
+			var requests int
+			srv := newServer(t, func(w http.ResponseWriter, r *http.Request) {
+				ioutil.ReadAll(r.Body)
+				clock.Advance(attemptDuration)
+				status := tt.statuses[len(tt.statuses)-1]
+				if requests < len(tt.statuses) {
+					status = tt.statuses[requests]
+				}
+				requests++
+				w.WriteHeader(status)
+			})
+			path := filepath.Join(t.TempDir(), "traces.jsonl")
+			traces, err := NewTraceFile(path, DefaultTraceFileMaxSize, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer traces.Close()
+			data := testMetadata(t, srv.URL, WithMaxRetries(tt.retries), WithTraceFile(traces), WithSourceName("traced"))
+			if resp, err := HandleHTTPRequest("{}", http.Header{}, data, zap.NewNop()); err == nil {
+				resp.Body.Close()
+			}
+			records := readTraces(t, path)
+			if len(records) != 1 {
+				t.Fatalf("wrote %v trace records, want 1", len(records))
+			}
+			record := records[0]
+			if record.Outcome != tt.wantOutcome || record.Source != "traced" || record.Endpoint != srv.URL || record.ErrorKind != tt.wantKind {
+				t.Errorf("trace record %+v, want outcome %v and error kind %q", record, tt.wantOutcome, tt.wantKind)
+			}
+			wantDuration := time.Duration(len(tt.wantStatuses)) * attemptDuration
+			if !record.Start.Equal(start) || !record.End.Equal(start.Add(wantDuration)) || record.DurationMs != wantDuration.Milliseconds() {
+				t.Errorf("traced %v to %v in %vms, want %v lasting %v", record.Start, record.End, record.DurationMs, start, wantDuration)
+			}
+			if len(record.Attempts) != len(tt.wantStatuses) {
+				t.Fatalf("traced %v attempts, want %v", len(record.Attempts), len(tt.wantStatuses))
+			}
+			for i, attempt := range record.Attempts {
+				if attempt.StatusCode != tt.wantStatuses[i] || attempt.DurationMs != attemptDuration.Milliseconds() || attempt.Endpoint != srv.URL {
+					t.Errorf("attempt %v = %+v, want status %v lasting %v", i, attempt, tt.wantStatuses[i], attemptDuration)
+				}
+				if want := start.Add(time.Duration(i) * attemptDuration); !attempt.Start.Equal(want) {
+					t.Errorf("attempt %v started at %v, want %v", i, attempt.Start, want)
+				}
+			}
+		})
+	}
+}
+
+func TestTraceFileRecordsTransportErrors(t *testing.T) {
+	srv := newServer(t, func(http.ResponseWriter, *http.Request) {})
+	srv.Close()
+	path := filepath.Join(t.TempDir(), "traces.jsonl")
+	traces, err := NewTraceFile(path, DefaultTraceFileMaxSize, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer traces.Close()
+	data := testMetadata(t, srv.URL, WithTraceFile(traces))
+	if _, err := HandleHTTPRequest("{}", http.Header{}, data, zap.NewNop()); err == nil {
+		t.Fatal("expected the invocation to fail")
+	}
+	records := readTraces(t, path)
+	if len(records) != 1 || len(records[0].Attempts) != 1 {
+		t.Fatalf("wrote %+v, want a record with one attempt", records)
+	}
+	if attempt := records[0].Attempts[0]; attempt.Error == "" || attempt.StatusCode != 0 {
+		t.Errorf("attempt %+v, want its error without status", attempt)
+	}
+}
+
+func TestTraceFileRotation(t *testing.T) {
+	record := TraceRecord{Source: "rotated", Outcome: "success", Attempts: []TraceAttempt{}}
+	line, _ := json.Marshal(record)
+	lineSize := int64(len(line) + 1)
+	tests := []struct {
+		name      string
+		backups   int
+		writes    int
+		wantFiles map[string]int
+	}{
+		{name: "within size", backups: 2, writes: 3, wantFiles: map[string]int{"": 3}},
+		{name: "rotated", backups: 2, writes: 7, wantFiles: map[string]int{"": 1, ".1": 3, ".2": 3}},
+		{name: "oldest dropped", backups: 1, writes: 7, wantFiles: map[string]int{"": 1, ".1": 3, ".2": 0}},
+		{name: "without backups", backups: 0, writes: 4, wantFiles: map[string]int{"": 1, ".1": 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "traces.jsonl")
+			traces, err := NewTraceFile(path, 3*lineSize, tt.backups)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < tt.writes; i++ {
+				if err := traces.Write(record); err != nil {
+					t.Fatalf("write %v failed: %v", i, err)
+				}
+			}
+			traces.Close()
+			for suffix, want := range tt.wantFiles {
+				if want == 0 {
+					if _, err := os.Stat(path + suffix); !os.IsNotExist(err) {
+						t.Errorf("file %q exists, want it removed", suffix)
+					}
+					continue
+				}
+				if got := len(readTraces(t, path+suffix)); got != want {
+					t.Errorf("file %q holds %v records, want %v", suffix, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestNewTraceFileInvalid(t *testing.T) {
+	dir := t.TempDir()
+	for i, tt := range []struct {
+		path    string
+		maxSize int64
+		backups int
+	}{
+		{path: filepath.Join(dir, "a"), maxSize: 0, backups: 1},
+		{path: filepath.Join(dir, "b"), maxSize: 10, backups: -1},
+		{path: filepath.Join(dir, "missing", "c"), maxSize: 10, backups: 1},
+	} {
+		if _, err := NewTraceFile(tt.path, tt.maxSize, tt.backups); err == nil {
+			t.Errorf("case %v: NewTraceFile() succeeded", i)
+		}
+	}
+}
+
+// openHandles returns the number of file descriptors of the process open on path
+func openHandles(t *testing.T, path string) int {
+	t.Helper()
+	fds, err := ioutil.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Skipf("file descriptors can't be listed: %v", err)
+	}
+	count := 0
+	for _, fd := range fds {
+		if target, err := os.Readlink(filepath.Join("/proc/self/fd", fd.Name())); err == nil && target == path {
+			count++
+		}
+	}
+	return count
+}
+
+func TestParseConnectorMetadataTraceFile(t *testing.T) {
+	tests := []struct {
+		name        string
+		env         map[string]string
+		wantErr     bool
+		wantHandles int
+	}{
+		{name: "valid", env: map[string]string{}, wantHandles: 1},
+		{name: "invalid size", env: map[string]string{"TRACE_FILE_MAX_SIZE": "big"}, wantErr: true},
+		{name: "later setting invalid", env: map[string]string{"ERROR_OUTPUT": "printer"}, wantErr: true},
+		{name: "options invalid", env: map[string]string{"HEDGE_LIMIT": "-1"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "traces.jsonl")
+			env := map[string]string{
+				"TOPIC":               "topic",
+				"HTTP_ENDPOINT":       "http://function.default",
+				"MAX_RETRIES":         "3",
+				"CONTENT_TYPE":        "application/json",
+				"TRACE_FILE":          path,
+				"TRACE_FILE_MAX_SIZE": "",
+				"ERROR_OUTPUT":        "",
+				"HEDGE_LIMIT":         "",
+			}
+			for name, value := range tt.env {
+				env[name] = value
+			}
+			setEnv(t, env)
+			meta, err := ParseConnectorMetadata()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseConnectorMetadata() error = %v, want error %v", err, tt.wantErr)
+			}
+			if got := openHandles(t, path); got != tt.wantHandles {
+				t.Errorf("%v handles open on the trace file, want %v", got, tt.wantHandles)
+			}
+			if meta.Traces != nil {
+				meta.Traces.Close()
+			}
+		})
+	}
+}
@@ -0,0 +1,49 @@
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"text/template"
+)
+
+// BodyTransformer reshapes a body along with its headers
+type BodyTransformer func(body []byte, headers http.Header) ([]byte, error)
+
+// templateData is what templates of NewTemplateTransformer are executed with
+type templateData struct {
+	// Body is the body as a string
+	Body string
+	// JSON is the body decoded from JSON, nil if it isn't JSON
+	JSON interface{}
+	// Headers are the headers of the body
+	Headers http.Header
+}
+
+// templateFuncs are the functions available to templates of NewTemplateTransformer
+var templateFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		raw, err := json.Marshal(v)
+		return string(raw), err
+	},
+}
+
+// NewTemplateTransformer returns a BodyTransformer executing the text/template text with the fields
+// .Body, .JSON and .Headers, and the json function marshaling a value back to JSON
+func NewTemplateTransformer(text string) (BodyTransformer, error) {
+	tmpl, err := template.New("transform").Funcs(templateFuncs).Option("missingkey=zero").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	return func(body []byte, headers http.Header) ([]byte, error) {
+		data := templateData{Body: string(body), Headers: headers}
+		if err := json.Unmarshal(body, &data.JSON); err != nil {
+			data.JSON = nil
+		}
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, data); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}, nil
+}
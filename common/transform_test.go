@@ -0,0 +1,118 @@
+package common
+
+import (
+	"net/http"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestTemplateTransformer(t *testing.T) {
+	tests := []struct {
+		name    string
+		text    string
+		body    string
+		headers http.Header
+		want    string
+		wantErr bool
+	}{
+		{name: "raw body", text: `{"wrapped":{{json .Body}}}`, body: "plain", want: `{"wrapped":"plain"}`},
+		{name: "json field", text: `{{.JSON.result.id}}`, body: `{"result":{"id":42}}`, want: "42"},
+		{name: "json subtree", text: `{{json .JSON.result}}`, body: `{"result":{"id":42,"ok":true}}`, want: `{"id":42,"ok":true}`},
+		{name: "missing field", text: `[{{.JSON.missing}}]`, body: `{"result":1}`, want: "[<no value>]"},
+		{name: "non json body", text: `{{if .JSON}}json{{else}}text{{end}}`, body: "not json", want: "text"},
+		{name: "headers", text: `{{.Headers.Get "X-Request-Id"}}`, headers: http.Header{"X-Request-Id": {"abc"}}, want: "abc"},
+		{name: "execution error", text: `{{index .JSON 1}}`, body: `{"a":1}`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transform, err := NewTemplateTransformer(tt.text)
+			if err != nil {
+				t.Fatalf("NewTemplateTransformer() error = %v", err)
+			}
+			got, err := transform([]byte(tt.body), tt.headers)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("transform() error = %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil && string(got) != tt.want {
+				t.Errorf("transform() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTemplateTransformerInvalid(t *testing.T) {
+	if _, err := NewTemplateTransformer(`{{.Body`); err == nil {
+		t.Error("NewTemplateTransformer() accepted an unterminated action")
+	}
+}
+
+func TestForwardResponseTransformed(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		body     string
+		want     string
+		wantErr  bool
+	}{
+		{name: "transformed", template: `{"id":{{.JSON.id}}}`, body: `{"id":7,"debug":"x"}`, want: `{"id":7}`},
+		{name: "failing template not published", template: `{{index .JSON 1}}`, body: `{"id":7}`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transform, err := NewTemplateTransformer(tt.template)
+			if err != nil {
+				t.Fatal(err)
+			}
+			publisher := &recordingPublisher{}
+			data := testMetadata(t, "http://function", WithResponseTopic("responses"), WithResponseTransformer(transform))
+			f := NewForwarder(publisher.publish, data, zap.NewNop())
+			err = f.ForwardResponse("key", []byte(tt.body), http.Header{})
+			f.Close()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ForwardResponse() error = %v, want error %v", err, tt.wantErr)
+			}
+			published := publisher.published()
+			if tt.wantErr {
+				if len(published) != 0 {
+					t.Errorf("published %v messages, want none", len(published))
+				}
+				return
+			}
+			if len(published) != 1 || string(published[0].value) != tt.want {
+				t.Errorf("published %+v, want %q", published, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseConnectorMetadataResponseTemplate(t *testing.T) {
+	tests := []struct {
+		name    string
+		text    string
+		want    bool
+		wantErr bool
+	}{
+		{name: "unset"},
+		{name: "valid", text: `{{.Body}}`, want: true},
+		{name: "invalid", text: `{{.Body`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setEnv(t, map[string]string{
+				"TOPIC":             "topic",
+				"HTTP_ENDPOINT":     "http://function.default",
+				"MAX_RETRIES":       "3",
+				"CONTENT_TYPE":      "application/json",
+				"RESPONSE_TEMPLATE": tt.text,
+			})
+			meta, err := ParseConnectorMetadata()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseConnectorMetadata() error = %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil && (meta.ResponseTransformer != nil) != tt.want {
+				t.Errorf("transformer configured = %v, want %v", meta.ResponseTransformer != nil, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,250 @@
+package common
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TLSConfig points to the TLS material used to connect to an endpoint
+type TLSConfig struct {
+	// CAFile is a PEM bundle of CAs trusted for the server certificate, the system pool is used when empty
+	CAFile string `json:"ca_file"`
+	// CertFile and KeyFile hold the PEM client certificate and key presented to the server
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+	// MinVersion and MaxVersion restrict the TLS versions negotiated, e.g. "1.2", the Go defaults are used when empty
+	MinVersion string `json:"min_version,omitempty"`
+	MaxVersion string `json:"max_version,omitempty"`
+	// CipherSuites is a comma separated list of the cipher suite names allowed for TLS 1.2 and below, e.g.
+	// "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", the Go defaults are used when empty
+	CipherSuites string `json:"cipher_suites,omitempty"`
+}
+
+// tlsVersions maps the accepted TLS version names to their values
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// validate checks that the TLS settings are consistent
+func (c TLSConfig) validate() error {
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return fmt.Errorf("client certificate and key must be set together")
+	}
+	minVersion, err := parseTLSVersion(c.MinVersion)
+	if err != nil {
+		return err
+	}
+	maxVersion, err := parseTLSVersion(c.MaxVersion)
+	if err != nil {
+		return err
+	}
+	if minVersion != 0 && maxVersion != 0 && minVersion > maxVersion {
+		return fmt.Errorf("tls min version %v is above max version %v", c.MinVersion, c.MaxVersion)
+	}
+	_, err = parseCipherSuites(c.CipherSuites)
+	return err
+}
+
+// parseTLSVersion returns the value of a TLS version name, zero if empty
+func parseTLSVersion(name string) (uint16, error) {
+	if name == "" {
+		return 0, nil
+	}
+	version, ok := tlsVersions[strings.TrimSpace(name)]
+	if !ok {
+		return 0, fmt.Errorf("unknown tls version %q, expected 1.0, 1.1, 1.2 or 1.3", name)
+	}
+	return version, nil
+}
+
+// parseCipherSuites returns the IDs of a comma separated list of cipher suite names, nil if empty
+func parseCipherSuites(names string) ([]uint16, error) {
+	var ids []uint16
+	for _, name := range splitList(names) {
+		id, ok := cipherSuiteID(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown tls cipher suite %q", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// cipherSuiteID looks up a cipher suite by name among those implemented by crypto/tls
+func cipherSuiteID(name string) (uint16, bool) {
+	for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		if suite.Name == name {
+			return suite.ID, true
+		}
+	}
+	return 0, false
+}
+
+// load builds a tls.Config from the referenced files and the version and cipher restrictions
+func (c TLSConfig) load() (*tls.Config, error) {
+	config := &tls.Config{}
+	var err error
+	if config.MinVersion, err = parseTLSVersion(c.MinVersion); err != nil {
+		return nil, err
+	}
+	if config.MaxVersion, err = parseTLSVersion(c.MaxVersion); err != nil {
+		return nil, err
+	}
+	if config.CipherSuites, err = parseCipherSuites(c.CipherSuites); err != nil {
+		return nil, err
+	}
+	if c.CAFile != "" {
+		pem, err := ioutil.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA file %v: %v", c.CAFile, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in CA file %v", c.CAFile)
+		}
+		config.RootCAs = pool
+	}
+	if c.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate %v: %v", c.CertFile, err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// tlsConfigFor returns the TLS settings used for endpoint
+func (m ConnectorMetadata) tlsConfigFor(endpoint string) TLSConfig {
+	if config, ok := m.EndpointTLS[endpoint]; ok {
+		return config
+	}
+	return m.TLS
+}
+
+// transportConfig holds the settings that require a dedicated HTTP transport
+type transportConfig struct {
+	tls                   TLSConfig
+	responseHeaderTimeout time.Duration
+	ioTimeout             time.Duration
+	http10                bool
+	connMaxLifetime       time.Duration
+	dnsCacheTTL           time.Duration
+	maxRedirects          int
+}
+
+// transportConfigFor returns the transport settings used for endpoint
+func (m ConnectorMetadata) transportConfigFor(endpoint string) transportConfig {
+	return transportConfig{
+		tls:                   m.tlsConfigFor(endpoint),
+		responseHeaderTimeout: m.ResponseHeaderTimeout,
+		ioTimeout:             m.IOTimeout,
+		http10:                m.ForceHTTP10,
+		connMaxLifetime:       m.ConnMaxLifetime,
+		dnsCacheTTL:           m.DNSCacheTTL,
+		maxRedirects:          m.maxRedirects(),
+	}
+}
+
+// clients caches the HTTP clients built for each distinct transport configuration,
+// so that connections are pooled across invocations
+var clients = struct {
+	sync.Mutex
+	byConfig map[transportConfig]*http.Client
+}{byConfig: make(map[transportConfig]*http.Client)}
+
+// clientFor returns the HTTP client to use for endpoint
+func (m ConnectorMetadata) clientFor(endpoint string) (*http.Client, error) {
+	config := m.transportConfigFor(endpoint)
+	if config == (transportConfig{}) {
+		return http.DefaultClient, nil
+	}
+	clients.Lock()
+	defer clients.Unlock()
+	if client, ok := clients.byConfig[config]; ok {
+		return client, nil
+	}
+	transport, err := config.newTransport()
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{Transport: transport}
+	if config.maxRedirects > 0 {
+		client.CheckRedirect = checkRedirect(config.maxRedirects)
+	}
+	clients.byConfig[config] = client
+	return client, nil
+}
+
+// newTransport builds an HTTP transport from the default one applying the configuration
+func (c transportConfig) newTransport() (*http.Transport, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if c.tls != (TLSConfig{}) {
+		tlsConfig, err := c.tls.load()
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+	transport.ResponseHeaderTimeout = c.responseHeaderTimeout
+	if c.http10 {
+		// Legacy servers close the connection after every response, never reuse them nor attempt HTTP/2
+		transport.DisableKeepAlives = true
+		transport.ForceAttemptHTTP2 = false
+	}
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	dial := dialFunc(dialer.DialContext)
+	if c.dnsCacheTTL > 0 {
+		dial = newDNSCache(net.DefaultResolver, c.dnsCacheTTL).dial(dial)
+	}
+	if c.ioTimeout > 0 {
+		resolved := dial
+		dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := resolved(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			return &deadlineConn{Conn: conn, timeout: c.ioTimeout}, nil
+		}
+	}
+	if c.connMaxLifetime > 0 {
+		dial = withConnLifetime(dial)
+	}
+	transport.DialContext = dial
+	return transport, nil
+}
+
+// deadlineConn fails reads and writes that make no progress within timeout, so that a server stalling
+// in the middle of a response fails the attempt instead of hanging it. This also closes connections idle for longer than timeout.
+type deadlineConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *deadlineConn) Read(b []byte) (int, error) {
+	if err := c.Conn.SetReadDeadline(time.Now().Add(c.timeout)); err != nil {
+		return 0, err
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *deadlineConn) Write(b []byte) (int, error) {
+	if err := c.Conn.SetWriteDeadline(time.Now().Add(c.timeout)); err != nil {
+		return 0, err
+	}
+	return c.Conn.Write(b)
+}
@@ -0,0 +1,315 @@
+package common
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// newCertTLSServer starts a TLS server with a certificate of its own, returning the file holding it to be trusted
+func newCertTLSServer(t *testing.T, handler http.HandlerFunc) (*httptest.Server, string) {
+	t.Helper()
+	return newConfiguredTLSServer(t, handler, nil)
+}
+
+// newConfiguredTLSServer starts a TLS server like newCertTLSServer, its TLS configuration modified by configure if set
+func newConfiguredTLSServer(t *testing.T, handler http.HandlerFunc, configure func(*tls.Config)) (*httptest.Server, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewUnstartedServer(handler)
+	srv.TLS = &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+	if configure != nil {
+		configure(srv.TLS)
+	}
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	path := filepath.Join(t.TempDir(), "ca.crt")
+	if err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return srv, path
+}
+
+func TestEndpointTLS(t *testing.T) {
+	primary, primaryCA := newCertTLSServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	secondary, secondaryCA := newCertTLSServer(t, func(w http.ResponseWriter, r *http.Request) {})
+	tests := []struct {
+		name    string
+		tls     map[string]string
+		wantErr bool
+	}{
+		{name: "each endpoint trusts its CA", tls: map[string]string{primary.URL: primaryCA, secondary.URL: secondaryCA}},
+		{name: "swapped CAs", tls: map[string]string{primary.URL: secondaryCA, secondary.URL: primaryCA}, wantErr: true},
+		{name: "no endpoint TLS", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := []Option{WithEndpoints(primary.URL, secondary.URL), WithMaxRetries(1)}
+			for endpoint, ca := range tt.tls {
+				opts = append(opts, WithEndpointTLS(endpoint, TLSConfig{CAFile: ca}))
+			}
+			data := testMetadata(t, primary.URL, opts...)
+			resp, err := HandleHTTPRequest("{}", http.Header{}, data, zap.NewNop())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("HandleHTTPRequest() error = %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil {
+				resp.Body.Close()
+			}
+		})
+	}
+}
+
+func TestTLSConfigFor(t *testing.T) {
+	data := ConnectorMetadata{
+		TLS:         TLSConfig{CAFile: "default.crt"},
+		EndpointTLS: map[string]TLSConfig{"https://b": {CAFile: "b.crt"}},
+	}
+	tests := []struct {
+		endpoint string
+		want     string
+	}{
+		{endpoint: "https://a", want: "default.crt"},
+		{endpoint: "https://b", want: "b.crt"},
+	}
+	for _, tt := range tests {
+		if got := data.tlsConfigFor(tt.endpoint).CAFile; got != tt.want {
+			t.Errorf("tlsConfigFor(%v) CA = %v, want %v", tt.endpoint, got, tt.want)
+		}
+	}
+}
+
+// stallingServer starts a server writing the response headers if headers is set and stalling until the test completes
+func stallingServer(t *testing.T, headers bool) *httptest.Server {
+	t.Helper()
+	release := make(chan struct{})
+	srv := newServer(t, func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		if headers {
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte("partial"))
+			w.(http.Flusher).Flush()
+		}
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	})
+	// Cleanups run last in first out, releasing the handler before the server is closed
+	t.Cleanup(func() { close(release) })
+	return srv
+}
+
+func TestConnectionTimeouts(t *testing.T) {
+	const timeout = 50 * time.Millisecond
+	tests := []struct {
+		name    string
+		headers bool
+		opt     Option
+	}{
+		{name: "response header timeout", headers: false, opt: WithResponseHeaderTimeout(timeout)},
+		{name: "io timeout before headers", headers: false, opt: WithIOTimeout(timeout)},
+		{name: "io timeout after headers", headers: true, opt: WithIOTimeout(timeout)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := stallingServer(t, tt.headers)
+			data := testMetadata(t, srv.URL, tt.opt)
+			start := time.Now()
+			resp, err := HandleHTTPRequest("{}", http.Header{}, data, zap.NewNop())
+			if err == nil {
+				_, err = ResponseString(resp)
+			}
+			if err == nil {
+				t.Fatal("expected the stalled attempt to fail")
+			}
+			if elapsed := time.Since(start); elapsed > 20*timeout {
+				t.Errorf("stalled attempt failed after %v, want about %v", elapsed, timeout)
+			}
+		})
+	}
+}
+
+// http10Server starts a server answering every request as a legacy HTTP/1.0 server, without Content-Length and
+// closing the connection after the response, returning its URL and the number of connections it accepted
+func http10Server(t *testing.T, body string) (string, *int32) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	var conns int32
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&conns, 1)
+			go func() {
+				defer conn.Close()
+				req, err := http.ReadRequest(bufio.NewReader(conn))
+				if err != nil {
+					return
+				}
+				ioutil.ReadAll(req.Body)
+				fmt.Fprintf(conn, "HTTP/1.0 200 OK\r\nContent-Type: text/plain\r\n\r\n%v", body)
+			}()
+		}
+	}()
+	return "http://" + listener.Addr().String(), &conns
+}
+
+func TestHTTP10Server(t *testing.T) {
+	tests := []struct {
+		name  string
+		force bool
+	}{
+		{name: "detected", force: false},
+		{name: "forced", force: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			endpoint, conns := http10Server(t, "legacy response")
+			data := testMetadata(t, endpoint, WithForceHTTP10(tt.force))
+			for i := 0; i < 2; i++ {
+				resp, err := HandleHTTPRequest("{}", http.Header{}, data, zap.NewNop())
+				if err != nil {
+					t.Fatalf("request %v failed: %v", i, err)
+				}
+				if resp.ProtoMajor != 1 || resp.ProtoMinor != 0 {
+					t.Errorf("response protocol = %v", resp.Proto)
+				}
+				if body, err := ResponseString(resp); err != nil || body != "legacy response" {
+					t.Errorf("body = %q with error %v", body, err)
+				}
+			}
+			if got := atomic.LoadInt32(conns); got != 2 {
+				t.Errorf("server accepted %v connections, want one per request", got)
+			}
+		})
+	}
+}
+
+func TestTLSConfigValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  TLSConfig
+		wantErr bool
+	}{
+		{name: "empty"},
+		{name: "versions", config: TLSConfig{MinVersion: "1.2", MaxVersion: "1.3"}},
+		{name: "single version", config: TLSConfig{MinVersion: "1.2", MaxVersion: "1.2"}},
+		{name: "unknown min version", config: TLSConfig{MinVersion: "1.4"}, wantErr: true},
+		{name: "unknown max version", config: TLSConfig{MaxVersion: "TLSv1.2"}, wantErr: true},
+		{name: "min above max", config: TLSConfig{MinVersion: "1.3", MaxVersion: "1.2"}, wantErr: true},
+		{name: "cipher suites", config: TLSConfig{CipherSuites: "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384"}},
+		{name: "insecure cipher suite", config: TLSConfig{CipherSuites: "TLS_RSA_WITH_RC4_128_SHA"}},
+		{name: "unknown cipher suite", config: TLSConfig{CipherSuites: "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,TLS_NOT_A_SUITE"}, wantErr: true},
+		{name: "certificate without key", config: TLSConfig{CertFile: "client.crt"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.config.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("validate() error = %v, want error %v", err, tt.wantErr)
+			}
+			_, err := NewConnectorMetadata(WithTopic("topic"), WithEndpoint("https://function"), WithContentType("application/json"), WithTLS(tt.config))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("NewConnectorMetadata() error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestTLSVersionsAndCiphers(t *testing.T) {
+	tests := []struct {
+		name        string
+		server      func(*tls.Config)
+		client      TLSConfig
+		wantVersion uint16
+		wantCipher  uint16
+		wantErr     bool
+	}{
+		{name: "defaults negotiate 1.3", wantVersion: tls.VersionTLS13},
+		{name: "client max version", client: TLSConfig{MaxVersion: "1.2"}, wantVersion: tls.VersionTLS12},
+		{
+			name:    "client min version above server max",
+			server:  func(c *tls.Config) { c.MaxVersion = tls.VersionTLS12 },
+			client:  TLSConfig{MinVersion: "1.3"},
+			wantErr: true,
+		},
+		{
+			name:        "allowed cipher suite",
+			client:      TLSConfig{MaxVersion: "1.2", CipherSuites: "TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384"},
+			wantVersion: tls.VersionTLS12,
+			wantCipher:  tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+		},
+		{
+			name: "no cipher suite in common",
+			server: func(c *tls.Config) {
+				c.CipherSuites = []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256}
+			},
+			client:  TLSConfig{MaxVersion: "1.2", CipherSuites: "TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, ca := newConfiguredTLSServer(t, func(w http.ResponseWriter, r *http.Request) {}, tt.server)
+			tt.client.CAFile = ca
+			data := testMetadata(t, srv.URL, WithTLS(tt.client))
+			resp, err := HandleHTTPRequest("{}", http.Header{}, data, zap.NewNop())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("HandleHTTPRequest() error = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			resp.Body.Close()
+			if resp.TLS.Version != tt.wantVersion {
+				t.Errorf("negotiated TLS version %x, want %x", resp.TLS.Version, tt.wantVersion)
+			}
+			if tt.wantCipher != 0 && resp.TLS.CipherSuite != tt.wantCipher {
+				t.Errorf("negotiated cipher suite %x, want %x", resp.TLS.CipherSuite, tt.wantCipher)
+			}
+		})
+	}
+}
@@ -0,0 +1,103 @@
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"unicode/utf8"
+)
+
+// truncateErrorBody cuts body to data.MaxErrorBodySize bytes if set and reports whether it was cut.
+// The cut never splits a UTF-8 character, and with TruncateErrorBodyJSON a JSON body stays valid JSON.
+func truncateErrorBody(body []byte, data ConnectorMetadata) ([]byte, bool) {
+	limit := data.MaxErrorBodySize
+	if limit <= 0 || len(body) <= limit {
+		return body, false
+	}
+	if data.TruncateErrorBodyJSON && json.Valid(body) {
+		return truncateJSON(body, limit), true
+	}
+	return truncateUTF8(body, limit), true
+}
+
+// truncateUTF8 cuts body to at most limit bytes without splitting a UTF-8 character
+func truncateUTF8(body []byte, limit int) []byte {
+	cut := limit
+	// a character is at most utf8.UTFMax bytes, don't look back further into binary bodies
+	for i := 1; i < utf8.UTFMax && cut > 0 && !utf8.RuneStart(body[cut]); i++ {
+		cut--
+	}
+	if !utf8.RuneStart(body[cut]) {
+		cut = limit
+	}
+	return body[:cut]
+}
+
+// truncateJSON cuts the valid JSON body to at most limit bytes of valid JSON: arrays and objects keep the leading
+// elements or members that fit, other values are replaced by a JSON string of their truncated text
+func truncateJSON(body []byte, limit int) []byte {
+	trimmed := bytes.TrimSpace(body)
+	if len(trimmed) > 0 && (trimmed[0] == '[' || trimmed[0] == '{') {
+		if truncated, ok := truncateJSONContainer(trimmed, limit); ok {
+			return truncated
+		}
+	}
+	return truncateJSONString(body, limit)
+}
+
+// truncateJSONContainer keeps the leading elements of the array or members of the object trimmed which fit in limit
+// bytes along with the closing bracket, failing if none fits
+func truncateJSONContainer(trimmed []byte, limit int) ([]byte, bool) {
+	closing := byte(']')
+	if trimmed[0] == '{' {
+		closing = '}'
+	}
+	if limit < 2 {
+		return nil, false
+	}
+	dec := json.NewDecoder(bytes.NewReader(trimmed))
+	if _, err := dec.Token(); err != nil {
+		return nil, false
+	}
+	end := dec.InputOffset()
+	kept := 0
+	for dec.More() {
+		if closing == '}' {
+			if _, err := dec.Token(); err != nil {
+				return nil, false
+			}
+		}
+		var value json.RawMessage
+		if err := dec.Decode(&value); err != nil {
+			return nil, false
+		}
+		if dec.InputOffset()+1 > int64(limit) {
+			break
+		}
+		end = dec.InputOffset()
+		kept++
+	}
+	if kept == 0 {
+		return nil, false
+	}
+	truncated := make([]byte, 0, end+1)
+	truncated = append(truncated, trimmed[:end]...)
+	return append(truncated, closing), true
+}
+
+// truncateJSONString returns the longest JSON string of the text of body fitting in limit bytes once marshaled
+func truncateJSONString(body []byte, limit int) []byte {
+	best := []byte(`""`)
+	// escaping grows the text by an unknown amount, search for the longest cut fitting once marshaled
+	low, high := 0, limit
+	for low <= high {
+		cut := (low + high) / 2
+		quoted, _ := json.Marshal(string(truncateUTF8(body, cut)))
+		if len(quoted) <= limit {
+			best = quoted
+			low = cut + 1
+		} else {
+			high = cut - 1
+		}
+	}
+	return best
+}
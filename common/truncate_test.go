@@ -0,0 +1,70 @@
+package common
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"go.uber.org/zap"
+)
+
+func TestTruncateErrorBody(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		limit    int
+		keepJSON bool
+		want     string
+		wantCut  bool
+	}{
+		{name: "unlimited", body: strings.Repeat("x", 100), want: strings.Repeat("x", 100)},
+		{name: "within the limit", body: "short", limit: 10, want: "short"},
+		{name: "text cut", body: "0123456789", limit: 4, want: "0123", wantCut: true},
+		{name: "utf8 character not split", body: "aé€", limit: 4, want: "aé", wantCut: true},
+		{name: "json cut like text", body: `{"a":1,"b":2}`, limit: 8, want: `{"a":1,"`, wantCut: true},
+		{name: "array elements kept", body: `[1,22,333,4444]`, limit: 10, keepJSON: true, want: `[1,22,333]`, wantCut: true},
+		{name: "object members kept", body: `{"a":1,"b":"two","c":[3]}`, limit: 18, keepJSON: true, want: `{"a":1,"b":"two"}`, wantCut: true},
+		{name: "nested first element too large", body: `[{"message":"` + strings.Repeat("x", 50) + `"}]`, limit: 20, keepJSON: true, wantCut: true},
+		{name: "string shortened", body: `"` + strings.Repeat("x", 50) + `"`, limit: 12, keepJSON: true, want: `"\"xxxxxxxx"`, wantCut: true},
+		{name: "invalid json cut like text", body: `{"a":` + strings.Repeat("1", 20), limit: 8, keepJSON: true, want: `{"a":111`, wantCut: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := ConnectorMetadata{MaxErrorBodySize: tt.limit, TruncateErrorBodyJSON: tt.keepJSON}
+			got, cut := truncateErrorBody([]byte(tt.body), data)
+			if cut != tt.wantCut {
+				t.Errorf("cut = %v, want %v", cut, tt.wantCut)
+			}
+			if tt.limit > 0 && len(got) > tt.limit {
+				t.Errorf("truncated to %v bytes, above the limit of %v", len(got), tt.limit)
+			}
+			if !utf8.Valid(got) {
+				t.Errorf("truncated body %q isn't valid UTF-8", got)
+			}
+			if tt.keepJSON && !json.Valid(got) && json.Valid([]byte(tt.body)) {
+				t.Errorf("truncated body %q isn't valid JSON", got)
+			}
+			if tt.want != "" && string(got) != tt.want {
+				t.Errorf("truncated body = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTruncatedErrorBodyReported(t *testing.T) {
+	body := `{"errors":[` + strings.Repeat(`"failure",`, 100) + `"last"]}`
+	srv := newServer(t, func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(body))
+	})
+	data := testMetadata(t, srv.URL, WithMaxErrorBodySize(64, true))
+	_, err := HandleHTTPRequest("{}", http.Header{}, data, zap.NewNop())
+	errorResponse := errorResponseOf(t, err)
+	if !errorResponse.BodyTruncated || len(errorResponse.Body) > 64 || !json.Valid([]byte(errorResponse.Body)) {
+		t.Errorf("reported body %q truncated %v, want valid JSON of at most 64 bytes", errorResponse.Body, errorResponse.BodyTruncated)
+	}
+}
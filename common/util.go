@@ -1,13 +1,18 @@
 package common
 
 import (
+	"bytes"
+	"context"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"net/http"
 	"os"
 	"strconv"
 	"strings"
+	"time"
+	"unicode/utf8"
 
 	"github.com/aws/aws-sdk-go/aws/credentials"
 
@@ -22,11 +27,241 @@ type ConnectorMetadata struct {
 	ResponseTopic string
 	ErrorTopic    string
 	HTTPEndpoint  string
-	MaxRetries    int
-	ContentType   string
-	SourceName    string
+	// MaxRetries is the number of retries after the first attempt. With zero exactly one attempt is made:
+	// no backoff delay is waited, OnRetry is never called and only the first endpoint is used.
+	MaxRetries  int
+	ContentType string
+	SourceName  string
+	// ChunkedTransfer makes HandleHTTPRequestStream stream request bodies with chunked transfer encoding instead of
+	// buffering them to send an explicit Content-Length; other invocations always send a Content-Length
+	ChunkedTransfer bool
+	// HeaderMapping renames incoming headers (keys) to the outgoing header names (values) on every invocation
+	HeaderMapping map[string]string
+	// Hooks are optional callbacks invoked while handling a function invocation
+	Hooks Hooks
+	// ResponseCache caches responses of idempotent requests made with FetchHTTP, nil disables caching
+	ResponseCache *ResponseCache
+	// ResponseHeaderDenylist lists response headers removed before responses are logged or stored in ErrorResponse.
+	// When nil DefaultResponseHeaderDenylist is used.
+	ResponseHeaderDenylist []string
+	// HTTPEndpoints lists endpoints attempts fail over to in turn; when empty only HTTPEndpoint is used,
+	// when HTTPEndpoint is empty the first of them is the primary endpoint
+	HTTPEndpoints []string
+	// TLS is the TLS configuration used to connect to endpoints
+	TLS TLSConfig
+	// EndpointTLS overrides TLS for specific endpoints, keyed by endpoint
+	EndpointTLS map[string]TLSConfig
+	// StartupJitter bounds the random delay applied by WaitStartupJitter before the first consume or probe
+	StartupJitter time.Duration
+	// ResponseActionField names a field of JSON responses through which the function can request the message to be
+	// acked ("ack"), retried ("retry") or dead-lettered ("dead-letter"), overriding the status code
+	ResponseActionField string
+	// ResponseHeaderTimeout limits the time waiting for response headers once the request is written, zero means no limit
+	ResponseHeaderTimeout time.Duration
+	// IOTimeout limits the time a single read or write on a connection may make no progress, zero means no limit
+	IOTimeout time.Duration
+	// ErrorWriter receives every ErrorResponse as a JSON line independently of the logger, nil disables it
+	ErrorWriter io.Writer
+	// NormalizeContentType rewrites the request Content-Type in canonical form, e.g. "application/JSON ; charset=UTF-8"
+	// becomes "application/json; charset=UTF-8", defaulting it to ContentType when the message doesn't carry one
+	NormalizeContentType bool
+	// RetryBackoff is the delay before the first retry, zero retries immediately
+	RetryBackoff time.Duration
+	// RetryBackoffMultiplier multiplies the delay on every further retry, DefaultRetryBackoffMultiplier is used when zero
+	RetryBackoffMultiplier float64
+	// RetryMaxDelay caps the delay between retries, MaxRetryDelayLimit is used when zero
+	RetryMaxDelay time.Duration
+	// RequestTotalTimeout bounds a whole invocation including retries, zero means no limit
+	RequestTotalTimeout time.Duration
+	// SourceCoordinateHeaders names the incoming headers carrying the source coordinates of messages
+	SourceCoordinateHeaders SourceCoordinateHeaders
+	// ForceHTTP10 applies HTTP/1.0 semantics for legacy endpoints: connections are closed after every response
+	ForceHTTP10 bool
+	// EndpointPathHeader names an incoming header holding a subpath appended to the endpoint for the message
+	EndpointPathHeader string
+	// ErrorBuffer collects every ErrorResponse for the connector to drain and forward, nil disables it
+	ErrorBuffer *ErrorBuffer
+	// JoinHeaders sends multi-valued incoming headers as a single comma separated value instead of repeating them
+	JoinHeaders bool
+	// OutcomeReporter receives the outcome of every invocation, PrometheusReporter is used when nil
+	OutcomeReporter OutcomeReporter
+	// DefaultResponseContentType is set as Content-Type of responses lacking one
+	DefaultResponseContentType string
+	// WarmupBeforeSend sends a HEAD request to warm up the endpoint before invoking it when no open connection to reuse is known
+	WarmupBeforeSend bool
+	// BodyHeaders lists incoming headers injected as an object into JSON request bodies
+	BodyHeaders []string
+	// BodyHeadersField is the body field BodyHeaders are injected into, DefaultBodyHeadersField is used when empty
+	BodyHeadersField string
+	// BodyHeadersOnly stops sending BodyHeaders as HTTP headers when they are injected into the body
+	BodyHeadersOnly bool
+	// DedupeStore records processed messages so that redeliveries within DedupeTTL are skipped, nil disables deduplication
+	DedupeStore DedupeStore
+	// DedupeTTL is how long the fingerprint of a processed message is remembered
+	DedupeTTL time.Duration
+	// ErrorMessagePath is the dot separated path, e.g. "error.message", of the field of JSON error bodies
+	// used as ErrorResponse.Message instead of a generic message
+	ErrorMessagePath string
+	// ForwardConcurrency bounds the number of concurrent publishes of a Forwarder, one publishes serially
+	ForwardConcurrency int
+	// Retryable2xx lists 2xx statuses, e.g. 207 Multi-Status, treated as failures to retry rather than success
+	Retryable2xx []int
+	// NoRetryHeader names a response header, e.g. X-No-Retry, whose truthy value marks a failure as permanent
+	NoRetryHeader string
+	// CompressAlgorithm compresses request bodies using the named Content-Encoding, gzip, zstd or br, which must
+	// have an encoder registered with RegisterEncoder unless gzip; empty disables compression
+	CompressAlgorithm string
+	// RateLimitThrottle slows requests down as the X-RateLimit-Remaining of an endpoint approaches zero,
+	// pausing until X-RateLimit-Reset once it is exhausted
+	RateLimitThrottle bool
+	// ErrorEncoding is how ForwardError encodes the ErrorResponse, ErrorEncodingJSON when empty or ErrorEncodingForm
+	ErrorEncoding string
+	// ConnMaxLifetime closes pooled connections older than it once their request completes, so that connections
+	// are recycled behind load balancers limiting their age; zero keeps connections for as long as they are open
+	ConnMaxLifetime time.Duration
+	// PoisonThreshold is the number of consecutive failed deliveries of a message, counted in the DedupeStore,
+	// after which further deliveries are dead-lettered without invoking the function; zero disables detection
+	PoisonThreshold int
+	// DNSCacheTTL is how long the addresses endpoint hosts resolve to are reused, zero resolves them on every dial
+	DNSCacheTTL time.Duration
+	// CircuitBreaker stops invoking the function after consecutive failures, nil disables it
+	CircuitBreaker *CircuitBreaker
+	// OutboundQueue persists messages while the CircuitBreaker is open to send them with RunOutboundQueue, nil rejects them
+	OutboundQueue *OutboundQueue
+	// Limits stops processing after a total number of messages or bytes, see NewShutdownContext; nil is unlimited
+	Limits *ProcessingLimits
+	// SkipPostWriteTimeoutRetry stops retrying timeouts occurring after the request was fully sent, as the function
+	// may have processed it; timeouts connecting or sending the request are always retried
+	SkipPostWriteTimeoutRetry bool
+	// RecentErrors keeps the last error responses for its debug handler, nil disables it
+	RecentErrors *RecentErrors
+	// DebugToken is the bearer token required by the debug handler, empty disables authentication
+	DebugToken string
+	// DebugIncludeBodies exposes the request and response bodies of errors with the debug handler, which leaves
+	// them out by default as they may hold personal data
+	DebugIncludeBodies bool
+	// ResponseTransformer reshapes function responses before ForwardResponse publishes them, nil publishes them as is
+	ResponseTransformer BodyTransformer
+	// PartialFailureField is the dot separated path of the field of successful JSON responses listing failed parts,
+	// forwarded to the error topic by ForwardPartialSuccess while the rest is forwarded to the response topic
+	PartialFailureField string
+	// DefaultHeaders are sent along every invocation, merged with incoming headers according to DefaultHeadersPolicy
+	DefaultHeaders http.Header
+	// DefaultHeadersPolicy is DefaultHeadersIncoming, the default, or DefaultHeadersAppend
+	DefaultHeadersPolicy string
+	// HedgeDelay is how long an attempt waits for a response before sending the request again, using whichever
+	// response arrives first; zero disables hedging
+	HedgeDelay time.Duration
+	// HedgeLimit bounds the number of hedged requests in flight, DefaultHedgeLimit when zero
+	HedgeLimit int
+	// EventTimeHeader names the header holding the event time of messages, as RFC 3339 or unix seconds or milliseconds
+	EventTimeHeader string
+	// MaxMessageAge dead-letters messages whose event time is older, without invoking the function; zero disables it
+	MaxMessageAge time.Duration
+	// GatewayStatuses are the statuses of responses from gateways in front of the function, which never ran,
+	// reported with ErrorKindGateway; DefaultGatewayStatuses is used when nil
+	GatewayStatuses []int
+	// DeadlineHeader names the header carrying the deadline of the invocation context to the function, e.g.
+	// X-Request-Deadline as RFC 3339 or GRPCTimeoutHeader as the remaining time; empty doesn't send it
+	DeadlineHeader string
+	// AbortOnTLSTrustError stops retrying when the server certificate isn't trusted, transient TLS handshake
+	// failures being retried like other transport errors
+	AbortOnTLSTrustError bool
+	// ErrorBodyStreamLimit bounds the bytes of failed response bodies streamed when ErrorWriter is an
+	// ErrorBodyStreamer, DefaultErrorBodyStreamLimit when zero
+	ErrorBodyStreamLimit int64
+	// Traces receives a record of every invocation of the function with its attempts, nil disables it
+	Traces *TraceFile
+	// RetryImmediateFirst makes the first retry without waiting, to cheaply get over momentary blips,
+	// RetryBackoff applying from the second retry on
+	RetryImmediateFirst bool
+	// MaxErrorBodySize cuts the Body of ErrorResponses to this many bytes, zero keeps it whole
+	MaxErrorBodySize int
+	// TruncateErrorBodyJSON keeps cut JSON bodies valid JSON, keeping the leading elements of arrays and objects
+	// which fit and turning other values into a string
+	TruncateErrorBodyJSON bool
+	// SplitBatchOnTooLarge splits batches rejected with 413 Payload Too Large by InvokeHTTPBatch in halves
+	// instead of failing them whole
+	SplitBatchOnTooLarge bool
+	// Events emits Kubernetes events when the circuit breaker opens or invocations chronically exhaust their retries,
+	// nil disables them
+	Events *FailureEvents
+	// ResponseSchema is the JSON Schema successful responses must conform to, violations failing the invocation;
+	// nil doesn't validate responses
+	ResponseSchema *JSONSchema
+	// ResponseSchemaRetryable retries responses violating ResponseSchema instead of failing right away
+	ResponseSchemaRetryable bool
+	// IdempotencyReplayHeader names the response header set to true by the function when it had already processed
+	// the message, e.g. Idempotency-Replayed, reported as InvocationReport.Replayed; empty ignores replays
+	IdempotencyReplayHeader string
+	// AdaptiveLogging drops logs below Warn level while invocations are healthy, nil always logs them
+	AdaptiveLogging *AdaptiveLogging
+	// Instance identifies the connector pod or host in ErrorResponses and in InstanceHeader, empty leaves it out
+	Instance string
+	// InstanceHeader names the header carrying Instance to the function, empty doesn't send it
+	InstanceHeader string
+	// ErrorBatchSize, when above 1, makes the Forwarder publish up to this many ErrorResponses together as a JSON
+	// array, at least every ErrorBatchInterval
+	ErrorBatchSize int
+	// ErrorBatchInterval bounds how long error responses wait for a batch, DefaultErrorBatchInterval when zero
+	ErrorBatchInterval time.Duration
+	// FollowRedirects follows redirects of the function up to MaxRedirects, aborting without retrying on loops;
+	// when false the default policy of net/http applies
+	FollowRedirects bool
+	// MaxRedirects caps the redirects followed with FollowRedirects, DefaultMaxRedirects when zero
+	MaxRedirects int
+	// ContentTypeHeader names the incoming header holding the Content-Type of each message, e.g. when a connector
+	// handles mixed payload types; ContentType is used for messages without it
+	ContentTypeHeader string
+	// RequiredResponseHeaders must all be present in successful responses, e.g. a processing receipt echoed by
+	// the function; responses lacking one fail the invocation
+	RequiredResponseHeaders []string
+	// RequiredResponseHeadersRetryable retries responses lacking a required header instead of failing right away
+	RequiredResponseHeadersRetryable bool
+	// SLALatencyTarget is the latency successful invocations must complete within to comply with the SLA,
+	// counted by the sla_invocations_total metric; zero disables it
+	SLALatencyTarget time.Duration
+	// ShadowEndpoint receives a copy of every invocation request in the background, e.g. to test a new function
+	// version, its responses and failures being ignored; empty disables it
+	ShadowEndpoint string
+	// ShadowConcurrency bounds the shadow requests in flight, further copies being dropped,
+	// DefaultShadowConcurrency when zero
+	ShadowConcurrency int
+	// BodyFieldHeaders maps header names to the dot separated paths of the JSON body fields sent as their value,
+	// e.g. X-Order-Id to order.id; fields which aren't found or aren't scalars are left out
+	BodyFieldHeaders http.Header
+	// PriorityHeader names the header carrying the priority of a message, limited by PriorityLimits
+	PriorityHeader string
+	// DefaultPriority is the priority of messages without PriorityHeader
+	DefaultPriority string
+	// PriorityLimits caps the concurrency and rate of invocations per priority so that bulk low priority messages
+	// don't starve high priority ones; nil disables it
+	PriorityLimits *PriorityLimits
+	// EnablePprof exposes runtime profiles with PprofHandler, for performance debugging outside production
+	EnablePprof bool
+	// PprofToken is the bearer token required by the pprof handler, empty disables authentication
+	PprofToken string
+	// AlreadyProcessedStatuses lists statuses, e.g. 409 Conflict, by which the function signals it had already
+	// processed the message, e.g. when the response to a previous attempt was lost, treated as replayed successes
+	AlreadyProcessedStatuses []int
+	// AlreadyProcessedHeader names a response header whose truthy value signals the function had already processed
+	// the message, treated as a replayed success whatever the status; empty disables it
+	AlreadyProcessedHeader string
+	// LogRetryTimeline logs the timeline of every attempt in a single entry once retries are exhausted
+	LogRetryTimeline bool
 }
 
+// Policies merging DefaultHeaders with incoming headers of the same name
+const (
+	// DefaultHeadersIncoming sends the incoming values alone
+	DefaultHeadersIncoming = "incoming"
+	// DefaultHeadersAppend sends the incoming values followed by the default values they don't already hold
+	DefaultHeadersAppend = "append"
+)
+
+// DefaultResponseHeaderDenylist lists the response headers stripped unless configured otherwise
+var DefaultResponseHeaderDenylist = []string{"Set-Cookie", "Authorization"}
+
 type ErrorResponse struct {
 	Status       int    `json:"status"`
 	Message      string `json:"message"`
@@ -34,11 +269,122 @@ type ErrorResponse struct {
 	Source       string `json:"source"`
 	Body         string `json:"body"`
 	Request      string `json:"request"`
+	// Headers of the failed response with denylisted headers removed
+	Headers http.Header `json:"headers,omitempty"`
+	// Coordinates of the message in its source, if configured
+	Coordinates *SourceCoordinates `json:"source_coordinates,omitempty"`
+	// ErrorKind tells what kind of failure occurred
+	ErrorKind ErrorKind `json:"error_kind,omitempty"`
+	// Code is the error code of failed AWS operations
+	Code string `json:"code,omitempty"`
+	// Throttled tells whether the failure was caused by throttling
+	Throttled bool `json:"throttled,omitempty"`
+	// Version is the build version of the connector reporting the error, if set
+	Version string `json:"version,omitempty"`
+	// BodyEncoding is BodyEncodingBase64 when Body isn't valid UTF-8 and holds it base64 encoded
+	BodyEncoding string `json:"body_encoding,omitempty"`
+	// LatencyMs is how long the failed attempts took in total, in milliseconds
+	LatencyMs int64 `json:"latency_ms,omitempty"`
+	// BodyTruncated tells whether Body was cut to MaxErrorBodySize
+	BodyTruncated bool `json:"body_truncated,omitempty"`
+	// Instance identifies the connector pod or host reporting the error, if configured
+	Instance string `json:"instance,omitempty"`
+}
+
+// BodyEncodingBase64 marks an ErrorResponse.Body holding a binary body base64 encoded
+const BodyEncodingBase64 = "base64"
+
+// setBody sets Body to body, base64 encoding it if it isn't valid UTF-8 so that the ErrorResponse marshals cleanly
+func (e *ErrorResponse) setBody(body []byte) {
+	if utf8.Valid(body) {
+		e.Body = string(body)
+		e.BodyEncoding = ""
+		return
+	}
+	e.Body = base64.StdEncoding.EncodeToString(body)
+	e.BodyEncoding = BodyEncodingBase64
+}
+
+// BodyBytes returns the body of the failed response, decoding it according to BodyEncoding
+func (e ErrorResponse) BodyBytes() ([]byte, error) {
+	if e.BodyEncoding == BodyEncodingBase64 {
+		return base64.StdEncoding.DecodeString(e.Body)
+	}
+	return []byte(e.Body), nil
+}
+
+// ErrorKind classifies the failure an ErrorResponse describes
+type ErrorKind string
+
+const (
+	// ErrorKindTransport means no response was received from the function
+	ErrorKindTransport ErrorKind = "transport"
+	// ErrorKindResponse means the function responded with a failure
+	ErrorKindResponse ErrorKind = "response"
+	// ErrorKindPoison means the message was dead-lettered without invoking the function after failing repeatedly
+	ErrorKindPoison ErrorKind = "poison"
+	// ErrorKindPartial means the function succeeded but reported the failure of part of the message
+	ErrorKindPartial ErrorKind = "partial"
+	// ErrorKindStale means the message was dead-lettered without invoking the function for being older than MaxMessageAge
+	ErrorKindStale ErrorKind = "stale"
+	// ErrorKindGateway means a gateway in front of the function responded with a failure, the function never ran
+	ErrorKindGateway ErrorKind = "gateway"
+	// ErrorKindTLS means the TLS handshake failed because the server certificate isn't trusted
+	ErrorKindTLS ErrorKind = "tls"
+	// ErrorKindSchema means the function responded successfully with a body violating ResponseSchema
+	ErrorKindSchema ErrorKind = "schema"
+	// ErrorKindRedirect means the redirects of the function looped or exceeded MaxRedirects
+	ErrorKindRedirect ErrorKind = "redirect"
+	// ErrorKindMissingHeader means the function responded successfully without one of RequiredResponseHeaders
+	ErrorKindMissingHeader ErrorKind = "missing_header"
+)
+
+// DefaultInstanceHeader carries the identity of the connector instance to the function unless configured otherwise
+const DefaultInstanceHeader = "X-Connector-Instance"
+
+// DefaultGatewayStatuses are the statuses of responses from gateways rather than the function unless configured otherwise
+var DefaultGatewayStatuses = []int{http.StatusBadGateway, http.StatusGatewayTimeout}
+
+// errorKindFor returns the kind of failure of an invocation whose last response had status, zero meaning none
+func (m ConnectorMetadata) errorKindFor(status int) ErrorKind {
+	if status == 0 {
+		return ErrorKindTransport
+	}
+	gatewayStatuses := m.GatewayStatuses
+	if gatewayStatuses == nil {
+		gatewayStatuses = DefaultGatewayStatuses
+	}
+	if containsStatus(gatewayStatuses, status) {
+		return ErrorKindGateway
+	}
+	return ErrorKindResponse
+}
+
+// IsRetryable tells whether the failed message is worth processing again, so that consumers of the error topic
+// decide consistently whether to requeue it
+func (e ErrorResponse) IsRetryable() bool {
+	if e.ErrorKind == ErrorKindTransport || e.ErrorKind == ErrorKindGateway || e.Throttled {
+		return true
+	}
+	if e.ErrorKind == ErrorKindTLS || e.ErrorKind == ErrorKindRedirect {
+		return false
+	}
+	switch e.Status {
+	case http.StatusRequestTimeout, http.StatusTooEarly, http.StatusTooManyRequests:
+		return true
+	case http.StatusNotImplemented, http.StatusHTTPVersionNotSupported:
+		return false
+	}
+	return e.Status >= 500 && e.Status < 600
 }
 
 // ParseConnectorMetadata parses connector side common fields and returns as ConnectorMetadata or returns error
 func ParseConnectorMetadata() (ConnectorMetadata, error) {
-	for _, envVars := range []string{"TOPIC", "HTTP_ENDPOINT", "MAX_RETRIES", "CONTENT_TYPE"} {
+	required := []string{"TOPIC", "MAX_RETRIES", "CONTENT_TYPE"}
+	if os.Getenv("HTTP_ENDPOINTS") == "" {
+		required = append(required, "HTTP_ENDPOINT")
+	}
+	for _, envVars := range required {
 		if os.Getenv(envVars) == "" {
 			return ConnectorMetadata{}, fmt.Errorf("environment variable not found: %v", envVars)
 		}
@@ -50,84 +396,618 @@ func ParseConnectorMetadata() (ConnectorMetadata, error) {
 		HTTPEndpoint:  os.Getenv("HTTP_ENDPOINT"),
 		ContentType:   os.Getenv("CONTENT_TYPE"),
 		SourceName:    os.Getenv("SOURCE_NAME"),
+
+		ResponseActionField:        os.Getenv("RESPONSE_ACTION_FIELD"),
+		EndpointPathHeader:         os.Getenv("ENDPOINT_PATH_HEADER"),
+		DefaultResponseContentType: os.Getenv("DEFAULT_RESPONSE_CONTENT_TYPE"),
+		BodyHeadersField:           os.Getenv("BODY_HEADERS_FIELD"),
+		ErrorMessagePath:           os.Getenv("ERROR_MESSAGE_PATH"),
+		NoRetryHeader:              os.Getenv("NO_RETRY_HEADER"),
+		CompressAlgorithm:          os.Getenv("COMPRESS_ALGORITHM"),
+		ErrorEncoding:              os.Getenv("ERROR_ENCODING"),
+		DebugToken:                 os.Getenv("DEBUG_TOKEN"),
+		PartialFailureField:        os.Getenv("PARTIAL_FAILURE_FIELD"),
+		DefaultHeadersPolicy:       os.Getenv("DEFAULT_HEADERS_POLICY"),
+		EventTimeHeader:            os.Getenv("EVENT_TIME_HEADER"),
+		DeadlineHeader:             os.Getenv("DEADLINE_HEADER"),
+		IdempotencyReplayHeader:    os.Getenv("IDEMPOTENCY_REPLAY_HEADER"),
+		ContentTypeHeader:          os.Getenv("CONTENT_TYPE_HEADER"),
+		ShadowEndpoint:             os.Getenv("SHADOW_ENDPOINT"),
+		PriorityHeader:             os.Getenv("PRIORITY_HEADER"),
+		DefaultPriority:            os.Getenv("PRIORITY_DEFAULT"),
+		PprofToken:                 os.Getenv("PPROF_TOKEN"),
+		AlreadyProcessedHeader:     os.Getenv("ALREADY_PROCESSED_HEADER"),
+		SourceCoordinateHeaders: SourceCoordinateHeaders{
+			Topic:     os.Getenv("SOURCE_TOPIC_HEADER"),
+			Partition: os.Getenv("SOURCE_PARTITION_HEADER"),
+			Offset:    os.Getenv("SOURCE_OFFSET_HEADER"),
+		},
 	}
 	if meta.SourceName == "" {
 		meta.SourceName = "KEDAConnector"
 	}
+	// The trace file is opened along its settings, close it if a later setting is invalid
+	parsed := false
+	defer func() {
+		if !parsed && meta.Traces != nil {
+			meta.Traces.Close()
+		}
+	}()
 	val, err := strconv.ParseInt(strings.TrimSpace(os.Getenv("MAX_RETRIES")), 0, 64)
 	if err != nil {
 		return ConnectorMetadata{}, fmt.Errorf("failed to parse value from MAX_RETRIES environment variable %v", err)
 	}
 	meta.MaxRetries = int(val)
+	if meta.ChunkedTransfer, err = getBoolEnv("HTTP_CHUNKED_TRANSFER"); err != nil {
+		return ConnectorMetadata{}, err
+	}
+	if meta.HeaderMapping, err = getHeaderMapEnv("HEADER_MAPPING"); err != nil {
+		return ConnectorMetadata{}, err
+	}
+	if meta.DefaultHeaders, err = getHeadersEnv("DEFAULT_HEADERS"); err != nil {
+		return ConnectorMetadata{}, err
+	}
+	if denylist, ok := os.LookupEnv("RESPONSE_HEADER_DENYLIST"); ok {
+		meta.ResponseHeaderDenylist = splitList(denylist)
+	}
+	cacheTTL, err := getDurationEnv("RESPONSE_CACHE_TTL")
+	if err != nil {
+		return ConnectorMetadata{}, err
+	}
+	if cacheTTL > 0 {
+		var cacheSize int
+		if raw := strings.TrimSpace(os.Getenv("RESPONSE_CACHE_SIZE")); raw != "" {
+			if cacheSize, err = strconv.Atoi(raw); err != nil {
+				return ConnectorMetadata{}, fmt.Errorf("failed to parse value from RESPONSE_CACHE_SIZE environment variable %v", err)
+			}
+		}
+		meta.ResponseCache = NewResponseCache(cacheTTL, cacheSize)
+	}
+	if endpoints := os.Getenv("HTTP_ENDPOINTS"); endpoints != "" {
+		meta.HTTPEndpoints = splitList(endpoints)
+	}
+	if meta.HTTPEndpoint == "" && len(meta.HTTPEndpoints) == 0 {
+		return ConnectorMetadata{}, fmt.Errorf("environment variable not found: HTTP_ENDPOINT")
+	}
+	meta.defaultPrimaryEndpoint()
+	meta.TLS = TLSConfig{
+		CAFile:   os.Getenv("HTTP_TLS_CA_FILE"),
+		CertFile: os.Getenv("HTTP_TLS_CERT_FILE"),
+		KeyFile:  os.Getenv("HTTP_TLS_KEY_FILE"),
+
+		MinVersion:   os.Getenv("HTTP_TLS_MIN_VERSION"),
+		MaxVersion:   os.Getenv("HTTP_TLS_MAX_VERSION"),
+		CipherSuites: os.Getenv("HTTP_TLS_CIPHER_SUITES"),
+	}
+	if endpointTLS := os.Getenv("HTTP_ENDPOINT_TLS"); endpointTLS != "" {
+		if err := json.Unmarshal([]byte(endpointTLS), &meta.EndpointTLS); err != nil {
+			return ConnectorMetadata{}, fmt.Errorf("failed to parse value from HTTP_ENDPOINT_TLS environment variable %v", err)
+		}
+	}
+	if meta.StartupJitter, err = getDurationEnv("STARTUP_JITTER"); err != nil {
+		return ConnectorMetadata{}, err
+	}
+	if meta.ResponseHeaderTimeout, err = getDurationEnv("HTTP_RESPONSE_HEADER_TIMEOUT"); err != nil {
+		return ConnectorMetadata{}, err
+	}
+	if meta.IOTimeout, err = getDurationEnv("HTTP_IO_TIMEOUT"); err != nil {
+		return ConnectorMetadata{}, err
+	}
+	if meta.MaxMessageAge, err = getDurationEnv("MAX_MESSAGE_AGE"); err != nil {
+		return ConnectorMetadata{}, err
+	}
+	if meta.HedgeDelay, err = getDurationEnv("HEDGE_DELAY"); err != nil {
+		return ConnectorMetadata{}, err
+	}
+	if limit := strings.TrimSpace(os.Getenv("HEDGE_LIMIT")); limit != "" {
+		if meta.HedgeLimit, err = strconv.Atoi(limit); err != nil {
+			return ConnectorMetadata{}, fmt.Errorf("failed to parse value from HEDGE_LIMIT environment variable %v", err)
+		}
+	}
+	if meta.DNSCacheTTL, err = getDurationEnv("DNS_CACHE_TTL"); err != nil {
+		return ConnectorMetadata{}, err
+	}
+	if meta.ConnMaxLifetime, err = getDurationEnv("HTTP_CONN_MAX_LIFETIME"); err != nil {
+		return ConnectorMetadata{}, err
+	}
+	if meta.NormalizeContentType, err = getBoolEnv("NORMALIZE_CONTENT_TYPE"); err != nil {
+		return ConnectorMetadata{}, err
+	}
+	if meta.JoinHeaders, err = getBoolEnv("HEADER_JOIN"); err != nil {
+		return ConnectorMetadata{}, err
+	}
+	if bodyHeaders := os.Getenv("BODY_HEADERS"); bodyHeaders != "" {
+		meta.BodyHeaders = splitList(bodyHeaders)
+	}
+	if meta.BodyHeadersOnly, err = getBoolEnv("BODY_HEADERS_ONLY"); err != nil {
+		return ConnectorMetadata{}, err
+	}
+	if concurrency := strings.TrimSpace(os.Getenv("FORWARD_CONCURRENCY")); concurrency != "" {
+		if meta.ForwardConcurrency, err = strconv.Atoi(concurrency); err != nil {
+			return ConnectorMetadata{}, fmt.Errorf("failed to parse value from FORWARD_CONCURRENCY environment variable %v", err)
+		}
+	}
+	if meta.AbortOnTLSTrustError, err = getBoolEnv("HTTP_TLS_ABORT_ON_TRUST_ERROR"); err != nil {
+		return ConnectorMetadata{}, err
+	}
+	if meta.SkipPostWriteTimeoutRetry, err = getBoolEnv("RETRY_SKIP_POST_WRITE_TIMEOUT"); err != nil {
+		return ConnectorMetadata{}, err
+	}
+	if meta.RateLimitThrottle, err = getBoolEnv("RATE_LIMIT_THROTTLE"); err != nil {
+		return ConnectorMetadata{}, err
+	}
+	if meta.Retryable2xx, err = getStatusListEnv("RETRYABLE_2XX"); err != nil {
+		return ConnectorMetadata{}, err
+	}
+	if meta.GatewayStatuses, err = getStatusListEnv("GATEWAY_ERROR_STATUSES"); err != nil {
+		return ConnectorMetadata{}, err
+	}
+	if threshold := strings.TrimSpace(os.Getenv("POISON_THRESHOLD")); threshold != "" {
+		if meta.PoisonThreshold, err = strconv.Atoi(threshold); err != nil {
+			return ConnectorMetadata{}, fmt.Errorf("failed to parse value from POISON_THRESHOLD environment variable %v", err)
+		}
+	}
+	if meta.DedupeTTL, err = getDurationEnv("DEDUPE_TTL"); err != nil {
+		return ConnectorMetadata{}, err
+	}
+	if meta.DedupeTTL > 0 {
+		if addr := os.Getenv("DEDUPE_REDIS_ADDR"); addr != "" {
+			timeout, err := getDurationEnv("DEDUPE_REDIS_TIMEOUT")
+			if err != nil {
+				return ConnectorMetadata{}, err
+			}
+			meta.DedupeStore = NewRedisDedupeStore(addr, os.Getenv("DEDUPE_REDIS_PASSWORD"), timeout)
+		} else {
+			meta.DedupeStore = NewMemoryDedupeStore()
+		}
+	}
+	if threshold := strings.TrimSpace(os.Getenv("BREAKER_FAILURE_THRESHOLD")); threshold != "" {
+		failures, err := strconv.Atoi(threshold)
+		if err != nil {
+			return ConnectorMetadata{}, fmt.Errorf("failed to parse value from BREAKER_FAILURE_THRESHOLD environment variable %v", err)
+		}
+		cooldown, err := getDurationEnv("BREAKER_COOLDOWN")
+		if err != nil {
+			return ConnectorMetadata{}, err
+		}
+		if cooldown == 0 {
+			cooldown = DefaultBreakerCooldown
+		}
+		meta.CircuitBreaker = NewCircuitBreaker(failures, cooldown)
+	}
+	if raw := strings.TrimSpace(os.Getenv("DEBUG_RECENT_ERRORS")); raw != "" {
+		size, err := strconv.Atoi(raw)
+		if err != nil || size < 1 {
+			return ConnectorMetadata{}, fmt.Errorf("failed to parse value from DEBUG_RECENT_ERRORS environment variable, positive size expected: %v", raw)
+		}
+		meta.RecentErrors = NewRecentErrors(size)
+	}
+	if meta.DebugIncludeBodies, err = getBoolEnv("DEBUG_INCLUDE_BODIES"); err != nil {
+		return ConnectorMetadata{}, err
+	}
+	if text := os.Getenv("RESPONSE_TEMPLATE"); text != "" {
+		if meta.ResponseTransformer, err = NewTemplateTransformer(text); err != nil {
+			return ConnectorMetadata{}, fmt.Errorf("failed to parse value from RESPONSE_TEMPLATE environment variable %v", err)
+		}
+	}
+	var maxMessages, maxBytes int64
+	if raw := strings.TrimSpace(os.Getenv("MAX_TOTAL_MESSAGES")); raw != "" {
+		if maxMessages, err = strconv.ParseInt(raw, 10, 64); err != nil {
+			return ConnectorMetadata{}, fmt.Errorf("failed to parse value from MAX_TOTAL_MESSAGES environment variable %v", err)
+		}
+	}
+	if raw := strings.TrimSpace(os.Getenv("MAX_TOTAL_BYTES")); raw != "" {
+		if maxBytes, err = strconv.ParseInt(raw, 10, 64); err != nil {
+			return ConnectorMetadata{}, fmt.Errorf("failed to parse value from MAX_TOTAL_BYTES environment variable %v", err)
+		}
+	}
+	if raw := strings.TrimSpace(os.Getenv("ERROR_BODY_STREAM_LIMIT")); raw != "" {
+		if meta.ErrorBodyStreamLimit, err = strconv.ParseInt(raw, 10, 64); err != nil {
+			return ConnectorMetadata{}, fmt.Errorf("failed to parse value from ERROR_BODY_STREAM_LIMIT environment variable %v", err)
+		}
+	}
+	if maxMessages != 0 || maxBytes != 0 {
+		meta.Limits = NewProcessingLimits(maxMessages, maxBytes)
+	}
+	if path := os.Getenv("TRACE_FILE"); path != "" {
+		var maxSize int64 = DefaultTraceFileMaxSize
+		if raw := strings.TrimSpace(os.Getenv("TRACE_FILE_MAX_SIZE")); raw != "" {
+			if maxSize, err = strconv.ParseInt(raw, 10, 64); err != nil {
+				return ConnectorMetadata{}, fmt.Errorf("failed to parse value from TRACE_FILE_MAX_SIZE environment variable %v", err)
+			}
+		}
+		backups := DefaultTraceFileBackups
+		if raw := strings.TrimSpace(os.Getenv("TRACE_FILE_BACKUPS")); raw != "" {
+			if backups, err = strconv.Atoi(raw); err != nil {
+				return ConnectorMetadata{}, fmt.Errorf("failed to parse value from TRACE_FILE_BACKUPS environment variable %v", err)
+			}
+		}
+		if meta.Traces, err = NewTraceFile(path, maxSize, backups); err != nil {
+			return ConnectorMetadata{}, fmt.Errorf("failed to open trace file from TRACE_FILE environment variable %v", err)
+		}
+	}
+	events, err := getBoolEnv("K8S_EVENTS")
+	if err != nil {
+		return ConnectorMetadata{}, err
+	}
+	if events {
+		threshold := DefaultRetriesExhaustedThreshold
+		if raw := strings.TrimSpace(os.Getenv("K8S_EVENTS_RETRIES_EXHAUSTED_THRESHOLD")); raw != "" {
+			if threshold, err = strconv.Atoi(raw); err != nil {
+				return ConnectorMetadata{}, fmt.Errorf("failed to parse value from K8S_EVENTS_RETRIES_EXHAUSTED_THRESHOLD environment variable %v", err)
+			}
+		}
+		recorder, err := NewInClusterEventRecorder(os.Getenv("POD_NAMESPACE"), os.Getenv("POD_NAME"))
+		if err != nil {
+			return ConnectorMetadata{}, fmt.Errorf("failed to create kubernetes event recorder enabled by K8S_EVENTS environment variable %v", err)
+		}
+		meta.Events = NewFailureEvents(recorder, threshold)
+	}
+	identity, err := getBoolEnv("INSTANCE_IDENTITY")
+	if err != nil {
+		return ConnectorMetadata{}, err
+	}
+	if identity {
+		if meta.Instance = os.Getenv("POD_NAME"); meta.Instance == "" {
+			if meta.Instance, err = os.Hostname(); err != nil {
+				return ConnectorMetadata{}, fmt.Errorf("failed to get hostname for INSTANCE_IDENTITY environment variable %v", err)
+			}
+		}
+		if meta.InstanceHeader = os.Getenv("INSTANCE_HEADER"); meta.InstanceHeader == "" {
+			meta.InstanceHeader = DefaultInstanceHeader
+		}
+	}
+	if raw := strings.TrimSpace(os.Getenv("SHADOW_CONCURRENCY")); raw != "" {
+		if meta.ShadowConcurrency, err = strconv.Atoi(raw); err != nil {
+			return ConnectorMetadata{}, fmt.Errorf("failed to parse value from SHADOW_CONCURRENCY environment variable %v", err)
+		}
+	}
+	if meta.BodyFieldHeaders, err = getHeadersEnv("BODY_FIELD_HEADERS"); err != nil {
+		return ConnectorMetadata{}, err
+	}
+	if meta.PriorityLimits, err = getPriorityLimitsEnv(); err != nil {
+		return ConnectorMetadata{}, err
+	}
+	if meta.EnablePprof, err = getBoolEnv("ENABLE_PPROF"); err != nil {
+		return ConnectorMetadata{}, err
+	}
+	if meta.AlreadyProcessedStatuses, err = getStatusListEnv("ALREADY_PROCESSED_STATUSES"); err != nil {
+		return ConnectorMetadata{}, err
+	}
+	if meta.LogRetryTimeline, err = getBoolEnv("LOG_RETRY_TIMELINE"); err != nil {
+		return ConnectorMetadata{}, err
+	}
+	if meta.SLALatencyTarget, err = getDurationEnv("SLA_LATENCY_TARGET"); err != nil {
+		return ConnectorMetadata{}, err
+	}
+	if meta.FollowRedirects, err = getBoolEnv("FOLLOW_REDIRECTS"); err != nil {
+		return ConnectorMetadata{}, err
+	}
+	if raw := strings.TrimSpace(os.Getenv("MAX_REDIRECTS")); raw != "" {
+		if meta.MaxRedirects, err = strconv.Atoi(raw); err != nil {
+			return ConnectorMetadata{}, fmt.Errorf("failed to parse value from MAX_REDIRECTS environment variable %v", err)
+		}
+	}
+	if raw := strings.TrimSpace(os.Getenv("ERROR_BATCH_SIZE")); raw != "" {
+		if meta.ErrorBatchSize, err = strconv.Atoi(raw); err != nil {
+			return ConnectorMetadata{}, fmt.Errorf("failed to parse value from ERROR_BATCH_SIZE environment variable %v", err)
+		}
+	}
+	if meta.ErrorBatchInterval, err = getDurationEnv("ERROR_BATCH_INTERVAL"); err != nil {
+		return ConnectorMetadata{}, err
+	}
+	if raw := strings.TrimSpace(os.Getenv("ADAPTIVE_LOGGING_WINDOW")); raw != "" {
+		window, err := strconv.Atoi(raw)
+		if err != nil {
+			return ConnectorMetadata{}, fmt.Errorf("failed to parse value from ADAPTIVE_LOGGING_WINDOW environment variable %v", err)
+		}
+		var threshold float64
+		if raw := strings.TrimSpace(os.Getenv("ADAPTIVE_LOGGING_FAILURE_RATE")); raw != "" {
+			if threshold, err = strconv.ParseFloat(raw, 64); err != nil {
+				return ConnectorMetadata{}, fmt.Errorf("failed to parse value from ADAPTIVE_LOGGING_FAILURE_RATE environment variable %v", err)
+			}
+		}
+		if meta.AdaptiveLogging, err = NewAdaptiveLogging(window, threshold); err != nil {
+			return ConnectorMetadata{}, err
+		}
+	}
+	if headers := os.Getenv("REQUIRED_RESPONSE_HEADERS"); headers != "" {
+		meta.RequiredResponseHeaders = splitList(headers)
+	}
+	if meta.RequiredResponseHeadersRetryable, err = getBoolEnv("REQUIRED_RESPONSE_HEADERS_RETRY"); err != nil {
+		return ConnectorMetadata{}, err
+	}
+	if path := os.Getenv("RESPONSE_SCHEMA_FILE"); path != "" {
+		if meta.ResponseSchema, err = LoadJSONSchema(path); err != nil {
+			return ConnectorMetadata{}, fmt.Errorf("failed to load schema from RESPONSE_SCHEMA_FILE environment variable %v", err)
+		}
+	}
+	if meta.ResponseSchemaRetryable, err = getBoolEnv("RESPONSE_SCHEMA_RETRY"); err != nil {
+		return ConnectorMetadata{}, err
+	}
+	if dir := os.Getenv("OUTBOUND_QUEUE_DIR"); dir != "" {
+		size := DefaultOutboundQueueSize
+		if raw := strings.TrimSpace(os.Getenv("OUTBOUND_QUEUE_SIZE")); raw != "" {
+			if size, err = strconv.Atoi(raw); err != nil {
+				return ConnectorMetadata{}, fmt.Errorf("failed to parse value from OUTBOUND_QUEUE_SIZE environment variable %v", err)
+			}
+		}
+		if meta.OutboundQueue, err = NewOutboundQueue(dir, size); err != nil {
+			return ConnectorMetadata{}, fmt.Errorf("failed to open outbound queue from OUTBOUND_QUEUE_DIR environment variable %v", err)
+		}
+	}
+	if meta.WarmupBeforeSend, err = getBoolEnv("WARMUP_BEFORE_SEND"); err != nil {
+		return ConnectorMetadata{}, err
+	}
+	if meta.ForceHTTP10, err = getBoolEnv("HTTP_FORCE_HTTP10"); err != nil {
+		return ConnectorMetadata{}, err
+	}
+	if meta.RetryBackoff, err = getDurationEnv("RETRY_BACKOFF"); err != nil {
+		return ConnectorMetadata{}, err
+	}
+	if raw := strings.TrimSpace(os.Getenv("ERROR_BODY_MAX_SIZE")); raw != "" {
+		if meta.MaxErrorBodySize, err = strconv.Atoi(raw); err != nil {
+			return ConnectorMetadata{}, fmt.Errorf("failed to parse value from ERROR_BODY_MAX_SIZE environment variable %v", err)
+		}
+	}
+	if meta.TruncateErrorBodyJSON, err = getBoolEnv("ERROR_BODY_TRUNCATE_JSON"); err != nil {
+		return ConnectorMetadata{}, err
+	}
+	if meta.SplitBatchOnTooLarge, err = getBoolEnv("BATCH_SPLIT_ON_TOO_LARGE"); err != nil {
+		return ConnectorMetadata{}, err
+	}
+	if meta.RetryImmediateFirst, err = getBoolEnv("RETRY_IMMEDIATE_FIRST"); err != nil {
+		return ConnectorMetadata{}, err
+	}
+	if multiplier := strings.TrimSpace(os.Getenv("RETRY_BACKOFF_MULTIPLIER")); multiplier != "" {
+		if meta.RetryBackoffMultiplier, err = strconv.ParseFloat(multiplier, 64); err != nil {
+			return ConnectorMetadata{}, fmt.Errorf("failed to parse value from RETRY_BACKOFF_MULTIPLIER environment variable %v", err)
+		}
+	}
+	if meta.RetryMaxDelay, err = getDurationEnv("RETRY_MAX_DELAY"); err != nil {
+		return ConnectorMetadata{}, err
+	}
+	if meta.RequestTotalTimeout, err = getDurationEnv("REQUEST_TOTAL_TIMEOUT"); err != nil {
+		return ConnectorMetadata{}, err
+	}
+	if size := strings.TrimSpace(os.Getenv("ERROR_BUFFER_SIZE")); size != "" {
+		val, err := strconv.Atoi(size)
+		if err != nil {
+			return ConnectorMetadata{}, fmt.Errorf("failed to parse value from ERROR_BUFFER_SIZE environment variable %v", err)
+		}
+		policy := OverflowPolicy(os.Getenv("ERROR_BUFFER_OVERFLOW"))
+		if policy == "" {
+			policy = DropOldest
+		}
+		if meta.ErrorBuffer, err = NewErrorBuffer(val, policy); err != nil {
+			return ConnectorMetadata{}, err
+		}
+	}
+	switch output := os.Getenv("ERROR_OUTPUT"); output {
+	case "":
+	case "stderr":
+		meta.ErrorWriter = os.Stderr
+	case "stdout":
+		meta.ErrorWriter = os.Stdout
+	default:
+		return ConnectorMetadata{}, fmt.Errorf("invalid ERROR_OUTPUT environment variable %v: stderr or stdout expected", output)
+	}
+	if err := meta.validateOptions(); err != nil {
+		return ConnectorMetadata{}, err
+	}
+	parsed = true
 	return meta, nil
 }
 
-// HandleHTTPRequest sends message and headers data to HTTP endpoint using POST method and returns response on success or error in case of failure
-func HandleHTTPRequest(message string, headers http.Header, data ConnectorMetadata, logger *zap.Logger) (*http.Response, error) {
+// endpoints returns the endpoints attempts are spread over
+func (m ConnectorMetadata) endpoints() []string {
+	if len(m.HTTPEndpoints) > 0 {
+		return m.HTTPEndpoints
+	}
+	return []string{m.HTTPEndpoint}
+}
 
-	var resp *http.Response
-	for attempt := 0; attempt <= data.MaxRetries; attempt++ {
-		// Create request
-		req, err := http.NewRequest("POST", data.HTTPEndpoint, strings.NewReader(message))
+// getBoolEnv parses a boolean environment variable, returning false if it is not set
+func getBoolEnv(name string) (bool, error) {
+	raw := strings.TrimSpace(os.Getenv(name))
+	if raw == "" {
+		return false, nil
+	}
+	val, err := strconv.ParseBool(raw)
+	if err != nil {
+		return false, fmt.Errorf("failed to parse value from %v environment variable %v", name, err)
+	}
+	return val, nil
+}
+
+// splitList splits a comma separated list, dropping empty items
+func splitList(raw string) []string {
+	list := []string{}
+	for _, item := range strings.Split(raw, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// getStatusListEnv parses an environment variable of comma separated HTTP status codes, returning nil if it is not set
+func getStatusListEnv(name string) ([]int, error) {
+	var statuses []int
+	for _, item := range splitList(os.Getenv(name)) {
+		status, err := strconv.Atoi(item)
 		if err != nil {
-			return nil, errors.Wrapf(err, "failed to create HTTP request to invoke function. http_endpoint: %v, source: %v", data.HTTPEndpoint, data.SourceName)
+			return nil, fmt.Errorf("failed to parse value from %v environment variable %v", name, err)
 		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
 
-		// Add headers
-		for key, vals := range headers {
-			for _, val := range vals {
-				req.Header.Add(key, val)
-			}
+// getDurationEnv parses a duration environment variable, returning zero if it is not set
+func getDurationEnv(name string) (time.Duration, error) {
+	raw := strings.TrimSpace(os.Getenv(name))
+	if raw == "" {
+		return 0, nil
+	}
+	val, err := time.ParseDuration(raw)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse value from %v environment variable %v", name, err)
+	}
+	if val < 0 {
+		return 0, fmt.Errorf("%v environment variable must not be negative", name)
+	}
+	return val, nil
+}
+
+// getHeaderMapEnv parses an environment variable of comma separated from=to header name pairs, returning nil if it is not set
+func getHeaderMapEnv(name string) (map[string]string, error) {
+	raw := strings.TrimSpace(os.Getenv(name))
+	if raw == "" {
+		return nil, nil
+	}
+	mapping := make(map[string]string)
+	for _, pair := range strings.Split(raw, ",") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" || strings.TrimSpace(kv[1]) == "" {
+			return nil, fmt.Errorf("failed to parse value from %v environment variable: invalid header mapping %q", name, pair)
 		}
+		mapping[http.CanonicalHeaderKey(strings.TrimSpace(kv[0]))] = http.CanonicalHeaderKey(strings.TrimSpace(kv[1]))
+	}
+	return mapping, nil
+}
 
-		// Make the request
-		resp, err = http.DefaultClient.Do(req)
-		if err != nil {
-			logger.Error("sending function invocation request failed",
-				zap.Error(err),
-				zap.String("http_endpoint", data.HTTPEndpoint),
-				zap.String("source", data.SourceName))
+// getHeadersEnv parses an environment variable of comma separated name=value headers, returning nil if it is not set
+func getHeadersEnv(name string) (http.Header, error) {
+	raw := strings.TrimSpace(os.Getenv(name))
+	if raw == "" {
+		return nil, nil
+	}
+	headers := make(http.Header)
+	for _, pair := range strings.Split(raw, ",") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			return nil, fmt.Errorf("failed to parse value from %v environment variable: invalid header %q", name, pair)
+		}
+		headers.Add(strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1]))
+	}
+	return headers, nil
+}
+
+// mergeDefaultHeaders returns a copy of headers with defaults merged according to policy: incoming values replace
+// default ones with DefaultHeadersIncoming, default values missing from incoming ones are added with DefaultHeadersAppend
+func mergeDefaultHeaders(headers, defaults http.Header, policy string) http.Header {
+	if len(defaults) == 0 {
+		return headers
+	}
+	merged := headers.Clone()
+	if merged == nil {
+		merged = make(http.Header, len(defaults))
+	}
+	for key, vals := range defaults {
+		incoming := merged.Values(key)
+		if len(incoming) == 0 {
+			merged[key] = append([]string(nil), vals...)
 			continue
 		}
-		if resp == nil {
+		if policy != DefaultHeadersAppend {
 			continue
 		}
-		if err == nil && resp.StatusCode >= 200 && resp.StatusCode < 300 {
-			// Success, quit retrying
-			return resp, nil
+		for _, val := range vals {
+			if !containsString(incoming, val) {
+				merged.Add(key, val)
+			}
 		}
 	}
+	return merged
+}
 
-	if resp == nil {
-		errorResponce := ErrorResponse{
-			Status:       503,
-			Message:      "every function invocation retry failed; final retry gave empty response.",
-			HttpEndpoint: data.HTTPEndpoint,
-			Source:       data.SourceName,
-			Request:      message,
+// containsString tells whether s is in list
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
 		}
-		jsonString, _ := json.Marshal(errorResponce)
-		logger.Info(string(jsonString))
-		return nil, fmt.Errorf(string(jsonString))
 	}
+	return false
+}
+
+// mapHeaders returns a copy of headers with the keys present in mapping renamed to their mapped names
+func mapHeaders(headers http.Header, mapping map[string]string) http.Header {
+	if len(mapping) == 0 {
+		return headers
+	}
+	mapped := make(http.Header, len(headers))
+	for key, vals := range headers {
+		if to, ok := mapping[http.CanonicalHeaderKey(key)]; ok {
+			key = to
+		}
+		for _, val := range vals {
+			mapped.Add(key, val)
+		}
+	}
+	return mapped
+}
+
+// stripHeaders returns a copy of headers without the denylisted ones
+func stripHeaders(headers http.Header, denylist []string) http.Header {
+	if denylist == nil {
+		denylist = DefaultResponseHeaderDenylist
+	}
+	stripped := headers.Clone()
+	for _, key := range denylist {
+		stripped.Del(key)
+	}
+	return stripped
+}
 
-	if resp.StatusCode < 200 || resp.StatusCode > 300 {
-		defer resp.Body.Close()
-		body, _ := ioutil.ReadAll(resp.Body)
+// HandleHTTPRequest sends message and headers data to HTTP endpoint using POST method and returns response on success or error in case of failure
+func HandleHTTPRequest(message string, headers http.Header, data ConnectorMetadata, logger *zap.Logger) (*http.Response, error) {
+	resp, _, err := InvokeHTTPRequest(context.Background(), message, headers, data, logger)
+	return resp, err
+}
 
-		errorBody := ErrorResponse{
-			Status:       resp.StatusCode,
-			Message:      "request returned failure",
-			HttpEndpoint: data.HTTPEndpoint,
-			Source:       data.SourceName,
-			Body:         string(body),
-			Request:      message,
+// HandleHTTPRequestBytes is like HandleHTTPRequest for a message held as bytes, avoiding its conversion to a string
+func HandleHTTPRequestBytes(message []byte, headers http.Header, data ConnectorMetadata, logger *zap.Logger) (*http.Response, error) {
+	body := payload{
+		open:    func() io.Reader { return bytes.NewReader(message) },
+		length:  int64(len(message)),
+		message: func() string { return string(message) },
+	}
+	resp, _, err := handleHTTPRequest(context.Background(), body, headers, data, logger)
+	return resp, err
+}
+
+// HandleHTTPRequestStream sends the content of body and headers data to HTTP endpoint using POST method and returns response on success or error in case of failure.
+// By default body is buffered so that the request carries an explicit Content-Length and can be retried.
+// If ChunkedTransfer is set, body is streamed with chunked transfer encoding instead; since a stream can't be replayed, only a single attempt is made.
+func HandleHTTPRequestStream(body io.Reader, headers http.Header, data ConnectorMetadata, logger *zap.Logger) (*http.Response, error) {
+	if !data.ChunkedTransfer {
+		buf := getBuffer()
+		if _, err := buf.ReadFrom(body); err != nil {
+			putBuffer(buf)
+			return nil, errors.Wrapf(err, "failed to read request body. http_endpoint: %v, source: %v", data.HTTPEndpoint, data.SourceName)
 		}
-		jsonString, _ := json.Marshal(errorBody)
-		logger.Info(string(jsonString))
-		return nil, fmt.Errorf(string(jsonString))
+		shared := newSharedBuffer(buf)
+		defer shared.release()
+		buffered := payload{
+			open:    func() io.Reader { return shared.reader() },
+			length:  int64(buf.Len()),
+			message: buf.String,
+		}
+		resp, _, err := handleHTTPRequest(context.Background(), buffered, headers, data, logger)
+		return resp, err
+	}
+	// Keep a copy of what was streamed so it can be reported in case of failure
+	var sent bytes.Buffer
+	stream := payload{
+		open:    func() io.Reader { return io.TeeReader(body, &sent) },
+		length:  -1,
+		once:    true,
+		message: sent.String,
 	}
-	return resp, nil
+	resp, _, err := handleHTTPRequest(context.Background(), stream, headers, data, logger)
+	return resp, err
 }
 
 // GetAwsConfig get's the configuration required to connect to aws
@@ -143,14 +1023,31 @@ func GetAwsConfig() (*aws.Config, error) {
 		config.Endpoint = &endpoint
 		return config, nil
 	}
+	if err := auditSinkFromEnv(); err != nil {
+		return nil, err
+	}
 	if os.Getenv("AWS_ACCESS_KEY_ID") != "" && os.Getenv("AWS_SECRET_ACCESS_KEY") != "" {
-		config.Credentials = credentials.NewStaticCredentials(os.Getenv("AWS_ACCESS_KEY_ID"),
-			os.Getenv("AWS_SECRET_ACCESS_KEY"), "")
+		config.Credentials = NewInstrumentedCredentials(&credentials.StaticProvider{Value: credentials.Value{
+			AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		}}, credentials.StaticProviderName)
+		audit(AuditEvent{
+			Event:         AuditCredentialSelected,
+			Provider:      credentials.StaticProviderName,
+			AccessKeyHint: redactAccessKey(os.Getenv("AWS_ACCESS_KEY_ID")),
+		})
 		return config, nil
 	}
 	if os.Getenv("AWS_CRED_PATH") != "" && os.Getenv("AWS_CRED_PROFILE") != "" {
-		config.Credentials = credentials.NewSharedCredentials(os.Getenv("AWS_CRED_PATH"),
-			os.Getenv("AWS_CRED_PROFILE"))
+		config.Credentials = NewInstrumentedCredentials(&credentials.SharedCredentialsProvider{
+			Filename: os.Getenv("AWS_CRED_PATH"),
+			Profile:  os.Getenv("AWS_CRED_PROFILE"),
+		}, credentials.SharedCredsProviderName)
+		audit(AuditEvent{
+			Event:    AuditCredentialSelected,
+			Provider: credentials.SharedCredsProviderName,
+			Profile:  os.Getenv("AWS_CRED_PROFILE"),
+		})
 		return config, nil
 	}
 	return nil, errors.New("no aws configuration specified")
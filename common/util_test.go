@@ -0,0 +1,445 @@
+package common
+
+import (
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// testMetadata returns the metadata of a connector invoking endpoint once, adjusted by opts
+func testMetadata(t *testing.T, endpoint string, opts ...Option) ConnectorMetadata {
+	t.Helper()
+	base := []Option{
+		WithTopic("topic"),
+		WithEndpoint(endpoint),
+		WithMaxRetries(0),
+		WithContentType("application/json"),
+	}
+	meta, err := NewConnectorMetadata(append(base, opts...)...)
+	if err != nil {
+		t.Fatalf("invalid test metadata: %v", err)
+	}
+	return meta
+}
+
+// newServer starts a server handling requests with handler, closed once the test completes
+func newServer(t *testing.T, handler http.HandlerFunc) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// newConnStateServer starts a server handling requests with handler and reporting connection state changes to
+// connState, closed once the test completes
+func newConnStateServer(t *testing.T, handler http.HandlerFunc, connState func(net.Conn, http.ConnState)) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewUnstartedServer(handler)
+	srv.Config.ConnState = connState
+	srv.Start()
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// newTLSServer starts a TLS server handling requests with handler, closed once the test completes
+func newTLSServer(t *testing.T, handler http.HandlerFunc) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewTLSServer(handler)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// serverCAFile writes the certificate of the TLS server srv to a file, returning its path
+func serverCAFile(t *testing.T, srv *httptest.Server) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "ca.crt")
+	block := &pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}
+	if err := ioutil.WriteFile(path, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// statusServer starts a server responding with the statuses in turn, repeating the last one, and counting requests
+func statusServer(t *testing.T, statuses ...int) (*httptest.Server, *int32) {
+	t.Helper()
+	var requests int32
+	srv := newServer(t, func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		n := int(atomic.AddInt32(&requests, 1))
+		if n > len(statuses) {
+			n = len(statuses)
+		}
+		w.WriteHeader(statuses[n-1])
+	})
+	return srv, &requests
+}
+
+// useFakeClock makes the package use a fake clock for the duration of the test
+func useFakeClock(t *testing.T) *FakeClock {
+	t.Helper()
+	c := NewFakeClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	SetClock(c)
+	t.Cleanup(func() { SetClock(nil) })
+	return c
+}
+
+// waitForTimers waits until n timers of clock are pending, e.g. until the code under test sleeps
+func waitForTimers(t *testing.T, clock *FakeClock, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for clock.Timers() < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("%v timers pending, want %v", clock.Timers(), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// errorResponseOf returns the ErrorResponse a failed invocation reported as err
+func errorResponseOf(t *testing.T, err error) ErrorResponse {
+	t.Helper()
+	if err == nil {
+		t.Fatal("expected the invocation to fail")
+	}
+	var errorResponse ErrorResponse
+	if jsonErr := json.Unmarshal([]byte(err.Error()), &errorResponse); jsonErr != nil {
+		t.Fatalf("error isn't an ErrorResponse: %v", err)
+	}
+	return errorResponse
+}
+
+// setEnv sets the environment variables for the duration of the test, restoring their previous values
+func setEnv(t *testing.T, env map[string]string) {
+	t.Helper()
+	for name, value := range env {
+		previous, ok := os.LookupEnv(name)
+		os.Setenv(name, value)
+		name := name
+		t.Cleanup(func() {
+			if ok {
+				os.Setenv(name, previous)
+			} else {
+				os.Unsetenv(name)
+			}
+		})
+	}
+}
+
+func TestHandleHTTPRequestStreamChunkedTransfer(t *testing.T) {
+	tests := []struct {
+		name        string
+		chunked     bool
+		stream      bool
+		wantChunked bool
+	}{
+		{name: "buffered stream", chunked: false, stream: true, wantChunked: false},
+		{name: "chunked stream", chunked: true, stream: true, wantChunked: true},
+		{name: "message ignores the flag", chunked: true, stream: false, wantChunked: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var gotEncoding []string
+			var gotLength int64
+			var gotBody string
+			srv := newServer(t, func(w http.ResponseWriter, r *http.Request) {
+				gotEncoding, gotLength = r.TransferEncoding, r.ContentLength
+				body, _ := ioutil.ReadAll(r.Body)
+				gotBody = string(body)
+			})
+			data := testMetadata(t, srv.URL, WithChunkedTransfer(tt.chunked))
+			var resp *http.Response
+			var err error
+			if tt.stream {
+				resp, err = HandleHTTPRequestStream(strings.NewReader("payload"), http.Header{}, data, zap.NewNop())
+			} else {
+				resp, err = HandleHTTPRequest("payload", http.Header{}, data, zap.NewNop())
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			resp.Body.Close()
+			if chunked := len(gotEncoding) == 1 && gotEncoding[0] == "chunked"; chunked != tt.wantChunked {
+				t.Errorf("transfer encoding = %v, want chunked %v", gotEncoding, tt.wantChunked)
+			}
+			if !tt.wantChunked && gotLength != int64(len("payload")) {
+				t.Errorf("content length = %v, want %v", gotLength, len("payload"))
+			}
+			if gotBody != "payload" {
+				t.Errorf("body = %q, want %q", gotBody, "payload")
+			}
+		})
+	}
+}
+
+func TestHeaderMapping(t *testing.T) {
+	tests := []struct {
+		name    string
+		mapping map[string]string
+		in      http.Header
+		want    http.Header
+	}{
+		{
+			name:    "renamed",
+			mapping: map[string]string{"X-Trace": "Traceparent"},
+			in:      http.Header{"X-Trace": {"abc"}, "X-Other": {"kept"}},
+			want:    http.Header{"Traceparent": {"abc"}, "X-Other": {"kept"}},
+		},
+		{
+			name:    "multiple values",
+			mapping: map[string]string{"X-Tenant": "X-Org"},
+			in:      http.Header{"X-Tenant": {"a", "b"}},
+			want:    http.Header{"X-Org": {"a", "b"}},
+		},
+		{
+			name: "no mapping",
+			in:   http.Header{"X-Trace": {"abc"}},
+			want: http.Header{"X-Trace": {"abc"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got http.Header
+			srv := newServer(t, func(w http.ResponseWriter, r *http.Request) { got = r.Header })
+			data := testMetadata(t, srv.URL, WithHeaderMapping(tt.mapping))
+			resp, err := HandleHTTPRequest("{}", tt.in, data, zap.NewNop())
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			resp.Body.Close()
+			for key, vals := range tt.want {
+				if !reflect.DeepEqual(got.Values(key), vals) {
+					t.Errorf("header %v = %v, want %v", key, got.Values(key), vals)
+				}
+			}
+			for key := range tt.in {
+				if _, ok := tt.want[key]; !ok && got.Get(key) != "" {
+					t.Errorf("header %v was sent under its incoming name", key)
+				}
+			}
+		})
+	}
+}
+
+func TestGetHeaderMapEnv(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    map[string]string
+		wantErr bool
+	}{
+		{value: "", want: nil},
+		{value: "x-trace=traceparent, X-Tenant = X-Org", want: map[string]string{"X-Trace": "Traceparent", "X-Tenant": "X-Org"}},
+		{value: "x-trace", wantErr: true},
+		{value: "x-trace=", wantErr: true},
+	}
+	for _, tt := range tests {
+		setEnv(t, map[string]string{"HEADER_MAPPING": tt.value})
+		got, err := getHeaderMapEnv("HEADER_MAPPING")
+		if (err != nil) != tt.wantErr {
+			t.Errorf("getHeaderMapEnv(%q) error = %v, want error %v", tt.value, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("getHeaderMapEnv(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestResponseHeaderDenylist(t *testing.T) {
+	tests := []struct {
+		name     string
+		denylist []string
+		want     []string
+		denied   []string
+	}{
+		{name: "default", denylist: nil, want: []string{"X-Request-Id", "Authorization-Hint"}, denied: []string{"Set-Cookie", "Authorization"}},
+		{name: "configured", denylist: []string{"X-Request-Id"}, want: []string{"Set-Cookie", "Authorization"}, denied: []string{"X-Request-Id"}},
+		{name: "empty keeps all", denylist: []string{}, want: []string{"Set-Cookie", "Authorization", "X-Request-Id"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newServer(t, func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Set-Cookie", "session=secret")
+				w.Header().Set("Authorization", "Bearer secret")
+				w.Header().Set("Authorization-Hint", "none")
+				w.Header().Set("X-Request-Id", "42")
+				w.WriteHeader(http.StatusBadRequest)
+			})
+			core, logs := observer.New(zapcore.InfoLevel)
+			data := testMetadata(t, srv.URL, WithResponseHeaderDenylist(tt.denylist))
+			_, err := HandleHTTPRequest("{}", http.Header{}, data, zap.New(core))
+			errorResponse := errorResponseOf(t, err)
+			for _, header := range tt.want {
+				if errorResponse.Headers.Get(header) == "" {
+					t.Errorf("header %v was removed", header)
+				}
+			}
+			for _, header := range tt.denied {
+				if errorResponse.Headers.Get(header) != "" {
+					t.Errorf("denied header %v was kept", header)
+				}
+				for _, entry := range logs.All() {
+					if tt.denylist == nil && strings.Contains(entry.Message, "secret") {
+						t.Errorf("denied header value logged: %v", entry.Message)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestErrorResponseIsRetryable(t *testing.T) {
+	tests := []struct {
+		name          string
+		errorResponse ErrorResponse
+		want          bool
+	}{
+		{name: "transport", errorResponse: ErrorResponse{Status: 503, ErrorKind: ErrorKindTransport}, want: true},
+		{name: "gateway", errorResponse: ErrorResponse{Status: 502, ErrorKind: ErrorKindGateway}, want: true},
+		{name: "throttled", errorResponse: ErrorResponse{Status: 400, Throttled: true}, want: true},
+		{name: "server error", errorResponse: ErrorResponse{Status: 500, ErrorKind: ErrorKindResponse}, want: true},
+		{name: "request timeout", errorResponse: ErrorResponse{Status: 408}, want: true},
+		{name: "too many requests", errorResponse: ErrorResponse{Status: 429}, want: true},
+		{name: "too early", errorResponse: ErrorResponse{Status: 425}, want: true},
+		{name: "bad request", errorResponse: ErrorResponse{Status: 400, ErrorKind: ErrorKindResponse}, want: false},
+		{name: "not found", errorResponse: ErrorResponse{Status: 404}, want: false},
+		{name: "not implemented", errorResponse: ErrorResponse{Status: 501}, want: false},
+		{name: "http version not supported", errorResponse: ErrorResponse{Status: 505}, want: false},
+		{name: "untrusted certificate", errorResponse: ErrorResponse{Status: 503, ErrorKind: ErrorKindTLS}, want: false},
+		{name: "redirect loop", errorResponse: ErrorResponse{Status: 508, ErrorKind: ErrorKindRedirect}, want: false},
+		{name: "poison", errorResponse: ErrorResponse{ErrorKind: ErrorKindPoison}, want: false},
+	}
+	for _, tt := range tests {
+		if got := tt.errorResponse.IsRetryable(); got != tt.want {
+			t.Errorf("%v: IsRetryable() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestNonUTF8ErrorBody(t *testing.T) {
+	tests := []struct {
+		name         string
+		body         []byte
+		wantEncoding string
+	}{
+		{name: "binary", body: []byte{0x1f, 0x8b, 0x08, 0x00, 0xff, 0xfe}, wantEncoding: BodyEncodingBase64},
+		{name: "invalid UTF-8", body: []byte("caf\xe9"), wantEncoding: BodyEncodingBase64},
+		{name: "text", body: []byte("café"), wantEncoding: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newServer(t, func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write(tt.body)
+			})
+			data := testMetadata(t, srv.URL)
+			_, err := HandleHTTPRequest("{}", http.Header{}, data, zap.NewNop())
+			if err == nil {
+				t.Fatal("expected the invocation to fail")
+			}
+			if !json.Valid([]byte(err.Error())) {
+				t.Fatalf("error response isn't valid JSON: %q", err.Error())
+			}
+			errorResponse := errorResponseOf(t, err)
+			if errorResponse.BodyEncoding != tt.wantEncoding {
+				t.Errorf("body encoding = %q, want %q", errorResponse.BodyEncoding, tt.wantEncoding)
+			}
+			if body, err := errorResponse.BodyBytes(); err != nil || string(body) != string(tt.body) {
+				t.Errorf("BodyBytes() = %q with error %v, want %q", body, err, tt.body)
+			}
+		})
+	}
+}
+
+func TestDefaultHeaders(t *testing.T) {
+	defaults := http.Header{"X-Tenant": {"default"}, "X-Tags": {"a", "b"}}
+	tests := []struct {
+		name   string
+		policy string
+		in     http.Header
+		want   http.Header
+	}{
+		{
+			name: "added when missing",
+			in:   http.Header{"X-Other": {"kept"}},
+			want: http.Header{"X-Tenant": {"default"}, "X-Tags": {"a", "b"}, "X-Other": {"kept"}},
+		},
+		{
+			name:   "incoming replaces defaults",
+			policy: DefaultHeadersIncoming,
+			in:     http.Header{"X-Tenant": {"incoming"}, "X-Tags": {"c"}},
+			want:   http.Header{"X-Tenant": {"incoming"}, "X-Tags": {"c"}},
+		},
+		{
+			name: "incoming replaces defaults by default",
+			in:   http.Header{"X-Tenant": {"incoming"}},
+			want: http.Header{"X-Tenant": {"incoming"}, "X-Tags": {"a", "b"}},
+		},
+		{
+			name:   "append missing values",
+			policy: DefaultHeadersAppend,
+			in:     http.Header{"X-Tenant": {"incoming"}, "X-Tags": {"b", "c"}},
+			want:   http.Header{"X-Tenant": {"incoming", "default"}, "X-Tags": {"b", "c", "a"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got http.Header
+			srv := newServer(t, func(w http.ResponseWriter, r *http.Request) { got = r.Header })
+			data := testMetadata(t, srv.URL, WithDefaultHeaders(defaults, tt.policy))
+			in := tt.in.Clone()
+			resp, err := HandleHTTPRequest("{}", in, data, zap.NewNop())
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			resp.Body.Close()
+			for key, vals := range tt.want {
+				if !reflect.DeepEqual(got.Values(key), vals) {
+					t.Errorf("header %v = %v, want %v", key, got.Values(key), vals)
+				}
+			}
+			if !reflect.DeepEqual(in, tt.in) {
+				t.Errorf("incoming headers modified to %v", in)
+			}
+		})
+	}
+}
+
+func TestGetHeadersEnv(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    http.Header
+		wantErr bool
+	}{
+		{value: "", want: nil},
+		{value: "x-tenant=acme, X-Tags = a, x-tags=b", want: http.Header{"X-Tenant": {"acme"}, "X-Tags": {"a", "b"}}},
+		{value: "x-empty=", want: http.Header{"X-Empty": {""}}},
+		{value: "x-tenant", wantErr: true},
+		{value: "=acme", wantErr: true},
+	}
+	for _, tt := range tests {
+		setEnv(t, map[string]string{"DEFAULT_HEADERS": tt.value})
+		got, err := getHeadersEnv("DEFAULT_HEADERS")
+		if (err != nil) != tt.wantErr {
+			t.Errorf("getHeadersEnv(%q) error = %v, want error %v", tt.value, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("getHeadersEnv(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
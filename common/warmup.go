@@ -0,0 +1,75 @@
+package common
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// warmConnectionWindow is how long an idle connection is assumed to stay open, matching the idle timeout of the default transport
+const warmConnectionWindow = 90 * time.Second
+
+// warmEndpoints records when a connection to each endpoint was last returned to the idle pool
+var warmEndpoints = struct {
+	sync.Mutex
+	idleSince map[string]time.Time
+}{idleSince: make(map[string]time.Time)}
+
+// isWarm tells whether an idle connection to endpoint is likely available
+func isWarm(endpoint string) bool {
+	warmEndpoints.Lock()
+	defer warmEndpoints.Unlock()
+	idleSince, ok := warmEndpoints.idleSince[endpoint]
+	return ok && since(idleSince) < warmConnectionWindow
+}
+
+// setWarm records whether an idle connection to endpoint is available
+func setWarm(endpoint string, warm bool) {
+	warmEndpoints.Lock()
+	defer warmEndpoints.Unlock()
+	if warm {
+		warmEndpoints.idleSince[endpoint] = now()
+	} else {
+		delete(warmEndpoints.idleSince, endpoint)
+	}
+}
+
+// traceConnections returns a context tracking through httptrace whether requests to endpoint leave a connection to reuse
+func traceConnections(ctx context.Context, endpoint string) context.Context {
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if !info.Reused {
+				// No idle connection was left, whatever was recorded
+				setWarm(endpoint, false)
+			}
+		},
+		PutIdleConn: func(err error) {
+			setWarm(endpoint, err == nil)
+		},
+	})
+}
+
+// warmup sends a HEAD request to target when no idle connection to endpoint is known, so that the cold start
+// penalty of gateways is paid by it rather than by the real request. Failures are only logged.
+func warmup(ctx context.Context, client *http.Client, endpoint, target string, data ConnectorMetadata, logger *zap.Logger) {
+	if isWarm(endpoint) {
+		return
+	}
+	req, err := http.NewRequest(http.MethodHead, target, nil)
+	if err != nil {
+		return
+	}
+	resp, err := client.Do(req.WithContext(traceConnections(ctx, endpoint)))
+	if err != nil {
+		logger.Debug("warmup request failed",
+			zap.Error(err),
+			zap.String("http_endpoint", endpoint),
+			zap.String("source", data.SourceName))
+		return
+	}
+	resp.Body.Close()
+}
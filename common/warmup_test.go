@@ -0,0 +1,83 @@
+package common
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// methodRecorder starts a server recording the method of every request and counting the connections it accepted
+type methodRecorder struct {
+	mu      sync.Mutex
+	methods []string
+	conns   int
+}
+
+func newMethodRecorder(t *testing.T) (*methodRecorder, string) {
+	t.Helper()
+	rec := &methodRecorder{}
+	srv := newConnStateServer(t, func(w http.ResponseWriter, r *http.Request) {
+		rec.mu.Lock()
+		defer rec.mu.Unlock()
+		rec.methods = append(rec.methods, r.Method)
+	}, func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			rec.mu.Lock()
+			defer rec.mu.Unlock()
+			rec.conns++
+		}
+	})
+	return rec, srv.URL
+}
+
+func (rec *methodRecorder) take() ([]string, int) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	methods, conns := rec.methods, rec.conns
+	rec.methods, rec.conns = nil, 0
+	return methods, conns
+}
+
+func TestWarmupBeforeSend(t *testing.T) {
+	clock := useFakeClock(t)
+	rec, endpoint := newMethodRecorder(t)
+	data := testMetadata(t, endpoint, WithWarmupBeforeSend(true))
+	tests := []struct {
+		name      string
+		advance   time.Duration
+		want      []string
+		wantConns int
+	}{
+		{name: "fresh connection", want: []string{http.MethodHead, http.MethodPost}, wantConns: 1},
+		{name: "reused connection", want: []string{http.MethodPost}},
+		{name: "idle beyond the window", advance: warmConnectionWindow, want: []string{http.MethodHead, http.MethodPost}},
+	}
+	for _, tt := range tests {
+		clock.Advance(tt.advance)
+		resp, err := HandleHTTPRequest("{}", http.Header{}, data, zap.NewNop())
+		if err != nil {
+			t.Fatalf("%v: unexpected error: %v", tt.name, err)
+		}
+		ResponseString(resp)
+		if methods, conns := rec.take(); len(methods) != len(tt.want) || methods[0] != tt.want[0] || conns != tt.wantConns {
+			t.Errorf("%v: server received %v over %v new connections, want %v over %v", tt.name, methods, conns, tt.want, tt.wantConns)
+		}
+	}
+}
+
+func TestWarmupDisabled(t *testing.T) {
+	rec, endpoint := newMethodRecorder(t)
+	data := testMetadata(t, endpoint)
+	resp, err := HandleHTTPRequest("{}", http.Header{}, data, zap.NewNop())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	ResponseString(resp)
+	if methods, conns := rec.take(); len(methods) != 1 || methods[0] != http.MethodPost || conns != 1 {
+		t.Errorf("server received %v over %v connections, want a single POST", methods, conns)
+	}
+}